@@ -0,0 +1,393 @@
+package authsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//adminPath is the path prefix for the admin API.
+const adminPath = "/auth/admin/"
+
+//writeJSON will write v as JSON with the status code.
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("error: failed to write JSON response: ", err)
+	}
+}
+
+//writeJSONError will write an error message as JSON with the status code.
+func writeJSONError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+//isAdmin will return true if the request is done with a verified TLS
+// client certificate with a common name set with WithAdminClientCerts,
+// or by an authenticated user of the built-in provider with one of the
+// roles set with WithAdminRoles in the session.
+func (a *Auth) isAdmin(r *http.Request) bool {
+	if r.TLS != nil {
+		for _, chain := range r.TLS.VerifiedChains {
+			if len(chain) == 0 {
+				continue
+			}
+			for _, name := range a.adminCertNames {
+				if chain[0].Subject.CommonName == name {
+					return true
+				}
+			}
+		}
+	}
+
+	if len(a.adminRoles) == 0 {
+		return false
+	}
+
+	session, ok := a.authenticated(r)
+	if !ok {
+		return false
+	}
+	email, _ := session.Values[sessionKeyEmail].(string)
+	if provider, _ := splitProviderUser(email); provider != "" {
+		return false
+	}
+	su := a.newSessionUser(r, session.Values)
+	for _, role := range a.adminRoles {
+		if su.hasRole(role) {
+			return true
+		}
+	}
+
+	return false
+}
+
+//adminEnabled will return true if admins are configured, and the
+// admin API should be served.
+func (a *Auth) adminEnabled() bool {
+	return len(a.adminRoles) > 0 || len(a.adminCertNames) > 0
+}
+
+//requireAdmin is a wrapper around the admin handlers only allowing
+// requests from admins. Requests changing anything must have the
+// Content-Type application/json, which browsers will not send cross
+// site without asking first, so the admin session cookie can't be
+// used from other sites.
+func (a *Auth) requireAdmin(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.banned(r) || !a.isAdmin(r) {
+			writeJSONError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+				writeJSONError(w, http.StatusUnsupportedMediaType, "Content-Type must be application/json")
+				return
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+//adminHandler will return the handler for the admin API, serving:
+//
+//	GET    /auth/admin/sessions                list the active sessions
+//	DELETE /auth/admin/sessions/{id}           revoke a session
+//	DELETE /auth/admin/users/{user}/sessions   revoke all sessions for a user ID or email
+//	GET    /auth/admin/users                   list the users
+//	POST   /auth/admin/users/{email}/disable   disable a user, and revoke the sessions
+//	POST   /auth/admin/users/{email}/enable    enable a user
+//	GET    /auth/admin/allowlist               list the allowlist entries
+//	POST   /auth/admin/allowlist               add an entry, body {"entry": "@example.com"}
+//	DELETE /auth/admin/allowlist/{entry}       remove an entry
+//	POST   /auth/admin/keys/rotate             rotate the cookie key, body {"keep": 2}
+//	GET    /auth/admin/dashboard               HTML dashboard with sessions, logins, failures and bans
+//	GET    /auth/admin/debug                   current counts and recent errors
+//	POST   /auth/admin/inspect                 inspect a session, body {"cookie": "..."} or {"sessionID": "..."}
+//	GET    /auth/admin/providers               list the providers registered at runtime
+//	POST   /auth/admin/providers               register a provider, body is a Provider
+//	DELETE /auth/admin/providers/{id}          remove a provider
+func (a *Auth) adminHandler() http.Handler {
+	mux := a.newRouteMux()
+	mux.HandleFunc("GET /auth/admin/sessions", a.adminListSessions)
+	mux.HandleFunc("DELETE /auth/admin/sessions/{id}", a.adminRevokeSession)
+	mux.HandleFunc("DELETE /auth/admin/users/{user}/sessions", a.adminRevokeUser)
+	mux.HandleFunc("GET /auth/admin/users", a.adminListUsers)
+	mux.HandleFunc("POST /auth/admin/users/{email}/disable", a.adminSetUserDisabled(true))
+	mux.HandleFunc("POST /auth/admin/users/{email}/enable", a.adminSetUserDisabled(false))
+	mux.HandleFunc("GET /auth/admin/allowlist", a.adminListAllowList)
+	mux.HandleFunc("POST /auth/admin/allowlist", a.adminAddAllowList)
+	mux.HandleFunc("DELETE /auth/admin/allowlist/{entry}", a.adminRemoveAllowList)
+	mux.HandleFunc("POST /auth/admin/keys/rotate", a.adminRotateKey)
+	mux.HandleFunc("GET /auth/admin/dashboard", a.adminDashboard)
+	mux.HandleFunc("GET /auth/admin/debug", a.adminDebug)
+	mux.HandleFunc("POST /auth/admin/inspect", a.adminInspect)
+	mux.HandleFunc("GET /auth/admin/providers", a.adminListProviders)
+	mux.HandleFunc("POST /auth/admin/providers", a.adminRegisterProvider)
+	mux.HandleFunc("DELETE /auth/admin/providers/{id}", a.adminRemoveProvider)
+
+	return a.requireAdmin(mux)
+}
+
+func (a *Auth) adminListSessions(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no session store configured")
+		return
+	}
+
+	sessions, err := a.sessions.List()
+	if err != nil {
+		a.logRequestError(r, "error: admin: session store List failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list sessions")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (a *Auth) adminRevokeSession(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no session store configured")
+		return
+	}
+
+	si, _, err := a.sessions.Get(r.PathValue("id"))
+	if err != nil {
+		a.logRequestError(r, "error: admin: session store Get failed: ", err)
+	}
+	if err := a.sessions.Delete(r.PathValue("id")); err != nil {
+		a.logRequestError(r, "error: admin: session store Delete failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke session")
+		return
+	}
+	a.watchers.notify(si.Email, "revoked")
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Auth) adminRevokeUser(w http.ResponseWriter, r *http.Request) {
+	if a.sessions == nil && a.epochs == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no session store or epoch store configured")
+		return
+	}
+
+	email, err := a.adminUserEmail(r.PathValue("user"))
+	if err != nil {
+		a.logRequestError(r, "error: admin: failed to find the email of the user: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to revoke sessions")
+		return
+	}
+
+	if a.epochs != nil {
+		if _, err := a.epochs.Increment(epochUser(email)); err != nil {
+			a.logRequestError(r, "error: admin: epoch store Increment failed: ", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to revoke sessions")
+			return
+		}
+	}
+
+	var n int
+	if a.sessions != nil {
+		n, err = a.sessions.DeleteUser(email)
+		if err != nil {
+			a.logRequestError(r, "error: admin: session store DeleteUser failed: ", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to revoke sessions")
+			return
+		}
+	}
+
+	a.watchers.notify(email, "revoked")
+	writeJSON(w, http.StatusOK, map[string]int{"revoked": n})
+}
+
+//adminUserEmail will return the email of the user, given the ID or the
+// email of the user. The epochs are kept by email, so a user ID must be
+// converted to the email to revoke the stateless sessions too. The user
+// store is checked first, then the sessions, and user is returned as is
+// if not found as an ID.
+func (a *Auth) adminUserEmail(user string) (string, error) {
+	if a.users != nil {
+		users, err := a.users.List()
+		if err != nil {
+			return "", fmt.Errorf("user store List failed: %v", err)
+		}
+		for _, u := range users {
+			if u.ID != "" && u.ID == user {
+				return u.Email, nil
+			}
+		}
+	}
+	if a.sessions != nil {
+		sessions, err := a.sessions.List()
+		if err != nil {
+			return "", fmt.Errorf("session store List failed: %v", err)
+		}
+		for _, s := range sessions {
+			if s.UserID != "" && s.UserID == user && s.Email != "" {
+				return s.Email, nil
+			}
+		}
+	}
+	return user, nil
+}
+
+func (a *Auth) adminListUsers(w http.ResponseWriter, r *http.Request) {
+	if a.users == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no user store configured")
+		return
+	}
+
+	users, err := a.users.List()
+	if err != nil {
+		a.logRequestError(r, "error: admin: user store List failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list users")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, users)
+}
+
+//adminSetUserDisabled will return a handler setting the user to disabled
+// or enabled. A user not found in the user store is added, so users can
+// be disabled before they have logged in. All the sessions of a disabled
+// user are revoked.
+func (a *Auth) adminSetUserDisabled(disabled bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.users == nil {
+			writeJSONError(w, http.StatusNotImplemented, "no user store configured")
+			return
+		}
+
+		email := r.PathValue("email")
+		u, ok, err := a.users.Get(email)
+		if err != nil {
+			a.logRequestError(r, "error: admin: user store Get failed: ", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to get user")
+			return
+		}
+		if !ok {
+			u = UserRecord{Email: email, Created: time.Now()}
+			a.privacy.tagPersonalData(&u, "admin", u.Created)
+		}
+
+		u.Disabled = disabled
+		if err := a.users.Put(u); err != nil {
+			a.logRequestError(r, "error: admin: user store Put failed: ", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to update user")
+			return
+		}
+
+		if disabled && a.sessions != nil {
+			if _, err := a.sessions.DeleteUser(email); err != nil {
+				a.logRequestError(r, "error: admin: session store DeleteUser failed: ", err)
+			}
+		}
+		if disabled {
+			a.watchers.notify(email, "disabled")
+		}
+
+		writeJSON(w, http.StatusOK, u)
+	}
+}
+
+func (a *Auth) adminListAllowList(w http.ResponseWriter, r *http.Request) {
+	if a.allowList == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no allowlist configured")
+		return
+	}
+
+	entries, err := a.allowList.List()
+	if err != nil {
+		a.logRequestError(r, "error: admin: allowlist List failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list allowlist")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (a *Auth) adminAddAllowList(w http.ResponseWriter, r *http.Request) {
+	if a.allowList == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no allowlist configured")
+		return
+	}
+
+	body := struct {
+		Entry string `json:"entry"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Entry == "" {
+		writeJSONError(w, http.StatusBadRequest, "expected a JSON body with an entry")
+		return
+	}
+
+	if err := a.allowList.Add(body.Entry); err != nil {
+		a.logRequestError(r, "error: admin: allowlist Add failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to add to allowlist")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *Auth) adminRemoveAllowList(w http.ResponseWriter, r *http.Request) {
+	if a.allowList == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no allowlist configured")
+		return
+	}
+
+	if err := a.allowList.Remove(r.PathValue("entry")); err != nil {
+		a.logRequestError(r, "error: admin: allowlist Remove failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to remove from allowlist")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+//adminRotateKey will create a new random cookie key and start using it.
+// The key is given to the function set with WithCookieKeyRotated so it
+// can be stored, otherwise it is lost when the web server restarts. Like
+// Config.RotateCookieKey, the key is the base64 text of 32 random bytes,
+// so it can be put in CookieStoreKeys as it is.
+func (a *Auth) adminRotateKey(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Keep int `json:"keep"`
+	}{Keep: 2}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "expected a JSON body")
+			return
+		}
+	}
+
+	key, err := a.newKey(32, KeyBase64URLPadded)
+	if err != nil {
+		a.logRequestError(r, "error: admin: failed to create cookie key: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to create cookie key")
+		return
+	}
+
+	if a.cookieKeyRotated != nil {
+		if err := a.cookieKeyRotated([]byte(key)); err != nil {
+			a.logRequestError(r, "error: admin: storing the rotated cookie key failed: ", err)
+			writeJSONError(w, http.StatusInternalServerError, "failed to store cookie key")
+			return
+		}
+	}
+
+	if err := a.RotateCookieKey([]byte(key), body.Keep); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]bool{
+		"rotated": true,
+		"stored":  a.cookieKeyRotated != nil,
+	})
+}
@@ -0,0 +1,81 @@
+package authsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+//testAdminCookie will return the cookie of a session of the built-in
+// provider logged in as the user with the roles.
+func testAdminCookie(t *testing.T, a *Auth, email string, roles ...string) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s, _ := a.store.Get(r, "cookie-name")
+	s.Values[sessionKeyAuthenticated] = true
+	s.Values[sessionKeyEmail] = email
+	s.Values[sessionKeySID] = "sid-" + email
+	s.Values[sessionKeyRoles] = roles
+	if err := s.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+func TestIsAdminRoles(t *testing.T) {
+	a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret", WithAdminRoles("admin"))
+	tests := []struct {
+		name  string
+		email string
+		roles []string
+		want  bool
+	}{
+		{"admin role", "a@example.com", []string{"viewer", "admin"}, true},
+		{"other roles", "a@example.com", []string{"viewer"}, false},
+		{"no roles", "a@example.com", nil, false},
+		{"runtime provider", "acme:a@example.com", []string{"admin"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/auth/admin/sessions", nil)
+			r.AddCookie(testAdminCookie(t, a, tt.email, tt.roles...))
+			if got := a.isAdmin(r); got != tt.want {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAdminRevokeUserByID(t *testing.T) {
+	users := NewFileUserStore("")
+	users.Put(UserRecord{ID: "u1", Email: "Bob@example.com"})
+	epochs := NewMemoryEpochStore()
+	sessions := NewFileSessionStore("")
+	sessions.Add(SessionInfo{ID: "s1", UserID: "u1", Email: "Bob@example.com"})
+	sessions.Add(SessionInfo{ID: "s2", Email: "Bob@example.com"})
+	a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret",
+		WithAdminRoles("admin"), WithUserStore(users), WithEpochStore(epochs), WithSessionStore(sessions))
+
+	r := httptest.NewRequest("DELETE", "/auth/admin/users/u1/sessions", nil)
+	r.Header.Set("Content-Type", "application/json")
+	r.AddCookie(testAdminCookie(t, a, "admin@example.com", "admin"))
+	sessions.Add(SessionInfo{ID: "sid-admin@example.com", Email: "admin@example.com"})
+	w := httptest.NewRecorder()
+	a.adminHandler().ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("got status %v: %v", w.Code, w.Body.String())
+	}
+
+	epoch, err := epochs.Get(epochUser("bob@example.com"))
+	if err != nil || epoch != 1 {
+		t.Fatalf("got epoch %v for the email, want 1, err %v", epoch, err)
+	}
+	if epoch, _ := epochs.Get("u1"); epoch != 0 {
+		t.Fatalf("got epoch %v for the user ID, want 0", epoch)
+	}
+	left, err := sessions.List()
+	if err != nil || len(left) != 1 || left[0].Email != "admin@example.com" {
+		t.Fatalf("got sessions %v left, want only the admin session, err %v", left, err)
+	}
+}
@@ -0,0 +1,97 @@
+package authsession
+
+import (
+	"strings"
+)
+
+//AllowList holds the emails and domains allowed to log in. An entry is
+// either a full email like someone@example.com, or a domain starting
+// with @ like @example.com allowing all the emails in that domain.
+// When an AllowList is set with WithAllowList, only users allowed by
+// it can log in.
+type AllowList interface {
+	//Add will add an entry.
+	Add(entry string) error
+	//Remove will remove an entry.
+	Remove(entry string) error
+	//List will return all the entries.
+	List() ([]string, error)
+	//Allowed will return true if the email is allowed by an entry.
+	Allowed(email string) (bool, error)
+}
+
+//FileAllowList is an AllowList keeping the entries in a JSON file.
+type FileAllowList struct {
+	m *jsonFileMap[bool]
+}
+
+//NewFileAllowList will return a *FileAllowList storing the entries in
+// the file at path. If path is empty the entries are only kept in memory.
+func NewFileAllowList(path string) *FileAllowList {
+	return &FileAllowList{
+		m: newJSONFileMap[bool](path),
+	}
+}
+
+//Add will add an entry.
+func (f *FileAllowList) Add(entry string) error {
+	return f.m.update(func(m map[string]bool) error {
+		m[strings.ToLower(entry)] = true
+		return nil
+	})
+}
+
+//Remove will remove an entry.
+func (f *FileAllowList) Remove(entry string) error {
+	return f.m.update(func(m map[string]bool) error {
+		delete(m, strings.ToLower(entry))
+		return nil
+	})
+}
+
+//List will return all the entries.
+func (f *FileAllowList) List() ([]string, error) {
+	var entries []string
+	err := f.m.view(func(m map[string]bool) error {
+		for e := range m {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+//Allowed will return true if the email, or the domain of the email
+// is in the list.
+func (f *FileAllowList) Allowed(email string) (bool, error) {
+	email = strings.ToLower(email)
+
+	var allowed bool
+	err := f.m.view(func(m map[string]bool) error {
+		if m[email] {
+			allowed = true
+			return nil
+		}
+		if domain := emailDomain(email); domain != "" {
+			allowed = m[domain]
+		}
+		return nil
+	})
+	return allowed, err
+}
+
+//emailDomain will return the allowlist entry for the domain of the email,
+// like "@example.com", or "acme:@example.com" for the users of the
+// provider acme registered at runtime, so a domain allowed for one
+// provider is not allowed for the others. It is empty if the email has no
+// domain.
+func emailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	if provider, _ := splitProviderUser(email); provider != "" {
+		return provider + providerUserSep + email[i:]
+	}
+	return email[i:]
+}
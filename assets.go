@@ -0,0 +1,91 @@
+package authsession
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+//assetsPath is where the JavaScript helpers for frontends are served.
+const assetsPath = "/auth/assets/"
+
+//SessionJSVersion is the version of the session.js helper served at
+// /auth/assets/session.js, which is also given by AuthSession.version in
+// the browser. It is changed when the API of the helper changes.
+const SessionJSVersion = "1.0.0"
+
+//assetFS holds the JavaScript helpers served.
+//
+//go:embed assets
+var assetFS embed.FS
+
+//asset is a file served from assetsPath.
+type asset struct {
+	contentType string
+	body        []byte
+	//hash is the start of the SHA-256 of the body, used as the ETag, and
+	// in the versioned URL.
+	hash string
+}
+
+//assets are the files served from assetsPath, by name.
+var assets = map[string]asset{
+	"session.js": newAsset("assets/session.js", "text/javascript; charset=utf-8"),
+}
+
+//newAsset will return the asset of the embedded file at name, with the
+// version put in.
+func newAsset(name string, contentType string) asset {
+	b, err := assetFS.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	b = bytes.ReplaceAll(b, []byte("__AUTHSESSION_VERSION__"), []byte(SessionJSVersion))
+	sum := sha256.Sum256(b)
+	return asset{contentType: contentType, body: b, hash: hex.EncodeToString(sum[:8])}
+}
+
+//SessionJSURL will return the path of the session.js helper, with the
+// hash of the content in the query, so it can be cached by the browser
+// until the package is upgraded, like for a script tag in the pages of an
+// app.
+func (a *Auth) SessionJSURL() string {
+	return assetsPath + "session.js?v=" + assets["session.js"].hash
+}
+
+//serveAsset will serve the assets from assetsPath. A request with the
+// hash of the current content in v is cached for a year, and other
+// requests are revalidated with the ETag.
+func (a *Auth) serveAsset(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	f, ok := assets[strings.TrimPrefix(r.URL.Path, assetsPath)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := `"` + f.hash + `"`
+	w.Header().Set("Content-Type", f.contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("ETag", etag)
+	if r.URL.Query().Get("v") == f.hash {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write(f.body)
+}
@@ -0,0 +1,358 @@
+/*
+ * session.js, the session helper of authsession __AUTHSESSION_VERSION__.
+ *
+ * Served from /auth/assets/session.js. It handles the client side of the
+ * session endpoints: the expiry countdown, the silent extension of the
+ * session while the user is active, the revoke and expiry events, and the
+ * login in a popup.
+ *
+ *   var s = AuthSession.start({
+ *     onExpiring: function (secondsLeft) { ... },
+ *     onExpired: function () { ... },
+ *     onRevoked: function (reason) { ... }
+ *   });
+ *
+ *   AuthSession.popupLogin({provider: "github"}).then(function (result) { ... });
+ */
+(function (global) {
+	"use strict";
+
+	var version = "__AUTHSESSION_VERSION__";
+
+	var defaults = {
+		//base is put in front of the paths, like "https://auth.example.com"
+		// when the auth endpoints are on another origin, which must then
+		// allow the origin of the page with CORS. Empty uses the origin of
+		// the page.
+		base: "",
+		sessionPath: "/auth/session",
+		loginPath: "/slogin",
+		//warnBefore is the number of seconds before the expiry when
+		// onExpiring is called.
+		warnBefore: 120,
+		//refresh will extend the session silently when it is about to
+		// expire, if the user has been active since the last extension.
+		refresh: true,
+		//events will use the Server-Sent Events of the session, so revokes
+		// are seen right away. Without them the status is polled.
+		events: true,
+		//pollInterval is the number of seconds between the status requests
+		// when the events are not used.
+		pollInterval: 60,
+		onStatus: null,
+		onTick: null,
+		onExpiring: null,
+		onExpired: null,
+		onRevoked: null,
+		onError: null
+	};
+
+	function merge(opts) {
+		var o = {};
+		var k;
+		for (k in defaults) {
+			if (Object.prototype.hasOwnProperty.call(defaults, k)) {
+				o[k] = defaults[k];
+			}
+		}
+		for (k in opts || {}) {
+			if (Object.prototype.hasOwnProperty.call(opts, k)) {
+				o[k] = opts[k];
+			}
+		}
+		return o;
+	}
+
+	function call(fn) {
+		if (typeof fn !== "function") {
+			return;
+		}
+		try {
+			fn.apply(null, Array.prototype.slice.call(arguments, 1));
+		} catch (e) {
+			if (global.console) {
+				global.console.error("authsession:", e);
+			}
+		}
+	}
+
+	function credentials(o) {
+		return o.base ? "include" : "same-origin";
+	}
+
+	function request(o, method, path) {
+		var init = {method: method, credentials: credentials(o), headers: {"Accept": "application/json"}};
+		if (method === "POST") {
+			//The extend endpoint only takes JSON, which plain forms on
+			// other sites can't send.
+			init.headers["Content-Type"] = "application/json";
+			init.body = "{}";
+		}
+		return global.fetch(o.base + path, init).then(function (resp) {
+			return resp.json().then(function (body) {
+				if (!resp.ok) {
+					var err = new Error(body.error || ("status " + resp.status));
+					err.status = resp.status;
+					err.code = body.code;
+					throw err;
+				}
+				return body;
+			});
+		});
+	}
+
+	//Session follows the session of the page, started with AuthSession.start.
+	function Session(opts) {
+		this.o = merge(opts);
+		this.expiresAt = 0;
+		this.authenticated = false;
+		this.active = false;
+		this.warned = false;
+		this.extending = false;
+		this.stopped = false;
+		this.source = null;
+		this.timer = null;
+		this.poller = null;
+
+		var self = this;
+		this.onActivity = function () {
+			self.active = true;
+		};
+		["keydown", "mousedown", "touchstart", "scroll"].forEach(function (e) {
+			global.addEventListener(e, self.onActivity, {passive: true});
+		});
+
+		this.timer = global.setInterval(function () {
+			self.tick();
+		}, 1000);
+		this.status().then(function () {
+			if (self.o.events && global.EventSource) {
+				self.listen();
+			} else {
+				self.poll();
+			}
+		}, function (err) {
+			call(self.o.onError, err);
+			self.poll();
+		});
+	}
+
+	//update will set the status given by the server. The expiry is kept as
+	// the time left, so the clock of the browser doesn't matter.
+	Session.prototype.update = function (st) {
+		var was = this.authenticated;
+		this.authenticated = !!st.authenticated;
+		this.expiresAt = st.expiresIn ? Date.now() + st.expiresIn * 1000 : 0;
+		this.warned = false;
+		call(this.o.onStatus, st);
+		if (was && !this.authenticated) {
+			this.end("expired");
+		}
+	};
+
+	//secondsLeft will return the seconds until the session expires, or -1 if
+	// the session does not expire or there is no session.
+	Session.prototype.secondsLeft = function () {
+		if (!this.authenticated || !this.expiresAt) {
+			return -1;
+		}
+		return Math.max(0, Math.round((this.expiresAt - Date.now()) / 1000));
+	};
+
+	//status will get the status of the session from the server.
+	Session.prototype.status = function () {
+		var self = this;
+		return request(this.o, "GET", this.o.sessionPath).then(function (st) {
+			self.update(st);
+			return st;
+		});
+	};
+
+	//extend will extend the session, and return the new status.
+	Session.prototype.extend = function () {
+		var self = this;
+		this.extending = true;
+		this.active = false;
+		return request(this.o, "POST", this.o.sessionPath + "/extend").then(function (st) {
+			self.extending = false;
+			self.update(st);
+			return st;
+		}, function (err) {
+			self.extending = false;
+			if (err.status === 401) {
+				self.update({authenticated: false});
+			}
+			throw err;
+		});
+	};
+
+	Session.prototype.tick = function () {
+		var left = this.secondsLeft();
+		if (left < 0) {
+			return;
+		}
+		call(this.o.onTick, left);
+
+		if (left === 0) {
+			this.authenticated = false;
+			this.end("expired");
+			return;
+		}
+		if (left > this.o.warnBefore) {
+			return;
+		}
+		if (this.o.refresh && this.active && !this.extending) {
+			var self = this;
+			this.extend().catch(function (err) {
+				call(self.o.onError, err);
+			});
+			return;
+		}
+		if (!this.warned && !this.extending) {
+			this.warned = true;
+			call(this.o.onExpiring, left);
+		}
+	};
+
+	//listen will follow the Server-Sent Events of the session, and poll the
+	// status instead if the stream is closed, like when the session is gone.
+	Session.prototype.listen = function () {
+		var self = this;
+		var es = new global.EventSource(this.o.base + this.o.sessionPath + "/events", {withCredentials: !!this.o.base});
+		this.source = es;
+		es.addEventListener("status", function (e) {
+			self.update(JSON.parse(e.data));
+		});
+		es.addEventListener("expired", function () {
+			self.authenticated = false;
+			self.end("expired");
+		});
+		es.addEventListener("revoked", function (e) {
+			var reason = "";
+			try {
+				reason = JSON.parse(e.data).reason || "";
+			} catch (err) {
+				reason = "";
+			}
+			self.authenticated = false;
+			self.end("revoked", reason);
+		});
+		es.onerror = function () {
+			if (es.readyState === global.EventSource.CLOSED && !self.stopped) {
+				self.source = null;
+				self.poll();
+			}
+		};
+	};
+
+	Session.prototype.poll = function () {
+		var self = this;
+		if (this.poller || this.stopped) {
+			return;
+		}
+		this.poller = global.setInterval(function () {
+			self.status().catch(function (err) {
+				call(self.o.onError, err);
+			});
+		}, this.o.pollInterval * 1000);
+	};
+
+	//end will stop following the session, and tell why it ended.
+	Session.prototype.end = function (why, reason) {
+		if (this.stopped) {
+			return;
+		}
+		this.stop();
+		if (why === "revoked") {
+			call(this.o.onRevoked, reason);
+		} else {
+			call(this.o.onExpired);
+		}
+	};
+
+	//stop will stop following the session.
+	Session.prototype.stop = function () {
+		var self = this;
+		this.stopped = true;
+		global.clearInterval(this.timer);
+		global.clearInterval(this.poller);
+		if (this.source) {
+			this.source.close();
+			this.source = null;
+		}
+		["keydown", "mousedown", "touchstart", "scroll"].forEach(function (e) {
+			global.removeEventListener(e, self.onActivity);
+		});
+	};
+
+	//popupLogin will open the login in a popup, and resolve with the result
+	// posted by the popup, {success, email, redirect}. It rejects with an
+	// error with the code, like "login_failed", or "cancelled" when the
+	// popup is closed. The options are the provider, a returnTo signed by
+	// the server, and the width and height. WithPopupLogin must be set on
+	// the server.
+	function popupLogin(opts) {
+		var o = merge(opts);
+		var width = o.width || 500;
+		var height = o.height || 600;
+		var origin = o.base ? new URL(o.base, global.location.href).origin : global.location.origin;
+
+		var url = o.base + o.loginPath + "?popup=1";
+		if (o.provider) {
+			url += "&provider=" + encodeURIComponent(o.provider);
+		}
+		if (o.returnTo) {
+			url += "&return_to=" + encodeURIComponent(o.returnTo);
+		}
+		var left = global.screenX + (global.outerWidth - width) / 2;
+		var top = global.screenY + (global.outerHeight - height) / 2;
+		var popup = global.open(url, "authsession-login", "width=" + width + ",height=" + height + ",left=" + left + ",top=" + top);
+
+		return new Promise(function (resolve, reject) {
+			var closed;
+			var seenClosed = false;
+			function fail(code, message) {
+				var err = new Error(message || code);
+				err.code = code;
+				reject(err);
+			}
+			if (!popup) {
+				fail("popup_blocked", "the login popup was blocked");
+				return;
+			}
+			function done() {
+				global.removeEventListener("message", onMessage);
+				global.clearInterval(closed);
+			}
+			function onMessage(e) {
+				if (e.origin !== origin || e.source !== popup || !e.data || e.data.type !== "authsession.login") {
+					return;
+				}
+				done();
+				if (e.data.success) {
+					resolve(e.data);
+				} else {
+					fail(e.data.error, e.data.message);
+				}
+			}
+			global.addEventListener("message", onMessage);
+			closed = global.setInterval(function () {
+				//The result is posted right before the popup closes, so wait
+				// one more round for it.
+				if (popup.closed && seenClosed) {
+					done();
+					fail("cancelled", "the login popup was closed");
+				}
+				seenClosed = popup.closed;
+			}, 500);
+		});
+	}
+
+	global.AuthSession = {
+		version: version,
+		start: function (opts) {
+			return new Session(opts);
+		},
+		popupLogin: popupLogin
+	};
+})(window);
@@ -0,0 +1,246 @@
+package authsession
+
+import (
+	"bufio"
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+)
+
+//auditCheckpointMethod is the Method of the checkpoint events of the
+// audit chain.
+const auditCheckpointMethod = "checkpoint"
+
+//AuditChainConfig is the hash chaining of the events written to the event
+// sink, set with WithAuditChain. Every event carries the hash of the event
+// before, so an event changed, removed or put in breaks the chain, and
+// the checkpoints are signed, so the chain can't be made again without
+// the key.
+type AuditChainConfig struct {
+	//Signer signs the checkpoints, like KeySigner with an RSA key, or a
+	// key in a key management service. The chain is verified with its
+	// public key by VerifyAuditChain.
+	Signer Signer
+	//CheckpointEvery is the number of events between the checkpoints,
+	// which defaults to 1000.
+	CheckpointEvery int
+	//CheckpointInterval is the longest time an event is written without a
+	// checkpoint after it, which defaults to an hour. The checkpoints are
+	// made by RunJobs.
+	CheckpointInterval time.Duration
+}
+
+//auditChain is the state of the audit chain, which are the sequence
+// number and the hash of the last event written.
+type auditChain struct {
+	conf AuditChainConfig
+
+	mu   sync.Mutex
+	seq  int64
+	last string
+	//since is the number of events written since the last checkpoint.
+	since int
+}
+
+//newAuditChain will return an *auditChain for the conf, with the
+// defaults set.
+func newAuditChain(conf AuditChainConfig) *auditChain {
+	if conf.CheckpointEvery <= 0 {
+		conf.CheckpointEvery = 1000
+	}
+	if conf.CheckpointInterval <= 0 {
+		conf.CheckpointInterval = time.Hour
+	}
+	return &auditChain{conf: conf}
+}
+
+//link will return the event with the sequence number, the hash of the
+// event before and its own hash set. Checkpoints are signed too. It must
+// be called with mu held.
+func (c *auditChain) link(e LoginEvent) (LoginEvent, error) {
+	e.Seq = c.seq + 1
+	e.PrevHash = c.last
+	sum, err := auditEventHash(e)
+	if err != nil {
+		return LoginEvent{}, err
+	}
+	e.Hash = hex.EncodeToString(sum)
+	if e.Method == auditCheckpointMethod {
+		sig, err := c.conf.Signer.Sign(sum)
+		if err != nil {
+			return LoginEvent{}, fmt.Errorf("signing audit checkpoint failed: %v", err)
+		}
+		e.Signature = base64.RawURLEncoding.EncodeToString(sig)
+		c.since = 0
+	} else {
+		c.since++
+	}
+	c.seq = e.Seq
+	c.last = e.Hash
+	return e, nil
+}
+
+//checkpoint will return a checkpoint event for the chain, told by reason.
+func (c *auditChain) checkpoint(reason string) LoginEvent {
+	return LoginEvent{
+		Time:     time.Now(),
+		Success:  true,
+		Reason:   reason,
+		Severity: SeverityInfo,
+		Method:   auditCheckpointMethod,
+	}
+}
+
+//auditEventHash will return the SHA-256 hash of the JSON of the event,
+// without its hash and signature.
+func auditEventHash(e LoginEvent) ([]byte, error) {
+	e.Hash = ""
+	e.Signature = ""
+	b, err := json.Marshal(e)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(b)
+	return sum[:], nil
+}
+
+//writeChained will link the event into the audit chain and write it to
+// the sinks, with a checkpoint first if the chain is new, and after it
+// if CheckpointEvery events were written since the last one. The chain
+// is locked while writing, so the events are written in the order of
+// the chain.
+func (l *loginEvents) writeChained(e LoginEvent) {
+	l.chain.mu.Lock()
+	defer l.chain.mu.Unlock()
+
+	if l.chain.seq == 0 {
+		l.writeLinked(l.chain.checkpoint("audit chain started"))
+	}
+	l.writeLinked(e)
+	if l.chain.since >= l.chain.conf.CheckpointEvery {
+		l.writeLinked(l.chain.checkpoint(fmt.Sprintf("audit chain checkpoint after %d events", l.chain.since)))
+	}
+}
+
+//writeLinked will link the event into the audit chain and write it to
+// the sinks. It must be called with the chain locked.
+func (l *loginEvents) writeLinked(e LoginEvent) {
+	e, err := l.chain.link(e)
+	if err != nil {
+		log.Printf("error: audit chain: %v\n", err)
+		return
+	}
+	l.writeSinks(e)
+}
+
+//auditCheckpoint will write a checkpoint if events were written since
+// the last one, run every CheckpointInterval by RunJobs.
+func (l *loginEvents) auditCheckpoint(ctx context.Context) error {
+	l.chain.mu.Lock()
+	defer l.chain.mu.Unlock()
+
+	if l.chain.since == 0 {
+		return nil
+	}
+	e, err := l.chain.link(l.chain.checkpoint(fmt.Sprintf("audit chain checkpoint after %d events", l.chain.since)))
+	if err != nil {
+		return err
+	}
+	l.writeSinks(e)
+	return nil
+}
+
+//AuditChainResult is the result of VerifyAuditChain.
+type AuditChainResult struct {
+	//Events is the number of events verified, which are the events up to
+	// the last checkpoint, with the checkpoints.
+	Events int `json:"events"`
+	//Checkpoints is the number of signed checkpoints verified.
+	Checkpoints int `json:"checkpoints"`
+	//Unsigned is the number of events after the last checkpoint of a
+	// chain. They are chained, but could have been changed together with
+	// their hashes, since there is no checkpoint after them yet.
+	Unsigned int `json:"unsigned"`
+}
+
+//VerifyAuditChain will verify the events chained by WithAuditChain, read
+// from r as written by a WriterEventSink with EventFormatJSON, with the
+// public key of the Signer of the checkpoints. An error is returned for
+// the first event not valid, like changed, missing, or not chained. Every
+// restart of the server starts a new chain with a signed checkpoint.
+func VerifyAuditChain(r io.Reader, pub *rsa.PublicKey) (AuditChainResult, error) {
+	var res AuditChainResult
+	var prev string
+	var seq int64
+	var pending int
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var e LoginEvent
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return res, fmt.Errorf("line %d: event is not valid JSON: %v", line, err)
+		}
+		if e.Hash == "" {
+			return res, fmt.Errorf("line %d: event is not chained", line)
+		}
+
+		switch {
+		case e.Seq == 1:
+			if e.Method != auditCheckpointMethod || e.PrevHash != "" {
+				return res, fmt.Errorf("line %d: chain does not start with a checkpoint", line)
+			}
+			res.Unsigned += pending
+			pending = 0
+		case seq == 0:
+			return res, fmt.Errorf("line %d: chain does not start with a checkpoint", line)
+		case e.Seq != seq+1:
+			return res, fmt.Errorf("line %d: event %d follows event %d, events are missing or put in", line, e.Seq, seq)
+		case e.PrevHash != prev:
+			return res, fmt.Errorf("line %d: hash of the event before does not match, events are changed", line)
+		}
+
+		sum, err := auditEventHash(e)
+		if err != nil {
+			return res, fmt.Errorf("line %d: %v", line, err)
+		}
+		if hex.EncodeToString(sum) != e.Hash {
+			return res, fmt.Errorf("line %d: hash does not match, the event is changed", line)
+		}
+
+		if e.Method == auditCheckpointMethod {
+			sig, err := base64.RawURLEncoding.DecodeString(e.Signature)
+			if err != nil {
+				return res, fmt.Errorf("line %d: checkpoint signature is not valid base64: %v", line, err)
+			}
+			if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum, sig); err != nil {
+				return res, fmt.Errorf("line %d: checkpoint signature is not valid: %v", line, err)
+			}
+			res.Events += pending + 1
+			res.Checkpoints++
+			pending = 0
+		} else {
+			pending++
+		}
+		prev = e.Hash
+		seq = e.Seq
+	}
+	if err := scanner.Err(); err != nil {
+		return res, err
+	}
+	if seq == 0 {
+		return res, errors.New("no chained events found")
+	}
+	res.Unsigned += pending
+	return res, nil
+}
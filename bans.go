@@ -0,0 +1,172 @@
+package authsession
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//Ban is a banned IP address. A zero Expires means the ban never expires.
+type Ban struct {
+	IP      string    `json:"ip"`
+	Reason  string    `json:"reason"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+}
+
+//expired will return true if the ban has expired.
+func (b Ban) expired(now time.Time) bool {
+	return !b.Expires.IsZero() && now.After(b.Expires)
+}
+
+//BanStore keeps track of banned IP addresses. When a BanStore is set
+// with WithBanStore, requests from banned addresses are refused both
+// for login and for the handlers wrapped with IsAuthenticated.
+type BanStore interface {
+	//Ban will add, or replace the ban for an IP.
+	Ban(b Ban) error
+	//Unban will remove the ban for the ip.
+	Unban(ip string) error
+	//IsBanned will return true if ip is banned, and the ban is not expired.
+	IsBanned(ip string) (bool, error)
+	//List will return all the bans that are not expired.
+	List() ([]Ban, error)
+}
+
+//FileBanStore is a BanStore keeping the bans in a JSON file.
+type FileBanStore struct {
+	m *jsonFileMap[Ban]
+}
+
+//NewFileBanStore will return a *FileBanStore storing the bans in the
+// file at path. If path is empty the bans are only kept in memory.
+func NewFileBanStore(path string) *FileBanStore {
+	return &FileBanStore{
+		m: newJSONFileMap[Ban](path),
+	}
+}
+
+//Ban will add, or replace the ban for an IP.
+func (f *FileBanStore) Ban(b Ban) error {
+	return f.m.update(func(m map[string]Ban) error {
+		m[b.IP] = b
+		return nil
+	})
+}
+
+//Unban will remove the ban for the ip.
+func (f *FileBanStore) Unban(ip string) error {
+	return f.m.update(func(m map[string]Ban) error {
+		delete(m, ip)
+		return nil
+	})
+}
+
+//Cleanup will remove the bans expired at now, and return the number
+// removed.
+func (f *FileBanStore) Cleanup(now time.Time) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]Ban) error {
+		for ip, b := range m {
+			if b.expired(now) {
+				delete(m, ip)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//IsBanned will return true if ip is banned, and the ban is not expired.
+func (f *FileBanStore) IsBanned(ip string) (bool, error) {
+	var banned bool
+	err := f.m.view(func(m map[string]Ban) error {
+		b, ok := m[ip]
+		banned = ok && !b.expired(time.Now())
+		return nil
+	})
+	return banned, err
+}
+
+//List will return all the bans that are not expired.
+func (f *FileBanStore) List() ([]Ban, error) {
+	var bans []Ban
+	err := f.m.view(func(m map[string]Ban) error {
+		now := time.Now()
+		for _, b := range m {
+			if !b.expired(now) {
+				bans = append(bans, b)
+			}
+		}
+		return nil
+	})
+	return bans, err
+}
+
+//remoteIP will return the IP address the request came from.
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+//clientIP will return the IP address of the client doing the request.
+// Behind the proxies set with WithTrustedProxies, it is taken from the
+// X-Forwarded-For header.
+func (a *Auth) clientIP(r *http.Request) string {
+	ip, _ := a.resolveClientIP(r)
+	return ip
+}
+
+//resolveClientIP will return the IP address of the client doing the
+// request, and false if it is not known to be the client. The forwarded
+// headers are only used from the proxies set with WithTrustedProxies, and
+// the IP the request came from is used for everyone else, since the
+// client can send any headers. The client is only unknown when a trusted
+// proxy sends a chain that can't be used, and the IP is then the one of
+// a proxy, shared by all its users.
+func (a *Auth) resolveClientIP(r *http.Request) (string, bool) {
+	ip := remoteIP(r)
+	if !a.trustedProxy(ip) {
+		return ip, true
+	}
+	forwarded := r.Header.Values("X-Forwarded-For")
+
+	//Each proxy adds the IP it got the request from, so the client is
+	// the last IP which is not a trusted proxy.
+	var hops []string
+	for _, v := range forwarded {
+		for _, hop := range strings.Split(v, ",") {
+			hops = append(hops, strings.TrimSpace(hop))
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if net.ParseIP(hops[i]) == nil {
+			return ip, false
+		}
+		ip = hops[i]
+		if !a.trustedProxy(ip) {
+			return ip, true
+		}
+	}
+	return ip, false
+}
+
+//trustedProxy will return true if the ip is in the networks set with
+// WithTrustedProxies.
+func (a *Auth) trustedProxy(ip string) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, n := range a.trustedProxies {
+		if n.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,229 @@
+package authsession
+
+import (
+	"context"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//pbkdf2Prefix is the start of a PBKDF2 password hash, as made by
+// PBKDF2PasswordHash, which is followed by the iterations, the salt and
+// the key, separated by "$".
+const pbkdf2Prefix = "$pbkdf2-sha256$"
+
+//The parameters of the PBKDF2 password hashes made, and the smallest
+// accepted, which are the ones approved by NIST SP 800-132.
+const (
+	pbkdf2Iterations    = 600000
+	pbkdf2MinIterations = 1000
+	pbkdf2SaltSize      = 16
+	pbkdf2KeySize       = 32
+	pbkdf2MinKeySize    = 14
+)
+
+//BasicCredential is a user and password accepted with HTTP basic auth by
+// IsAuthenticated, for monitoring probes and scripts which can't log in
+// with OAuth. The credentials are set with WithBasicAuth.
+type BasicCredential struct {
+	//User is the user name, given as the email of the User in the request
+	// context.
+	User string
+	//PasswordHash is the bcrypt hash of the password, or the PBKDF2 hash
+	// made by PBKDF2PasswordHash. Only PBKDF2 is accepted with the FIPS
+	// crypto profile.
+	PasswordHash string
+	//Paths are the paths the credential can be used for, with the same
+	// patterns as ProtectRule, like "/metrics" or "/api/". No paths allow
+	// none, so a credential is not accepted everywhere by mistake.
+	Paths []string
+	//Roles are the roles of the user, as checked by Protect.
+	Roles []string
+}
+
+//allows will return true if the credential can be used for the path.
+func (c BasicCredential) allows(p string) bool {
+	for _, pattern := range c.Paths {
+		if matchPath(pattern, p) {
+			return true
+		}
+	}
+	return false
+}
+
+//basicAuth are the credentials set with WithBasicAuth, and the passwords
+// verified, so the hash is only done once for each of them.
+type basicAuth struct {
+	creds []BasicCredential
+	//fips will refuse the bcrypt hashes, set by the FIPS crypto profile.
+	fips bool
+
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+//check will return the credential of the user and password, and false if
+// they are not valid.
+func (b *basicAuth) check(user string, password string) (BasicCredential, bool) {
+	for _, c := range b.creds {
+		if c.User != user {
+			continue
+		}
+		key := sha256.Sum256([]byte(c.PasswordHash + "\x00" + password))
+		b.mu.Lock()
+		ok := b.verified[key]
+		b.mu.Unlock()
+		if ok {
+			return c, true
+		}
+		if b.matches(c.PasswordHash, password) {
+			b.mu.Lock()
+			b.verified[key] = true
+			b.mu.Unlock()
+			return c, true
+		}
+	}
+	return BasicCredential{}, false
+}
+
+//matches will return true if the password matches the hash, which is a
+// PBKDF2 hash, or a bcrypt hash unless the FIPS crypto profile is used.
+func (b *basicAuth) matches(hash string, password string) bool {
+	if strings.HasPrefix(hash, pbkdf2Prefix) {
+		h, err := parsePBKDF2Hash(hash)
+		if err != nil {
+			return false
+		}
+		key, err := pbkdf2.Key(sha256.New, password, h.salt, h.iterations, len(h.key))
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare(key, h.key) == 1
+	}
+	if b.fips {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+//pbkdf2Hash is a parsed PBKDF2 password hash.
+type pbkdf2Hash struct {
+	iterations int
+	salt       []byte
+	key        []byte
+}
+
+//parsePBKDF2Hash will parse a hash made by PBKDF2PasswordHash, and return
+// an error if it is not a PBKDF2 hash, or the parameters are weaker than
+// approved.
+func parsePBKDF2Hash(s string) (pbkdf2Hash, error) {
+	if !strings.HasPrefix(s, pbkdf2Prefix) {
+		return pbkdf2Hash{}, errors.New("password hash is not a PBKDF2-SHA256 hash")
+	}
+	parts := strings.Split(strings.TrimPrefix(s, pbkdf2Prefix), "$")
+	if len(parts) != 3 {
+		return pbkdf2Hash{}, errors.New("PBKDF2 password hash is malformed")
+	}
+
+	var h pbkdf2Hash
+	var err error
+	if h.iterations, err = strconv.Atoi(parts[0]); err != nil {
+		return pbkdf2Hash{}, fmt.Errorf("PBKDF2 password hash iterations are not valid: %v", err)
+	}
+	if h.salt, err = base64.RawStdEncoding.DecodeString(parts[1]); err != nil {
+		return pbkdf2Hash{}, fmt.Errorf("PBKDF2 password hash salt is not valid: %v", err)
+	}
+	if h.key, err = base64.RawStdEncoding.DecodeString(parts[2]); err != nil {
+		return pbkdf2Hash{}, fmt.Errorf("PBKDF2 password hash key is not valid: %v", err)
+	}
+
+	switch {
+	case h.iterations < pbkdf2MinIterations:
+		return pbkdf2Hash{}, fmt.Errorf("PBKDF2 password hash has %d iterations, at least %d are needed", h.iterations, pbkdf2MinIterations)
+	case len(h.salt) < pbkdf2SaltSize:
+		return pbkdf2Hash{}, fmt.Errorf("PBKDF2 password hash salt is %d bytes, at least %d are needed", len(h.salt), pbkdf2SaltSize)
+	case len(h.key) < pbkdf2MinKeySize:
+		return pbkdf2Hash{}, fmt.Errorf("PBKDF2 password hash key is %d bytes, at least %d are needed", len(h.key), pbkdf2MinKeySize)
+	}
+	return h, nil
+}
+
+//PBKDF2PasswordHash will return a PBKDF2-HMAC-SHA256 hash of the password,
+// with a random salt, for the PasswordHash of a BasicCredential, like
+// when bcrypt can't be used with the FIPS crypto profile.
+func PBKDF2PasswordHash(password string) (string, error) {
+	salt, err := createRandomKey(pbkdf2SaltSize)
+	if err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, pbkdf2Iterations, pbkdf2KeySize)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%v%d$%v$%v", pbkdf2Prefix, pbkdf2Iterations, base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+//basicAuthenticated will check the basic auth of the request, if any.
+// It returns the request with the user in the context and true if the
+// credentials are valid for the path. If the request has basic auth not
+// valid, a 401 is written and the request is nil. Requests without
+// basic auth are returned as they are with false.
+func (a *Auth) basicAuthenticated(w http.ResponseWriter, r *http.Request) (*http.Request, bool) {
+	if !a.hasBasicAuth(r) {
+		return r, false
+	}
+
+	br, ok, wait := a.basicAuthUser(r)
+	if wait > 0 {
+		setRetryAfter(w, time.Now().Add(wait))
+		http.Error(w, "Too Many Requests", http.StatusTooManyRequests)
+		return nil, false
+	}
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="authsession", charset="UTF-8"`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return nil, false
+	}
+	return br, true
+}
+
+//hasBasicAuth will return true if basic auth is set with WithBasicAuth,
+// and the request has basic auth.
+func (a *Auth) hasBasicAuth(r *http.Request) bool {
+	if a.basicAuth == nil {
+		return false
+	}
+	_, _, ok := r.BasicAuth()
+	return ok
+}
+
+//basicAuthUser will check the basic auth of the request, without writing
+// a response. It returns the request with the user in the context and
+// true if the credentials are valid for the path, and how long to wait
+// if the user is throttled.
+func (a *Auth) basicAuthUser(r *http.Request) (*http.Request, bool, time.Duration) {
+	user, password, _ := r.BasicAuth()
+	if wait := a.loginWait(r, user); wait > 0 {
+		return nil, false, wait
+	}
+
+	c, ok := a.basicAuth.check(user, password)
+	if !ok || !c.allows(r.URL.Path) {
+		a.events.basicAuthFailure(r, user, "credentials not valid for "+r.URL.Path)
+		return nil, false, 0
+	}
+
+	a.events.basicAuthSuccess(r, user)
+	su := sessionUser{user: User{ID: c.User, Email: c.User, FullName: c.User, Roles: c.Roles}}
+	return r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, su)), true, 0
+}
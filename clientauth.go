@@ -0,0 +1,145 @@
+package authsession
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//The methods a provider can use for authenticating us at its token
+// endpoint, set in Provider.TokenAuthMethod.
+const (
+	//AuthClientSecretBasic will send the client secret with basic auth.
+	// This is the default.
+	AuthClientSecretBasic = "client_secret_basic"
+	//AuthPrivateKeyJWT will send a client assertion signed with the key
+	// given with WithClientSigningKey, instead of the client secret.
+	AuthPrivateKeyJWT = "private_key_jwt"
+	//AuthTLSClientAuth will present the certificate given with
+	// WithClientCertificate, instead of the client secret.
+	AuthTLSClientAuth = "tls_client_auth"
+)
+
+//checkTokenAuthMethod will check that the token auth method of the
+// provider is known, and that we have what is needed to use it.
+func (a *Auth) checkTokenAuthMethod(p Provider) error {
+	switch p.TokenAuthMethod {
+	case "", AuthClientSecretBasic:
+	case AuthPrivateKeyJWT:
+		if a.clientSigner == nil {
+			return errors.New("no client signing key configured, see WithClientSigningKey")
+		}
+	case AuthTLSClientAuth:
+		if a.clientCert == nil {
+			return errors.New("no client certificate configured, see WithClientCertificate")
+		}
+	default:
+		return fmt.Errorf("unknown token auth method %q", p.TokenAuthMethod)
+	}
+	return nil
+}
+
+//clientAuthParams will return the parameters authenticating us to the
+// endpoint at aud of the provider, or nil when the client secret is sent
+// with basic auth.
+func (a *Auth) clientAuthParams(p Provider, aud string) (url.Values, error) {
+	switch p.TokenAuthMethod {
+	case AuthPrivateKeyJWT:
+		assertion, err := a.clientAssertion(p, aud)
+		if err != nil {
+			return nil, err
+		}
+		v := url.Values{}
+		v.Set("client_id", p.ClientID)
+		v.Set("client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer")
+		v.Set("client_assertion", assertion)
+		return v, nil
+	case AuthTLSClientAuth:
+		v := url.Values{}
+		v.Set("client_id", p.ClientID)
+		return v, nil
+	}
+	return nil, nil
+}
+
+//clientAssertion will return a short lived client assertion for the
+// endpoint at aud, signed with the client signing key.
+func (a *Auth) clientAssertion(p Provider, aud string) (string, error) {
+	if a.clientSigner == nil {
+		return "", errors.New("no client signing key configured, see WithClientSigningKey")
+	}
+
+	jti, err := a.newKey(16, KeyBase64URL)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(a.clientSigner, "JWT", map[string]interface{}{
+		"iss": p.ClientID,
+		"sub": p.ClientID,
+		"aud": aud,
+		"iat": now.Unix(),
+		"exp": now.Add(time.Minute).Unix(),
+		"jti": jti,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to sign client assertion: %v", err)
+	}
+	return assertion, nil
+}
+
+//providerHTTPClient will return the http client to use for the back
+// channel requests to the provider, presenting the client certificate
+// for providers using tls_client_auth. Failing requests are retried.
+func (a *Auth) providerHTTPClient(p Provider) *http.Client {
+	var base http.RoundTripper = http.DefaultTransport
+	if p.TokenAuthMethod == AuthTLSClientAuth && a.clientCert != nil {
+		base = &http.Transport{
+			TLSClientConfig: &tls.Config{Certificates: []tls.Certificate{*a.clientCert}},
+		}
+	}
+	return &http.Client{Timeout: 10 * time.Second, Transport: a.retry.transport(base)}
+}
+
+//exchange will exchange the code for a token with the provider, using
+// the token auth method of the provider.
+func (a *Auth) exchange(ctx context.Context, providerID string, oauthConfig *oauth2.Config, code string) (*oauth2.Token, error) {
+	if providerID == "" || a.providers == nil {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, a.providerClient())
+		return oauthConfig.Exchange(ctx, code)
+	}
+
+	p, ok, err := a.providers.Get(providerID)
+	if err != nil {
+		return nil, fmt.Errorf("provider store Get failed: %v", err)
+	}
+	if !ok || p.TokenAuthMethod == "" || p.TokenAuthMethod == AuthClientSecretBasic {
+		ctx = context.WithValue(ctx, oauth2.HTTPClient, a.providerHTTPClient(p))
+		return oauthConfig.Exchange(ctx, code)
+	}
+
+	params, err := a.clientAuthParams(p, p.TokenURL)
+	if err != nil {
+		return nil, err
+	}
+	var opts []oauth2.AuthCodeOption
+	for k := range params {
+		opts = append(opts, oauth2.SetAuthURLParam(k, params.Get(k)))
+	}
+
+	//Only the client_id is sent by the oauth2 package when the secret is
+	// empty, and the assertion or certificate authenticates us instead.
+	c := *oauthConfig
+	c.ClientSecret = ""
+	c.Endpoint.AuthStyle = oauth2.AuthStyleInParams
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, a.providerHTTPClient(p))
+
+	return c.Exchange(ctx, code, opts...)
+}
@@ -0,0 +1,243 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//clientCredentialsEarlyExpiry is how long before it expires a cached
+// client credentials token is replaced, so a token is never used just as
+// it expires.
+const clientCredentialsEarlyExpiry = 30 * time.Second
+
+//ClientCredentialsConfig is a client getting tokens with the client
+// credentials grant, for backend jobs calling APIs without a user.
+type ClientCredentialsConfig struct {
+	//TokenURL is the token endpoint, like the /oidc/token of the issuer.
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	//Scopes are the scopes asked for. The server decides if empty.
+	Scopes []string
+	//Resource is the API the token is asked for with RFC 8707, like one of
+	// the Audiences of a client of the issuer. Optional.
+	Resource string
+}
+
+//clientCredentialsSource is an oauth2.TokenSource getting a new token
+// with the client credentials grant for every call.
+type clientCredentialsSource struct {
+	conf    ClientCredentialsConfig
+	client  *http.Client
+	timeout time.Duration
+	//authParams will return the parameters authenticating the client
+	// instead of sending the secret with basic auth, like a client
+	// assertion. Nil sends the secret.
+	authParams func() (url.Values, error)
+}
+
+//NewClientCredentialsTokenSource will return an oauth2.TokenSource with
+// the tokens of the client credentials grant of c. The token is cached,
+// and a new one is got a bit before it expires, so the source can be
+// used for all the requests of a backend job, like with
+// oauth2.NewClient.
+func NewClientCredentialsTokenSource(c ClientCredentialsConfig) oauth2.TokenSource {
+	return newClientCredentialsTokenSource(c, &http.Client{Timeout: 10 * time.Second}, nil)
+}
+
+//newClientCredentialsTokenSource will return the cached source of the
+// tokens of c, got with client and authenticated by authParams if set.
+func newClientCredentialsTokenSource(c ClientCredentialsConfig, client *http.Client, authParams func() (url.Values, error)) oauth2.TokenSource {
+	src := &clientCredentialsSource{
+		conf:       c,
+		client:     client,
+		timeout:    10 * time.Second,
+		authParams: authParams,
+	}
+	return oauth2.ReuseTokenSourceWithExpiry(nil, src, clientCredentialsEarlyExpiry)
+}
+
+//Token will get a new token from the token endpoint.
+func (s *clientCredentialsSource) Token() (*oauth2.Token, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	v := url.Values{}
+	v.Set("grant_type", "client_credentials")
+	if len(s.conf.Scopes) > 0 {
+		v.Set("scope", strings.Join(s.conf.Scopes, " "))
+	}
+	if s.conf.Resource != "" {
+		v.Set("resource", s.conf.Resource)
+	}
+	if s.authParams != nil {
+		params, err := s.authParams()
+		if err != nil {
+			return nil, err
+		}
+		for k := range params {
+			v.Set(k, params.Get(k))
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.conf.TokenURL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if s.authParams == nil {
+		req.SetBasicAuth(url.QueryEscape(s.conf.ClientID), url.QueryEscape(s.conf.ClientSecret))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("client credentials token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error       string `json:"error"`
+			Description string `json:"error_description"`
+		}
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(b, &e)
+		return nil, fmt.Errorf("client credentials token request failed: %v %v %v", resp.Status, e.Error, e.Description)
+	}
+
+	var tr struct {
+		AccessToken string `json:"access_token"`
+		TokenType   string `json:"token_type"`
+		ExpiresIn   int64  `json:"expires_in"`
+		Scope       string `json:"scope"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("failed parsing client credentials token response: %v", err)
+	}
+	if tr.AccessToken == "" {
+		return nil, errors.New("client credentials token response has no access token")
+	}
+
+	t := &oauth2.Token{AccessToken: tr.AccessToken, TokenType: tr.TokenType}
+	if tr.ExpiresIn > 0 {
+		t.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+	}
+	return t.WithExtra(map[string]interface{}{"scope": tr.Scope}), nil
+}
+
+//ClientCredentials will return an oauth2.TokenSource with tokens from the
+// provider got with the client credentials grant, for backend jobs
+// calling the APIs of the provider without a user. providerID is the ID
+// of a provider registered with RegisterProvider, using its token auth
+// method, or empty for the provider given to NewAuth. The token is
+// cached, and a new one is got a bit before it expires.
+func (a *Auth) ClientCredentials(providerID string, scopes ...string) (oauth2.TokenSource, error) {
+	if providerID == "" {
+		c := ClientCredentialsConfig{
+			TokenURL:     a.googleOauthConfig.Endpoint.TokenURL,
+			ClientID:     a.googleOauthConfig.ClientID,
+			ClientSecret: a.googleOauthConfig.ClientSecret,
+			Scopes:       scopes,
+		}
+		return newClientCredentialsTokenSource(c, a.providerClient(), nil), nil
+	}
+
+	if a.providers == nil {
+		return nil, errors.New("no provider store configured")
+	}
+	p, ok, err := a.providers.Get(providerID)
+	if err != nil {
+		return nil, fmt.Errorf("provider store Get failed: %v", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", providerID)
+	}
+	if err := a.checkTokenAuthMethod(p); err != nil {
+		return nil, err
+	}
+
+	c := ClientCredentialsConfig{
+		TokenURL:     p.TokenURL,
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		Scopes:       scopes,
+	}
+	var authParams func() (url.Values, error)
+	if p.TokenAuthMethod != "" && p.TokenAuthMethod != AuthClientSecretBasic {
+		authParams = func() (url.Values, error) {
+			return a.clientAuthParams(p, p.TokenURL)
+		}
+	}
+	return newClientCredentialsTokenSource(c, a.providerHTTPClient(p), authParams), nil
+}
+
+//clientCredentialsGrant will handle the client credentials grant at the
+// token endpoint of the issuer, giving the client an access token for
+// itself, with the subject being the client ID. The scopes granted are
+// the Scopes of the client asked for, or all of them.
+func (a *Auth) clientCredentialsGrant(w http.ResponseWriter, r *http.Request, client OIDCClient, iss string, audience string, jkt string) {
+	scope := strings.Join(client.Scopes, " ")
+	if s := r.PostFormValue("scope"); s != "" {
+		for _, sc := range strings.Fields(s) {
+			if !slices.Contains(client.Scopes, sc) {
+				tokenError(w, http.StatusBadRequest, "invalid_scope", "the scope is not allowed for the client")
+				return
+			}
+		}
+		scope = strings.Join(strings.Fields(s), " ")
+	}
+
+	jti, err := a.newKey(16, KeyBase64URL)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to make token ID: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": iss,
+		"sub": client.ID,
+		"aud": audience,
+		"azp": client.ID,
+		"iat": now.Unix(),
+		"exp": now.Add(a.issuer.conf.TokenTTL).Unix(),
+		"jti": jti,
+	}
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	tokenType := "Bearer"
+	if jkt != "" {
+		claims["cnf"] = map[string]string{"jkt": jkt}
+		tokenType = "DPoP"
+	}
+	//The tokens of a client have no user, and are kept in the default
+	// region.
+	accessToken, err := a.issuer.signAccessToken(claims, "")
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to sign access token: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   tokenType,
+		"expires_in":   int(a.issuer.conf.TokenTTL.Seconds()),
+	}
+	if scope != "" {
+		resp["scope"] = scope
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,27 @@
+package authsession
+
+import (
+	"errors"
+	"time"
+)
+
+//defaultClockSkew is how much the clocks of the servers are allowed to
+// differ when checking the times in tokens, set with WithClockSkew.
+const defaultClockSkew = 2 * time.Minute
+
+//checkTimeClaims will check the exp, iat and nbf claims of a token,
+// allowing the clocks to differ by skew. Claims that are 0 are not set,
+// and not checked.
+func checkTimeClaims(exp int64, iat int64, nbf int64, skew time.Duration) error {
+	now := time.Now()
+	if exp != 0 && now.After(time.Unix(exp, 0).Add(skew)) {
+		return errors.New("token is expired")
+	}
+	if iat != 0 && time.Unix(iat, 0).After(now.Add(skew)) {
+		return errors.New("token is issued in the future")
+	}
+	if nbf != 0 && time.Unix(nbf, 0).After(now.Add(skew)) {
+		return errors.New("token is not valid yet")
+	}
+	return nil
+}
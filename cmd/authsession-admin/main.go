@@ -0,0 +1,486 @@
+//authsession-admin is a tool for operators to manage the sessions, bans,
+// invitations and cookie keys used by authsession, using the same config
+// file as the web server. Run with -h to see the commands.
+package main
+
+import (
+	"context"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/postmannen/authsession"
+	"golang.org/x/oauth2/google"
+)
+
+func main() {
+	configFile := flag.String("config", "config.json", "the config file used by the web server")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() < 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	conf, err := authsession.LoadConfig(*configFile)
+	if err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+
+	cmd, args := flag.Arg(0), flag.Args()[1:]
+
+	switch cmd {
+	case "sessions":
+		err = listSessions(conf)
+	case "revoke":
+		err = revoke(conf, args)
+	case "revoke-user":
+		err = revokeUser(conf, args)
+	case "bans":
+		err = listBans(conf)
+	case "ban":
+		err = ban(conf, args)
+	case "unban":
+		err = unban(conf, args)
+	case "rotate-key":
+		err = rotateKey(conf, *configFile, args)
+	case "invite":
+		err = invite(conf, args)
+	case "invitations":
+		err = listInvitations(conf)
+	case "validate":
+		err = conf.Validate()
+		if err == nil {
+			fmt.Println("config ok")
+		}
+	case "doctor":
+		err = doctor(conf)
+	case "inspect":
+		err = inspect(conf, args)
+	case "migrate-sessions":
+		err = migrateSessions(conf, args)
+	case "verify-audit":
+		err = verifyAudit(args)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		log.Fatalf("error: %s: %v\n", cmd, err)
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `usage: authsession-admin [-config file] <command> [arguments]
+
+commands:
+  sessions                 list the active sessions
+  revoke <session id>      revoke a session
+  revoke-user <user>       revoke all sessions for a user ID or email
+  bans                     list the banned IP addresses
+  ban [-for 1h] [-reason text] <ip>
+                           ban an IP address
+  unban <ip>               remove the ban for an IP address
+  rotate-key [-keep 2]     create a new cookie key, and write it to the config file
+  invite [-ttl 168h] <email>
+                           create an invitation for an email
+  invitations              list the invitations
+  validate                 validate the config file
+  doctor                   check the config end to end against the provider and the stores
+  inspect [-cookie value] [-session id]
+                           show the values of a session cookie or ID, and if it is allowed access
+  migrate-sessions -from <store> -to <store> [-dry-run] [-overwrite] [-delete] [-prefix p]
+                           copy the active sessions to another session store, where a store is
+                           config, file:<path>, memcached:<addr>[,<addr>...],
+                           dynamodb:<region>/<table> or firestore:<project>/<collection>
+  verify-audit <events file> <public key file>
+                           verify the audit chain of the events written as JSON, with the
+                           PEM public key of the checkpoint signer
+`)
+}
+
+//sessionStore will return the session store from the config, or an
+// error if it is not configured.
+func sessionStore(conf authsession.Config) (authsession.SessionStore, error) {
+	if conf.SessionStoreFile == "" {
+		return nil, fmt.Errorf("sessionStoreFile is not set in the config")
+	}
+	return conf.SessionStore()
+}
+
+//banStore will return the ban store from the config, or an error if
+// it is not configured.
+func banStore(conf authsession.Config) (*authsession.FileBanStore, error) {
+	if conf.BanStoreFile == "" {
+		return nil, fmt.Errorf("banStoreFile is not set in the config")
+	}
+	return authsession.NewFileBanStore(conf.BanStoreFile), nil
+}
+
+//invitationStore will return the invitation store from the config, or
+// an error if it is not configured.
+func invitationStore(conf authsession.Config) (*authsession.FileInvitationStore, error) {
+	if conf.InvitationStoreFile == "" {
+		return nil, fmt.Errorf("invitationStoreFile is not set in the config")
+	}
+	return authsession.NewFileInvitationStore(conf.InvitationStoreFile), nil
+}
+
+func listSessions(conf authsession.Config) error {
+	store, err := sessionStore(conf)
+	if err != nil {
+		return err
+	}
+
+	sessions, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSER ID\tEMAIL\tDEVICE\tIP\tCREATED\tEXPIRES")
+	for _, s := range sessions {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.UserID, s.Email, s.DisplayName(), s.IP, s.Created.Format(time.RFC3339), s.Expires.Format(time.RFC3339))
+	}
+	return tw.Flush()
+}
+
+func revoke(conf authsession.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a session id")
+	}
+
+	store, err := sessionStore(conf)
+	if err != nil {
+		return err
+	}
+
+	return store.Delete(args[0])
+}
+
+func revokeUser(conf authsession.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected a user ID or email")
+	}
+
+	store, err := sessionStore(conf)
+	if err != nil {
+		return err
+	}
+
+	n, err := store.DeleteUser(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("revoked %d sessions\n", n)
+
+	return nil
+}
+
+func listBans(conf authsession.Config) error {
+	store, err := banStore(conf)
+	if err != nil {
+		return err
+	}
+
+	bans, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "IP\tCREATED\tEXPIRES\tREASON")
+	for _, b := range bans {
+		expires := "never"
+		if !b.Expires.IsZero() {
+			expires = b.Expires.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", b.IP, b.Created.Format(time.RFC3339), expires, b.Reason)
+	}
+	return tw.Flush()
+}
+
+func ban(conf authsession.Config, args []string) error {
+	fs := flag.NewFlagSet("ban", flag.ExitOnError)
+	duration := fs.Duration("for", 0, "how long the ban should last, 0 means forever")
+	reason := fs.String("reason", "", "the reason for the ban")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected an IP address")
+	}
+
+	store, err := banStore(conf)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	b := authsession.Ban{
+		IP:      fs.Arg(0),
+		Reason:  *reason,
+		Created: now,
+	}
+	if *duration > 0 {
+		b.Expires = now.Add(*duration)
+	}
+
+	return store.Ban(b)
+}
+
+func unban(conf authsession.Config, args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("expected an IP address")
+	}
+
+	store, err := banStore(conf)
+	if err != nil {
+		return err
+	}
+
+	return store.Unban(args[0])
+}
+
+func rotateKey(conf authsession.Config, configFile string, args []string) error {
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	keep := fs.Int("keep", 2, "the number of cookie keys to keep, including the new one")
+	fs.Parse(args)
+
+	if err := conf.RotateCookieKey(*keep); err != nil {
+		return err
+	}
+	if err := conf.Save(configFile); err != nil {
+		return err
+	}
+	fmt.Println("new cookie key written to the config, restart the web server to use it")
+
+	return nil
+}
+
+func invite(conf authsession.Config, args []string) error {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	ttl := fs.Duration("ttl", 7*24*time.Hour, "how long the invitation can be accepted, 0 means forever")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return fmt.Errorf("expected an email")
+	}
+
+	store, err := invitationStore(conf)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	i := authsession.Invitation{
+		Email:   fs.Arg(0),
+		Created: now,
+	}
+	if *ttl > 0 {
+		i.Expires = now.Add(*ttl)
+	}
+
+	return store.Add(i)
+}
+
+func listInvitations(conf authsession.Config) error {
+	store, err := invitationStore(conf)
+	if err != nil {
+		return err
+	}
+
+	invitations, err := store.List()
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "EMAIL\tCREATED\tEXPIRES\tACCEPTED")
+	for _, i := range invitations {
+		expires, accepted := "never", "no"
+		if !i.Expires.IsZero() {
+			expires = i.Expires.Format(time.RFC3339)
+		}
+		if !i.Accepted.IsZero() {
+			accepted = i.Accepted.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", i.Email, i.Created.Format(time.RFC3339), expires, accepted)
+	}
+	return tw.Flush()
+}
+
+func doctor(conf authsession.Config) error {
+	a, _, err := authsession.NewAuthFromConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	findings := a.Validate(ctx)
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "LEVEL\tCHECK\tMESSAGE")
+	for _, f := range findings {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Level, f.Check, f.Message)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if authsession.HasErrors(findings) {
+		return fmt.Errorf("found errors in the configuration")
+	}
+	return nil
+}
+
+func inspect(conf authsession.Config, args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ExitOnError)
+	cookie := fs.String("cookie", "", "the value of the session cookie")
+	sessionID := fs.String("session", "", "the session ID")
+	fs.Parse(args)
+
+	a, _, err := authsession.NewAuthFromConfig(conf)
+	if err != nil {
+		return err
+	}
+
+	var si authsession.SessionInspection
+	switch {
+	case *cookie != "":
+		si, err = a.InspectCookie(*cookie)
+	case *sessionID != "":
+		si, err = a.InspectSession(*sessionID)
+	default:
+		return fmt.Errorf("expected -cookie or -session")
+	}
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(si)
+}
+
+//openStore will return the session store given by spec, which is
+// "config" for the store of the config file, or the kind of the store
+// and where it is, like "file:sessions.json" or "dynamodb:eu-west-1/sessions".
+// The AWS credentials are read from the environment, and the Google
+// credentials are the application default credentials.
+func openStore(ctx context.Context, conf authsession.Config, spec string, prefix string) (authsession.SessionStore, error) {
+	kind, where, _ := strings.Cut(spec, ":")
+	switch kind {
+	case "config":
+		return sessionStore(conf)
+	case "cookie":
+		return nil, fmt.Errorf("sessions kept only in cookies can't be listed or copied")
+	case "file":
+		return authsession.NewFileSessionStore(where), nil
+	case "memcached":
+		return authsession.NewMemcachedSessionStore(authsession.MemcachedConfig{
+			Addrs:  strings.Split(where, ","),
+			Prefix: prefix,
+		}), nil
+	case "dynamodb":
+		region, table, ok := strings.Cut(where, "/")
+		if !ok {
+			return nil, fmt.Errorf("expected dynamodb:<region>/<table>, got %q", spec)
+		}
+		return authsession.NewDynamoDBSessionStore(region, os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"), os.Getenv("AWS_SESSION_TOKEN"), table), nil
+	case "firestore":
+		project, collection, ok := strings.Cut(where, "/")
+		if !ok {
+			return nil, fmt.Errorf("expected firestore:<project>/<collection>, got %q", spec)
+		}
+		ts, err := google.DefaultTokenSource(ctx, "https://www.googleapis.com/auth/datastore")
+		if err != nil {
+			return nil, err
+		}
+		return authsession.NewFirestoreSessionStore(ts, project, collection), nil
+	default:
+		return nil, fmt.Errorf("unknown session store %q", spec)
+	}
+}
+
+func migrateSessions(conf authsession.Config, args []string) error {
+	fs := flag.NewFlagSet("migrate-sessions", flag.ExitOnError)
+	from := fs.String("from", "config", "the session store to copy the sessions from")
+	to := fs.String("to", "", "the session store to copy the sessions to")
+	prefix := fs.String("prefix", "", "the prefix of the keys, for memcached")
+	dryRun := fs.Bool("dry-run", false, "only count the sessions to copy")
+	overwrite := fs.Bool("overwrite", false, "replace the sessions already in the new store")
+	deleteSource := fs.Bool("delete", false, "delete the sessions from the old store when copied")
+	fs.Parse(args)
+
+	if *to == "" {
+		return fmt.Errorf("expected -to")
+	}
+
+	ctx := context.Background()
+	fromStore, err := openStore(ctx, conf, *from, *prefix)
+	if err != nil {
+		return err
+	}
+	toStore, err := openStore(ctx, conf, *to, *prefix)
+	if err != nil {
+		return err
+	}
+
+	res, err := authsession.MigrateSessions(ctx, fromStore, toStore, authsession.StoreMigrationOptions{
+		Overwrite:    *overwrite,
+		DeleteSource: *deleteSource,
+		DryRun:       *dryRun,
+	})
+	fmt.Printf("copied %d sessions, skipped %d already in the new store, and %d expired\n", res.Copied, res.Skipped, res.Expired)
+	return err
+}
+
+//verifyAudit will verify the audit chain of the events in a file, with
+// the RSA public key of the checkpoint signer in a PEM file.
+func verifyAudit(args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("expected an events file and a public key file")
+	}
+
+	b, err := os.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+	block, _ := pem.Decode(b)
+	if block == nil {
+		return fmt.Errorf("no PEM block found in %v", args[1])
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("failed parsing public key: %v", err)
+	}
+	pub, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return fmt.Errorf("public key is a %T, and not an RSA key", key)
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	res, err := authsession.VerifyAuditChain(f, pub)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("audit chain ok: %d events verified with %d checkpoints, %d events after the last checkpoint\n", res.Events, res.Checkpoints, res.Unsigned)
+	return nil
+}
@@ -0,0 +1,156 @@
+//authsession-init will make a small web app with Google login using
+// authsession, with a main.go, a config file, the templates of a start
+// page and a protected page, and a Dockerfile, so there is a working app
+// to start from. Run with -h to see the flags.
+package main
+
+import (
+	"crypto/rand"
+	"embed"
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/postmannen/authsession"
+)
+
+//skeleton are the files of the app. Files ending in .tmpl are executed
+// with the settings, using [[ and ]] as delimiters so the Go templates of
+// the app are kept as they are, and written without the .tmpl suffix.
+//
+//go:embed skeleton
+var skeleton embed.FS
+
+//settings are the values used in the skeleton.
+type settings struct {
+	Name   string
+	Module string
+	Port   string
+}
+
+//skeletonNames are the names of the files to write, where the name in the
+// skeleton is different.
+var skeletonNames = map[string]string{
+	"gitignore": ".gitignore",
+}
+
+func main() {
+	dir := flag.String("dir", "authsession-app", "the directory to make the app in")
+	module := flag.String("module", "", "the module path of the app, defaults to example.com/<name of dir>")
+	proto := flag.String("proto", "http", "http or https, used for the callback url")
+	host := flag.String("host", "localhost", "the host name of the app, used for the callback url")
+	port := flag.String("port", "8080", "the port of the app")
+	clientID := flag.String("client-id", os.Getenv("GOOGLE_CLIENT_ID"), "the client ID of the oauth app in the Google cloud console, defaults to $GOOGLE_CLIENT_ID")
+	clientSecret := flag.String("client-secret", os.Getenv("GOOGLE_CLIENT_SECRET"), "the client secret of the oauth app, defaults to $GOOGLE_CLIENT_SECRET")
+	force := flag.Bool("force", false, "overwrite files that already exist")
+	flag.Parse()
+
+	name := filepath.Base(filepath.Clean(*dir))
+	if *module == "" {
+		*module = "example.com/" + name
+	}
+	s := settings{Name: name, Module: *module, Port: *port}
+
+	if err := writeSkeleton(*dir, s, *force); err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+
+	key, err := newCookieKey()
+	if err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+	conf := authsession.Config{
+		Proto:            *proto,
+		Host:             *host,
+		Port:             *port,
+		CookieStoreKeys:  []string{key},
+		ClientID:         *clientID,
+		ClientSecret:     *clientSecret,
+		SessionStoreFile: "sessions.store.json",
+		UserStoreFile:    "users.store.json",
+	}
+	if conf.ClientID == "" {
+		conf.ClientID = "your-client-id.apps.googleusercontent.com"
+	}
+	if conf.ClientSecret == "" {
+		conf.ClientSecret = "your-client-secret"
+	}
+	if err := writeFile(filepath.Join(*dir, "config.json"), *force, conf.Save); err != nil {
+		log.Fatalf("error: %v\n", err)
+	}
+
+	fmt.Printf(`Made the app %v in %v.
+
+Register %v://%v:%v/callback as an authorized redirect URI of the oauth app
+in the Google cloud console, and put the client ID and secret in config.json
+if not given with -client-id and -client-secret. Then run:
+
+  cd %v
+  go mod tidy
+  go run .
+
+and open %v://%v:%v/ in the browser.
+`, name, *dir, *proto, *host, *port, *dir, *proto, *host, *port)
+}
+
+//writeSkeleton will write the files of the skeleton to dir.
+func writeSkeleton(dir string, s settings, force bool) error {
+	return fs.WalkDir(skeleton, "skeleton", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+
+		b, err := fs.ReadFile(skeleton, p)
+		if err != nil {
+			return err
+		}
+		t, err := template.New(path.Base(p)).Delims("[[", "]]").Parse(string(b))
+		if err != nil {
+			return fmt.Errorf("failed parsing %v: %v", p, err)
+		}
+
+		rel := strings.TrimSuffix(strings.TrimPrefix(p, "skeleton/"), ".tmpl")
+		if n, ok := skeletonNames[rel]; ok {
+			rel = n
+		}
+		return writeFile(filepath.Join(dir, filepath.FromSlash(rel)), force, func(name string) error {
+			var out strings.Builder
+			if err := t.Execute(&out, s); err != nil {
+				return fmt.Errorf("failed executing %v: %v", p, err)
+			}
+			return os.WriteFile(name, []byte(out.String()), 0644)
+		})
+	})
+}
+
+//writeFile will make the directory of the file name, and call write to
+// write it, unless the file exists and force is false.
+func writeFile(name string, force bool, write func(name string) error) error {
+	if _, err := os.Stat(name); err == nil && !force {
+		return fmt.Errorf("%v already exists, use -force to overwrite it", name)
+	}
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return err
+	}
+	if err := write(name); err != nil {
+		return err
+	}
+	fmt.Println("wrote", name)
+	return nil
+}
+
+//newCookieKey will return a random key for the cookie store.
+func newCookieKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed making a cookie key: %v", err)
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
@@ -0,0 +1,314 @@
+package authsession
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/gorilla/sessions"
+)
+
+//Config is the configuration for Auth, that can be read from a JSON file.
+// It is used with NewAuthFromConfig, and by the authsession-admin tool
+// to find the stores used by the web server.
+type Config struct {
+	//Proto is either http or https.
+	Proto string `json:"proto"`
+	//Host is the name of your server, like example.com or localhost.
+	Host string `json:"host"`
+	//Port is the port of your server, like 8080.
+	Port string `json:"port"`
+	//CookieStoreKeys are the secret keys used for the cookie storage.
+	// The first key is used for new cookies, and the rest are only used
+	// to decode existing cookies, which allows the keys to be rotated.
+	CookieStoreKeys []string `json:"cookieStoreKeys"`
+	//ClientID is the Client ID key for your oauth app.
+	ClientID string `json:"clientID"`
+	//ClientSecret is the client secret for your oauth app.
+	ClientSecret string `json:"clientSecret"`
+	//SessionStoreFile is the file to keep the active sessions in.
+	// Sessions are not kept server side if empty.
+	SessionStoreFile string `json:"sessionStoreFile"`
+	//SessionEncryptionKeys are base64 encoded keys of 16, 24 or 32 bytes
+	// used to encrypt the personal data in the session store. The first
+	// key is used for encrypting, and all the keys for decrypting.
+	SessionEncryptionKeys []string `json:"sessionEncryptionKeys"`
+	//BanStoreFile is the file to keep the banned IP addresses in.
+	// No IP's are banned if empty.
+	BanStoreFile string `json:"banStoreFile"`
+	//TrustedProxies are the networks of the reverse proxies, like
+	// "10.0.0.0/8", the client IP is taken from X-Forwarded-For for.
+	TrustedProxies []string `json:"trustedProxies"`
+	//InvitationStoreFile is the file to keep the invitations in.
+	// All users are allowed to log in if empty.
+	InvitationStoreFile string `json:"invitationStoreFile"`
+	//UserStoreFile is the file to keep the users in, which is needed
+	// to disable users.
+	UserStoreFile string `json:"userStoreFile"`
+	//UserEncryptionKeys are base64 encoded keys of 16, 24 or 32 bytes
+	// used to encrypt the personal data in the user store. The first key
+	// is used for encrypting, and all the keys for decrypting.
+	UserEncryptionKeys []string `json:"userEncryptionKeys"`
+	//UserIndexKey is the base64 encoded key of at least 16 bytes for the
+	// blind index of the emails in the encrypted user store. It is needed
+	// with UserEncryptionKeys, and can't be changed.
+	UserIndexKey string `json:"userIndexKey"`
+	//AllowListFile is the file to keep the allowlist in.
+	// All users are allowed to log in if empty.
+	AllowListFile string `json:"allowListFile"`
+	//AdminRoles are the roles of the users allowed to use the admin API.
+	AdminRoles []string `json:"adminRoles"`
+	//TenantStoreFile is the file to keep the tenants in.
+	// Tenants are not used if empty.
+	TenantStoreFile string `json:"tenantStoreFile"`
+	//TenantFrom is either host or path, and tells if the tenant is
+	// found from the host name or the first part of the path.
+	TenantFrom string `json:"tenantFrom"`
+	//ProviderStoreFile is the file to keep the providers registered at
+	// runtime in. Only the default provider is used if empty.
+	ProviderStoreFile string `json:"providerStoreFile"`
+	//Production turns on production mode, where NewAuthFromConfig and
+	// Serve refuse to start with obviously bad secrets, see SelfCheck.
+	Production bool `json:"production"`
+	//CryptoProfile is the crypto profile, like "fips", see
+	// WithCryptoProfile. It follows the Go FIPS 140-3 mode if empty.
+	CryptoProfile string `json:"cryptoProfile"`
+	//LogSalt is the secret the emails and user IDs in the logs are hashed
+	// with, see WithLogIdentifiers. It is derived from the first cookie
+	// key if empty.
+	LogSalt string `json:"logSalt"`
+}
+
+//LoadConfig will read the JSON config file at path.
+func LoadConfig(path string) (Config, error) {
+	var c Config
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return c, fmt.Errorf("failed reading config file: %v", err)
+	}
+
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("failed parsing config file: %v", err)
+	}
+
+	return c, nil
+}
+
+//Save will write the config as JSON to the file at path.
+func (c Config) Save(path string) error {
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, b, 0600)
+}
+
+//Validate will check that all the required values are set, and return
+// an error describing all the problems found.
+func (c Config) Validate() error {
+	var errs []error
+
+	if c.Proto != "http" && c.Proto != "https" {
+		errs = append(errs, fmt.Errorf("proto must be http or https, got %q", c.Proto))
+	}
+	if c.Host == "" {
+		errs = append(errs, errors.New("host is missing"))
+	}
+	if c.Port == "" {
+		errs = append(errs, errors.New("port is missing"))
+	}
+	if len(c.CookieStoreKeys) == 0 {
+		errs = append(errs, errors.New("cookieStoreKeys is missing"))
+	}
+	for i, k := range c.CookieStoreKeys {
+		if k == "" {
+			errs = append(errs, fmt.Errorf("cookieStoreKeys[%d] is empty", i))
+		}
+	}
+	if c.ClientID == "" {
+		errs = append(errs, errors.New("clientID is missing"))
+	}
+	if c.ClientSecret == "" {
+		errs = append(errs, errors.New("clientSecret is missing"))
+	}
+	if c.TenantFrom != "" && c.TenantFrom != "host" && c.TenantFrom != "path" {
+		errs = append(errs, fmt.Errorf("tenantFrom must be host or path, got %q", c.TenantFrom))
+	}
+	for i, k := range c.SessionEncryptionKeys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || (len(b) != 16 && len(b) != 24 && len(b) != 32) {
+			errs = append(errs, fmt.Errorf("sessionEncryptionKeys[%d] must be base64 of 16, 24 or 32 bytes", i))
+		}
+	}
+	if len(c.SessionEncryptionKeys) > 0 && c.SessionStoreFile == "" {
+		errs = append(errs, errors.New("sessionEncryptionKeys is set, but sessionStoreFile is not"))
+	}
+
+	for i, k := range c.UserEncryptionKeys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil || (len(b) != 16 && len(b) != 24 && len(b) != 32) {
+			errs = append(errs, fmt.Errorf("userEncryptionKeys[%d] must be base64 of 16, 24 or 32 bytes", i))
+		}
+	}
+	if len(c.UserEncryptionKeys) > 0 {
+		b, err := base64.StdEncoding.DecodeString(c.UserIndexKey)
+		if err != nil || len(b) < minBlindIndexKeySize {
+			errs = append(errs, fmt.Errorf("userIndexKey must be base64 of at least %d bytes when userEncryptionKeys is set", minBlindIndexKeySize))
+		}
+		if c.UserStoreFile == "" {
+			errs = append(errs, errors.New("userEncryptionKeys is set, but userStoreFile is not"))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+//SessionStore will return the session store from the config, encrypted
+// if SessionEncryptionKeys are set, or nil if SessionStoreFile is not set.
+func (c Config) SessionStore() (SessionStore, error) {
+	if c.SessionStoreFile == "" {
+		return nil, nil
+	}
+
+	store := NewFileSessionStore(c.SessionStoreFile)
+	if len(c.SessionEncryptionKeys) == 0 {
+		return store, nil
+	}
+
+	var keys [][]byte
+	for i, k := range c.SessionEncryptionKeys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("sessionEncryptionKeys[%d]: %v", i, err)
+		}
+		keys = append(keys, b)
+	}
+	return NewEncryptedSessionStore(store, keys...)
+}
+
+//UserStore will return the user store from the config, encrypted if
+// UserEncryptionKeys are set, or nil if UserStoreFile is not set.
+func (c Config) UserStore() (UserStore, error) {
+	if c.UserStoreFile == "" {
+		return nil, nil
+	}
+
+	store := NewFileUserStore(c.UserStoreFile)
+	if len(c.UserEncryptionKeys) == 0 {
+		return store, nil
+	}
+
+	var keys [][]byte
+	for i, k := range c.UserEncryptionKeys {
+		b, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, fmt.Errorf("userEncryptionKeys[%d]: %v", i, err)
+		}
+		keys = append(keys, b)
+	}
+	indexKey, err := base64.StdEncoding.DecodeString(c.UserIndexKey)
+	if err != nil {
+		return nil, fmt.Errorf("userIndexKey: %v", err)
+	}
+	return NewEncryptedUserStore(store, indexKey, keys...)
+}
+
+//RotateCookieKey will create a new random cookie key, and put it first
+// in CookieStoreKeys so it is used for all new cookies. The older keys
+// are kept to decode existing cookies, with at most keep keys kept in
+// total. A keep less than 1 will keep all the keys.
+func (c *Config) RotateCookieKey(keep int) error {
+	keyRAW, err := createRandomKey(32)
+	if err != nil {
+		return fmt.Errorf("failed to create cookie key: %v", err)
+	}
+
+	c.CookieStoreKeys = append([]string{base64.URLEncoding.EncodeToString(keyRAW)}, c.CookieStoreKeys...)
+	if keep > 0 && len(c.CookieStoreKeys) > keep {
+		c.CookieStoreKeys = c.CookieStoreKeys[:keep]
+	}
+
+	return nil
+}
+
+//cookieStoreKeys will return the cookie keys as []byte's.
+func (c Config) cookieStoreKeys() [][]byte {
+	var keys [][]byte
+	for _, k := range c.CookieStoreKeys {
+		keys = append(keys, []byte(k))
+	}
+	return keys
+}
+
+//NewAuthFromConfig will validate the config, and return *Auth and a
+// *sessions.CookieStore like NewAuth, with the stores given in the
+// config set. Additional opts are applied after the config. In production
+// mode an error is returned when SelfCheck finds a problem.
+func NewAuthFromConfig(c Config, opts ...Option) (*Auth, *sessions.CookieStore, error) {
+	if err := c.Validate(); err != nil {
+		return nil, nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	var configOpts []Option
+	sessionStore, err := c.SessionStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sessionStore != nil {
+		configOpts = append(configOpts, WithSessionStore(sessionStore))
+	}
+	if c.BanStoreFile != "" {
+		configOpts = append(configOpts, WithBanStore(NewFileBanStore(c.BanStoreFile)))
+	}
+	if len(c.TrustedProxies) > 0 {
+		configOpts = append(configOpts, WithTrustedProxies(c.TrustedProxies...))
+	}
+	if c.InvitationStoreFile != "" {
+		configOpts = append(configOpts, WithInvitationStore(NewFileInvitationStore(c.InvitationStoreFile)))
+	}
+	userStore, err := c.UserStore()
+	if err != nil {
+		return nil, nil, err
+	}
+	if userStore != nil {
+		configOpts = append(configOpts, WithUserStore(userStore))
+	}
+	if c.AllowListFile != "" {
+		configOpts = append(configOpts, WithAllowList(NewFileAllowList(c.AllowListFile)))
+	}
+	if c.TenantStoreFile != "" {
+		from := TenantFromHost
+		if c.TenantFrom == "path" {
+			from = TenantFromPath
+		}
+		configOpts = append(configOpts, WithTenants(NewFileTenantStore(c.TenantStoreFile), from))
+	}
+	if c.ProviderStoreFile != "" {
+		configOpts = append(configOpts, WithProviderStore(NewFileProviderStore(c.ProviderStoreFile)))
+	}
+	if len(c.AdminRoles) > 0 {
+		configOpts = append(configOpts, WithAdminRoles(c.AdminRoles...))
+	}
+	if c.Production {
+		configOpts = append(configOpts, WithProductionMode())
+	}
+	if c.CryptoProfile != "" {
+		configOpts = append(configOpts, WithCryptoProfile(CryptoProfile(c.CryptoProfile)))
+	}
+	if c.LogSalt != "" {
+		configOpts = append(configOpts, WithLogIdentifiers(LogIdentifiers{Salt: c.LogSalt}))
+	}
+
+	keys := c.cookieStoreKeys()
+	store := sessions.NewCookieStore(keys[0])
+	a := newAuth(newOauthConfig(c.Proto, c.Host, c.Port, c.ClientID, c.ClientSecret), store, keys, append(configOpts, opts...))
+	if err := a.startupCheck(); err != nil {
+		return nil, nil, err
+	}
+
+	return a, store, nil
+}
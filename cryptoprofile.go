@@ -0,0 +1,184 @@
+package authsession
+
+import (
+	"crypto/fips140"
+	"fmt"
+	"strings"
+)
+
+//CryptoProfile is the set of cryptographic algorithms the package may
+// use, set with WithCryptoProfile.
+type CryptoProfile string
+
+const (
+	//CryptoProfileDefault allows all the algorithms of the package.
+	CryptoProfileDefault CryptoProfile = "default"
+	//CryptoProfileFIPS only allows the algorithms approved by FIPS 140-3,
+	// for regulated deployments. PASETO, using Ed25519, XChaCha20 and
+	// BLAKE2b, must not be configured, and the basic auth passwords must
+	// be PBKDF2 hashes, since bcrypt is not approved.
+	CryptoProfileFIPS CryptoProfile = "fips"
+)
+
+//The algorithms used by the package, and where. They are listed for the
+// current configuration by CryptoInventory.
+//
+//	session cookies          HMAC-SHA256, by securecookie
+//	stateless sessions       AES-GCM, or PASETO v4.local (XChaCha20, BLAKE2b)
+//	encrypted session store  AES-GCM
+//	encrypted user store     AES-GCM, blind index HMAC-SHA256
+//	ID tokens, JWT           RS256 (RSASSA-PKCS1-v1_5 with SHA-256)
+//	PASETO access tokens     PASETO v4.public (Ed25519)
+//	reference tokens         random, stored by their SHA-256 hash
+//	DPoP proofs, assertions  RS256 or ES256 (ECDSA P-256 with SHA-256)
+//	refresh tokens, IDs      random, stored by their SHA-256 hash
+//	basic auth passwords     PBKDF2-HMAC-SHA256, or bcrypt
+//	SES mail requests        HMAC-SHA256 (AWS Signature Version 4)
+//	keys, states and tokens  crypto/rand
+
+//CryptoUse is an algorithm used by the package, for the current
+// configuration, as returned by CryptoInventory.
+type CryptoUse struct {
+	//Use is what the algorithm is used for, like "session cookies".
+	Use string `json:"use"`
+	//Algorithm is the algorithm, like "HMAC-SHA256".
+	Algorithm string `json:"algorithm"`
+	//Approved is true if the algorithm, with the key sizes used, is
+	// approved by FIPS 140-3.
+	Approved bool `json:"approved"`
+}
+
+//fipsMinRSABits is the smallest RSA key approved for signing.
+const fipsMinRSABits = 2048
+
+//fipsMinHMACKeySize is the smallest HMAC key approved, which is 112 bits.
+const fipsMinHMACKeySize = 14
+
+//fips will return true if the FIPS crypto profile is used.
+func (a *Auth) fips() bool {
+	return a.cryptoProfile == CryptoProfileFIPS
+}
+
+//enforceCryptoProfile will set the crypto profile, which follows the Go
+// FIPS 140-3 mode unless set with WithCryptoProfile, and log what the
+// profile doesn't allow. The configuration is not changed, and what is
+// not allowed is reported as an error by SelfCheck, so a production
+// deployment refuses to start instead of running with another config
+// than the one given. It is done after all the options, so it doesn't
+// matter in which order they are given.
+func (a *Auth) enforceCryptoProfile() {
+	if a.cryptoProfile == "" {
+		a.cryptoProfile = CryptoProfileDefault
+		if fips140.Enabled() {
+			a.cryptoProfile = CryptoProfileFIPS
+		}
+	}
+	if !a.fips() {
+		return
+	}
+
+	if a.issuer != nil && a.issuer.conf.TokenFormat == TokenFormatPASETO {
+		a.logError("error: crypto profile fips: PASETO access tokens use Ed25519, which is not approved, and are reported by SelfCheck")
+	}
+	if a.stateless != nil && a.stateless.pasetoKeys != nil {
+		a.logError("error: crypto profile fips: PASETO stateless sessions use XChaCha20 and BLAKE2b, which are not approved, and are reported by SelfCheck")
+	}
+	if a.basicAuth != nil {
+		a.basicAuth.fips = true
+		for _, c := range a.basicAuth.creds {
+			if _, err := parsePBKDF2Hash(c.PasswordHash); err != nil {
+				a.logError(fmt.Sprintf("error: crypto profile fips: basic auth user %v will be refused:", c.User), err)
+			}
+		}
+	}
+}
+
+//CryptoInventory will return the algorithms used by the package for the
+// current configuration, and if they are approved by FIPS 140-3, like to
+// document a regulated deployment.
+func (a *Auth) CryptoInventory() []CryptoUse {
+	var uses []CryptoUse
+
+	approved := true
+	for _, k := range a.codec.cookieKeys() {
+		if len(k) < fipsMinHMACKeySize {
+			approved = false
+		}
+	}
+	uses = append(uses, CryptoUse{"session cookies", "HMAC-SHA256", approved})
+
+	if a.stateless != nil {
+		if a.stateless.pasetoKeys != nil {
+			uses = append(uses, CryptoUse{"stateless sessions", "PASETO v4.local (XChaCha20, BLAKE2b)", false})
+		} else {
+			uses = append(uses, CryptoUse{"stateless sessions", "AES-GCM", true})
+		}
+	}
+	if _, ok := a.sessions.(*EncryptedSessionStore); ok {
+		uses = append(uses, CryptoUse{"session store", "AES-GCM", true})
+	}
+	if _, ok := unwrapStore(a.users).(*EncryptedUserStore); ok {
+		uses = append(uses, CryptoUse{"user store", "AES-GCM", true})
+		uses = append(uses, CryptoUse{"user store blind index", "HMAC-SHA256", true})
+	}
+
+	if a.issuer != nil {
+		bits := a.issuer.conf.Signer.PublicKey().N.BitLen()
+		rs256 := fmt.Sprintf("RS256 (RSA %d bits)", bits)
+		uses = append(uses, CryptoUse{"ID tokens", rs256, bits >= fipsMinRSABits})
+		switch a.issuer.conf.TokenFormat {
+		case TokenFormatPASETO:
+			uses = append(uses, CryptoUse{"access tokens", "PASETO v4.public (Ed25519)", false})
+		case TokenFormatReference:
+			uses = append(uses, CryptoUse{"access tokens", "random reference, SHA-256 ID", true})
+		default:
+			uses = append(uses, CryptoUse{"access tokens", rs256, bits >= fipsMinRSABits})
+		}
+		uses = append(uses, CryptoUse{"refresh tokens", "random, SHA-256 ID", true})
+		uses = append(uses, CryptoUse{"DPoP proofs and client assertions", "RS256, ES256", true})
+	}
+
+	if a.basicAuth != nil {
+		for _, c := range a.basicAuth.creds {
+			_, err := parsePBKDF2Hash(c.PasswordHash)
+			switch {
+			case err == nil:
+				uses = append(uses, CryptoUse{"basic auth password of " + c.User, "PBKDF2-HMAC-SHA256", true})
+			case strings.HasPrefix(c.PasswordHash, pbkdf2Prefix):
+				uses = append(uses, CryptoUse{"basic auth password of " + c.User, "PBKDF2-HMAC-SHA256 with weak parameters", false})
+			default:
+				uses = append(uses, CryptoUse{"basic auth password of " + c.User, "bcrypt", false})
+			}
+		}
+	}
+
+	uses = append(uses, CryptoUse{"keys, states and tokens", "crypto/rand", true})
+	return uses
+}
+
+//checkCryptoProfile will check that the algorithms used are approved
+// with the FIPS crypto profile.
+func (a *Auth) checkCryptoProfile() []Finding {
+	var findings []Finding
+	var other []string
+
+	for _, u := range a.CryptoInventory() {
+		if u.Approved {
+			continue
+		}
+		if a.fips() {
+			findings = append(findings, Finding{"crypto profile", FindingError, fmt.Sprintf("%v uses %v, which is not approved by FIPS 140-3", u.Use, u.Algorithm)})
+		} else {
+			other = append(other, u.Use)
+		}
+	}
+
+	if len(findings) == 0 {
+		msg := fmt.Sprintf("crypto profile %v, all algorithms approved by FIPS 140-3", a.cryptoProfile)
+		if len(other) > 0 {
+			msg = fmt.Sprintf("crypto profile %v, not approved by FIPS 140-3: %v", a.cryptoProfile, strings.Join(other, ", "))
+		}
+		findings = append(findings, Finding{"crypto profile", FindingOK, msg})
+	}
+	return findings
+}
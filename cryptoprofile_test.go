@@ -0,0 +1,55 @@
+package authsession
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"strings"
+	"testing"
+)
+
+func TestCryptoProfileFIPSReportsPASETO(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pasetoKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a, _ := NewAuth("https", "example.com", "443", "a-long-cookie-key-123", "id", "s",
+		WithCryptoProfile(CryptoProfileFIPS),
+		WithIssuer(IssuerConfig{URL: "https://auth.example.com", SigningKey: key, Clients: NewFileClientStore(""), TokenFormat: TokenFormatPASETO, PASETOKey: pasetoKey}),
+		WithStatelessSessions(StatelessConfig{Keys: [][]byte{make([]byte, 32)}, Format: TokenFormatPASETO}))
+
+	//The configuration given is kept, and not changed to something else.
+	if a.issuer.conf.TokenFormat != TokenFormatPASETO {
+		t.Fatalf("got the access token format %v, want %v", a.issuer.conf.TokenFormat, TokenFormatPASETO)
+	}
+	if a.stateless == nil || a.stateless.pasetoKeys == nil {
+		t.Fatal("the PASETO stateless sessions were turned off")
+	}
+
+	err = a.SelfCheck()
+	if err == nil {
+		t.Fatal("SelfCheck passed with PASETO in the FIPS crypto profile")
+	}
+	for _, use := range []string{"stateless sessions", "access tokens"} {
+		if !strings.Contains(err.Error(), use) {
+			t.Errorf("SelfCheck did not report the %v: %v", use, err)
+		}
+	}
+}
+
+func TestCryptoProfileDefaultAllowsPASETO(t *testing.T) {
+	a, _ := NewAuth("https", "example.com", "443", "a-long-cookie-key-123", "id", "s",
+		WithCryptoProfile(CryptoProfileDefault),
+		WithStatelessSessions(StatelessConfig{Keys: [][]byte{make([]byte, 32)}, Format: TokenFormatPASETO}))
+
+	for _, f := range a.checkCryptoProfile() {
+		if f.Level == FindingError {
+			t.Fatalf("got the finding %+v", f)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package authsession
+
+import (
+	"embed"
+	"html/template"
+	"net/http"
+)
+
+//templateFS holds the default templates for the pages served.
+//
+//go:embed templates
+var templateFS embed.FS
+
+//defaultDashboardTemplate is the default template for the admin dashboard.
+var defaultDashboardTemplate = template.Must(template.ParseFS(templateFS, "templates/dashboard.html"))
+
+//DashboardData is the data given to the dashboard template.
+type DashboardData struct {
+	//SessionsEnabled is true if a SessionStore is set.
+	SessionsEnabled bool
+	Sessions        []SessionInfo
+	//Logins are the most recent successful logins, newest first.
+	Logins []LoginEvent
+	//Failures are the most recent failed logins, newest first.
+	Failures []LoginEvent
+	//BansEnabled is true if a BanStore is set.
+	BansEnabled bool
+	Bans        []Ban
+}
+
+//adminDashboard will render the dashboard page showing the active
+// sessions, recent logins and failures, and bans.
+func (a *Auth) adminDashboard(w http.ResponseWriter, r *http.Request) {
+	data := DashboardData{
+		Logins:   a.events.recent(true),
+		Failures: a.events.recent(false),
+	}
+
+	var err error
+	if a.sessions != nil {
+		data.SessionsEnabled = true
+		data.Sessions, err = a.sessions.List()
+		if err != nil {
+			a.logRequestError(r, "error: dashboard: session store List failed: ", err)
+		}
+	}
+	if a.bans != nil {
+		data.BansEnabled = true
+		data.Bans, err = a.bans.List()
+		if err != nil {
+			a.logRequestError(r, "error: dashboard: ban store List failed: ", err)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := a.dashboardTemplate.Execute(w, data); err != nil {
+		a.logRequestError(r, "error: executing dashboard template: ", err)
+	}
+}
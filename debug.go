@@ -0,0 +1,132 @@
+package authsession
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//ErrorSample is an error logged by the package.
+type ErrorSample struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+//errorSamples keeps the most recent errors logged in memory.
+type errorSamples struct {
+	mu      sync.Mutex
+	size    int
+	samples []ErrorSample
+}
+
+//newErrorSamples will return a *errorSamples keeping the last size errors.
+func newErrorSamples(size int) *errorSamples {
+	return &errorSamples{
+		size: size,
+	}
+}
+
+//add will add the message, and drop the oldest sample if full.
+func (e *errorSamples) add(msg string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	e.samples = append(e.samples, ErrorSample{Time: time.Now(), Message: msg})
+	if len(e.samples) > e.size {
+		e.samples = e.samples[len(e.samples)-e.size:]
+	}
+}
+
+//recent will return the samples, newest first.
+func (e *errorSamples) recent() []ErrorSample {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	samples := make([]ErrorSample, 0, len(e.samples))
+	for i := len(e.samples) - 1; i >= 0; i-- {
+		samples = append(samples, e.samples[i])
+	}
+	return samples
+}
+
+//logError will log the error like log.Println, and keep it as a sample
+// for the debug endpoint.
+func (a *Auth) logError(v ...interface{}) {
+	msg := fmt.Sprintln(v...)
+	log.Print(msg)
+	a.errors.add(strings.TrimSpace(msg))
+}
+
+//DebugInfo is the current state of Auth returned by the debug endpoint.
+type DebugInfo struct {
+	//ActiveSessions is the number of sessions in the session store,
+	// or -1 if no session store is set.
+	ActiveSessions int `json:"activeSessions"`
+	//PendingLoginStates is the number of logins started, where the
+	// callback is not yet done.
+	PendingLoginStates int `json:"pendingLoginStates"`
+	//PendingLogins are the counts of the logins started, expired and
+	// evicted since too many were pending.
+	PendingLogins PendingLoginStats `json:"pendingLogins"`
+	//Bans is the number of bans in the ban store, or -1 if no ban
+	// store is set.
+	Bans int `json:"bans"`
+	//Panics is the number of panics recovered in the handlers.
+	Panics int64 `json:"panics"`
+	//RecentErrors are the most recent errors logged, newest first.
+	RecentErrors []ErrorSample `json:"recentErrors"`
+	//RecentFailures are the most recent failed logins, newest first.
+	RecentFailures []LoginEvent `json:"recentFailures"`
+	//Jobs are the counts of the background jobs run by RunJobs.
+	Jobs []JobStats `json:"jobs"`
+	//Stores are the counts and durations of the operations of the stores.
+	Stores []StoreStats `json:"stores"`
+	//LoginFunnel are the counts of the stages of the logins with a
+	// provider, and of the logins dropped at them.
+	LoginFunnel []FunnelStageStats `json:"loginFunnel"`
+	//Honeypot are the counts of the honeypot, if set with WithHoneypot.
+	Honeypot *HoneypotStats `json:"honeypot,omitempty"`
+}
+
+//adminDebug will write the current counts and the most recent errors
+// as JSON, for quick operational triage.
+func (a *Auth) adminDebug(w http.ResponseWriter, r *http.Request) {
+	info := DebugInfo{
+		ActiveSessions: -1,
+		Bans:           -1,
+		RecentErrors:   a.errors.recent(),
+		RecentFailures: a.events.recent(false),
+		Panics:         a.panics.Load(),
+		Jobs:           a.JobStats(),
+		Stores:         a.StoreStats(),
+		LoginFunnel:    a.LoginFunnelStats(),
+	}
+
+	if a.honeypot != nil {
+		stats := a.HoneypotStats()
+		info.Honeypot = &stats
+	}
+
+	info.PendingLogins = a.pending.statistics()
+	info.PendingLoginStates = info.PendingLogins.Pending
+
+	if a.sessions != nil {
+		sessions, err := a.sessions.List()
+		if err != nil {
+			a.logRequestError(r, "error: debug: session store List failed: ", err)
+		}
+		info.ActiveSessions = len(sessions)
+	}
+	if a.bans != nil {
+		bans, err := a.bans.List()
+		if err != nil {
+			a.logRequestError(r, "error: debug: ban store List failed: ", err)
+		}
+		info.Bans = len(bans)
+	}
+
+	writeJSON(w, http.StatusOK, info)
+}
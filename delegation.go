@@ -0,0 +1,105 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//maxDelegationTTL is the longest a delegation token can be valid.
+const maxDelegationTTL = time.Hour
+
+//Delegation is what a delegation token allows, which is to act as the
+// user with only the scopes of the token.
+type Delegation struct {
+	User    string
+	Tenant  string
+	Scopes  []string
+	Expires time.Time
+}
+
+//Allows will return true if the delegation has the scope.
+func (d Delegation) Allows(scope string) bool {
+	for _, s := range d.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+//delegationValue is the value signed in a delegation token.
+type delegationValue struct {
+	User    string
+	Tenant  string
+	SID     string
+	Epoch   int64
+	Scopes  []string
+	Expires int64
+}
+
+//DelegationToken will return a token representing the user of the request
+// with only the scopes given, like "export-report", so an async worker
+// can act for the user without holding the session or the provider token.
+// The scopes are defined by the app. The token is valid for the ttl, at
+// most 1 hour, and never past the session. It stops working when the
+// session or the sessions of the user are revoked, or the user is disabled.
+func (a *Auth) DelegationToken(r *http.Request, scopes []string, ttl time.Duration) (string, error) {
+	if len(scopes) == 0 {
+		return "", errors.New("delegation token needs at least one scope")
+	}
+	if ttl <= 0 || ttl > maxDelegationTTL {
+		return "", fmt.Errorf("delegation token ttl must be more than 0 and at most %v", maxDelegationTTL)
+	}
+
+	session, ok := a.authenticated(r)
+	if !ok {
+		return "", errors.New("delegation token needs an authenticated session")
+	}
+
+	expires := time.Now().Add(ttl)
+	if sessionExpires, ok := sessionExpiry(session.Values); ok && sessionExpires.Before(expires) {
+		expires = sessionExpires
+	}
+
+	v := delegationValue{Scopes: append([]string(nil), scopes...), Expires: expires.Unix()}
+	v.User, _ = session.Values[sessionKeyEmail].(string)
+	v.Tenant, _ = session.Values[sessionKeyTenant].(string)
+	v.SID, _ = session.Values[sessionKeySID].(string)
+	v.Epoch, _ = session.Values[sessionKeyEpoch].(int64)
+
+	return a.codec.Encode("delegation", v)
+}
+
+//VerifyDelegationToken will check the token made with DelegationToken,
+// and that it has the scope, and return what it allows.
+func (a *Auth) VerifyDelegationToken(token string, scope string) (Delegation, error) {
+	var v delegationValue
+	if err := a.codec.Decode("delegation", token, &v); err != nil {
+		return Delegation{}, errors.New("delegation token not valid")
+	}
+	if time.Now().Unix() > v.Expires {
+		return Delegation{}, errors.New("delegation token has expired")
+	}
+
+	d := Delegation{User: v.User, Tenant: v.Tenant, Scopes: v.Scopes, Expires: time.Unix(v.Expires, 0)}
+	if !d.Allows(scope) {
+		return Delegation{}, fmt.Errorf("delegation token does not have the scope %q", scope)
+	}
+
+	if a.sessions != nil {
+		_, ok, err := a.sessions.Get(v.SID)
+		if err != nil {
+			a.logError("error: session store Get failed: ", err)
+		}
+		if !ok {
+			return Delegation{}, errors.New("delegation token session is revoked or expired")
+		}
+	}
+	if a.userRevoked(nil, v.User, v.Epoch) {
+		return Delegation{}, errors.New("delegation token user is revoked or disabled")
+	}
+
+	return d, nil
+}
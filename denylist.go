@@ -0,0 +1,287 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"math"
+	"sync"
+	"time"
+)
+
+//RevokedToken is an access token of the issuer revoked before its expiry.
+type RevokedToken struct {
+	//ID is the jti of the token.
+	ID string `json:"id"`
+	//Expires is when the token expires, and when it can be removed from
+	// the denylist.
+	Expires time.Time `json:"expires"`
+}
+
+//TokenDenylist keeps the access tokens of the issuer revoked before their
+// expiry. Set with WithTokenDenylist, a bloom filter in memory is put in
+// front of it, so checking a token which is not revoked, which is the
+// common case, costs no lookup in the store.
+type TokenDenylist interface {
+	//Revoke will add the token to the denylist.
+	Revoke(t RevokedToken) error
+	//IsRevoked will return true if the token with the id is revoked, and
+	// not expired.
+	IsRevoked(id string) (bool, error)
+	//List will return the revoked tokens not expired, for filling the
+	// bloom filter.
+	List() ([]RevokedToken, error)
+}
+
+//FileTokenDenylist is a TokenDenylist keeping the revoked tokens in a
+// JSON file.
+type FileTokenDenylist struct {
+	m *jsonFileMap[RevokedToken]
+}
+
+//NewFileTokenDenylist will return a *FileTokenDenylist storing the
+// revoked tokens in the file at path. If path is empty the revoked tokens
+// are only kept in memory.
+func NewFileTokenDenylist(path string) *FileTokenDenylist {
+	return &FileTokenDenylist{
+		m: newJSONFileMap[RevokedToken](path),
+	}
+}
+
+//Revoke will add the token to the denylist.
+func (f *FileTokenDenylist) Revoke(t RevokedToken) error {
+	return f.m.update(func(m map[string]RevokedToken) error {
+		m[t.ID] = t
+		return nil
+	})
+}
+
+//IsRevoked will return true if the token with the id is revoked, and not
+// expired.
+func (f *FileTokenDenylist) IsRevoked(id string) (bool, error) {
+	var revoked bool
+	err := f.m.view(func(m map[string]RevokedToken) error {
+		t, ok := m[id]
+		revoked = ok && time.Now().Before(t.Expires)
+		return nil
+	})
+	return revoked, err
+}
+
+//List will return the revoked tokens not expired.
+func (f *FileTokenDenylist) List() ([]RevokedToken, error) {
+	var tokens []RevokedToken
+	err := f.m.view(func(m map[string]RevokedToken) error {
+		now := time.Now()
+		for _, t := range m {
+			if now.Before(t.Expires) {
+				tokens = append(tokens, t)
+			}
+		}
+		return nil
+	})
+	return tokens, err
+}
+
+//Cleanup will remove the tokens expired at now, and return the number
+// removed.
+func (f *FileTokenDenylist) Cleanup(now time.Time) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]RevokedToken) error {
+		for id, t := range m {
+			if !now.Before(t.Expires) {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//TokenDenylistConfig is how the bloom filter in front of the
+// TokenDenylist is made, set with WithTokenDenylist.
+type TokenDenylistConfig struct {
+	//RefreshInterval is how often the bloom filter is filled again from
+	// the denylist by RunJobs, which is when the tokens revoked by the
+	// other instances of the server are found. Defaults to 1 minute.
+	RefreshInterval time.Duration
+	//Capacity is the number of revoked tokens the bloom filter is sized
+	// for, and is grown when more tokens are revoked. Defaults to 10000.
+	Capacity int
+	//FalsePositiveRate is the rate of tokens not revoked which are still
+	// looked up in the denylist. Defaults to 0.01.
+	FalsePositiveRate float64
+}
+
+//bloomFilter is a bloom filter of strings, which never gives a false
+// negative, and gives false positives at about the rate it was sized for.
+type bloomFilter struct {
+	bits   []uint64
+	hashes int
+	seeds  [2]maphash.Seed
+}
+
+//newBloomFilter will return a *bloomFilter sized for n strings with the
+// false positive rate p.
+func newBloomFilter(n int, p float64) *bloomFilter {
+	m := math.Ceil(-float64(n) * math.Log(p) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &bloomFilter{
+		bits:   make([]uint64, (int(m)+63)/64),
+		hashes: k,
+		seeds:  [2]maphash.Seed{maphash.MakeSeed(), maphash.MakeSeed()},
+	}
+}
+
+//positions will call f with the position of every bit for s, using
+// double hashing of two hashes of s.
+func (b *bloomFilter) positions(s string, f func(word int, mask uint64)) {
+	h1 := maphash.String(b.seeds[0], s)
+	h2 := maphash.String(b.seeds[1], s) | 1
+	size := uint64(len(b.bits) * 64)
+	for i := 0; i < b.hashes; i++ {
+		pos := (h1 + uint64(i)*h2) % size
+		f(int(pos/64), 1<<(pos%64))
+	}
+}
+
+//add will add s to the filter.
+func (b *bloomFilter) add(s string) {
+	b.positions(s, func(word int, mask uint64) {
+		b.bits[word] |= mask
+	})
+}
+
+//has will return false if s was never added, and true if it might have
+// been.
+func (b *bloomFilter) has(s string) bool {
+	found := true
+	b.positions(s, func(word int, mask uint64) {
+		if b.bits[word]&mask == 0 {
+			found = false
+		}
+	})
+	return found
+}
+
+//tokenDenylist is the TokenDenylist with the bloom filter in front.
+type tokenDenylist struct {
+	store TokenDenylist
+	conf  TokenDenylistConfig
+
+	mu sync.RWMutex
+	//filter is nil until filled the first time, and every token is
+	// looked up in the store until then.
+	filter *bloomFilter
+	//revoked are the tokens revoked here since the last refresh started,
+	// which are added to the new filter, as they might be missing from
+	// the list read from the store.
+	revoked []string
+}
+
+//newTokenDenylist will return a *tokenDenylist using the store, with the
+// defaults of the config filled in.
+func newTokenDenylist(store TokenDenylist, c TokenDenylistConfig) *tokenDenylist {
+	if c.RefreshInterval <= 0 {
+		c.RefreshInterval = time.Minute
+	}
+	if c.Capacity <= 0 {
+		c.Capacity = 10000
+	}
+	if c.FalsePositiveRate <= 0 || c.FalsePositiveRate >= 1 {
+		c.FalsePositiveRate = 0.01
+	}
+	return &tokenDenylist{store: store, conf: c}
+}
+
+//refresh will fill a new bloom filter with the revoked tokens of the
+// store, so the tokens revoked by other instances are found, and the
+// expired tokens are left out. It is run as a job by RunJobs.
+func (d *tokenDenylist) refresh(ctx context.Context) error {
+	d.mu.Lock()
+	d.revoked = nil
+	d.mu.Unlock()
+
+	tokens, err := d.store.List()
+	if err != nil {
+		return err
+	}
+	n := d.conf.Capacity
+	if len(tokens)*2 > n {
+		n = len(tokens) * 2
+	}
+	f := newBloomFilter(n, d.conf.FalsePositiveRate)
+	for _, t := range tokens {
+		f.add(t.ID)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, id := range d.revoked {
+		f.add(id)
+	}
+	d.filter = f
+	return nil
+}
+
+//revoke will add the token to the store, and to the bloom filter.
+func (d *tokenDenylist) revoke(t RevokedToken) error {
+	if err := d.store.Revoke(t); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.filter != nil {
+		d.filter.add(t.ID)
+	}
+	d.revoked = append(d.revoked, t.ID)
+	return nil
+}
+
+//isRevoked will return true if the token with the id is revoked. The store
+// is only asked when the bloom filter says the token might be revoked.
+func (d *tokenDenylist) isRevoked(id string) (bool, error) {
+	d.mu.RLock()
+	maybe := d.filter == nil || d.filter.has(id)
+	d.mu.RUnlock()
+
+	if !maybe {
+		return false, nil
+	}
+	return d.store.IsRevoked(id)
+}
+
+//RevokeAccessToken will revoke the access token issued in issuer mode,
+// which was verified with VerifyAccessToken, so it is not accepted any
+// more before it expires. A reference token is deleted from the
+// ReferenceTokens store, and other tokens need a TokenDenylist set with
+// WithTokenDenylist. The other instances of the server find the revoked
+// token when they fill their bloom filter again.
+func (a *Auth) RevokeAccessToken(at AccessToken) error {
+	if a.issuer != nil && a.issuer.conf.ReferenceTokens != nil && at.ID != "" {
+		//A reference token is revoked by deleting it, which all the
+		// instances see at once.
+		_, ok, err := a.issuer.conf.ReferenceTokens.Get(at.ID)
+		if err != nil {
+			return fmt.Errorf("reference token store Get failed: %v", err)
+		}
+		if ok {
+			return a.issuer.conf.ReferenceTokens.Delete(at.ID)
+		}
+	}
+	if a.denylist == nil {
+		return errors.New("no token denylist configured")
+	}
+	if at.ID == "" {
+		return errors.New("access token has no ID, and was not issued here")
+	}
+	return a.denylist.revoke(RevokedToken{ID: at.ID, Expires: at.Expires})
+}
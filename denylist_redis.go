@@ -0,0 +1,84 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//RedisTokenDenylist is a TokenDenylist keeping the revoked tokens in a
+// sorted set in Redis, scored by their expiry, so it is shared by all the
+// instances of the server.
+type RedisTokenDenylist struct {
+	client  redis.UniversalClient
+	key     string
+	timeout time.Duration
+}
+
+//NewRedisTokenDenylist will return a *RedisTokenDenylist using client,
+// with the revoked tokens in the sorted set with the key, like
+// "authsession:denylist".
+func NewRedisTokenDenylist(client redis.UniversalClient, key string) *RedisTokenDenylist {
+	return &RedisTokenDenylist{
+		client:  client,
+		key:     key,
+		timeout: 5 * time.Second,
+	}
+}
+
+//Revoke will add the token to the denylist.
+func (r *RedisTokenDenylist) Revoke(t RevokedToken) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	return r.client.ZAdd(ctx, r.key, redis.Z{Score: float64(t.Expires.Unix()), Member: t.ID}).Err()
+}
+
+//IsRevoked will return true if the token with the id is revoked, and not
+// expired.
+func (r *RedisTokenDenylist) IsRevoked(id string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	expires, err := r.client.ZScore(ctx, r.key, id).Result()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Unix() < int64(expires), nil
+}
+
+//List will return the revoked tokens not expired.
+func (r *RedisTokenDenylist) List() ([]RevokedToken, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	zs, err := r.client.ZRangeByScoreWithScores(ctx, r.key, &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().Unix(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	tokens := make([]RevokedToken, 0, len(zs))
+	for _, z := range zs {
+		id, _ := z.Member.(string)
+		tokens = append(tokens, RevokedToken{ID: id, Expires: time.Unix(int64(z.Score), 0)})
+	}
+	return tokens, nil
+}
+
+//Cleanup will remove the tokens expired at now, and return the number
+// removed.
+func (r *RedisTokenDenylist) Cleanup(now time.Time) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	n, err := r.client.ZRemRangeByScore(ctx, r.key, "-inf", strconv.FormatInt(now.Unix(), 10)).Result()
+	return int(n), err
+}
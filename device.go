@@ -0,0 +1,201 @@
+package authsession
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+//maxSessionNameLength is the max length of the name a user can give a session.
+const maxSessionNameLength = 64
+
+//deviceName will return a short name for the device from the user agent,
+// like "Chrome on macOS".
+func deviceName(userAgent string) string {
+	if userAgent == "" {
+		return ""
+	}
+
+	var browser string
+	switch {
+	case strings.Contains(userAgent, "Edg/"):
+		browser = "Edge"
+	case strings.Contains(userAgent, "OPR/"):
+		browser = "Opera"
+	case strings.Contains(userAgent, "Firefox/"), strings.Contains(userAgent, "FxiOS/"):
+		browser = "Firefox"
+	case strings.Contains(userAgent, "Chrome/"), strings.Contains(userAgent, "CriOS/"):
+		browser = "Chrome"
+	case strings.Contains(userAgent, "Safari/"):
+		browser = "Safari"
+	default:
+		browser = "Unknown browser"
+	}
+
+	var platform string
+	switch {
+	case strings.Contains(userAgent, "iPhone"), strings.Contains(userAgent, "iPad"):
+		platform = "iOS"
+	case strings.Contains(userAgent, "Android"):
+		platform = "Android"
+	case strings.Contains(userAgent, "CrOS"):
+		platform = "ChromeOS"
+	case strings.Contains(userAgent, "Mac OS X"), strings.Contains(userAgent, "Macintosh"):
+		platform = "macOS"
+	case strings.Contains(userAgent, "Windows"):
+		platform = "Windows"
+	case strings.Contains(userAgent, "Linux"):
+		platform = "Linux"
+	default:
+		return browser
+	}
+
+	return browser + " on " + platform
+}
+
+//sessionLocation will return the location of the ip from the function
+// given with WithSessionLocation, or from the GeoIP resolver given with
+// WithGeoIP, or an empty string if none are set.
+func (a *Auth) sessionLocation(ip string) string {
+	if a.location == nil {
+		return a.geoLocation(ip).String()
+	}
+	return a.location(ip)
+}
+
+//DisplayName will return the name to show for the session, which is the
+// name given by the user or the device, followed by the location if known,
+// like "Chrome on macOS - Oslo".
+func (s SessionInfo) DisplayName() string {
+	name := s.Name
+	if name == "" {
+		name = s.Device
+	}
+	if name == "" {
+		name = s.ID
+	}
+	if s.Location != "" {
+		name += " - " + s.Location
+	}
+	return name
+}
+
+//UserSession is a session of the user, as listed by /auth/session/list.
+type UserSession struct {
+	SessionInfo
+	DisplayName string `json:"displayName"`
+	//Current is true for the session of the request.
+	Current bool `json:"current"`
+}
+
+//UserSessions will return the active sessions of the user of the request.
+func (a *Auth) UserSessions(r *http.Request) ([]UserSession, error) {
+	if a.sessions == nil {
+		return nil, errors.New("no session store configured")
+	}
+	session, ok := a.authenticated(r)
+	if !ok {
+		return nil, errors.New("no valid session")
+	}
+
+	email, _ := session.Values[sessionKeyEmail].(string)
+	sid, _ := session.Values[sessionKeySID].(string)
+	list, err := a.sessions.ListUser(email)
+	if err != nil {
+		return nil, fmt.Errorf("session store ListUser failed: %v", err)
+	}
+
+	tenant, _ := session.Values[sessionKeyTenant].(string)
+	var sessions []UserSession
+	for _, s := range list {
+		if s.Tenant != tenant {
+			continue
+		}
+		sessions = append(sessions, UserSession{
+			SessionInfo: s,
+			DisplayName: s.DisplayName(),
+			Current:     s.ID == sid,
+		})
+	}
+	return sessions, nil
+}
+
+//NameSession will set the name of the session of the request, shown
+// instead of the device in the lists of sessions. An empty name removes
+// the name.
+func (a *Auth) NameSession(r *http.Request, name string) error {
+	if a.sessions == nil {
+		return errors.New("no session store configured")
+	}
+	name = strings.TrimSpace(name)
+	if utf8.RuneCountInString(name) > maxSessionNameLength {
+		return fmt.Errorf("the name can be at most %d characters", maxSessionNameLength)
+	}
+
+	session, ok := a.authenticated(r)
+	if !ok {
+		return errors.New("no valid session")
+	}
+	sid, _ := session.Values[sessionKeySID].(string)
+	s, ok, err := a.sessions.Get(sid)
+	if err != nil {
+		return fmt.Errorf("session store Get failed: %v", err)
+	}
+	if !ok {
+		return errors.New("no valid session")
+	}
+
+	s.Name = name
+	if err := a.sessions.Add(s); err != nil {
+		return fmt.Errorf("session store Add failed: %v", err)
+	}
+	return nil
+}
+
+func (a *Auth) sessionList(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	if _, ok := a.authenticated(r); !ok {
+		a.writeJSONMessage(w, r, http.StatusUnauthorized, "error.no_session")
+		return
+	}
+	sessions, err := a.UserSessions(r)
+	if err != nil {
+		a.logRequestError(r, "error: "+sessionPath+"/list: ", err)
+		a.writeJSONMessage(w, r, http.StatusInternalServerError, "error.sessions")
+		return
+	}
+	writeJSON(w, http.StatusOK, sessions)
+}
+
+func (a *Auth) sessionName(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	//Require a JSON content type, which can't be sent by a plain form on
+	// another site.
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		a.writeJSONMessage(w, r, http.StatusUnsupportedMediaType, "error.json_content_type")
+		return
+	}
+	if _, ok := a.authenticated(r); !ok {
+		a.writeJSONMessage(w, r, http.StatusUnauthorized, "error.no_session")
+		return
+	}
+
+	var body struct {
+		Name string `json:"name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		a.writeJSONMessage(w, r, http.StatusBadRequest, "error.bad_request")
+		return
+	}
+	if err := a.NameSession(r, body.Name); err != nil {
+		a.logRequestError(r, "error: "+sessionPath+"/name: ", err)
+		a.writeJSONMessage(w, r, http.StatusBadRequest, "error.session_name")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
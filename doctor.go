@@ -0,0 +1,232 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//googleDiscoveryURL is the OpenID Connect discovery document for Google.
+const googleDiscoveryURL = "https://accounts.google.com/.well-known/openid-configuration"
+
+//FindingLevel tells how serious a Finding is.
+type FindingLevel string
+
+const (
+	FindingOK      FindingLevel = "ok"
+	FindingWarning FindingLevel = "warning"
+	FindingError   FindingLevel = "error"
+)
+
+//Finding is the result of one of the checks done by Validate.
+type Finding struct {
+	Check   string       `json:"check"`
+	Level   FindingLevel `json:"level"`
+	Message string       `json:"message"`
+}
+
+//HasErrors will return true if any of the findings is an error.
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Level == FindingError {
+			return true
+		}
+	}
+	return false
+}
+
+//Validate will check the configuration end to end, and return what was
+// found. It checks that the provider discovery document and JWKS can be
+// fetched, that the provider accepts the client ID and redirect URL by
+// doing a dry run of the login redirect, the strength of the cookie
+// keys, the misuse of the secrets checked by SelfCheck, the algorithms
+// not allowed by the crypto profile, that the configured stores can be
+// read, and the clock skew against the provider. It is meant to be run
+// before deployment, since it will do requests to the provider.
+func (a *Auth) Validate(ctx context.Context) []Finding {
+	var findings []Finding
+
+	findings = append(findings, a.checkRedirectURL()...)
+	findings = append(findings, a.checkCookieKeys()...)
+	findings = append(findings, a.checkSecrets()...)
+	findings = append(findings, a.checkCryptoProfile()...)
+	findings = append(findings, a.checkStores()...)
+	findings = append(findings, a.checkProvider(ctx)...)
+
+	return findings
+}
+
+//checkRedirectURL will check that the redirect URL is using https for
+// anything else than localhost.
+func (a *Auth) checkRedirectURL() []Finding {
+	u, err := url.Parse(a.googleOauthConfig.RedirectURL)
+	if err != nil {
+		return []Finding{{"redirect url", FindingError, fmt.Sprintf("redirect url %q is not valid: %v", a.googleOauthConfig.RedirectURL, err)}}
+	}
+
+	if u.Scheme != "https" && u.Hostname() != "localhost" && u.Hostname() != "127.0.0.1" {
+		return []Finding{{"redirect url", FindingWarning, fmt.Sprintf("redirect url %v is not using https, the authorization code will be sent in clear text", u)}}
+	}
+
+	return []Finding{{"redirect url", FindingOK, u.String()}}
+}
+
+//checkCookieKeys will check that the cookie keys are not the example
+// value from the README, and that they are long enough.
+func (a *Auth) checkCookieKeys() []Finding {
+	var findings []Finding
+
+	for i, k := range a.codec.cookieKeys() {
+		switch {
+		case string(k) == exampleCookieKey:
+			findings = append(findings, Finding{"cookie key", FindingError, fmt.Sprintf("cookie key %d is the example value from the documentation, create a random key", i)})
+		case len(k) < 32:
+			findings = append(findings, Finding{"cookie key", FindingWarning, fmt.Sprintf("cookie key %d is only %d bytes, use at least 32 random bytes", i, len(k))})
+		default:
+			findings = append(findings, Finding{"cookie key", FindingOK, fmt.Sprintf("cookie key %d is %d bytes", i, len(k))})
+		}
+	}
+
+	return findings
+}
+
+//checkStores will check that all the configured stores can be read.
+func (a *Auth) checkStores() []Finding {
+	var findings []Finding
+
+	check := func(name string, set bool, list func() error) {
+		if !set {
+			return
+		}
+		if err := list(); err != nil {
+			findings = append(findings, Finding{name, FindingError, fmt.Sprintf("failed to read store: %v", err)})
+			return
+		}
+		findings = append(findings, Finding{name, FindingOK, "store can be read"})
+	}
+
+	check("session store", a.sessions != nil, func() error { _, err := a.sessions.List(); return err })
+	check("ban store", a.bans != nil, func() error { _, err := a.bans.List(); return err })
+	check("invitation store", a.invitations != nil, func() error { _, err := a.invitations.List(); return err })
+	check("user store", a.users != nil, func() error { _, err := a.users.List(); return err })
+	check("allowlist", a.allowList != nil, func() error { _, err := a.allowList.List(); return err })
+
+	return findings
+}
+
+//checkProvider will fetch the discovery document and the JWKS, check
+// the clock skew against the Date header of the provider, and do a dry
+// run of the login redirect to see that the provider accepts the client
+// ID and the redirect URL.
+func (a *Auth) checkProvider(ctx context.Context) []Finding {
+	var findings []Finding
+
+	resp, body, err := doctorGet(ctx, googleDiscoveryURL, true)
+	if err != nil {
+		return append(findings, Finding{"provider discovery", FindingError, fmt.Sprintf("failed to fetch %v: %v", googleDiscoveryURL, err)})
+	}
+	if resp.StatusCode != http.StatusOK {
+		return append(findings, Finding{"provider discovery", FindingError, fmt.Sprintf("%v returned %v", googleDiscoveryURL, resp.Status)})
+	}
+
+	discovery := struct {
+		JWKSURI string `json:"jwks_uri"`
+	}{}
+	if err := json.Unmarshal(body, &discovery); err != nil || discovery.JWKSURI == "" {
+		return append(findings, Finding{"provider discovery", FindingError, "discovery document has no jwks_uri"})
+	}
+	findings = append(findings, Finding{"provider discovery", FindingOK, googleDiscoveryURL})
+
+	findings = append(findings, clockSkewFinding(resp))
+
+	jwksResp, _, err := doctorGet(ctx, discovery.JWKSURI, true)
+	switch {
+	case err != nil:
+		findings = append(findings, Finding{"provider jwks", FindingError, fmt.Sprintf("failed to fetch %v: %v", discovery.JWKSURI, err)})
+	case jwksResp.StatusCode != http.StatusOK:
+		findings = append(findings, Finding{"provider jwks", FindingError, fmt.Sprintf("%v returned %v", discovery.JWKSURI, jwksResp.Status)})
+	default:
+		findings = append(findings, Finding{"provider jwks", FindingOK, discovery.JWKSURI})
+	}
+
+	//Do a dry run of the login redirect. The provider will answer with an
+	// error page if the client ID is unknown, or the redirect URL is not
+	// registered for the client, and redirect to its login page if ok.
+	authURL := a.googleOauthConfig.AuthCodeURL("doctor")
+	authResp, authBody, err := doctorGet(ctx, authURL, false)
+	switch {
+	case err != nil:
+		findings = append(findings, Finding{"provider client", FindingError, fmt.Sprintf("failed to do dry run of login: %v", err)})
+	case authResp.StatusCode >= 400:
+		msg := fmt.Sprintf("provider answered %v on the login redirect", authResp.Status)
+		switch {
+		case strings.Contains(string(authBody), "redirect_uri_mismatch"):
+			msg = fmt.Sprintf("redirect url %v is not registered for the client ID at the provider", a.googleOauthConfig.RedirectURL)
+		case strings.Contains(string(authBody), "invalid_client"):
+			msg = "the client ID is not known by the provider"
+		}
+		findings = append(findings, Finding{"provider client", FindingError, msg})
+	case strings.Contains(authResp.Header.Get("Location"), "error="):
+		findings = append(findings, Finding{"provider client", FindingError, fmt.Sprintf("provider redirected with an error: %v", authResp.Header.Get("Location"))})
+	default:
+		findings = append(findings, Finding{"provider client", FindingOK, "provider accepted the client ID and redirect url"})
+	}
+
+	return findings
+}
+
+//clockSkewFinding will compare the local clock with the Date header of
+// the response from the provider.
+func clockSkewFinding(resp *http.Response) Finding {
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return Finding{"clock skew", FindingWarning, "provider response has no Date header, clock skew not checked"}
+	}
+
+	skew := time.Since(date).Round(time.Second)
+	if skew < 0 {
+		skew = -skew
+	}
+
+	switch {
+	case skew > 2*time.Minute:
+		return Finding{"clock skew", FindingError, fmt.Sprintf("local clock differs %v from the provider, tokens will be rejected", skew)}
+	case skew > 30*time.Second:
+		return Finding{"clock skew", FindingWarning, fmt.Sprintf("local clock differs %v from the provider", skew)}
+	}
+	return Finding{"clock skew", FindingOK, fmt.Sprintf("local clock differs %v from the provider", skew)}
+}
+
+//doctorGet will do a GET request to url, and return the response with
+// the body read. Redirects are only followed if follow is true.
+func doctorGet(ctx context.Context, url string, follow bool) (*http.Response, []byte, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	if !follow {
+		client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return resp, body, nil
+}
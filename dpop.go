@@ -0,0 +1,592 @@
+package authsession
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//dpopMaxAge is how old a DPoP proof can be, and how long the jti of a
+// proof is remembered to stop replays.
+const dpopMaxAge = 5 * time.Minute
+
+//errUseDPoPNonce is returned when a DPoP proof is missing the current
+// nonce, and the client should retry with the nonce from the DPoP-Nonce
+// header.
+var errUseDPoPNonce = errors.New("use_dpop_nonce")
+
+//jwk is the part of a JSON Web Key used for the keys of DPoP proofs.
+type jwk struct {
+	Kty string `json:"kty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+//publicKey will return the public key of the JWK.
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	b64 := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := b64.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := b64.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+			return nil, errors.New("ec key is not on the curve")
+		}
+		return pub, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+//thumbprint will return the RFC 7638 thumbprint of the JWK.
+func (k jwk) thumbprint() string {
+	var s string
+	switch k.Kty {
+	case "RSA":
+		s = fmt.Sprintf(`{"e":%q,"kty":"RSA","n":%q}`, k.E, k.N)
+	case "EC":
+		s = fmt.Sprintf(`{"crv":%q,"kty":"EC","x":%q,"y":%q}`, k.Crv, k.X, k.Y)
+	}
+	sum := sha256.Sum256([]byte(s))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+//jwtHeader is the part of the JWT header used.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+	Kid string `json:"kid"`
+	JWK *jwk   `json:"jwk"`
+}
+
+//parseJWT will split and decode the JWT, and verify the signature with
+// the key returned by keyFn for the header. The claims are decoded into
+// claims.
+func parseJWT(token string, keyFn func(h jwtHeader) (crypto.PublicKey, error), claims interface{}) (jwtHeader, error) {
+	var h jwtHeader
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return h, errors.New("malformed jwt")
+	}
+	b64 := base64.RawURLEncoding
+
+	hb, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return h, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	if err := json.Unmarshal(hb, &h); err != nil {
+		return h, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	sig, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return h, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+
+	key, err := keyFn(h)
+	if err != nil {
+		return h, err
+	}
+
+	sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch h.Alg {
+	case "RS256":
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return h, errors.New("RS256 needs a RSA key")
+		}
+		if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+			return h, errors.New("jwt signature is not valid")
+		}
+	case "ES256":
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(sig) != 64 {
+			return h, errors.New("ES256 needs a P-256 key and a 64 byte signature")
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(pub, sum[:], r, s) {
+			return h, errors.New("jwt signature is not valid")
+		}
+	default:
+		return h, fmt.Errorf("unsupported jwt alg %q", h.Alg)
+	}
+
+	pb, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return h, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+	if err := json.Unmarshal(pb, claims); err != nil {
+		return h, fmt.Errorf("malformed jwt payload: %v", err)
+	}
+
+	return h, nil
+}
+
+//dpopClaims are the claims of a DPoP proof.
+type dpopClaims struct {
+	JTI   string `json:"jti"`
+	HTM   string `json:"htm"`
+	HTU   string `json:"htu"`
+	IAT   int64  `json:"iat"`
+	Nonce string `json:"nonce"`
+	ATH   string `json:"ath"`
+}
+
+//dpopState holds the server nonces and the jti's seen, for checking
+// DPoP proofs.
+type dpopState struct {
+	mu        sync.Mutex
+	nonce     string
+	prevNonce string
+	rotated   time.Time
+	seen      map[string]time.Time
+}
+
+func newDPoPState() *dpopState {
+	return &dpopState{
+		seen: make(map[string]time.Time),
+	}
+}
+
+//currentNonce will return the nonce clients should put in their proofs.
+// The nonce is rotated every dpopMaxAge, and the previous nonce is still
+// accepted so clients in the middle of a request are not rejected.
+func (d *dpopState) currentNonce() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.nonce == "" || time.Since(d.rotated) > dpopMaxAge {
+		nonceRAW, err := createRandomKey(16)
+		if err != nil {
+			return d.nonce
+		}
+		d.prevNonce = d.nonce
+		d.nonce = base64.RawURLEncoding.EncodeToString(nonceRAW)
+		d.rotated = time.Now()
+	}
+	return d.nonce
+}
+
+//validNonce will return true if the nonce is the current or the previous nonce.
+func (d *dpopState) validNonce(nonce string) bool {
+	current := d.currentNonce()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if nonce == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(nonce), []byte(current)) == 1 ||
+		(d.prevNonce != "" && subtle.ConstantTimeCompare([]byte(nonce), []byte(d.prevNonce)) == 1)
+}
+
+//replayed will remember the jti, and return true if it was already seen.
+func (d *dpopState) replayed(jti string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for k, t := range d.seen {
+		if now.Sub(t) > 2*dpopMaxAge {
+			delete(d.seen, k)
+		}
+	}
+	if _, ok := d.seen[jti]; ok {
+		return true
+	}
+	d.seen[jti] = now
+	return false
+}
+
+//requestURL will return the url of the request without query and
+// fragment, as used for the htu claim. baseURL, the issuer URL or the
+// external URL, is used for the scheme and host when given, since the
+// server can be behind a proxy.
+func requestURL(r *http.Request, baseURL string) string {
+	if baseURL != "" {
+		return strings.TrimSuffix(baseURL, "/") + r.URL.Path
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.Path
+}
+
+//checkDPoPProof will check the DPoP proof in the DPoP header of the
+// request, and return the thumbprint of the key it was signed with.
+// accessToken is given when the proof is sent together with an access
+// token, and the proof must then carry its hash. The iat of the proof can
+// differ by skew from our clock.
+func (d *dpopState) checkDPoPProof(r *http.Request, htu string, accessToken string, skew time.Duration) (string, error) {
+	proofs := r.Header.Values("DPoP")
+	if len(proofs) != 1 {
+		return "", errors.New("exactly one DPoP proof is required")
+	}
+
+	var claims dpopClaims
+	h, err := parseJWT(proofs[0], func(h jwtHeader) (crypto.PublicKey, error) {
+		if h.Typ != "dpop+jwt" {
+			return nil, errors.New("DPoP proof must have typ dpop+jwt")
+		}
+		if h.JWK == nil {
+			return nil, errors.New("DPoP proof is missing the jwk")
+		}
+		return h.JWK.publicKey()
+	}, &claims)
+	if err != nil {
+		return "", err
+	}
+
+	if claims.JTI == "" {
+		return "", errors.New("DPoP proof is missing the jti")
+	}
+	if claims.HTM != r.Method {
+		return "", errors.New("DPoP proof htm does not match the request method")
+	}
+	if strings.TrimSuffix(claims.HTU, "/") != strings.TrimSuffix(htu, "/") {
+		return "", errors.New("DPoP proof htu does not match the request url")
+	}
+	iat := time.Unix(claims.IAT, 0)
+	if time.Since(iat) > dpopMaxAge+skew || time.Until(iat) > skew {
+		return "", errors.New("DPoP proof is too old, or from the future")
+	}
+	if accessToken != "" {
+		sum := sha256.Sum256([]byte(accessToken))
+		if subtle.ConstantTimeCompare([]byte(claims.ATH), []byte(base64.RawURLEncoding.EncodeToString(sum[:]))) != 1 {
+			return "", errors.New("DPoP proof ath does not match the access token")
+		}
+	}
+	if !d.validNonce(claims.Nonce) {
+		return "", errUseDPoPNonce
+	}
+	if d.replayed(claims.JTI) {
+		return "", errors.New("DPoP proof has already been used")
+	}
+
+	return h.JWK.thumbprint(), nil
+}
+
+//accessTokenClaims are the claims of the access tokens issued in issuer mode.
+type accessTokenClaims struct {
+	Iss   string `json:"iss"`
+	Sub   string `json:"sub"`
+	Aud   string `json:"aud"`
+	Azp   string `json:"azp"`
+	Scope string `json:"scope"`
+	Exp   int64  `json:"exp"`
+	Iat   int64  `json:"iat"`
+	Nbf   int64  `json:"nbf"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+	Jti   string `json:"jti"`
+	Cnf   *struct {
+		JKT string `json:"jkt"`
+	} `json:"cnf,omitempty"`
+	//Act is the client acting for the subject, for a token given by
+	// token exchange.
+	Act *tokenActor `json:"act,omitempty"`
+}
+
+//tokenActor is the act claim of RFC 8693, with the client acting for
+// the subject, and the client it acted for in turn, if any.
+type tokenActor struct {
+	Sub string      `json:"sub"`
+	Act *tokenActor `json:"act,omitempty"`
+}
+
+//pasetoAccessTokenClaims are the claims of a PASETO access token, where
+// the times are ISO 8601 strings.
+type pasetoAccessTokenClaims struct {
+	accessTokenClaims
+	Exp time.Time `json:"exp"`
+	Iat time.Time `json:"iat"`
+	Nbf time.Time `json:"nbf"`
+}
+
+//parsePASETOAccessToken will verify a PASETO access token issued here,
+// and return its claims with the times as unix times.
+func (i *issuer) parsePASETOAccessToken(token string) (accessTokenClaims, error) {
+	footer, err := pasetoFooter(token)
+	if err != nil || i.conf.PASETOKey == nil {
+		return accessTokenClaims{}, errNotIssuedHere
+	}
+	var f struct {
+		Kid string `json:"kid"`
+	}
+	if err := json.Unmarshal(footer, &f); err != nil || f.Kid != i.pasetoKid {
+		return accessTokenClaims{}, errNotIssuedHere
+	}
+
+	message, _, err := pasetoVerify(i.conf.PASETOKey.Public().(ed25519.PublicKey), token, nil)
+	if err != nil {
+		return accessTokenClaims{}, err
+	}
+	var pc pasetoAccessTokenClaims
+	if err := json.Unmarshal(message, &pc); err != nil {
+		return accessTokenClaims{}, fmt.Errorf("access token claims are not valid: %v", err)
+	}
+
+	claims := pc.accessTokenClaims
+	for _, t := range []struct {
+		dst *int64
+		src time.Time
+	}{{&claims.Exp, pc.Exp}, {&claims.Iat, pc.Iat}, {&claims.Nbf, pc.Nbf}} {
+		if !t.src.IsZero() {
+			*t.dst = t.src.Unix()
+		}
+	}
+	return claims, nil
+}
+
+//AccessToken is a verified access token, issued in issuer mode or
+// checked with token introspection.
+type AccessToken struct {
+	Subject  string
+	ClientID string
+	Email    string
+	Name     string
+	//Audiences are the audiences of the token, which is the API the token
+	// was asked for, or the client ID.
+	Audiences []string
+	//Issuer is the issuer of a token issued in issuer mode.
+	Issuer string
+	//Tenant is the tenant of the issuer of a token issued in issuer mode,
+	// when every tenant has its own issuer.
+	Tenant string
+	//Actors are the IDs of the clients acting for the subject of a token
+	// given by token exchange, the last one to exchange the token first.
+	Actors []string
+	//Scope are the scopes of the token, space separated.
+	Scope string
+	//DPoPBound is true if the token is bound to the key of the client.
+	DPoPBound bool
+	//ID is the jti of a token issued in issuer mode, used to revoke it
+	// with RevokeAccessToken.
+	ID string
+	//Expires is when a token issued in issuer mode expires.
+	Expires time.Time
+}
+
+//errNotIssuedHere is returned when the access token was not issued in
+// issuer mode, and might be checked with introspection instead.
+var errNotIssuedHere = errors.New("access token was not issued here")
+
+//VerifyAccessToken will verify the access token given with the request,
+// for APIs using the tokens. Tokens issued in issuer mode are checked
+// locally, and other tokens, like opaque tokens from a provider, are
+// checked with token introspection if set with WithTokenIntrospection.
+// A token bound with DPoP is only accepted together with a valid DPoP
+// proof from the same key, so a stolen token alone is useless.
+func (a *Auth) VerifyAccessToken(r *http.Request) (AccessToken, error) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if token == "" {
+		return AccessToken{}, errors.New("missing access token")
+	}
+
+	err := errNotIssuedHere
+	var at AccessToken
+	if a.issuer != nil {
+		at, err = a.verifyIssuedToken(r, scheme, token)
+	}
+	if !errors.Is(err, errNotIssuedHere) {
+		return at, err
+	}
+
+	if a.introspection == nil {
+		return AccessToken{}, errors.New("access token was not issued here, and no token introspection configured")
+	}
+	if !strings.EqualFold(scheme, "Bearer") {
+		return AccessToken{}, errors.New("expected a Bearer token")
+	}
+	return a.introspection.verify(r.Context(), token, a.clockSkew)
+}
+
+//verifyIssuedToken will verify an access token issued in issuer mode.
+func (a *Auth) verifyIssuedToken(r *http.Request, scheme string, token string) (AccessToken, error) {
+	at, claims, err := a.parseIssuedToken(token)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	//A request for a tenant only accepts the tokens of its issuer.
+	if at.Tenant != "" {
+		if t, found := a.Tenant(r); found && t.ID != at.Tenant {
+			return AccessToken{}, errors.New("access token is from the issuer of another tenant")
+		}
+	}
+
+	if claims.Cnf == nil {
+		if !strings.EqualFold(scheme, "Bearer") {
+			return AccessToken{}, errors.New("expected a Bearer token")
+		}
+		return at, nil
+	}
+
+	if !strings.EqualFold(scheme, "DPoP") {
+		return AccessToken{}, errors.New("DPoP bound token must use the DPoP scheme")
+	}
+	jkt, err := a.issuer.dpop.checkDPoPProof(r, requestURL(r, a.externalURL), token, a.clockSkew)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if subtle.ConstantTimeCompare([]byte(jkt), []byte(claims.Cnf.JKT)) != 1 {
+		return AccessToken{}, errors.New("DPoP proof is not from the key the token is bound to")
+	}
+	at.DPoPBound = true
+
+	return at, nil
+}
+
+//parseIssuedToken will verify the signature, the issuer and the times of
+// an access token issued in issuer mode, and check that it is not
+// revoked. The binding of a DPoP bound token is not checked.
+func (a *Auth) parseIssuedToken(token string) (AccessToken, accessTokenClaims, error) {
+	var claims accessTokenClaims
+	var err error
+	switch {
+	case strings.HasPrefix(token, pasetoPublicHeader) && a.fips():
+		return AccessToken{}, accessTokenClaims{}, errors.New("PASETO access tokens are refused by the FIPS crypto profile")
+	case strings.HasPrefix(token, pasetoPublicHeader):
+		claims, err = a.issuer.parsePASETOAccessToken(token)
+	case isReferenceToken(token):
+		claims, err = a.issuer.lookupReferenceToken(token)
+	case strings.Count(token, ".") == 2:
+		_, err = parseJWT(token, func(h jwtHeader) (crypto.PublicKey, error) {
+			pub, ok := a.issuer.verifyKey(h.Kid)
+			if !ok {
+				return nil, errNotIssuedHere
+			}
+			//The ID tokens are signed with the same key, and must not be
+			// taken as access tokens.
+			if !strings.EqualFold(h.Typ, accessTokenType) && !strings.EqualFold(h.Typ, "application/"+accessTokenType) {
+				return nil, fmt.Errorf("access token must have typ %v", accessTokenType)
+			}
+			return pub, nil
+		}, &claims)
+	default:
+		return AccessToken{}, accessTokenClaims{}, errNotIssuedHere
+	}
+	if err != nil {
+		return AccessToken{}, accessTokenClaims{}, err
+	}
+	tenant, ok := a.issuerTenant(claims.Iss)
+	if !ok {
+		return AccessToken{}, accessTokenClaims{}, errors.New("access token is from another issuer")
+	}
+	if claims.Exp == 0 {
+		return AccessToken{}, accessTokenClaims{}, errors.New("access token has no expiry")
+	}
+	if claims.Jti == "" {
+		return AccessToken{}, accessTokenClaims{}, errors.New("access token has no jti")
+	}
+	if err := checkTimeClaims(claims.Exp, claims.Iat, claims.Nbf, a.clockSkew); err != nil {
+		return AccessToken{}, accessTokenClaims{}, fmt.Errorf("access token: %v", err)
+	}
+
+	if a.denylist != nil {
+		revoked, err := a.denylist.isRevoked(claims.Jti)
+		if err != nil {
+			return AccessToken{}, accessTokenClaims{}, fmt.Errorf("failed checking the token denylist: %v", err)
+		}
+		if revoked {
+			return AccessToken{}, accessTokenClaims{}, errors.New("access token is revoked")
+		}
+	}
+
+	at := AccessToken{
+		Subject:   claims.Sub,
+		ClientID:  claims.Aud,
+		Email:     claims.Email,
+		Name:      claims.Name,
+		Audiences: []string{claims.Aud},
+		Scope:     claims.Scope,
+		Issuer:    claims.Iss,
+		Tenant:    tenant,
+		ID:        claims.Jti,
+		Expires:   time.Unix(claims.Exp, 0),
+	}
+	if claims.Azp != "" {
+		at.ClientID = claims.Azp
+	}
+	for act := claims.Act; act != nil; act = act.Act {
+		at.Actors = append(at.Actors, act.Sub)
+	}
+	return at, claims, nil
+}
+
+//RequireAccessToken will only call h if the request carries a valid
+// access token, checked with VerifyAccessToken.
+func (a *Auth) RequireAccessToken(h http.HandlerFunc) http.HandlerFunc {
+	return a.requireAccessToken(a.VerifyAccessToken, h)
+}
+
+//RequireAccessTokenFor will only call h if the request carries a valid
+// access token issued for the audience, checked with
+// VerifyAccessTokenFor.
+func (a *Auth) RequireAccessTokenFor(audience string, h http.HandlerFunc) http.HandlerFunc {
+	return a.requireAccessToken(func(r *http.Request) (AccessToken, error) {
+		return a.VerifyAccessTokenFor(r, audience)
+	}, h)
+}
+
+//requireAccessToken will only call h if verify accepts the access token
+// of the request.
+func (a *Auth) requireAccessToken(verify func(r *http.Request) (AccessToken, error), h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		_, err := verify(r)
+		if errors.Is(err, errUseDPoPNonce) {
+			w.Header().Set("DPoP-Nonce", a.issuer.dpop.currentNonce())
+			w.Header().Set("WWW-Authenticate", `DPoP error="use_dpop_nonce"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if header, ok := scopeErrorHeader(err); ok {
+			w.Header().Set("WWW-Authenticate", header)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,309 @@
+package authsession
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWKThumbprint(t *testing.T) {
+	//The example of RFC 7638, section 3.1.
+	k := jwk{
+		Kty: "RSA",
+		N:   "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+		E:   "AQAB",
+	}
+	if got, want := k.thumbprint(), "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Fatalf("got thumbprint %v, want %v", got, want)
+	}
+
+	pub, err := k.publicKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rk, ok := pub.(*rsa.PublicKey); !ok || rk.E != 65537 || rk.N.BitLen() != 2048 {
+		t.Fatalf("got public key %v", pub)
+	}
+}
+
+func TestJWKPublicKeyRejected(t *testing.T) {
+	tests := []struct {
+		name string
+		k    jwk
+	}{
+		{"unknown key type", jwk{Kty: "oct"}},
+		{"unsupported curve", jwk{Kty: "EC", Crv: "P-384", X: "AA", Y: "AA"}},
+		{"point not on the curve", jwk{Kty: "EC", Crv: "P-256", X: "AQ", Y: "AQ"}},
+		{"bad base64", jwk{Kty: "RSA", N: "!!", E: "AQAB"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := tt.k.publicKey(); err == nil {
+				t.Fatal("key was accepted")
+			}
+		})
+	}
+}
+
+func TestSignJWT(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := signJWT(KeySigner(key), accessTokenType, map[string]interface{}{"sub": "1", "jti": "j1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyFn := func(h jwtHeader) (crypto.PublicKey, error) {
+		if h.Kid != keyID(&key.PublicKey) {
+			return nil, errors.New("unknown kid")
+		}
+		return &key.PublicKey, nil
+	}
+	var claims struct {
+		Sub string `json:"sub"`
+		JTI string `json:"jti"`
+	}
+	h, err := parseJWT(token, keyFn, &claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Alg != "RS256" || h.Typ != accessTokenType || claims.Sub != "1" || claims.JTI != "j1" {
+		t.Fatalf("got header %+v and claims %+v", h, claims)
+	}
+
+	parts := strings.Split(token, ".")
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherToken, err := signJWT(KeySigner(other), accessTokenType, map[string]interface{}{"sub": "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b64 := base64.RawURLEncoding
+
+	tests := []struct {
+		name  string
+		token string
+		keyFn func(h jwtHeader) (crypto.PublicKey, error)
+	}{
+		{"tampered signature", parts[0] + "." + parts[1] + "." + tamper(parts[2], 10), keyFn},
+		{"tampered payload", parts[0] + "." + b64.EncodeToString([]byte(`{"sub":"2","jti":"j1"}`)) + "." + parts[2], keyFn},
+		{"other key", otherToken, func(h jwtHeader) (crypto.PublicKey, error) { return &key.PublicKey, nil }},
+		{"alg none", b64.EncodeToString([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", keyFn},
+		{"RS256 with an EC key", token, func(h jwtHeader) (crypto.PublicKey, error) { return &ecKey.PublicKey, nil }},
+		{"refused by keyFn", otherToken, keyFn},
+		{"malformed", parts[0] + "." + parts[1], keyFn},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var claims map[string]interface{}
+			if _, err := parseJWT(tt.token, tt.keyFn, &claims); err == nil {
+				t.Fatal("token was accepted")
+			}
+		})
+	}
+}
+
+//dpopProof will return a DPoP proof signed with the key, with the header
+// and the claims given replacing the defaults.
+func dpopProof(t *testing.T, key *ecdsa.PrivateKey, header map[string]interface{}, claims map[string]interface{}) string {
+	t.Helper()
+	h := map[string]interface{}{
+		"alg": "ES256",
+		"typ": "dpop+jwt",
+		"jwk": map[string]string{
+			"kty": "EC",
+			"crv": "P-256",
+			"x":   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		},
+	}
+	for k, v := range header {
+		h[k] = v
+	}
+	hb, err := json.Marshal(h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cb, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(hb) + "." + base64.RawURLEncoding.EncodeToString(cb)
+	sum := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestCheckDPoPProof(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const htu = "https://auth.example.com/oidc/token"
+	const accessToken = "access-token"
+	sum := sha256.Sum256([]byte(accessToken))
+	ath := base64.RawURLEncoding.EncodeToString(sum[:])
+
+	d := newDPoPState()
+	claims := func(jti string, change map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"jti":   jti,
+			"htm":   "POST",
+			"htu":   htu,
+			"iat":   time.Now().Unix(),
+			"nonce": d.currentNonce(),
+			"ath":   ath,
+		}
+		for k, v := range change {
+			c[k] = v
+		}
+		return c
+	}
+	check := func(proof string) (string, error) {
+		r := httptest.NewRequest("POST", htu, nil)
+		r.Header.Set("DPoP", proof)
+		return d.checkDPoPProof(r, htu, accessToken, 0)
+	}
+
+	proof := dpopProof(t, key, nil, claims("j1", nil))
+	jkt, err := check(proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var h jwtHeader
+	if _, err := parseJWT(proof, func(hd jwtHeader) (crypto.PublicKey, error) { h = hd; return hd.JWK.publicKey() }, &map[string]interface{}{}); err != nil {
+		t.Fatal(err)
+	}
+	if jkt != h.JWK.thumbprint() {
+		t.Fatalf("got thumbprint %v, want %v", jkt, h.JWK.thumbprint())
+	}
+	if _, err := check(proof); err == nil {
+		t.Fatal("replayed proof was accepted")
+	}
+
+	if _, err := check(dpopProof(t, key, nil, claims("j2", map[string]interface{}{"nonce": ""}))); err != errUseDPoPNonce {
+		t.Fatalf("got error %v for a proof without a nonce, want %v", err, errUseDPoPNonce)
+	}
+
+	tests := []struct {
+		name   string
+		header map[string]interface{}
+		claims map[string]interface{}
+	}{
+		{"typ JWT", map[string]interface{}{"typ": "JWT"}, nil},
+		{"no jwk", map[string]interface{}{"jwk": nil}, nil},
+		{"no jti", nil, map[string]interface{}{"jti": ""}},
+		{"other method", nil, map[string]interface{}{"htm": "GET"}},
+		{"other url", nil, map[string]interface{}{"htu": "https://auth.example.com/oidc/userinfo"}},
+		{"too old", nil, map[string]interface{}{"iat": time.Now().Add(-2 * dpopMaxAge).Unix()}},
+		{"from the future", nil, map[string]interface{}{"iat": time.Now().Add(time.Minute).Unix()}},
+		{"other access token", nil, map[string]interface{}{"ath": base64.RawURLEncoding.EncodeToString(make([]byte, 32))}},
+		{"unknown nonce", nil, map[string]interface{}{"nonce": "unknown"}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			jti := "bad-" + string(rune('a'+i))
+			if _, err := check(dpopProof(t, key, tt.header, claims(jti, tt.claims))); err == nil {
+				t.Fatal("proof was accepted")
+			}
+		})
+	}
+
+	other, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := strings.Split(dpopProof(t, other, nil, claims("j3", nil)), ".")
+	embedded := strings.Split(dpopProof(t, key, nil, claims("j3", nil)), ".")
+	if _, err := check(embedded[0] + "." + signed[1] + "." + signed[2]); err == nil {
+		t.Fatal("proof signed with another key than its jwk was accepted")
+	}
+}
+
+func TestVerifyAccessTokenExternalURL(t *testing.T) {
+	signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	k := jwk{
+		Kty: "EC",
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(clientKey.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(clientKey.Y.FillBytes(make([]byte, 32))),
+	}
+
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"behind a TLS proxy", []Option{WithExternalURL("https://api.example.com/")}, true},
+		{"no external URL", nil, false},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := append([]Option{WithIssuer(IssuerConfig{URL: "https://auth.example.com", SigningKey: signingKey, Clients: NewFileClientStore("")})}, tt.opts...)
+			a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret", opts...)
+			token, err := a.issuer.signAccessToken(map[string]interface{}{
+				"iss": a.issuer.issuerURL(),
+				"sub": "u1",
+				"aud": "app",
+				"jti": "t1",
+				"iat": time.Now().Unix(),
+				"exp": time.Now().Add(time.Hour).Unix(),
+				"cnf": map[string]string{"jkt": k.thumbprint()},
+			}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sum := sha256.Sum256([]byte(token))
+
+			//The proxy terminates TLS, and the request reaches the server
+			// over plain http on another host.
+			r := httptest.NewRequest("GET", "http://10.0.0.5:8080/reports", nil)
+			r.Header.Set("Authorization", "DPoP "+token)
+			r.Header.Set("DPoP", dpopProof(t, clientKey, nil, map[string]interface{}{
+				"jti":   "p" + string(rune('a'+i)),
+				"htm":   "GET",
+				"htu":   "https://api.example.com/reports",
+				"iat":   time.Now().Unix(),
+				"nonce": a.issuer.dpop.currentNonce(),
+				"ath":   base64.RawURLEncoding.EncodeToString(sum[:]),
+			}))
+			at, err := a.VerifyAccessToken(r)
+			if tt.ok && (err != nil || !at.DPoPBound) {
+				t.Fatalf("got error %v, bound %v", err, at.DPoPBound)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("proof for another URL was accepted")
+			}
+		})
+	}
+}
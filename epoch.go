@@ -0,0 +1,83 @@
+package authsession
+
+import (
+	"errors"
+	"strings"
+	"sync"
+)
+
+//EpochStore keeps a counter, the epoch, for every user. The epoch of the
+// user is put in the session cookie at login, and a cookie with an older
+// epoch than the one in the store is not accepted, so all the sessions of
+// a user can be revoked by incrementing the epoch, without keeping every
+// session server side. The store should be shared by all the instances
+// of the server.
+type EpochStore interface {
+	//Get will return the epoch for the user, which is 0 if not set.
+	Get(user string) (int64, error)
+	//Increment will increment the epoch for the user, and return the new epoch.
+	Increment(user string) (int64, error)
+}
+
+//MemoryEpochStore is an EpochStore keeping the epochs in memory, for
+// running a single instance.
+type MemoryEpochStore struct {
+	mu     sync.Mutex
+	epochs map[string]int64
+}
+
+//NewMemoryEpochStore will return a new *MemoryEpochStore.
+func NewMemoryEpochStore() *MemoryEpochStore {
+	return &MemoryEpochStore{
+		epochs: make(map[string]int64),
+	}
+}
+
+//Get will return the epoch for the user, which is 0 if not set.
+func (m *MemoryEpochStore) Get(user string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.epochs[user], nil
+}
+
+//Increment will increment the epoch for the user, and return the new epoch.
+func (m *MemoryEpochStore) Increment(user string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.epochs[user]++
+	return m.epochs[user], nil
+}
+
+//epochUser will return the key used for the user in the epoch store.
+func epochUser(email string) string {
+	return strings.ToLower(email)
+}
+
+//RevokeUserSessions will revoke all the sessions of the user with the
+// email, by incrementing the epoch of the user in the epoch store, and
+// deleting the sessions of the user from the session store if used.
+func (a *Auth) RevokeUserSessions(email string) error {
+	return a.revokeUserSessions(email, "revoked")
+}
+
+//revokeUserSessions will revoke all the sessions of the user like
+// RevokeUserSessions, and tell the open session event streams of the user
+// the reason.
+func (a *Auth) revokeUserSessions(email string, reason string) error {
+	if a.epochs == nil && a.sessions == nil {
+		return errors.New("no epoch store or session store configured")
+	}
+
+	if a.epochs != nil {
+		if _, err := a.epochs.Increment(epochUser(email)); err != nil {
+			return err
+		}
+	}
+	if a.sessions != nil {
+		if _, err := a.sessions.DeleteUser(email); err != nil {
+			return err
+		}
+	}
+	a.watchers.notify(email, reason)
+	return nil
+}
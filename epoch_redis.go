@@ -0,0 +1,47 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//RedisEpochStore is an EpochStore keeping the epochs in Redis, so they
+// are shared by all the instances of the server.
+type RedisEpochStore struct {
+	client  redis.UniversalClient
+	prefix  string
+	timeout time.Duration
+}
+
+//NewRedisEpochStore will return a *RedisEpochStore using client, with
+// the epochs stored in keys starting with prefix, like "authsession:epoch:".
+func NewRedisEpochStore(client redis.UniversalClient, prefix string) *RedisEpochStore {
+	return &RedisEpochStore{
+		client:  client,
+		prefix:  prefix,
+		timeout: 5 * time.Second,
+	}
+}
+
+//Get will return the epoch for the user, which is 0 if not set.
+func (r *RedisEpochStore) Get(user string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	epoch, err := r.client.Get(ctx, r.prefix+user).Int64()
+	if errors.Is(err, redis.Nil) {
+		return 0, nil
+	}
+	return epoch, err
+}
+
+//Increment will increment the epoch for the user, and return the new epoch.
+func (r *RedisEpochStore) Increment(user string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	return r.client.Incr(ctx, r.prefix+user).Result()
+}
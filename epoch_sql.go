@@ -0,0 +1,111 @@
+package authsession
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//SQLEpochStore is an EpochStore keeping the epochs in a SQL table, so
+// they are shared by all the instances of the server. The table has the
+// columns user_id and epoch, and can be created with CreateTable.
+type SQLEpochStore struct {
+	db      *sql.DB
+	table   string
+	dollar  bool
+	timeout time.Duration
+}
+
+//NewSQLEpochStore will return a *SQLEpochStore using the table in db.
+// Set dollarPlaceholders for databases using $1 as placeholders, like
+// PostgreSQL, instead of ?.
+func NewSQLEpochStore(db *sql.DB, table string, dollarPlaceholders bool) *SQLEpochStore {
+	return &SQLEpochStore{
+		db:      db,
+		table:   table,
+		dollar:  dollarPlaceholders,
+		timeout: 5 * time.Second,
+	}
+}
+
+//query will return the query with the placeholders for the database.
+func (s *SQLEpochStore) query(q string) string {
+	q = strings.ReplaceAll(q, "{table}", s.table)
+	if !s.dollar {
+		return q
+	}
+	for n := 1; strings.Contains(q, "?"); n++ {
+		q = strings.Replace(q, "?", fmt.Sprintf("$%d", n), 1)
+	}
+	return q
+}
+
+//CreateTable will create the table if it does not exist.
+func (s *SQLEpochStore) CreateTable() error {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	_, err := s.db.ExecContext(ctx, s.query("CREATE TABLE IF NOT EXISTS {table} (user_id VARCHAR(255) PRIMARY KEY, epoch BIGINT NOT NULL)"))
+	return err
+}
+
+//Get will return the epoch for the user, which is 0 if not set.
+func (s *SQLEpochStore) Get(user string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	var epoch int64
+	err := s.db.QueryRowContext(ctx, s.query("SELECT epoch FROM {table} WHERE user_id = ?"), user).Scan(&epoch)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return epoch, err
+}
+
+//Increment will increment the epoch for the user, and return the new epoch.
+func (s *SQLEpochStore) Increment(user string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), s.timeout)
+	defer cancel()
+
+	//Two instances can insert the first epoch for a user at the same
+	// time, so the update is tried again if the insert fails.
+	for i := 0; ; i++ {
+		epoch, err := s.increment(ctx, user)
+		if err == nil || i == 1 {
+			return epoch, err
+		}
+	}
+}
+
+//increment will increment the epoch for the user in a transaction.
+func (s *SQLEpochStore) increment(ctx context.Context, user string) (int64, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, s.query("UPDATE {table} SET epoch = epoch + 1 WHERE user_id = ?"), user)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		if _, err := tx.ExecContext(ctx, s.query("INSERT INTO {table} (user_id, epoch) VALUES (?, 1)"), user); err != nil {
+			return 0, err
+		}
+	}
+
+	var epoch int64
+	if err := tx.QueryRowContext(ctx, s.query("SELECT epoch FROM {table} WHERE user_id = ?"), user).Scan(&epoch); err != nil {
+		return 0, err
+	}
+
+	return epoch, tx.Commit()
+}
@@ -0,0 +1,273 @@
+package authsession
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//Severity tells how serious a LoginEvent is for the security of the users.
+type Severity string
+
+const (
+	//SeverityInfo is a normal event, like a successful login.
+	SeverityInfo Severity = "info"
+	//SeverityWarning is a failed login.
+	SeverityWarning Severity = "warning"
+	//SeverityCritical is an event which should be looked into at once,
+	// like the reuse of a refresh token, or many failed logins in a row
+	// from the same IP.
+	SeverityCritical Severity = "critical"
+)
+
+const (
+	//massFailures is the number of failed logins from an IP within
+	// massFailuresWindow making a critical event.
+	massFailures = 10
+	//massFailuresWindow is the time the failed logins are counted in.
+	massFailuresWindow = time.Minute
+)
+
+//LoginEvent is a login attempt, which either succeeded or failed, or
+// another security event like the reuse of a refresh token.
+type LoginEvent struct {
+	Time     time.Time `json:"time"`
+	Email    string    `json:"email"`
+	IP       string    `json:"ip"`
+	Success  bool      `json:"success"`
+	Reason   string    `json:"reason"`
+	Severity Severity  `json:"severity"`
+	Location string    `json:"location,omitempty"`
+	//RequestID is the ID of the request of the event.
+	RequestID string `json:"requestID,omitempty"`
+	//Method is how the user authenticated when not with a login, like
+	// "basic" for HTTP basic auth.
+	Method string `json:"method,omitempty"`
+	//Risk is the risk score of the login or the session, when scored with
+	// WithRiskScoring.
+	Risk int `json:"risk,omitempty"`
+	//Seq is the number of the event in the audit chain, when chained with
+	// WithAuditChain.
+	Seq int64 `json:"seq,omitempty"`
+	//PrevHash is the hash of the event before in the audit chain.
+	PrevHash string `json:"prevHash,omitempty"`
+	//Hash is the hex encoded SHA-256 hash of the event in the audit chain,
+	// with PrevHash.
+	Hash string `json:"hash,omitempty"`
+	//Signature is the signature of the Hash of a checkpoint in the audit
+	// chain.
+	Signature string `json:"signature,omitempty"`
+}
+
+//loginEvents keeps the most recent login events in memory, and writes
+// them to the event sinks.
+type loginEvents struct {
+	mu     sync.Mutex
+	size   int
+	events []LoginEvent
+
+	sink     EventSink
+	critical EventSink
+	//chain is the audit chain of the events written, set with
+	// WithAuditChain.
+	chain *auditChain
+	//location will return the location of an IP, from WithSessionLocation
+	// or WithGeoIP.
+	location func(ip string) string
+	//failed is called with the failed logins, for WithLoginThrottle.
+	failed func(e LoginEvent)
+	//clientIP will return the IP of the client of a request.
+	clientIP func(r *http.Request) string
+}
+
+//newLoginEvents will return a *loginEvents keeping the last size events.
+func newLoginEvents(size int) *loginEvents {
+	return &loginEvents{
+		size:     size,
+		clientIP: remoteIP,
+	}
+}
+
+//add will add the event, and drop the oldest event if full. If the event
+// is a failure, and there have been too many failures from the IP lately,
+// a critical event is added too.
+func (l *loginEvents) add(e LoginEvent) {
+	if e.Location == "" && e.IP != "" && l.location != nil {
+		e.Location = l.location(e.IP)
+	}
+
+	l.mu.Lock()
+	l.events = append(l.events, e)
+	if len(l.events) > l.size {
+		l.events = l.events[len(l.events)-l.size:]
+	}
+
+	var mass *LoginEvent
+	if !e.Success && e.Severity == SeverityWarning {
+		failures := 0
+		for _, prev := range l.events {
+			if !prev.Success && prev.Severity == SeverityWarning && prev.IP == e.IP && e.Time.Sub(prev.Time) < massFailuresWindow {
+				failures++
+			}
+		}
+		//Only when reaching the limit, so there is one critical event
+		// for each burst of failures.
+		if failures == massFailures {
+			mass = &LoginEvent{
+				Time:     e.Time,
+				IP:       e.IP,
+				Reason:   fmt.Sprintf("%d failed logins within %v", failures, massFailuresWindow),
+				Severity: SeverityCritical,
+			}
+			l.events = append(l.events, *mass)
+		}
+	}
+	l.mu.Unlock()
+
+	if l.failed != nil && !e.Success && e.Severity == SeverityWarning {
+		l.failed(e)
+	}
+	l.write(e)
+	if mass != nil {
+		l.write(*mass)
+	}
+}
+
+//write will write the event to the sinks, chained into the audit chain
+// if set.
+func (l *loginEvents) write(e LoginEvent) {
+	if l.chain != nil {
+		l.writeChained(e)
+		return
+	}
+	l.writeSinks(e)
+}
+
+//writeSinks will write the event to the sink, and critical events to the
+// critical sink too.
+func (l *loginEvents) writeSinks(e LoginEvent) {
+	if l.sink != nil {
+		if err := l.sink.WriteEvent(e); err != nil {
+			log.Printf("error: writing event to the event sink failed: %v\n", err)
+		}
+	}
+	if l.critical != nil && e.Severity == SeverityCritical {
+		if err := l.critical.WriteEvent(e); err != nil {
+			log.Printf("error: writing event to the critical event sink failed: %v\n", err)
+		}
+	}
+}
+
+//success will add a successful login for email, with the risk score of
+// the login.
+func (l *loginEvents) success(r *http.Request, email string, risk int) {
+	l.add(LoginEvent{
+		Time:      time.Now(),
+		Email:     email,
+		IP:        l.clientIP(r),
+		Success:   true,
+		Severity:  SeverityInfo,
+		RequestID: RequestID(r.Context()),
+		Risk:      risk,
+	})
+}
+
+//risk will add an event about the risk score of a login or a session.
+func (l *loginEvents) risk(r *http.Request, email string, score int, reason string, severity Severity) {
+	l.add(LoginEvent{
+		Time:      time.Now(),
+		Email:     email,
+		IP:        l.clientIP(r),
+		Reason:    reason,
+		Severity:  severity,
+		RequestID: RequestID(r.Context()),
+		Risk:      score,
+	})
+}
+
+//failure will add a failed login with the reason. The email is empty
+// if the login failed before the user was known.
+func (l *loginEvents) failure(r *http.Request, email string, reason string) {
+	l.add(LoginEvent{
+		Time:      time.Now(),
+		Email:     email,
+		IP:        l.clientIP(r),
+		Reason:    reason,
+		Severity:  SeverityWarning,
+		RequestID: RequestID(r.Context()),
+	})
+}
+
+//criticalFailure will add a failed event with the reason, which should be
+// looked into at once.
+func (l *loginEvents) criticalFailure(r *http.Request, email string, reason string) {
+	l.add(LoginEvent{
+		Time:      time.Now(),
+		Email:     email,
+		IP:        l.clientIP(r),
+		Reason:    reason,
+		Severity:  SeverityCritical,
+		RequestID: RequestID(r.Context()),
+	})
+}
+
+//basicAuthSuccess will add a request authenticated with the basic auth
+// credential of the user.
+func (l *loginEvents) basicAuthSuccess(r *http.Request, user string) {
+	l.add(LoginEvent{
+		Time:      time.Now(),
+		Email:     user,
+		IP:        l.clientIP(r),
+		Success:   true,
+		Severity:  SeverityInfo,
+		RequestID: RequestID(r.Context()),
+		Method:    "basic",
+	})
+}
+
+//basicAuthFailure will add a request with basic auth not valid.
+func (l *loginEvents) basicAuthFailure(r *http.Request, user string, reason string) {
+	l.add(LoginEvent{
+		Time:      time.Now(),
+		Email:     user,
+		IP:        l.clientIP(r),
+		Reason:    reason,
+		Severity:  SeverityWarning,
+		RequestID: RequestID(r.Context()),
+		Method:    "basic",
+	})
+}
+
+//failures will return the number of failed logins of the user with the
+// email, or from the ip, since the time.
+func (l *loginEvents) failures(email string, ip string, since time.Time) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	n := 0
+	for _, e := range l.events {
+		if e.Success || e.Severity != SeverityWarning || e.Time.Before(since) {
+			continue
+		}
+		if (email != "" && e.Email == email) || e.IP == ip {
+			n++
+		}
+	}
+	return n
+}
+
+//recent will return the successful or the failed events, newest first.
+func (l *loginEvents) recent(success bool) []LoginEvent {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var events []LoginEvent
+	for i := len(l.events) - 1; i >= 0; i-- {
+		if l.events[i].Success == success {
+			events = append(events, l.events[i])
+		}
+	}
+	return events
+}
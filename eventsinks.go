@@ -0,0 +1,194 @@
+package authsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//EventSink gets the login and security events as they happen, like for
+// shipping them to a SIEM. It is set with WithEventSink.
+type EventSink interface {
+	//WriteEvent will write the event.
+	WriteEvent(e LoginEvent) error
+}
+
+//EventFormat is how a WriterEventSink writes the events.
+type EventFormat string
+
+const (
+	//EventFormatJSON writes each event as the JSON of LoginEvent.
+	EventFormatJSON EventFormat = "json"
+	//EventFormatECS writes each event as JSON with the fields of the
+	// Elastic Common Schema.
+	EventFormatECS EventFormat = "ecs"
+	//EventFormatCEF writes each event in the ArcSight Common Event Format.
+	EventFormatCEF EventFormat = "cef"
+)
+
+//WriterEventSink is an EventSink writing each event as a line to an
+// io.Writer, like a file or os.Stdout collected by a log shipper.
+type WriterEventSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format EventFormat
+}
+
+//NewWriterEventSink will return a *WriterEventSink writing the events to
+// w in the format.
+func NewWriterEventSink(w io.Writer, format EventFormat) *WriterEventSink {
+	return &WriterEventSink{w: w, format: format}
+}
+
+//WriteEvent will write the event as a line.
+func (s *WriterEventSink) WriteEvent(e LoginEvent) error {
+	var line []byte
+	switch s.format {
+	case EventFormatCEF:
+		line = []byte(cefEvent(e))
+	case EventFormatECS:
+		b, err := json.Marshal(ecsEvent(e))
+		if err != nil {
+			return err
+		}
+		line = b
+	default:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = b
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(line)
+	return err
+}
+
+//severityNumber will return the severity as a number from 0 to 10, as
+// used by CEF and the ECS event.severity.
+func severityNumber(s Severity) int {
+	switch s {
+	case SeverityCritical:
+		return 9
+	case SeverityWarning:
+		return 6
+	default:
+		return 3
+	}
+}
+
+//eventOutcome will return "success" or "failure".
+func eventOutcome(e LoginEvent) string {
+	if e.Success {
+		return "success"
+	}
+	return "failure"
+}
+
+//ecsEvent will return the event with the fields of the Elastic Common Schema.
+func ecsEvent(e LoginEvent) map[string]interface{} {
+	event := map[string]interface{}{
+		"kind":     "event",
+		"category": []string{"authentication"},
+		"type":     []string{"start"},
+		"action":   "login",
+		"outcome":  eventOutcome(e),
+		"severity": severityNumber(e.Severity),
+	}
+	if e.Severity == SeverityCritical {
+		event["kind"] = "alert"
+	}
+	if e.Method == "basic" {
+		event["action"] = "basic-auth"
+	}
+	if e.Method == auditCheckpointMethod {
+		event["action"] = "audit-checkpoint"
+	}
+	if e.Reason != "" {
+		event["reason"] = e.Reason
+	}
+	if e.Hash != "" {
+		event["sequence"] = e.Seq
+		event["hash"] = e.Hash
+	}
+
+	ecs := map[string]interface{}{
+		"@timestamp": e.Time.UTC().Format(time.RFC3339Nano),
+		"ecs":        map[string]string{"version": "8.11"},
+		"event":      event,
+		"log":        map[string]string{"level": string(e.Severity), "logger": "authsession"},
+		"message":    eventMessage(e),
+	}
+	if e.Email != "" {
+		ecs["user"] = map[string]string{"email": e.Email, "name": e.Email}
+	}
+	if e.IP != "" {
+		source := map[string]interface{}{"ip": e.IP}
+		if e.Location != "" {
+			source["geo"] = map[string]string{"name": e.Location}
+		}
+		ecs["source"] = source
+	}
+	if e.RequestID != "" {
+		ecs["http"] = map[string]interface{}{"request": map[string]string{"id": e.RequestID}}
+	}
+	return ecs
+}
+
+//eventMessage will return a short description of the event.
+func eventMessage(e LoginEvent) string {
+	action := "login"
+	if e.Method == "basic" {
+		action = "basic auth"
+	}
+	switch {
+	case e.Method == auditCheckpointMethod:
+		return e.Reason
+	case e.Success:
+		return action + " succeeded"
+	case e.Reason != "":
+		return action + " failed: " + e.Reason
+	default:
+		return action + " failed"
+	}
+}
+
+//cefEvent will return the event as a CEF line.
+func cefEvent(e LoginEvent) string {
+	header := strings.NewReplacer(`\`, `\\`, `|`, `\|`)
+	ext := strings.NewReplacer(`\`, `\\`, `=`, `\=`, "\r", `\r`, "\n", `\n`)
+
+	signature := "login-" + eventOutcome(e)
+	if e.Method == "basic" {
+		signature = "basic-auth-" + eventOutcome(e)
+	}
+	if e.Method == auditCheckpointMethod {
+		signature = "audit-checkpoint"
+	}
+	if e.Severity == SeverityCritical {
+		signature = "security-alert"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "CEF:0|authsession|authsession|1.0|%s|%s|%d|", signature, header.Replace(eventMessage(e)), severityNumber(e.Severity))
+	fmt.Fprintf(&b, "rt=%d outcome=%s", e.Time.UnixMilli(), eventOutcome(e))
+	if e.IP != "" {
+		fmt.Fprintf(&b, " src=%s", ext.Replace(e.IP))
+	}
+	if e.Email != "" {
+		fmt.Fprintf(&b, " suser=%s", ext.Replace(e.Email))
+	}
+	if e.Reason != "" {
+		fmt.Fprintf(&b, " reason=%s", ext.Replace(e.Reason))
+	}
+	if e.RequestID != "" {
+		fmt.Fprintf(&b, " cs1Label=requestID cs1=%s", ext.Replace(e.RequestID))
+	}
+	return b.String()
+}
@@ -0,0 +1,136 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+//sessionPath is where the session endpoints for frontends are served.
+const sessionPath = "/auth/session"
+
+//sessionExpiry will return when the session expires, from the expires
+// value set at login. Sessions from before the value was added don't
+// have it, and false is returned.
+func sessionExpiry(values map[interface{}]interface{}) (time.Time, bool) {
+	exp, ok := values[sessionKeyExpires].(int64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(exp, 0), true
+}
+
+//SessionExpiry will return when the session of the request expires, and
+// false if the request has no valid session.
+func (a *Auth) SessionExpiry(r *http.Request) (time.Time, bool) {
+	session, ok := a.authenticated(r)
+	if !ok {
+		return time.Time{}, false
+	}
+	return sessionExpiry(session.Values)
+}
+
+//ExtendSession will extend the session of the request to expire
+// sessionMaxAge from now, and return the new expiry time.
+func (a *Auth) ExtendSession(w http.ResponseWriter, r *http.Request) (time.Time, error) {
+	session, ok := a.authenticated(r)
+	if !ok {
+		return time.Time{}, errors.New("no valid session")
+	}
+	return a.extendSession(w, r, session)
+}
+
+//extendSession will set the expiry of the session to sessionMaxAge from
+// now, both in the cookie and in the session store.
+func (a *Auth) extendSession(w http.ResponseWriter, r *http.Request, session *sessions.Session) (time.Time, error) {
+	expires := time.Now().Add(sessionMaxAge * time.Second).Truncate(time.Second)
+	session.Values[sessionKeyExpires] = expires.Unix()
+	session.Options.MaxAge = sessionMaxAge
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		return time.Time{}, fmt.Errorf("session.Save failed: %v", err)
+	}
+
+	if a.sessions != nil {
+		sid, _ := session.Values[sessionKeySID].(string)
+		si, ok, err := a.sessions.Get(sid)
+		if err != nil {
+			return time.Time{}, fmt.Errorf("session store Get failed: %v", err)
+		}
+		if ok {
+			si.Expires = expires
+			if err := a.sessions.Add(si); err != nil {
+				return time.Time{}, fmt.Errorf("session store Add failed: %v", err)
+			}
+		}
+	}
+
+	return expires, nil
+}
+
+//SessionStatus is returned by the session endpoints, so frontends can
+// warn the user before the session expires.
+type SessionStatus struct {
+	Authenticated bool      `json:"authenticated"`
+	Expires       time.Time `json:"expires,omitempty"`
+	//ExpiresIn is the number of seconds until the session expires.
+	ExpiresIn int `json:"expiresIn,omitempty"`
+}
+
+//sessionHandler will return the handler for the session endpoints.
+// GET /auth/session returns the SessionStatus, and POST
+// /auth/session/extend extends the session and returns the new status.
+// GET /auth/session/list lists the sessions of the user, and POST
+// /auth/session/name names the session. GET /auth/session/events streams
+// the changes to the session as Server-Sent Events.
+func (a *Auth) sessionHandler() http.Handler {
+	mux := a.newRouteMux()
+	mux.HandleFunc("GET "+sessionPath, a.sessionStatus)
+	mux.HandleFunc("POST "+sessionPath+"/extend", a.sessionExtend)
+	mux.HandleFunc("GET "+sessionPath+"/list", a.sessionList)
+	mux.HandleFunc("POST "+sessionPath+"/name", a.sessionName)
+	mux.HandleFunc("GET "+sessionPath+"/events", a.sessionEvents)
+	return mux
+}
+
+//newSessionStatus will return the status for the session expiring at expires.
+func newSessionStatus(expires time.Time) SessionStatus {
+	return SessionStatus{
+		Authenticated: true,
+		Expires:       expires,
+		ExpiresIn:     int(time.Until(expires).Seconds()),
+	}
+}
+
+func (a *Auth) sessionStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	expires, ok := a.SessionExpiry(r)
+	if !ok {
+		writeJSON(w, http.StatusOK, SessionStatus{})
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionStatus(expires))
+}
+
+func (a *Auth) sessionExtend(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	//Require a JSON content type, which can't be sent by a plain form on
+	// another site, so other sites can't keep a session alive.
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		a.writeJSONMessage(w, r, http.StatusUnsupportedMediaType, "error.json_content_type")
+		return
+	}
+
+	expires, err := a.ExtendSession(w, r)
+	if err != nil {
+		a.writeJSONMessage(w, r, http.StatusUnauthorized, "error.no_session")
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionStatus(expires))
+}
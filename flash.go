@@ -0,0 +1,74 @@
+package authsession
+
+import (
+	"encoding/gob"
+	"fmt"
+	"net/http"
+)
+
+//FlashLevel is the level of a flash message, which can be used to style it.
+type FlashLevel string
+
+const (
+	FlashInfo    FlashLevel = "info"
+	FlashSuccess FlashLevel = "success"
+	FlashWarning FlashLevel = "warning"
+	FlashError   FlashLevel = "error"
+)
+
+//Flash is a message kept in the session until it is shown once, like
+// "You have been logged out".
+type Flash struct {
+	Level   FlashLevel
+	Message string
+}
+
+func init() {
+	//Flashes are stored in the session, which is gob encoded.
+	gob.Register(Flash{})
+}
+
+//AddFlash will add a flash message to the session of the request, to be
+// shown on the next page calling Flashes. It works for users not logged
+// in too.
+func (a *Auth) AddFlash(w http.ResponseWriter, r *http.Request, level FlashLevel, msg string) error {
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in AddFlash: ", err)
+	}
+
+	session.AddFlash(Flash{Level: level, Message: msg})
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("session.Save failed: %v", err)
+	}
+	return nil
+}
+
+//Flashes will return the flash messages of the session of the request,
+// and remove them from the session so they are only shown once. It must
+// be called before anything is written to w, since the cookie is updated.
+func (a *Auth) Flashes(w http.ResponseWriter, r *http.Request) ([]Flash, error) {
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in Flashes: ", err)
+	}
+
+	values := session.Flashes()
+	if len(values) == 0 {
+		return nil, nil
+	}
+
+	var flashes []Flash
+	for _, v := range values {
+		if f, ok := v.(Flash); ok {
+			flashes = append(flashes, f)
+		}
+	}
+
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		return flashes, fmt.Errorf("session.Save failed: %v", err)
+	}
+	return flashes, nil
+}
@@ -0,0 +1,53 @@
+package authsession
+
+import (
+	"html/template"
+	"net/http"
+)
+
+//handoffTemplate is the page posting the fields of a form_post callback
+// from the provider to the callback again, from our own site, so the
+// browser sends the session cookie with it.
+var handoffTemplate = template.Must(template.New("handoff").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Logging in</title></head>
+<body onload="document.forms[0].submit()">
+<form method="POST" action="{{.Action}}">
+{{range $name, $values := .Fields}}{{range $values}}<input type="hidden" name="{{$name}}" value="{{.}}">
+{{end}}{{end}}<input type="hidden" name="handoff" value="1">
+<noscript><button type="submit">Continue</button></noscript>
+</form>
+</body>
+</html>
+`))
+
+//formPostHandoff will write the hand-off page and return true, if the
+// callback is a POST from the provider without the session cookie. The
+// cookie is left out by the browser when the POST comes from the site of
+// the provider, since it is SameSite=Lax by default.
+func (a *Auth) formPostHandoff(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodPost || r.PostFormValue("handoff") != "" {
+		return false
+	}
+	if _, err := r.Cookie("cookie-name"); err == nil {
+		return false
+	}
+
+	fields := make(map[string][]string)
+	for name, values := range r.PostForm {
+		fields[name] = values
+	}
+	data := struct {
+		Action string
+		Fields map[string][]string
+	}{
+		Action: r.URL.Path,
+		Fields: fields,
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := handoffTemplate.Execute(w, data); err != nil {
+		a.logRequestError(r, "error: executing callback hand-off template: ", err)
+	}
+	return true
+}
@@ -0,0 +1,198 @@
+package authsession
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//FunnelStage is a step of the login with a provider, as counted by the
+// login funnel.
+type FunnelStage string
+
+//The stages of the login funnel, in the order a login goes through them.
+const (
+	//FunnelStarted is a login requested at /login.
+	FunnelStarted FunnelStage = "started"
+	//FunnelRedirected is a login redirected to the provider.
+	FunnelRedirected FunnelStage = "redirected"
+	//FunnelCallback is a login back from the provider at the callback.
+	FunnelCallback FunnelStage = "callback"
+	//FunnelSessionCreated is a login done, with the session created.
+	FunnelSessionCreated FunnelStage = "session_created"
+)
+
+//funnelStages are the stages of the login funnel, in order.
+var funnelStages = []FunnelStage{FunnelStarted, FunnelRedirected, FunnelCallback, FunnelSessionCreated}
+
+//The reasons a login is dropped in the funnel. They are fixed codes, and
+// never the error or anything given by the user or the provider, so no
+// personal data ends up in the analytics.
+const (
+	FunnelDropBanned              = "banned"
+	FunnelDropThrottled           = "throttled"
+	FunnelDropLoginClosed         = "login_closed"
+	FunnelDropUnknownProvider     = "unknown_provider"
+	FunnelDropInternalError       = "internal_error"
+	FunnelDropProviderUnavailable = "provider_unavailable"
+	FunnelDropCancelled           = "cancelled"
+	FunnelDropProviderError       = "provider_error"
+	FunnelDropStateInvalid        = "state_invalid"
+	FunnelDropStateExpired        = "state_expired"
+	FunnelDropExchangeFailed      = "exchange_failed"
+	FunnelDropTokenInvalid        = "token_invalid"
+	FunnelDropUserInfoFailed      = "userinfo_failed"
+	FunnelDropInsufficientScope   = "insufficient_scope"
+	FunnelDropEmailNotVerified    = "email_not_verified"
+	FunnelDropNotAllowed          = "not_allowed"
+	FunnelDropPostLoginRefused    = "post_login_refused"
+	FunnelDropTooManySessions     = "too_many_sessions"
+	FunnelDropRiskDenied          = "risk_denied"
+)
+
+//FunnelEvent is a login reaching a stage of the funnel, or dropped at it,
+// given to the Observer of LoginFunnelConfig. It has no personal data, like
+// the user, the IP or the user agent, so it can be sent to a product
+// analytics service.
+type FunnelEvent struct {
+	//Time is when the stage was reached, truncated to the minute, so the
+	// event can't be matched with the request logs by the time.
+	Time  time.Time   `json:"time"`
+	Stage FunnelStage `json:"stage"`
+	//Provider is the ID of the provider, empty for the default provider.
+	Provider string `json:"provider,omitempty"`
+	//Flow is the same for all the stages of one login, so the stages can
+	// be joined. It is a keyed hash of the state, with a key only kept in
+	// memory, so it can't be linked to the login in the logs. It is empty
+	// before the login has a state.
+	Flow string `json:"flow,omitempty"`
+	//DropReason is why the login ended at the stage, one of the
+	// FunnelDrop codes, or empty if the login went on.
+	DropReason string `json:"dropReason,omitempty"`
+}
+
+//LoginFunnelConfig is how the login funnel is observed, set with
+// WithLoginFunnel.
+type LoginFunnelConfig struct {
+	//Observer is called with every event of the funnel, like to send it
+	// to a product analytics service. It must not block.
+	Observer func(e FunnelEvent)
+}
+
+//FunnelStageStats are the counts of the logins reaching a stage of the
+// funnel, and of those ending at it, by the drop reason.
+type FunnelStageStats struct {
+	Stage   FunnelStage      `json:"stage"`
+	Reached int64            `json:"reached"`
+	Dropped map[string]int64 `json:"dropped,omitempty"`
+}
+
+//loginFunnel keeps the counts of the login funnel.
+type loginFunnel struct {
+	conf LoginFunnelConfig
+
+	keyOnce sync.Once
+	key     []byte
+
+	mu      sync.Mutex
+	reached map[FunnelStage]int64
+	dropped map[FunnelStage]map[string]int64
+}
+
+//flow will return the flow ID of the login with the state, or "" if no
+// state is given.
+func (f *loginFunnel) flow(state string) string {
+	if state == "" {
+		return ""
+	}
+	f.keyOnce.Do(func() {
+		f.key = make([]byte, 32)
+		if _, err := rand.Read(f.key); err != nil {
+			f.key = nil
+		}
+	})
+	if f.key == nil {
+		return ""
+	}
+	mac := hmac.New(sha256.New, f.key)
+	mac.Write([]byte(state))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+//record will count the login with the state and the provider reaching the
+// stage, or ending at it if reason is given, and give it to the observer.
+// A login dropped is recorded twice, when reaching the stage and when
+// dropped.
+func (f *loginFunnel) record(stage FunnelStage, provider string, state string, reason string) {
+	f.mu.Lock()
+	if f.reached == nil {
+		f.reached = make(map[FunnelStage]int64)
+		f.dropped = make(map[FunnelStage]map[string]int64)
+	}
+	if reason == "" {
+		f.reached[stage]++
+	} else {
+		if f.dropped[stage] == nil {
+			f.dropped[stage] = make(map[string]int64)
+		}
+		f.dropped[stage][reason]++
+	}
+	f.mu.Unlock()
+
+	if f.conf.Observer != nil {
+		f.conf.Observer(FunnelEvent{
+			Time:       time.Now().UTC().Truncate(time.Minute),
+			Stage:      stage,
+			Provider:   provider,
+			Flow:       f.flow(state),
+			DropReason: reason,
+		})
+	}
+}
+
+//funnelStep will count the login reaching the stage.
+func (a *Auth) funnelStep(stage FunnelStage, provider string, state string) {
+	a.funnel.record(stage, provider, state, "")
+}
+
+//funnelDrop will count the login ending at the stage for the reason. The
+// stage must be counted as reached first.
+func (a *Auth) funnelDrop(stage FunnelStage, provider string, state string, reason string) {
+	a.funnel.record(stage, provider, state, reason)
+}
+
+//funnelProvider will return the provider of the login in the callback
+// request, as remembered in the session by /login.
+func (a *Auth) funnelProvider(r *http.Request) string {
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		return ""
+	}
+	provider, _ := session.Values[sessionKeyProvider].(string)
+	return provider
+}
+
+//LoginFunnelStats will return the counts of the login funnel since
+// started, for every stage in order. The page to choose the provider is
+// not counted, only the login with the provider chosen.
+func (a *Auth) LoginFunnelStats() []FunnelStageStats {
+	a.funnel.mu.Lock()
+	defer a.funnel.mu.Unlock()
+
+	stats := make([]FunnelStageStats, 0, len(funnelStages))
+	for _, s := range funnelStages {
+		st := FunnelStageStats{Stage: s, Reached: a.funnel.reached[s]}
+		if len(a.funnel.dropped[s]) > 0 {
+			st.Dropped = make(map[string]int64, len(a.funnel.dropped[s]))
+			for reason, n := range a.funnel.dropped[s] {
+				st.Dropped[reason] = n
+			}
+		}
+		stats = append(stats, st)
+	}
+	return stats
+}
@@ -0,0 +1,206 @@
+package authsession
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+//GeoLocation is where an IP address is, as found by a GeoIPResolver.
+type GeoLocation struct {
+	//Country is the ISO 3166-1 code of the country, like "NO".
+	Country string
+	City    string
+	//ASN is the number of the autonomous system the IP belongs to, and
+	// ASOrg is the organization of it, like the ISP or the cloud.
+	ASN   uint
+	ASOrg string
+	//Latitude and Longitude are the approximate coordinates of the IP,
+	// used to find travel too fast between two logins.
+	Latitude  float64
+	Longitude float64
+}
+
+//String will return the location as shown in the sessions and the
+// events, like "Oslo, NO".
+func (g GeoLocation) String() string {
+	switch {
+	case g.City != "" && g.Country != "":
+		return g.City + ", " + g.Country
+	case g.Country != "":
+		return g.Country
+	default:
+		return g.City
+	}
+}
+
+//known will return true if anything was found for the IP.
+func (g GeoLocation) known() bool {
+	return g.Country != "" || g.ASN != 0
+}
+
+//GeoIPResolver finds the location of IP addresses, like from a MaxMind
+// database with NewMaxMindResolver.
+type GeoIPResolver interface {
+	//Lookup will return the location of the ip. The zero GeoLocation is
+	// returned for addresses not found.
+	Lookup(ip net.IP) (GeoLocation, error)
+}
+
+//MaxMindReader is the Lookup of a *maxminddb.Reader from
+// github.com/oschwald/maxminddb-golang, reading a GeoIP2 or GeoLite2
+// database.
+type MaxMindReader interface {
+	Lookup(ip net.IP, result interface{}) error
+}
+
+//maxMindRecord is the fields read from the MaxMind City, Country and ASN
+// databases.
+type maxMindRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	City struct {
+		Names map[string]string `maxminddb:"names"`
+	} `maxminddb:"city"`
+	Location struct {
+		Latitude  float64 `maxminddb:"latitude"`
+		Longitude float64 `maxminddb:"longitude"`
+	} `maxminddb:"location"`
+	ASN   uint   `maxminddb:"autonomous_system_number"`
+	ASOrg string `maxminddb:"autonomous_system_organization"`
+}
+
+//maxMindResolver is a GeoIPResolver reading MaxMind databases.
+type maxMindResolver struct {
+	readers []MaxMindReader
+}
+
+//NewMaxMindResolver will return a GeoIPResolver reading the MaxMind
+// databases, like a City database and an ASN database, where the fields
+// found are combined.
+func NewMaxMindResolver(readers ...MaxMindReader) GeoIPResolver {
+	return &maxMindResolver{readers: readers}
+}
+
+//Lookup will return the location of the ip.
+func (m *maxMindResolver) Lookup(ip net.IP) (GeoLocation, error) {
+	var g GeoLocation
+	for _, r := range m.readers {
+		var rec maxMindRecord
+		if err := r.Lookup(ip, &rec); err != nil {
+			return GeoLocation{}, fmt.Errorf("maxmind lookup of %v failed: %v", ip, err)
+		}
+		if g.Country == "" {
+			g.Country = rec.Country.ISOCode
+		}
+		if g.City == "" {
+			g.City = rec.City.Names["en"]
+		}
+		if g.ASN == 0 {
+			g.ASN, g.ASOrg = rec.ASN, rec.ASOrg
+		}
+		if g.Latitude == 0 && g.Longitude == 0 {
+			g.Latitude, g.Longitude = rec.Location.Latitude, rec.Location.Longitude
+		}
+	}
+	return g, nil
+}
+
+//GeoPolicy is the countries and autonomous systems users can log in and
+// use their sessions from. It is set with WithGeoIP.
+type GeoPolicy struct {
+	//AllowCountries are the countries allowed, like "NO", and no
+	// countries allows all the countries not denied.
+	AllowCountries []string
+	DenyCountries  []string
+	//AllowASNs are the autonomous systems allowed, and no ASNs allows all
+	// the ASNs not denied.
+	AllowASNs []uint
+	DenyASNs  []uint
+	//AllowUnknown allows the IP addresses not found in the database, like
+	// private addresses, when there are countries or ASNs to allow.
+	AllowUnknown bool
+	//PerRequest checks the policy for every request to IsAuthenticated,
+	// and not only at login.
+	PerRequest bool
+}
+
+//check will return an empty string if the location is allowed by the
+// policy, or the reason it is not.
+func (p GeoPolicy) check(g GeoLocation) string {
+	if !g.known() {
+		if !p.AllowUnknown && (len(p.AllowCountries) > 0 || len(p.AllowASNs) > 0) {
+			return "location unknown"
+		}
+		return ""
+	}
+
+	hasCountry := func(list []string) bool {
+		for _, c := range list {
+			if strings.EqualFold(c, g.Country) {
+				return true
+			}
+		}
+		return false
+	}
+	hasASN := func(list []uint) bool {
+		for _, n := range list {
+			if n == g.ASN {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case g.Country != "" && hasCountry(p.DenyCountries):
+		return "country " + g.Country + " is denied"
+	case g.ASN != 0 && hasASN(p.DenyASNs):
+		return fmt.Sprintf("ASN %v is denied", g.ASN)
+	case len(p.AllowCountries) > 0 && !hasCountry(p.AllowCountries):
+		return "country " + g.Country + " is not allowed"
+	case len(p.AllowASNs) > 0 && !hasASN(p.AllowASNs):
+		return fmt.Sprintf("ASN %v is not allowed", g.ASN)
+	}
+	return ""
+}
+
+//geoIP is the resolver and the policy set with WithGeoIP.
+type geoIP struct {
+	resolver GeoIPResolver
+	policy   GeoPolicy
+}
+
+//geoLocation will return the location of the ip, and the zero location
+// if GeoIP is not used or the ip is not found.
+func (a *Auth) geoLocation(ip string) GeoLocation {
+	if a.geoIP == nil {
+		return GeoLocation{}
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return GeoLocation{}
+	}
+	g, err := a.geoIP.resolver.Lookup(parsed)
+	if err != nil {
+		a.logError("error: geoip: ", err)
+		return GeoLocation{}
+	}
+	return g
+}
+
+//geoAllowed will return true if the location of the client of the
+// request is allowed by the GeoIP policy, and the location.
+func (a *Auth) geoAllowed(r *http.Request) (bool, GeoLocation) {
+	if a.geoIP == nil {
+		return true, GeoLocation{}
+	}
+	g := a.geoLocation(a.clientIP(r))
+	if reason := a.geoIP.policy.check(g); reason != "" {
+		logRequestf(r, "info: geoip: refused %v: %v\n", a.clientIP(r), reason)
+		return false, g
+	}
+	return true, g
+}
@@ -0,0 +1,235 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//defaultGroupSyncInterval is how often the groups of the active users
+// are resolved again, if not set in the GroupSyncConfig.
+const defaultGroupSyncInterval = 15 * time.Minute
+
+//GroupResolver gives the groups a user is a member of in an external
+// directory.
+type GroupResolver interface {
+	//Groups will return the ids of the groups the user with the email is
+	// a member of.
+	Groups(ctx context.Context, email string) ([]string, error)
+}
+
+//GroupSyncConfig is how the group membership of the active users is kept
+// in sync with an external directory.
+type GroupSyncConfig struct {
+	//Resolver gives the groups of the users.
+	Resolver GroupResolver
+	//Interval is how often the groups are resolved again. The default is
+	// 15 minutes.
+	Interval time.Duration
+}
+
+//groupSync keeps the groups last resolved for the users with an active
+// session, so a change in the membership can be found.
+type groupSync struct {
+	resolver GroupResolver
+
+	mu    sync.Mutex
+	known map[string]string
+}
+
+//groupKey will return the groups sorted and joined, to compare them.
+func groupKey(groups []string) string {
+	g := append([]string{}, groups...)
+	sort.Strings(g)
+	return strings.Join(g, "\n")
+}
+
+//remember will resolve and keep the groups of the user at login, so a
+// change after the login is found by the next sync.
+func (g *groupSync) remember(ctx context.Context, email string) error {
+	groups, err := g.resolver.Groups(ctx, email)
+	if err != nil {
+		return err
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.known[email] = groupKey(groups)
+	return nil
+}
+
+//syncGroups will resolve the groups of the users with an active session
+// again, and revoke the sessions of the users where the groups have
+// changed, so they have to log in again with their new membership.
+func (a *Auth) syncGroups(ctx context.Context) error {
+	if a.sessions == nil {
+		return errors.New("the group sync needs a session store, see WithSessionStore")
+	}
+	list, err := a.sessions.List()
+	if err != nil {
+		return fmt.Errorf("session store List failed: %v", err)
+	}
+
+	active := make(map[string]bool)
+	for _, s := range list {
+		active[s.Email] = true
+	}
+
+	g := a.groupSync
+	g.mu.Lock()
+	for email := range g.known {
+		if !active[email] {
+			delete(g.known, email)
+		}
+	}
+	g.mu.Unlock()
+
+	for email := range active {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		groups, err := g.resolver.Groups(ctx, email)
+		if err != nil {
+			a.logError("error: group sync: resolving the groups of "+a.LogIdentifier(email)+" failed: ", err)
+			continue
+		}
+
+		key := groupKey(groups)
+		g.mu.Lock()
+		previous, ok := g.known[email]
+		g.known[email] = key
+		g.mu.Unlock()
+
+		if ok && previous != key {
+			log.Printf("info: group sync: the groups of %v have changed, revoking the sessions\n", a.LogIdentifier(email))
+			if err := a.revokeUserSessions(email, "groups_changed"); err != nil {
+				a.logError("error: group sync: revoking the sessions of "+a.LogIdentifier(email)+" failed: ", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+//GoogleGroupsResolver is a GroupResolver for Google Groups, using the
+// Directory API of Google Workspace. The ids of the groups are the emails
+// of the groups.
+type GoogleGroupsResolver struct {
+	client  *http.Client
+	baseURL string
+}
+
+//NewGoogleGroupsResolver will return a *GoogleGroupsResolver doing the
+// requests with tokens from ts, which must have the
+// admin.directory.group.readonly scope, like a service account with
+// domain wide delegation.
+func NewGoogleGroupsResolver(ts oauth2.TokenSource) *GoogleGroupsResolver {
+	return &GoogleGroupsResolver{
+		client:  oauth2.NewClient(context.Background(), ts),
+		baseURL: "https://admin.googleapis.com/admin/directory/v1/groups",
+	}
+}
+
+//Groups will return the emails of the groups of the user.
+func (g *GoogleGroupsResolver) Groups(ctx context.Context, email string) ([]string, error) {
+	var groups []string
+	pageToken := ""
+	for {
+		q := url.Values{"userKey": {email}}
+		if pageToken != "" {
+			q.Set("pageToken", pageToken)
+		}
+
+		var page struct {
+			Groups []struct {
+				Email string `json:"email"`
+			} `json:"groups"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		if err := getDirectoryJSON(ctx, g.client, g.baseURL+"?"+q.Encode(), &page); err != nil {
+			return nil, err
+		}
+		for _, gr := range page.Groups {
+			groups = append(groups, gr.Email)
+		}
+
+		if page.NextPageToken == "" {
+			return groups, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+//AzureADGroupsResolver is a GroupResolver for Azure AD, using Microsoft
+// Graph. The ids of the groups are the object ids of the groups, and
+// groups the user is a member of through other groups are included.
+type AzureADGroupsResolver struct {
+	client  *http.Client
+	baseURL string
+}
+
+//NewAzureADGroupsResolver will return a *AzureADGroupsResolver doing the
+// requests with tokens from ts, which must have the GroupMember.Read.All
+// permission, like the client credentials of an app registration.
+func NewAzureADGroupsResolver(ts oauth2.TokenSource) *AzureADGroupsResolver {
+	return &AzureADGroupsResolver{
+		client:  oauth2.NewClient(context.Background(), ts),
+		baseURL: "https://graph.microsoft.com/v1.0",
+	}
+}
+
+//Groups will return the object ids of the groups of the user.
+func (g *AzureADGroupsResolver) Groups(ctx context.Context, email string) ([]string, error) {
+	var groups []string
+	next := g.baseURL + "/users/" + url.PathEscape(email) + "/transitiveMemberOf/microsoft.graph.group?$select=id"
+	for next != "" {
+		var page struct {
+			Value []struct {
+				ID string `json:"id"`
+			} `json:"value"`
+			NextLink string `json:"@odata.nextLink"`
+		}
+		if err := getDirectoryJSON(ctx, g.client, next, &page); err != nil {
+			return nil, err
+		}
+		for _, gr := range page.Value {
+			groups = append(groups, gr.ID)
+		}
+		next = page.NextLink
+	}
+	return groups, nil
+}
+
+//getDirectoryJSON will do a GET request to the directory, and decode the
+// JSON response into v.
+func getDirectoryJSON(ctx context.Context, client *http.Client, u string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("directory request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("directory request failed: %v", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed parsing directory response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package authsession
+
+import (
+	"hash/crc32"
+	"slices"
+	"sort"
+	"strconv"
+)
+
+//hashRingPoints is the number of points of each node on a hash ring, so
+// the keys are spread evenly.
+const hashRingPoints = 160
+
+//hashRing spreads keys over a set of nodes with consistent hashing, so
+// adding or removing a node only moves the keys of that node. The nodes
+// are given by their index in the names the ring was made from.
+type hashRing struct {
+	points []hashRingPoint
+	nodes  int
+}
+
+//hashRingPoint is a point of a node on the ring.
+type hashRingPoint struct {
+	hash uint32
+	node int
+}
+
+//newHashRing will return a *hashRing with the nodes named names. The
+// names must be unique and stay the same, since the points of a node are
+// made from its name.
+func newHashRing(names []string) *hashRing {
+	h := &hashRing{nodes: len(names)}
+	for node, name := range names {
+		for i := 0; i < hashRingPoints; i++ {
+			h.points = append(h.points, hashRingPoint{
+				hash: crc32.ChecksumIEEE([]byte(name + "-" + strconv.Itoa(i))),
+				node: node,
+			})
+		}
+	}
+	sort.Slice(h.points, func(i, j int) bool { return h.points[i].hash < h.points[j].hash })
+	return h
+}
+
+//lookup will return the indexes of the n nodes keeping the key, which are
+// the first distinct nodes of the points on the ring at or after the hash
+// of the key. Fewer nodes are returned if the ring has fewer than n.
+func (h *hashRing) lookup(key string, n int) []int {
+	if n > h.nodes {
+		n = h.nodes
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	hash := crc32.ChecksumIEEE([]byte(key))
+	start := sort.Search(len(h.points), func(i int) bool { return h.points[i].hash >= hash })
+	nodes := make([]int, 0, n)
+	for i := 0; i < len(h.points) && len(nodes) < n; i++ {
+		p := h.points[(start+i)%len(h.points)]
+		if !slices.Contains(nodes, p.node) {
+			nodes = append(nodes, p.node)
+		}
+	}
+	return nodes
+}
+
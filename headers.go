@@ -0,0 +1,64 @@
+package authsession
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//SecurityHeaderConfig is the security headers set by SecurityHeaders.
+type SecurityHeaderConfig struct {
+	//HSTSMaxAge is the max-age of the Strict-Transport-Security header.
+	// The default is 180 days, and a negative value leaves out the header.
+	HSTSMaxAge time.Duration
+	//HSTSIncludeSubdomains adds includeSubDomains to the HSTS header.
+	HSTSIncludeSubdomains bool
+	//HSTSPreload adds preload to the HSTS header.
+	HSTSPreload bool
+	//ReferrerPolicy is the Referrer-Policy header. The default is
+	// no-referrer, so codes and tokens in the URLs are not leaked.
+	ReferrerPolicy string
+}
+
+//defaultHSTSMaxAge is the max-age of the HSTS header if not set.
+const defaultHSTSMaxAge = 180 * 24 * time.Hour
+
+//SecurityHeaders will return a handler setting the security headers
+// before calling h. The headers are Strict-Transport-Security,
+// Cache-Control: no-store, Referrer-Policy and X-Content-Type-Options,
+// from the config given with WithSecurityHeaders, or the defaults. The
+// handlers of the package use it when WithSecurityHeaders is set.
+func (a *Auth) SecurityHeaders(h http.Handler) http.Handler {
+	c := SecurityHeaderConfig{}
+	if a.securityHeaders != nil {
+		c = *a.securityHeaders
+	}
+	if c.HSTSMaxAge == 0 {
+		c.HSTSMaxAge = defaultHSTSMaxAge
+	}
+	if c.ReferrerPolicy == "" {
+		c.ReferrerPolicy = "no-referrer"
+	}
+
+	hsts := ""
+	if c.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.FormatInt(int64(c.HSTSMaxAge/time.Second), 10)
+		if c.HSTSIncludeSubdomains {
+			hsts += "; includeSubDomains"
+		}
+		if c.HSTSPreload {
+			hsts += "; preload"
+		}
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if hsts != "" {
+			w.Header().Set("Strict-Transport-Security", hsts)
+		}
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+		w.Header().Set("Referrer-Policy", c.ReferrerPolicy)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,99 @@
+package authsession
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//loginStart is the response of a headless login started with a POST to
+// /slogin.
+type loginStart struct {
+	//AuthURL is the url of the provider to send the user to.
+	AuthURL string `json:"auth_url"`
+	//StateExpiry is when the login must be done by, with the callback.
+	StateExpiry time.Time `json:"state_expiry"`
+}
+
+//loginJSON will start a login like /slogin, but return the url of the
+// provider as JSON instead of redirecting to it, so mobile apps and
+// single-page apps can send the user there themselves. The state is
+// still made and kept by the server, in the session cookie set in the
+// response. The body can give the provider and a
+// signed return_to, like {"provider": "github", "return_to": "..."}.
+func (a *Auth) loginJSON(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	//Require a JSON content type, which can't be sent by a plain form on
+	// another site.
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		a.writeJSONMessage(w, r, http.StatusUnsupportedMediaType, "error.json_content_type")
+		return
+	}
+
+	var body struct {
+		Provider string `json:"provider"`
+		ReturnTo string `json:"return_to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		a.writeJSONMessage(w, r, http.StatusBadRequest, "error.bad_request")
+		return
+	}
+
+	if wait := a.loginWait(r, ""); wait > 0 {
+		a.writeThrottled(w, r, wait)
+		return
+	}
+	if closed, msgKey, until := a.loginClosed(body.Provider, time.Now()); closed {
+		setRetryAfter(w, until)
+		a.writeJSONMessage(w, r, http.StatusServiceUnavailable, msgKey)
+		return
+	}
+	oauthConfig, err := a.providerOauthConfig(r, body.Provider)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+		a.writeJSONMessage(w, r, http.StatusNotFound, "error.provider_not_found")
+		return
+	}
+
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in /login: ", err)
+	}
+	session.Values[sessionKeyProvider] = body.Provider
+	delete(session.Values, "popup")
+	if body.ReturnTo != "" {
+		p, ok := a.VerifyReturnTo(body.ReturnTo)
+		if !ok {
+			a.logRequestError(r, "error: return_to not valid or expired")
+			a.writeJSONMessage(w, r, http.StatusBadRequest, "error.bad_request")
+			return
+		}
+		session.Values["returnto"] = p
+	}
+
+	state, err := a.newState(r, session)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+		a.writeJSONMessage(w, r, http.StatusInternalServerError, "error.internal")
+		return
+	}
+
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		a.logRequestError(r, "error: session.Save in /login: ", err)
+		a.writeJSONMessage(w, r, http.StatusInternalServerError, "error.internal")
+		return
+	}
+
+	authURL, err := a.authCodeURL(r.Context(), body.Provider, oauthConfig, state)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+		a.writeJSONMessage(w, r, http.StatusBadGateway, "login_failed.provider")
+		return
+	}
+	writeJSON(w, http.StatusOK, loginStart{AuthURL: authURL, StateExpiry: time.Now().Add(a.stateTTL).UTC().Truncate(time.Second)})
+}
@@ -0,0 +1,227 @@
+package authsession
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+//defaultHoneypotPaths are the decoy paths used when none are given, which
+// are the login pages scanners probe for.
+var defaultHoneypotPaths = []string{
+	"/wp-login.php",
+	"/xmlrpc.php",
+	"/admin/login",
+	"/administrator/index.php",
+	"/phpmyadmin/",
+	"/.env",
+}
+
+//honeypotWindow is how long the hits of an IP are counted.
+const honeypotWindow = time.Hour
+
+//honeypotPage is the decoy login form served, so a scanner keeps going at
+// the decoy and not at the real login.
+const honeypotPage = `<!DOCTYPE html>
+<html><head><title>Log In</title></head>
+<body><form method="post"><input name="log"><input type="password" name="pwd"><input type="submit" value="Log In"></form></body></html>
+`
+
+//HoneypotConfig is the decoy login endpoints, set with WithHoneypot.
+// Clients probing them are held in a tarpit, and banned in the ban store
+// set with WithBanStore, so they are refused by the real login. Only the
+// hits which can't be made by the browser of a visitor, like from an
+// image on another site, are counted for the ban, which are the requests
+// not from a browser, and the POSTs from a browser which are not cross
+// site. Behind a reverse proxy, the proxy must be set with
+// WithTrustedProxies, or no IPs are banned.
+type HoneypotConfig struct {
+	//Paths are the decoy paths, like "/wp-login.php", served by the mux
+	// given to Register. They must not be used by the app. The default is
+	// a list of login pages commonly probed by scanners.
+	Paths []string
+	//BanAfter is the number of hits counted from an IP within an hour
+	// before it is banned, which defaults to 5.
+	BanAfter int
+	//BanDuration is how long an IP is banned, which defaults to 24 hours.
+	BanDuration time.Duration
+	//TarpitDelay is how long the response to a hit is held back, so the
+	// scanner is slowed down, which defaults to 10 seconds.
+	TarpitDelay time.Duration
+	//MaxTarpits is the number of responses held back at the same time,
+	// which defaults to 100. Hits above it are answered at once, so the
+	// tarpit can't be used to tie up the server.
+	MaxTarpits int
+}
+
+//HoneypotStats are the counts of the honeypot.
+type HoneypotStats struct {
+	//Hits is the number of requests to the decoy paths.
+	Hits int64 `json:"hits"`
+	//Bans is the number of IPs banned.
+	Bans int64 `json:"bans"`
+	//Tarpitted is the number of responses held back.
+	Tarpitted int64 `json:"tarpitted"`
+	//Tracked is the number of IPs with hits within the last hour.
+	Tracked int `json:"tracked"`
+}
+
+//honeypot keeps the hits of the IPs probing the decoy paths.
+type honeypot struct {
+	conf   HoneypotConfig
+	tarpit chan struct{}
+
+	hits      atomic.Int64
+	bans      atomic.Int64
+	tarpitted atomic.Int64
+
+	mu  sync.Mutex
+	ips map[string][]time.Time
+}
+
+//newHoneypot will return a *honeypot for the conf, with the defaults set.
+func newHoneypot(conf HoneypotConfig) *honeypot {
+	if len(conf.Paths) == 0 {
+		conf.Paths = defaultHoneypotPaths
+	}
+	if conf.BanAfter <= 0 {
+		conf.BanAfter = 5
+	}
+	if conf.BanDuration <= 0 {
+		conf.BanDuration = 24 * time.Hour
+	}
+	if conf.TarpitDelay <= 0 {
+		conf.TarpitDelay = 10 * time.Second
+	}
+	if conf.MaxTarpits <= 0 {
+		conf.MaxTarpits = 100
+	}
+	return &honeypot{
+		conf:   conf,
+		tarpit: make(chan struct{}, conf.MaxTarpits),
+		ips:    map[string][]time.Time{},
+	}
+}
+
+//hit will count a hit from the ip, and return the number of hits within
+// the window.
+func (h *honeypot) hit(now time.Time, ip string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var recent []time.Time
+	for _, t := range h.ips[ip] {
+		if now.Sub(t) < honeypotWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	h.ips[ip] = recent
+	return len(recent)
+}
+
+//cleanup will remove the IPs with no hits within the window, and return
+// the number removed.
+func (h *honeypot) cleanup(now time.Time) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var n int
+	for ip, hits := range h.ips {
+		if len(hits) == 0 || now.Sub(hits[len(hits)-1]) >= honeypotWindow {
+			delete(h.ips, ip)
+			n++
+		}
+	}
+	return n
+}
+
+//wait will hold the response back for the TarpitDelay, unless too many
+// responses are already held back, or the client goes away.
+func (h *honeypot) wait(r *http.Request) {
+	select {
+	case h.tarpit <- struct{}{}:
+	default:
+		return
+	}
+	defer func() { <-h.tarpit }()
+
+	h.tarpitted.Add(1)
+	t := time.NewTimer(h.conf.TarpitDelay)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-r.Context().Done():
+	}
+}
+
+//HoneypotStats will return the counts of the honeypot set with
+// WithHoneypot, like to export metrics.
+func (a *Auth) HoneypotStats() HoneypotStats {
+	if a.honeypot == nil {
+		return HoneypotStats{}
+	}
+	a.honeypot.mu.Lock()
+	tracked := len(a.honeypot.ips)
+	a.honeypot.mu.Unlock()
+	return HoneypotStats{
+		Hits:      a.honeypot.hits.Load(),
+		Bans:      a.honeypot.bans.Load(),
+		Tarpitted: a.honeypot.tarpitted.Load(),
+		Tracked:   tracked,
+	}
+}
+
+//honeypotCounted will return true if the hit is counted for a ban. The
+// browsers send Sec-Fetch-Site, and only their POSTs which are not from
+// another site are counted, so a page can't get its visitors banned by
+// making their browsers request the decoy paths.
+func honeypotCounted(r *http.Request) bool {
+	site := r.Header.Get("Sec-Fetch-Site")
+	if site == "" {
+		return true
+	}
+	return r.Method == http.MethodPost && (site == "same-origin" || site == "none")
+}
+
+//honeypotHandler will serve the decoy paths. The IP is banned when it has
+// hit them BanAfter times, and the response is held back before a decoy
+// login form is given, or the login is refused for a POST. Clients which
+// are not trusted proxies are counted by the IP they connect from, so a
+// forwarded header can't keep them from being banned. Hits are only not
+// counted when a trusted proxy doesn't tell the client.
+func (a *Auth) honeypotHandler(w http.ResponseWriter, r *http.Request) {
+	a.honeypot.hits.Add(1)
+	ip, resolved := a.resolveClientIP(r)
+	var n int
+	if resolved && honeypotCounted(r) {
+		n = a.honeypot.hit(time.Now(), ip)
+	}
+	logRequestf(r, "info: honeypot: %v %v from %v, hit %d\n", r.Method, r.URL.Path, ip, n)
+
+	if n == a.honeypot.conf.BanAfter && a.bans != nil {
+		now := time.Now()
+		err := a.bans.Ban(Ban{
+			IP:      ip,
+			Reason:  fmt.Sprintf("honeypot: probed %v", r.URL.Path),
+			Created: now,
+			Expires: now.Add(a.honeypot.conf.BanDuration),
+		})
+		if err != nil {
+			a.logRequestError(r, "error: honeypot: ban store Ban failed: ", err)
+		} else {
+			a.honeypot.bans.Add(1)
+			logRequestf(r, "info: honeypot: banned %v\n", ip)
+		}
+	}
+
+	a.honeypot.wait(r)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if r.Method == http.MethodPost {
+		w.WriteHeader(http.StatusUnauthorized)
+	}
+	fmt.Fprint(w, honeypotPage)
+}
@@ -0,0 +1,90 @@
+package authsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHoneypotBans(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     map[string]string
+		banned     string
+		notBanned  string
+	}{
+		{"direct client", "8.8.8.8", nil, "8.8.8.8", ""},
+		{"direct client with a forged header", "7.7.7.7", map[string]string{"X-Forwarded-For": "1.2.3.4"}, "7.7.7.7", "1.2.3.4"},
+		{"direct client with a forged Forwarded header", "7.7.7.8", map[string]string{"Forwarded": "for=1.2.3.4"}, "7.7.7.8", "1.2.3.4"},
+		{"trusted proxy", "10.1.1.1", map[string]string{"X-Forwarded-For": "6.6.6.6, 192.168.1.1"}, "6.6.6.6", "10.1.1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bans := NewFileBanStore("")
+			a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret", WithBanStore(bans),
+				WithTrustedProxies("10.0.0.0/8", "192.168.1.1"), WithHoneypot(HoneypotConfig{TarpitDelay: time.Millisecond}))
+			mux := http.NewServeMux()
+			a.register(mux)
+
+			for i := 0; i < a.honeypot.conf.BanAfter; i++ {
+				if ok, _ := bans.IsBanned(tt.banned); ok {
+					t.Fatalf("banned after %v hits", i)
+				}
+				r := httptest.NewRequest("GET", "/wp-login.php", nil)
+				r.RemoteAddr = tt.remoteAddr + ":1234"
+				for k, v := range tt.header {
+					r.Header.Set(k, v)
+				}
+				mux.ServeHTTP(httptest.NewRecorder(), r)
+			}
+
+			if ok, _ := bans.IsBanned(tt.banned); !ok {
+				t.Fatalf("%v was not banned", tt.banned)
+			}
+			if ok, _ := bans.IsBanned(tt.notBanned); tt.notBanned != "" && ok {
+				t.Fatalf("%v was banned", tt.notBanned)
+			}
+			if s := a.HoneypotStats(); s.Hits != int64(a.honeypot.conf.BanAfter) || s.Bans != 1 {
+				t.Fatalf("got stats %+v", s)
+			}
+		})
+	}
+}
+
+func TestHoneypotNotCounted(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		remoteAddr string
+		header     map[string]string
+	}{
+		{"cross site image", "GET", "8.8.8.8", map[string]string{"Sec-Fetch-Site": "cross-site", "Sec-Fetch-Dest": "image"}},
+		{"cross site form", "POST", "8.8.8.8", map[string]string{"Sec-Fetch-Site": "cross-site"}},
+		{"browser navigation", "GET", "8.8.8.8", map[string]string{"Sec-Fetch-Site": "none"}},
+		{"unknown client of a trusted proxy", "GET", "10.1.1.1", map[string]string{"X-Forwarded-For": "10.2.2.2"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bans := NewFileBanStore("")
+			a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret", WithBanStore(bans),
+				WithTrustedProxies("10.0.0.0/8"), WithHoneypot(HoneypotConfig{TarpitDelay: time.Millisecond}))
+			mux := http.NewServeMux()
+			a.register(mux)
+
+			for i := 0; i < 2*a.honeypot.conf.BanAfter; i++ {
+				r := httptest.NewRequest(tt.method, "/wp-login.php", nil)
+				r.RemoteAddr = tt.remoteAddr + ":1234"
+				for k, v := range tt.header {
+					r.Header.Set(k, v)
+				}
+				mux.ServeHTTP(httptest.NewRecorder(), r)
+			}
+
+			if list, _ := bans.List(); len(list) != 0 {
+				t.Fatalf("got bans %+v", list)
+			}
+		})
+	}
+}
@@ -0,0 +1,189 @@
+package authsession
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//defaultLanguage is the language of the built-in messages.
+const defaultLanguage = "en"
+
+//MessageCatalog gives the messages shown to users, on the built-in pages
+// and in the JSON error bodies, in other languages than English.
+type MessageCatalog interface {
+	//Languages will return the languages of the catalog, as BCP 47 tags
+	// like "nb" or "pt-BR".
+	Languages() []string
+	//Message will return the message with the key in the language, and
+	// false if the catalog has no such message.
+	Message(lang string, key string) (string, bool)
+}
+
+//MapCatalog is a MessageCatalog keeping the messages in a map, keyed by
+// the language and then the message key.
+type MapCatalog map[string]map[string]string
+
+//Languages will return the languages of the catalog.
+func (m MapCatalog) Languages() []string {
+	var langs []string
+	for l := range m {
+		langs = append(langs, l)
+	}
+	sort.Strings(langs)
+	return langs
+}
+
+//Message will return the message with the key in the language.
+func (m MapCatalog) Message(lang string, key string) (string, bool) {
+	msg, ok := m[lang][key]
+	return msg, ok
+}
+
+//defaultMessages are the built-in English messages.
+var defaultMessages = map[string]string{
+	"choose_provider.title":          "Login",
+	"choose_provider.text":           "Choose how to log in.",
+	"access_denied.title":            "Access denied",
+	"access_denied.text":             "You are not allowed to log in here.",
+	"access_denied.contact":          "Contact the administrator if you should have access.",
+	"login_failed.title":             "Login failed",
+	"login_failed.text":              "Something went wrong while logging you in.",
+	"login_failed.retry":             "Try again",
+	"login_failed.provider":          "The login provider could not be reached, please try again later.",
+	"login_failed.too_many_sessions": "You have too many active sessions, log out somewhere else and try again.",
+	"login_failed.risk":              "The login was refused to keep your account safe. Contact the administrator if this is wrong.",
+	"login_failed.form_expired":      "The login form has expired, please try again.",
+	"login_failed.credentials":       "Wrong username or password.",
+	"login_failed.state_expired":     "The login took too long, please try again.",
+	"login_failed.scope":             "The login did not give access to the information needed, please try again and allow it.",
+	"login_failed.unverified":        "Your email is not verified by the login provider, verify it there and try again.",
+	"login_cancelled.title":          "Login cancelled",
+	"login_cancelled.text":           "The login was cancelled, and you are not logged in.",
+	"login_cancelled.retry":          "Log in",
+	"session_expired.title":          "Session expired",
+	"session_expired.text":           "Your session has expired.",
+	"session_expired.login":          "Log in again",
+	"maintenance.title":              "Come back later",
+	"maintenance.text":               "Logging in is not possible right now because of maintenance.",
+	"maintenance.login_hours":        "Logging in is only possible during the login hours.",
+	"maintenance.until":              "You can log in again from",
+	"terms.title":                    "Terms of service",
+	"terms.text":                     "Read and accept the terms of service to continue.",
+	"terms.read":                     "Read the terms",
+	"terms.accept":                   "I accept the terms",
+	"too_many_attempts.title":        "Too many attempts",
+	"too_many_attempts.text":         "There have been too many failed logins, please wait before trying again.",
+	"too_many_attempts.wait":         "You can try again in",
+	"support.request_id":             "If you contact support, quote this ID:",
+	"error.method_not_allowed":       "Method not allowed.",
+	"error.no_session":               "You are not logged in.",
+	"error.json_content_type":        "Content-Type must be application/json.",
+	"error.providers":                "Failed to list the login providers.",
+	"error.sessions":                 "Failed to list your sessions.",
+	"error.bad_request":              "The request is not valid.",
+	"error.session_name":             "Failed to name the session.",
+	"error.provider_not_found":       "The login provider was not found.",
+	"error.internal":                 "Something went wrong on our side, please try again.",
+}
+
+//DefaultMessages will return a copy of the built-in English messages,
+// keyed by the message keys to use in a MessageCatalog.
+func DefaultMessages() map[string]string {
+	m := make(map[string]string, len(defaultMessages))
+	for k, v := range defaultMessages {
+		m[k] = v
+	}
+	return m
+}
+
+//negotiateLanguage will return the language in supported matching the
+// Accept-Language header best, or the default language if none match.
+// A requested language matches a supported language with the same tag,
+// or with the same primary language, so "pt-BR" matches "pt".
+func negotiateLanguage(acceptLanguage string, supported []string) string {
+	type accepted struct {
+		tag string
+		q   float64
+	}
+	var langs []accepted
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = f
+		}
+		if tag == "" || q <= 0 {
+			continue
+		}
+		langs = append(langs, accepted{tag, q})
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+
+	primary := func(tag string) string {
+		p, _, _ := strings.Cut(tag, "-")
+		return p
+	}
+	for _, l := range langs {
+		for _, s := range supported {
+			if strings.EqualFold(l.tag, s) {
+				return s
+			}
+		}
+		for _, s := range supported {
+			if strings.EqualFold(primary(l.tag), primary(s)) {
+				return s
+			}
+		}
+		if l.tag == "*" && len(supported) > 0 {
+			return supported[0]
+		}
+	}
+
+	return defaultLanguage
+}
+
+//language will return the language to use for the request, negotiated
+// from the Accept-Language header and the languages of the catalog.
+func (a *Auth) language(r *http.Request) string {
+	if a.messages == nil {
+		return defaultLanguage
+	}
+	return negotiateLanguage(r.Header.Get("Accept-Language"), append(a.messages.Languages(), defaultLanguage))
+}
+
+//translate will return the message with the key in the language from the
+// catalog, or the built-in message if the catalog doesn't have it.
+func (a *Auth) translate(lang string, key string) string {
+	if a.messages != nil {
+		if msg, ok := a.messages.Message(lang, key); ok {
+			return msg
+		}
+	}
+	if msg, ok := defaultMessages[key]; ok {
+		return msg
+	}
+	return key
+}
+
+//message will return the message with the key in the language of the request.
+func (a *Auth) message(r *http.Request, key string) string {
+	return a.translate(a.language(r), key)
+}
+
+//writeJSONMessage will write the message with the key in the language of
+// the request as a JSON error, together with the key so frontends can
+// handle the error without parsing the message.
+func (a *Auth) writeJSONMessage(w http.ResponseWriter, r *http.Request, status int, key string) {
+	w.Header().Set("Content-Language", a.language(r))
+	body := map[string]string{"error": a.message(r, key), "code": key}
+	if id := RequestID(r.Context()); id != "" {
+		body["requestID"] = id
+	}
+	writeJSON(w, status, body)
+}
@@ -0,0 +1,161 @@
+package authsession
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+//SessionInspection is the result of inspecting a session cookie or
+// a session ID, used to debug why a user is refused access.
+type SessionInspection struct {
+	//SessionID is the ID of the session in the session store.
+	SessionID string `json:"sessionID"`
+	//Values are the values decoded from the cookie. Empty when
+	// inspecting a session ID.
+	Values map[string]interface{} `json:"values,omitempty"`
+	//Issued is when the cookie was last written. Zero when inspecting
+	// a session ID.
+	Issued time.Time `json:"issued"`
+	//Expires is when the session expires.
+	Expires time.Time `json:"expires"`
+	//Session is the session found in the session store, if any.
+	Session *SessionInfo `json:"session,omitempty"`
+	//Allowed is true if the session would currently be allowed access
+	// to the handlers wrapped with IsAuthenticated.
+	Allowed bool `json:"allowed"`
+	//Reason tells why the session is not allowed.
+	Reason string `json:"reason,omitempty"`
+}
+
+//InspectCookie will decode the value of a session cookie, and report
+// the values, when it was issued and expires, and if it would currently
+// be allowed or denied access, and why.
+func (a *Auth) InspectCookie(value string) (SessionInspection, error) {
+	var si SessionInspection
+
+	values := make(map[interface{}]interface{})
+	if err := securecookie.DecodeMulti("cookie-name", value, &values, a.store.Codecs...); err != nil {
+		return si, fmt.Errorf("failed to decode cookie, it is not valid for any of the cookie keys or too old: %v", err)
+	}
+
+	si.Values = make(map[string]interface{}, len(values))
+	for k, v := range values {
+		si.Values[fmt.Sprint(k)] = v
+	}
+	si.SessionID, _ = values[sessionKeySID].(string)
+
+	if issued, err := cookieTimestamp(value); err == nil {
+		si.Issued = issued
+		si.Expires = issued.Add(sessionMaxAge * time.Second)
+	}
+
+	if err := a.inspectStoredSession(&si); err != nil {
+		return si, err
+	}
+
+	si.Allowed, si.Reason = a.checkSession(nil, values)
+
+	return si, nil
+}
+
+//InspectSession will look up the session ID in the session store, and
+// report when it expires, and if it would currently be allowed or denied
+// access, and why.
+func (a *Auth) InspectSession(id string) (SessionInspection, error) {
+	si := SessionInspection{SessionID: id}
+
+	if a.sessions == nil {
+		return si, errors.New("no session store configured")
+	}
+	if err := a.inspectStoredSession(&si); err != nil {
+		return si, err
+	}
+	if si.Session == nil {
+		si.Reason = "session is revoked or expired in the session store"
+		return si, nil
+	}
+
+	//Check the session as if it was given in a cookie.
+	si.Allowed, si.Reason = a.checkSession(nil, map[interface{}]interface{}{
+		sessionKeyAuthenticated: true,
+		sessionKeySID:           id,
+		sessionKeyEmail:         si.Session.Email,
+	})
+
+	return si, nil
+}
+
+//inspectStoredSession will add the session found in the session store
+// to si, if a session store is set.
+func (a *Auth) inspectStoredSession(si *SessionInspection) error {
+	if a.sessions == nil || si.SessionID == "" {
+		return nil
+	}
+
+	s, ok, err := a.sessions.Get(si.SessionID)
+	if err != nil {
+		return fmt.Errorf("session store Get failed: %v", err)
+	}
+	if ok {
+		si.Session = &s
+		si.Expires = s.Expires
+	}
+
+	return nil
+}
+
+//cookieTimestamp will return the time the securecookie encoded value
+// was created. The value is base64 of "timestamp|value|mac".
+func cookieTimestamp(value string) (time.Time, error) {
+	b, err := base64.URLEncoding.DecodeString(value)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	parts := strings.SplitN(string(b), "|", 2)
+	ts, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(ts, 0), nil
+}
+
+//adminInspect will inspect the cookie value or the session ID given in
+// the JSON body, like {"cookie": "MTY..."} or {"sessionID": "abc"}.
+func (a *Auth) adminInspect(w http.ResponseWriter, r *http.Request) {
+	body := struct {
+		Cookie    string `json:"cookie"`
+		SessionID string `json:"sessionID"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected a JSON body with a cookie or a sessionID")
+		return
+	}
+
+	var si SessionInspection
+	var err error
+	switch {
+	case body.Cookie != "":
+		si, err = a.InspectCookie(body.Cookie)
+	case body.SessionID != "":
+		si, err = a.InspectSession(body.SessionID)
+	default:
+		writeJSONError(w, http.StatusBadRequest, "expected a JSON body with a cookie or a sessionID")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, si)
+}
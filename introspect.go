@@ -0,0 +1,187 @@
+package authsession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+//IntrospectionConfig is the configuration for checking opaque access
+// tokens with the RFC 7662 introspection endpoint of a provider.
+type IntrospectionConfig struct {
+	//URL is the introspection endpoint of the provider.
+	URL string
+	//ClientID and ClientSecret are sent with basic auth to the endpoint.
+	ClientID     string
+	ClientSecret string
+	//BearerToken is sent in the Authorization header instead of the
+	// client credentials if given, for providers protecting the endpoint
+	// with a token.
+	BearerToken string
+	//CacheTTL is how long the result for a token is cached. A token is
+	// never cached past its expiry. Defaults to 1 minute.
+	CacheTTL time.Duration
+	//Timeout for the requests to the endpoint. Defaults to 10s.
+	Timeout time.Duration
+}
+
+//introspectionResponse is the part of the introspection response used.
+type introspectionResponse struct {
+	Active   bool   `json:"active"`
+	Scope    string `json:"scope"`
+	ClientID string `json:"client_id"`
+	Username string `json:"username"`
+	Sub      string `json:"sub"`
+	Email    string `json:"email"`
+	Exp      int64  `json:"exp"`
+	//Aud is a string, or a list of strings.
+	Aud json.RawMessage `json:"aud"`
+}
+
+//audiences will return the audiences of the response.
+func (ir introspectionResponse) audiences() []string {
+	var aud []string
+	if err := json.Unmarshal(ir.Aud, &aud); err == nil {
+		return aud
+	}
+	var s string
+	if err := json.Unmarshal(ir.Aud, &s); err == nil && s != "" {
+		return []string{s}
+	}
+	return nil
+}
+
+//introspectionResult is a cached introspection result.
+type introspectionResult struct {
+	token   AccessToken
+	active  bool
+	expires time.Time
+}
+
+//introspector will check tokens with the introspection endpoint, and
+// cache the results.
+type introspector struct {
+	conf   IntrospectionConfig
+	client *http.Client
+
+	mu    sync.Mutex
+	cache map[string]introspectionResult
+}
+
+//newIntrospector will return an *introspector using the config, with
+// the defaults filled in.
+func newIntrospector(c IntrospectionConfig) *introspector {
+	if c.CacheTTL <= 0 {
+		c.CacheTTL = time.Minute
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	return &introspector{
+		conf:   c,
+		client: &http.Client{Timeout: c.Timeout},
+		cache:  make(map[string]introspectionResult),
+	}
+}
+
+//verify will return the access token if the provider says the token is
+// active, and it is not expired allowing the clocks to differ by skew.
+// Results are cached by the hash of the token.
+func (i *introspector) verify(ctx context.Context, token string, skew time.Duration) (AccessToken, error) {
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	now := time.Now()
+
+	i.mu.Lock()
+	res, ok := i.cache[key]
+	i.mu.Unlock()
+
+	if !ok || now.After(res.expires) {
+		var err error
+		res, err = i.introspect(ctx, token, skew)
+		if err != nil {
+			return AccessToken{}, err
+		}
+
+		i.mu.Lock()
+		for k, v := range i.cache {
+			if now.After(v.expires) {
+				delete(i.cache, k)
+			}
+		}
+		i.cache[key] = res
+		i.mu.Unlock()
+	}
+
+	if !res.active {
+		return AccessToken{}, errors.New("access token is not active")
+	}
+	return res.token, nil
+}
+
+//introspect will ask the introspection endpoint about the token.
+func (i *introspector) introspect(ctx context.Context, token string, skew time.Duration) (introspectionResult, error) {
+	v := url.Values{}
+	v.Set("token", token)
+	v.Set("token_type_hint", "access_token")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.conf.URL, strings.NewReader(v.Encode()))
+	if err != nil {
+		return introspectionResult{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.conf.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+i.conf.BearerToken)
+	} else {
+		req.SetBasicAuth(url.QueryEscape(i.conf.ClientID), url.QueryEscape(i.conf.ClientSecret))
+	}
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return introspectionResult{}, fmt.Errorf("token introspection failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return introspectionResult{}, fmt.Errorf("token introspection failed: %v returned %v", i.conf.URL, resp.Status)
+	}
+
+	var ir introspectionResponse
+	if err := json.NewDecoder(resp.Body).Decode(&ir); err != nil {
+		return introspectionResult{}, fmt.Errorf("failed parsing introspection response: %v", err)
+	}
+
+	res := introspectionResult{
+		active:  ir.Active,
+		expires: time.Now().Add(i.conf.CacheTTL),
+		token: AccessToken{
+			Subject:   ir.Sub,
+			ClientID:  ir.ClientID,
+			Email:     ir.Email,
+			Name:      ir.Username,
+			Scope:     ir.Scope,
+			Audiences: ir.audiences(),
+		},
+	}
+	if ir.Active && ir.Exp != 0 {
+		exp := time.Unix(ir.Exp, 0)
+		if checkTimeClaims(ir.Exp, 0, 0, skew) != nil {
+			res.active = false
+		}
+		if exp.Before(res.expires) {
+			res.expires = exp
+		}
+	}
+
+	return res, nil
+}
@@ -0,0 +1,107 @@
+package authsession
+
+import (
+	"strings"
+	"time"
+)
+
+//Invitation allows the user with the email to log in. The invitation
+// must be accepted, which happens on the first login, before it expires.
+// A zero Expires means the invitation never expires.
+type Invitation struct {
+	Email    string    `json:"email"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	Accepted time.Time `json:"accepted"`
+}
+
+//Valid will return true if the invitation is accepted, or it can
+// still be accepted.
+func (i Invitation) Valid(now time.Time) bool {
+	if !i.Accepted.IsZero() {
+		return true
+	}
+	return i.Expires.IsZero() || now.Before(i.Expires)
+}
+
+//InvitationStore keeps the invitations. When an InvitationStore is set
+// with WithInvitationStore, only users with a valid invitation for
+// their email are allowed to log in.
+type InvitationStore interface {
+	//Add will add, or replace an invitation.
+	Add(i Invitation) error
+	//Get will return the invitation for the email, and false if not found.
+	Get(email string) (Invitation, bool, error)
+	//Accept will mark the invitation for the email as accepted.
+	Accept(email string) error
+	//Delete will delete the invitation for the email.
+	Delete(email string) error
+	//List will return all the invitations.
+	List() ([]Invitation, error)
+}
+
+//FileInvitationStore is an InvitationStore keeping the invitations in a JSON file.
+type FileInvitationStore struct {
+	m *jsonFileMap[Invitation]
+}
+
+//NewFileInvitationStore will return a *FileInvitationStore storing the
+// invitations in the file at path. If path is empty the invitations are
+// only kept in memory.
+func NewFileInvitationStore(path string) *FileInvitationStore {
+	return &FileInvitationStore{
+		m: newJSONFileMap[Invitation](path),
+	}
+}
+
+//Add will add, or replace an invitation.
+func (f *FileInvitationStore) Add(i Invitation) error {
+	return f.m.update(func(m map[string]Invitation) error {
+		m[strings.ToLower(i.Email)] = i
+		return nil
+	})
+}
+
+//Get will return the invitation for the email, and false if not found.
+func (f *FileInvitationStore) Get(email string) (Invitation, bool, error) {
+	var i Invitation
+	var ok bool
+	err := f.m.view(func(m map[string]Invitation) error {
+		i, ok = m[strings.ToLower(email)]
+		return nil
+	})
+	return i, ok, err
+}
+
+//Accept will mark the invitation for the email as accepted.
+func (f *FileInvitationStore) Accept(email string) error {
+	return f.m.update(func(m map[string]Invitation) error {
+		i, ok := m[strings.ToLower(email)]
+		if !ok || !i.Accepted.IsZero() {
+			return nil
+		}
+		i.Accepted = time.Now()
+		m[strings.ToLower(email)] = i
+		return nil
+	})
+}
+
+//Delete will delete the invitation for the email.
+func (f *FileInvitationStore) Delete(email string) error {
+	return f.m.update(func(m map[string]Invitation) error {
+		delete(m, strings.ToLower(email))
+		return nil
+	})
+}
+
+//List will return all the invitations.
+func (f *FileInvitationStore) List() ([]Invitation, error) {
+	var invitations []Invitation
+	err := f.m.view(func(m map[string]Invitation) error {
+		for _, i := range m {
+			invitations = append(invitations, i)
+		}
+		return nil
+	})
+	return invitations, err
+}
@@ -0,0 +1,717 @@
+package authsession
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//issuerPath is where the OpenID Connect provider endpoints are served
+// when running in issuer mode. The issuer is the URL of the server with
+// this path.
+const issuerPath = "/oidc"
+
+//OIDCClient is an internal app allowed to log users in with this server
+// as its OpenID Connect provider.
+type OIDCClient struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Secret string `json:"secret"`
+	//RedirectURIs are the exact redirect URIs the client may use.
+	RedirectURIs []string `json:"redirectURIs"`
+	//Audiences are the APIs, like https://api.example.com, the client may
+	// ask access tokens for with the resource parameter of RFC 8707.
+	// Without it the audience of the access tokens is the client ID.
+	Audiences []string `json:"audiences,omitempty"`
+	//Resources are the APIs served by the client, when it is a service.
+	// With token exchange the client can exchange the access tokens
+	// issued for them, or for its client ID, for tokens for its Audiences.
+	Resources []string `json:"resources,omitempty"`
+	//Scopes are the API scopes the client is granted for itself with the
+	// client credentials grant.
+	Scopes []string `json:"scopes,omitempty"`
+	//Tenants are the IDs of the tenants whose issuer the client may use,
+	// when every tenant has its own issuer. All if empty.
+	Tenants []string `json:"tenants,omitempty"`
+}
+
+//ClientStore keeps the clients for the issuer mode.
+type ClientStore interface {
+	//Put will add, or replace a client.
+	Put(c OIDCClient) error
+	//Get will return the client with the id, and false if not found.
+	Get(id string) (OIDCClient, bool, error)
+	//Delete will delete the client with the id.
+	Delete(id string) error
+	//List will return all the clients.
+	List() ([]OIDCClient, error)
+}
+
+//FileClientStore is a ClientStore keeping the clients in a JSON file.
+type FileClientStore struct {
+	m *jsonFileMap[OIDCClient]
+}
+
+//NewFileClientStore will return a *FileClientStore storing the clients
+// in the file at path. If path is empty the clients are only kept in memory.
+func NewFileClientStore(path string) *FileClientStore {
+	return &FileClientStore{
+		m: newJSONFileMap[OIDCClient](path),
+	}
+}
+
+//Put will add, or replace a client.
+func (f *FileClientStore) Put(c OIDCClient) error {
+	return f.m.update(func(m map[string]OIDCClient) error {
+		m[c.ID] = c
+		return nil
+	})
+}
+
+//Get will return the client with the id, and false if not found.
+func (f *FileClientStore) Get(id string) (OIDCClient, bool, error) {
+	var c OIDCClient
+	var ok bool
+	err := f.m.view(func(m map[string]OIDCClient) error {
+		c, ok = m[id]
+		return nil
+	})
+	return c, ok, err
+}
+
+//Delete will delete the client with the id.
+func (f *FileClientStore) Delete(id string) error {
+	return f.m.update(func(m map[string]OIDCClient) error {
+		delete(m, id)
+		return nil
+	})
+}
+
+//List will return all the clients.
+func (f *FileClientStore) List() ([]OIDCClient, error) {
+	var clients []OIDCClient
+	err := f.m.view(func(m map[string]OIDCClient) error {
+		for _, c := range m {
+			clients = append(clients, c)
+		}
+		return nil
+	})
+	return clients, err
+}
+
+//IssuerConfig is the configuration for running as an OpenID Connect
+// provider for internal apps.
+type IssuerConfig struct {
+	//URL is the public URL of this server, like https://auth.example.com.
+	// The issuer will be the URL followed by /oidc.
+	URL string
+	//SigningKey is used to sign the ID tokens.
+	SigningKey *rsa.PrivateKey
+	//Signer signs the ID tokens and the JWT access tokens instead of
+	// SigningKey, like with a key in a key management service, so
+	// SigningKey can be nil.
+	Signer Signer
+	//PublishedSigners are more keys published in the JWKS and accepted
+	// when verifying the access tokens, without signing with them, like
+	// the previous key while tokens signed with it are still valid, or the
+	// next key before rotating to it.
+	PublishedSigners []Signer
+	//Clients are the apps allowed to use the issuer.
+	Clients ClientStore
+	//TokenTTL is how long the issued tokens are valid. Defaults to 1 hour.
+	TokenTTL time.Duration
+	//RefreshTokens will keep the refresh tokens given to the clients. No
+	// refresh tokens are given if nil.
+	RefreshTokens RefreshTokenStore
+	//RefreshTokenTTL is how long a refresh token can be used. Defaults
+	// to 30 days.
+	RefreshTokenTTL time.Duration
+	//RequireDPoP will only issue access tokens bound to the key of the
+	// client with DPoP. Without it tokens are only bound when the client
+	// sends a DPoP proof.
+	RequireDPoP bool
+	//TokenFormat is the format of the access tokens, which is a JWT by
+	// default. The ID tokens are always JWTs, as OpenID Connect requires.
+	// Access tokens of both formats are accepted, so the format can be
+	// changed while tokens of the old format are still used.
+	TokenFormat TokenFormat
+	//PASETOKey signs the access tokens when TokenFormat is
+	// TokenFormatPASETO.
+	PASETOKey ed25519.PrivateKey
+	//TenantIssuers gives every tenant set with WithTenants its own
+	// issuer. With TenantFromPath the issuer of a tenant is the URL
+	// followed by /{tenant}/oidc, and with TenantFromHost it is the host
+	// of the tenant with the scheme of the URL, followed by /oidc. Codes
+	// and refresh tokens are only accepted by the issuer that gave them,
+	// and access tokens for a tenant are not accepted by another tenant.
+	TenantIssuers bool
+	//ScopeRoles are the API scopes, like "reports:read", clients can ask
+	// for, with the roles of which the user must have one for the scope
+	// to be granted. The scopes granted are put in the access tokens, and
+	// checked by the APIs with RequireTokenScope.
+	ScopeRoles map[string][]string
+	//TokenExchange turns on the token exchange grant of RFC 8693 at the
+	// token endpoint, where a service exchanges the access token of a
+	// user for a token to call a downstream API for the user.
+	TokenExchange bool
+	//ClientCredentials turns on the client credentials grant at the token
+	// endpoint, where a client gets an access token for itself, with the
+	// client ID as the subject, like for backend jobs.
+	ClientCredentials bool
+	//ReferenceTokens stores the access tokens when TokenFormat is
+	// TokenFormatReference. The APIs check the tokens at the introspection
+	// endpoint, /oidc/introspect, authenticated as a client, or with
+	// VerifyAccessToken when sharing the store.
+	ReferenceTokens ReferenceTokenStore
+}
+
+//authCode is an authorization code given to a client, to be exchanged
+// for tokens at the token endpoint.
+type authCode struct {
+	clientID      string
+	issuer        string
+	redirectURI   string
+	nonce         string
+	codeChallenge string
+	scope         string
+	user          User
+	//region is the region of the user, from the session.
+	region  string
+	expires time.Time
+}
+
+//issuer holds the state for the issuer mode.
+type issuer struct {
+	conf IssuerConfig
+	dpop *dpopState
+	//keys are the keys of the JWKS, which can be rotated while the
+	// server is running.
+	keysMu sync.RWMutex
+	keys   *issuerKeySet
+	//pasetoKid is the ID of the PASETO key, put in the footer of the
+	// PASETO access tokens.
+	pasetoKid string
+
+	mu    sync.Mutex
+	codes map[string]authCode
+}
+
+//newIssuer will return an *issuer using the config, with the defaults
+// filled in.
+func newIssuer(c IssuerConfig) *issuer {
+	if c.TokenTTL <= 0 {
+		c.TokenTTL = time.Hour
+	}
+	if c.RefreshTokenTTL <= 0 {
+		c.RefreshTokenTTL = 30 * 24 * time.Hour
+	}
+	c.URL = strings.TrimSuffix(c.URL, "/")
+	if c.Signer == nil {
+		c.Signer = KeySigner(c.SigningKey)
+	}
+
+	i := &issuer{
+		conf:  c,
+		dpop:  newDPoPState(),
+		keys:  newIssuerKeySet(c.Signer, c.PublishedSigners),
+		codes: make(map[string]authCode),
+	}
+	if c.PASETOKey != nil {
+		sum := sha256.Sum256(c.PASETOKey.Public().(ed25519.PublicKey))
+		i.pasetoKid = base64.RawURLEncoding.EncodeToString(sum[:8])
+	}
+	return i
+}
+
+//keyID will return the ID for the key, taken from the public key so a
+// new key gets a new ID.
+func keyID(pub *rsa.PublicKey) string {
+	sum := sha256.Sum256(pub.N.Bytes())
+	return base64.RawURLEncoding.EncodeToString(sum[:8])
+}
+
+//issuerURL will return the issuer identifier.
+func (i *issuer) issuerURL() string {
+	return i.conf.URL + issuerPath
+}
+
+//addCode will store the authorization code, and remove expired codes.
+func (i *issuer) addCode(code string, c authCode) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	now := time.Now()
+	for k, v := range i.codes {
+		if now.After(v.expires) {
+			delete(i.codes, k)
+		}
+	}
+	i.codes[code] = c
+}
+
+//cleanupCodes will remove the codes expired at now, and return the
+// number removed.
+func (i *issuer) cleanupCodes(now time.Time) int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	var n int
+	for k, v := range i.codes {
+		if now.After(v.expires) {
+			delete(i.codes, k)
+			n++
+		}
+	}
+	return n
+}
+
+//takeCode will return and remove the authorization code, so a code can
+// only be used once.
+func (i *issuer) takeCode(code string) (authCode, bool) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	c, ok := i.codes[code]
+	delete(i.codes, code)
+	if !ok || time.Now().After(c.expires) {
+		return authCode{}, false
+	}
+	return c, true
+}
+
+//signJWT will return the claims as a JWT signed with the signer using
+// RS256. The signature is checked with the public key, so a key in a key
+// management service with another algorithm is found at once.
+func signJWT(s Signer, typ string, claims map[string]interface{}) (string, error) {
+	pub := s.PublicKey()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": typ, "kid": keyID(pub)})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	sum := sha256.Sum256([]byte(signingInput))
+	sig, err := s.Sign(sum[:])
+	if err != nil {
+		return "", err
+	}
+	if err := rsa.VerifyPKCS1v15(pub, crypto.SHA256, sum[:], sig); err != nil {
+		return "", fmt.Errorf("signature made by the signer is not a valid RS256 signature: %v", err)
+	}
+
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+//accessTokenType is the typ of the JWT access tokens (RFC 9068), so they
+// can't be mistaken for the ID tokens signed with the same key.
+const accessTokenType = "at+jwt"
+
+//signAccessToken will return the claims as an access token in the format
+// of the config. The times of a PASETO token are ISO 8601 strings, as
+// PASETO requires. A reference token is stored in the region.
+func (i *issuer) signAccessToken(claims map[string]interface{}, region string) (string, error) {
+	switch i.conf.TokenFormat {
+	case TokenFormatPASETO:
+	case TokenFormatReference:
+		return i.newReferenceToken(claims, region)
+	default:
+		return signJWT(i.signer(), accessTokenType, claims)
+	}
+
+	pc := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		pc[k] = v
+	}
+	for _, k := range []string{"exp", "iat"} {
+		if t, ok := claims[k].(int64); ok {
+			pc[k] = time.Unix(t, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	message, err := json.Marshal(pc)
+	if err != nil {
+		return "", err
+	}
+	footer, err := json.Marshal(map[string]string{"kid": i.pasetoKid})
+	if err != nil {
+		return "", err
+	}
+	return pasetoSign(i.conf.PASETOKey, message, footer, nil), nil
+}
+
+//grantTypes will return the grant types supported at the token endpoint.
+func (i *issuer) grantTypes() []string {
+	grantTypes := []string{"authorization_code"}
+	if i.conf.RefreshTokens != nil {
+		grantTypes = append(grantTypes, "refresh_token")
+	}
+	if i.conf.TokenExchange {
+		grantTypes = append(grantTypes, grantTypeTokenExchange)
+	}
+	if i.conf.ClientCredentials {
+		grantTypes = append(grantTypes, "client_credentials")
+	}
+	return grantTypes
+}
+
+//issuerHandler will return the handler for the OpenID Connect provider
+// endpoints below /oidc/, and below /{tenant}/oidc/ when every tenant
+// found in the path has its own issuer.
+func (a *Auth) issuerHandler() http.Handler {
+	p := issuerPath
+	if a.tenantIssuers() && a.tenantFrom == TenantFromPath {
+		p = "/{tenant}" + issuerPath
+	}
+
+	mux := a.newRouteMux()
+	mux.HandleFunc("GET "+p+"/.well-known/openid-configuration", a.issuerDiscovery)
+	mux.HandleFunc("GET "+p+"/authorize", a.issuerAuthorize)
+	mux.HandleFunc("POST "+p+"/token", a.issuerToken)
+	mux.HandleFunc("GET "+p+"/jwks", a.issuerJWKS)
+	mux.HandleFunc("POST "+p+"/introspect", a.issuerIntrospect)
+	return a.issuerTenantHandler(mux)
+}
+
+//issuerDiscovery will serve the discovery document for the issuer.
+func (a *Auth) issuerDiscovery(w http.ResponseWriter, r *http.Request) {
+	iss := a.requestIssuerURL(r)
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                iss,
+		"authorization_endpoint":                iss + "/authorize",
+		"token_endpoint":                        iss + "/token",
+		"jwks_uri":                              iss + "/jwks",
+		"introspection_endpoint":                iss + "/introspect",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 a.issuer.grantTypes(),
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{"RS256"},
+		"scopes_supported":                      append([]string{"openid", "email", "profile"}, a.issuer.apiScopes()...),
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"code_challenge_methods_supported":      []string{"S256"},
+		"dpop_signing_alg_values_supported":     []string{"RS256", "ES256"},
+	})
+}
+
+//issuerJWKS will serve the public keys of the issuer, which are the key
+// signing the tokens and the other published keys. It may be cached for
+// jwksMaxAge.
+func (a *Auth) issuerJWKS(w http.ResponseWriter, r *http.Request) {
+	var keys []map[string]string
+	for _, k := range a.issuer.publishedKeys() {
+		pub := k.signer.PublicKey()
+		keys = append(keys, map[string]string{
+			"kty": "RSA",
+			"use": "sig",
+			"alg": "RS256",
+			"kid": k.kid,
+			"n":   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+		})
+	}
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(jwksMaxAge/time.Second)))
+	w.Header().Del("Pragma")
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"keys": keys,
+	})
+}
+
+//authenticateClient will return the client authenticated with its secret
+// by basic auth or the form of the request. The secret is the only way
+// clients authenticate, so a client without a secret is never
+// authenticated. The error is written to w, and false returned, if the
+// client is not authenticated.
+func (a *Auth) authenticateClient(w http.ResponseWriter, r *http.Request) (OIDCClient, bool) {
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostFormValue("client_id")
+		secret = r.PostFormValue("client_secret")
+	}
+	client, found, err := a.issuer.conf.Clients.Get(clientID)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: client store Get failed: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to get client")
+		return OIDCClient{}, false
+	}
+	if !found || client.Secret == "" || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 || !a.clientAllowed(r, client) {
+		tokenError(w, http.StatusUnauthorized, "invalid_client", "unknown client or wrong secret")
+		return OIDCClient{}, false
+	}
+	return client, true
+}
+
+//issuerAuthorize is the authorization endpoint. A user not logged in is
+// sent to the login first, and brought back here after the login. A
+// logged in user is redirected back to the client with a code.
+func (a *Auth) issuerAuthorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+
+	client, ok, err := a.issuer.conf.Clients.Get(q.Get("client_id"))
+	if err != nil {
+		a.logRequestError(r, "error: issuer: client store Get failed: ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	//Errors about the client or the redirect URI are shown to the user
+	// instead of redirecting, so we never redirect to an unknown URI.
+	redirectURI := q.Get("redirect_uri")
+	if !ok || !slices.Contains(client.RedirectURIs, redirectURI) || !a.clientAllowed(r, client) {
+		http.Error(w, "unknown client_id or redirect_uri", http.StatusBadRequest)
+		return
+	}
+
+	redirectError := func(code string, desc string) {
+		v := url.Values{}
+		v.Set("error", code)
+		v.Set("error_description", desc)
+		if s := q.Get("state"); s != "" {
+			v.Set("state", s)
+		}
+		http.Redirect(w, r, redirectURI+"?"+v.Encode(), http.StatusFound)
+	}
+
+	if q.Get("response_type") != "code" {
+		redirectError("unsupported_response_type", "only the code response type is supported")
+		return
+	}
+	if !slices.Contains(strings.Fields(q.Get("scope")), "openid") {
+		redirectError("invalid_scope", "the openid scope is required")
+		return
+	}
+	if m := q.Get("code_challenge_method"); q.Get("code_challenge") != "" && m != "S256" {
+		redirectError("invalid_request", "only the S256 code challenge method is supported")
+		return
+	}
+
+	session, ok := a.authenticated(r)
+	if !ok {
+		//Remember where to come back to after the login.
+		session.Values["returnto"] = r.URL.RequestURI()
+		if err := session.Save(r, w); err != nil {
+			a.logRequestError(r, "error: issuer: session.Save failed: ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, a.tenantPath(r, "/slogin"), http.StatusFound)
+		return
+	}
+
+	code, err := a.newKey(32, KeyBase64URL)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to create code: ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	user := a.sessionRoles(r, session.Values, (&Session{s: session}).User())
+	a.issuer.addCode(code, authCode{
+		clientID:      client.ID,
+		issuer:        a.requestIssuerURL(r),
+		redirectURI:   redirectURI,
+		nonce:         q.Get("nonce"),
+		codeChallenge: q.Get("code_challenge"),
+		scope:         a.issuer.grantScopes(q.Get("scope"), user),
+		user:          User{ID: user.ID, Email: user.Email, FullName: user.FullName},
+		region:        (&Session{s: session}).Region(),
+		expires:       time.Now().Add(time.Minute),
+	})
+
+	v := url.Values{}
+	v.Set("code", code)
+	if s := q.Get("state"); s != "" {
+		v.Set("state", s)
+	}
+	http.Redirect(w, r, redirectURI+"?"+v.Encode(), http.StatusFound)
+}
+
+//tokenError will write an error response from the token endpoint.
+func tokenError(w http.ResponseWriter, status int, code string, desc string) {
+	writeJSON(w, status, map[string]string{"error": code, "error_description": desc})
+}
+
+//issuerToken is the token endpoint, exchanging an authorization code for
+// an ID token and an access token.
+func (a *Auth) issuerToken(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, ok := a.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+	iss := a.requestIssuerURL(r)
+
+	//The audience of the access token is the API asked for with the
+	// resource parameter, or the client itself.
+	audience := client.ID
+	if resource := r.PostFormValue("resource"); resource != "" {
+		if !slices.Contains(client.Audiences, resource) {
+			tokenError(w, http.StatusBadRequest, "invalid_target", "the resource is not allowed for the client")
+			return
+		}
+		audience = resource
+	}
+
+	grantType := r.PostFormValue("grant_type")
+	if !slices.Contains(a.issuer.grantTypes(), grantType) {
+		tokenError(w, http.StatusBadRequest, "unsupported_grant_type", "the grant type is not supported")
+		return
+	}
+
+	//Check the DPoP proof before using the code or refresh token, so a
+	// client asked to retry with a nonce can still use it.
+	var jkt string
+	var err error
+	if r.Header.Get("DPoP") != "" || a.issuer.conf.RequireDPoP {
+		jkt, err = a.issuer.dpop.checkDPoPProof(r, requestURL(r, a.requestIssuerBase(r)), "", a.clockSkew)
+		w.Header().Set("DPoP-Nonce", a.issuer.dpop.currentNonce())
+		if errors.Is(err, errUseDPoPNonce) {
+			tokenError(w, http.StatusBadRequest, "use_dpop_nonce", "a DPoP nonce is required")
+			return
+		}
+		if err != nil {
+			tokenError(w, http.StatusBadRequest, "invalid_dpop_proof", err.Error())
+			return
+		}
+	}
+
+	switch grantType {
+	case grantTypeTokenExchange:
+		a.tokenExchange(w, r, client, iss, jkt)
+		return
+	case "client_credentials":
+		a.clientCredentialsGrant(w, r, client, iss, audience, jkt)
+		return
+	}
+
+	var user User
+	var nonce string
+	var scope string
+	var refreshToken string
+	var region string
+	switch grantType {
+	case "authorization_code":
+		code, ok := a.issuer.takeCode(r.PostFormValue("code"))
+		if !ok || code.clientID != client.ID || code.issuer != iss || code.redirectURI != r.PostFormValue("redirect_uri") {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", "the code is not valid")
+			return
+		}
+		if err := checkCodeVerifier(code.codeChallenge, r.PostFormValue("code_verifier")); err != nil {
+			tokenError(w, http.StatusBadRequest, "invalid_grant", err.Error())
+			return
+		}
+		user = code.user
+		nonce = code.nonce
+		scope = code.scope
+		region = code.region
+
+		if a.issuer.conf.RefreshTokens != nil {
+			refreshToken, err = a.issuer.newRefreshTokenFamily(client.ID, iss, scope, user, jkt, region)
+			if err != nil {
+				a.logRequestError(r, "error: issuer: failed to store refresh token: ", err)
+				tokenError(w, http.StatusInternalServerError, "server_error", "failed to create refresh token")
+				return
+			}
+		}
+	case "refresh_token":
+		var ok bool
+		user, scope, refreshToken, region, ok = a.refreshGrant(w, r, client, iss, jkt)
+		if !ok {
+			return
+		}
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   iss,
+		"sub":   user.ID,
+		"aud":   client.ID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(a.issuer.conf.TokenTTL).Unix(),
+		"email": user.Email,
+		"name":  user.FullName,
+	}
+	if nonce != "" {
+		claims["nonce"] = nonce
+	}
+	idToken, err := signJWT(a.issuer.signer(), "JWT", claims)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to sign id token: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+
+	delete(claims, "nonce")
+	jti, err := a.newKey(16, KeyBase64URL)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to make token ID: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+	claims["jti"] = jti
+	if scope != "" {
+		claims["scope"] = scope
+	}
+	if audience != client.ID {
+		claims["aud"] = audience
+		claims["azp"] = client.ID
+	}
+	tokenType := "Bearer"
+	if jkt != "" {
+		claims["cnf"] = map[string]string{"jkt": jkt}
+		tokenType = "DPoP"
+	}
+	accessToken, err := a.issuer.signAccessToken(claims, region)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to sign access token: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+
+	resp := map[string]interface{}{
+		"access_token": accessToken,
+		"token_type":   tokenType,
+		"expires_in":   int(a.issuer.conf.TokenTTL.Seconds()),
+		"id_token":     idToken,
+	}
+	if refreshToken != "" {
+		resp["refresh_token"] = refreshToken
+	}
+	if scope != "" {
+		resp["scope"] = scope
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+//checkCodeVerifier will check the PKCE code verifier against the code
+// challenge given to the authorization endpoint, if any.
+func checkCodeVerifier(challenge string, verifier string) error {
+	if challenge == "" {
+		return nil
+	}
+	if verifier == "" {
+		return errors.New("missing code_verifier")
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) != 1 {
+		return fmt.Errorf("code_verifier does not match the code_challenge")
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package authsession
+
+import (
+	"crypto/rsa"
+	"errors"
+	"testing"
+)
+
+//noKeySigner is a Signer without a public key, like a key management
+// service that could not be reached.
+type noKeySigner struct{}
+
+func (noKeySigner) PublicKey() *rsa.PublicKey { return nil }
+
+func (noKeySigner) Sign(digest []byte) ([]byte, error) { return nil, errors.New("no key") }
+
+func TestWithIssuerWithoutKey(t *testing.T) {
+	tests := []struct {
+		name string
+		conf IssuerConfig
+	}{
+		{"no key", IssuerConfig{URL: "https://auth.example.com", Clients: NewFileClientStore("")}},
+		{"signer without public key", IssuerConfig{URL: "https://auth.example.com", Clients: NewFileClientStore(""), Signer: noKeySigner{}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret", WithIssuer(tt.conf))
+			if a.issuer != nil {
+				t.Fatal("the issuer was enabled without a key")
+			}
+		})
+	}
+}
@@ -0,0 +1,180 @@
+package authsession
+
+import (
+	"crypto/rsa"
+	"errors"
+	"time"
+)
+
+//jwksPath is where the JWKS of the issuer is also served, at the well
+// known location on the server, for the services validating the tokens
+// of the issuer without using the discovery document.
+const jwksPath = "/.well-known/jwks.json"
+
+//jwksMaxAge is how long the JWKS of the issuer may be cached by the
+// services validating the tokens. A new key should be published with
+// AddIssuerKey at least this long before signing with it.
+const jwksMaxAge = 5 * time.Minute
+
+//issuerKey is a key published in the JWKS of the issuer.
+type issuerKey struct {
+	signer Signer
+	kid    string
+	//retires is when a previous key is removed from the JWKS, and is zero
+	// for a key kept until the server is restarted.
+	retires time.Time
+}
+
+//issuerKeySet holds the key signing the tokens of the issuer, and the
+// other keys published in the JWKS and accepted when verifying, like a
+// previous key still used by unexpired tokens, or the next key published
+// before signing with it.
+type issuerKeySet struct {
+	current issuerKey
+	others  []issuerKey
+}
+
+//newIssuerKeySet will return an *issuerKeySet signing with current, and
+// also publishing the others.
+func newIssuerKeySet(current Signer, others []Signer) *issuerKeySet {
+	k := &issuerKeySet{
+		current: issuerKey{signer: current, kid: keyID(current.PublicKey())},
+	}
+	for _, s := range others {
+		k.add(s)
+	}
+	return k
+}
+
+//add will publish the key without signing with it. A key already
+// published is not added again.
+func (k *issuerKeySet) add(s Signer) {
+	kid := keyID(s.PublicKey())
+	if kid == k.current.kid {
+		return
+	}
+	for i, o := range k.others {
+		if o.kid == kid {
+			k.others[i].retires = time.Time{}
+			return
+		}
+	}
+	k.others = append(k.others, issuerKey{signer: s, kid: kid})
+}
+
+//rotate will start signing with s, and keep publishing the current key
+// until retires. The keys already retired are removed.
+func (k *issuerKeySet) rotate(s Signer, retires time.Time, now time.Time) {
+	kid := keyID(s.PublicKey())
+	if kid == k.current.kid {
+		return
+	}
+	prev := k.current
+	prev.retires = retires
+	k.current = issuerKey{signer: s, kid: kid}
+
+	others := []issuerKey{prev}
+	for _, o := range k.others {
+		if o.kid == kid || (!o.retires.IsZero() && !now.Before(o.retires)) {
+			continue
+		}
+		others = append(others, o)
+	}
+	k.others = others
+}
+
+//published will return the keys in the JWKS at now, with the signing
+// key first.
+func (k *issuerKeySet) published(now time.Time) []issuerKey {
+	keys := []issuerKey{k.current}
+	for _, o := range k.others {
+		if o.retires.IsZero() || now.Before(o.retires) {
+			keys = append(keys, o)
+		}
+	}
+	return keys
+}
+
+//publicKey will return the public key with the kid if it is published at
+// now, and false if not.
+func (k *issuerKeySet) publicKey(kid string, now time.Time) (*rsa.PublicKey, bool) {
+	for _, key := range k.published(now) {
+		if key.kid == kid {
+			return key.signer.PublicKey(), true
+		}
+	}
+	return nil, false
+}
+
+//signer will return the key signing the tokens.
+func (i *issuer) signer() Signer {
+	i.keysMu.RLock()
+	defer i.keysMu.RUnlock()
+
+	return i.keys.current.signer
+}
+
+//publishedKeys will return the keys in the JWKS, with the signing key
+// first.
+func (i *issuer) publishedKeys() []issuerKey {
+	i.keysMu.RLock()
+	defer i.keysMu.RUnlock()
+
+	return i.keys.published(time.Now())
+}
+
+//verifyKey will return the public key with the kid, and false if it is
+// not a key of the issuer.
+func (i *issuer) verifyKey(kid string) (*rsa.PublicKey, bool) {
+	i.keysMu.RLock()
+	defer i.keysMu.RUnlock()
+
+	return i.keys.publicKey(kid, time.Now())
+}
+
+//AddIssuerKey will publish the key of s in the JWKS of the issuer, and
+// accept tokens signed with it, without signing with it. Publishing the
+// next key a while before rotating to it with RotateIssuerKey lets the
+// services validating the tokens get it before the first token signed
+// with it, even when they cache the JWKS. The key is only kept in
+// memory, so it must also be in IssuerConfig.PublishedSigners to be
+// published after a restart.
+func (a *Auth) AddIssuerKey(s Signer) error {
+	if a.issuer == nil {
+		return errors.New("issuer mode is not enabled")
+	}
+	if s == nil || s.PublicKey() == nil {
+		return errors.New("issuer key has no public key")
+	}
+
+	a.issuer.keysMu.Lock()
+	defer a.issuer.keysMu.Unlock()
+
+	a.issuer.keys.add(s)
+	return nil
+}
+
+//RotateIssuerKey will start signing the tokens of the issuer with s,
+// while the previous key stays published in the JWKS and accepted for
+// overlap, so the tokens already signed with it can still be validated.
+// An overlap of 0 or less uses the TokenTTL of the issuer. The key is
+// only kept in memory, so it must also be set as the Signer of the
+// IssuerConfig to be used after a restart.
+func (a *Auth) RotateIssuerKey(s Signer, overlap time.Duration) error {
+	if a.issuer == nil {
+		return errors.New("issuer mode is not enabled")
+	}
+	if s == nil || s.PublicKey() == nil {
+		return errors.New("issuer key has no public key")
+	}
+	if overlap <= 0 {
+		overlap = a.issuer.conf.TokenTTL
+	}
+
+	a.issuer.keysMu.Lock()
+	defer a.issuer.keysMu.Unlock()
+
+	now := time.Now()
+	a.issuer.keys.rotate(s, now.Add(overlap), now)
+	return nil
+}
@@ -0,0 +1,121 @@
+package authsession
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+//tenantIssuers will return true if every tenant has its own issuer.
+func (a *Auth) tenantIssuers() bool {
+	return a.issuer.conf.TenantIssuers && a.tenants != nil
+}
+
+//tenantIssuerURL will return the issuer of the tenant with the id.
+func (a *Auth) tenantIssuerURL(id string) string {
+	if a.tenantFrom == TenantFromPath {
+		return a.issuer.conf.URL + "/" + id + issuerPath
+	}
+	scheme := "https"
+	if u, err := url.Parse(a.issuer.conf.URL); err == nil && u.Scheme != "" {
+		scheme = u.Scheme
+	}
+	return scheme + "://" + id + issuerPath
+}
+
+//requestIssuerBase will return the scheme, the host and the base path
+// the endpoints of the issuer serving the request are under, which is
+// the host of the tenant when the tenants come from the host. The path
+// of the request is added to it for the htu of the DPoP proofs.
+func (a *Auth) requestIssuerBase(r *http.Request) string {
+	if a.tenantIssuers() && a.tenantFrom != TenantFromPath {
+		return strings.TrimSuffix(a.requestIssuerURL(r), issuerPath)
+	}
+	return a.issuer.conf.URL
+}
+
+//requestIssuerURL will return the issuer serving the request, which is
+// the issuer of the tenant of the request when every tenant has its own
+// issuer.
+func (a *Auth) requestIssuerURL(r *http.Request) string {
+	if !a.tenantIssuers() {
+		return a.issuer.issuerURL()
+	}
+	return a.tenantIssuerURL(a.tenantID(r))
+}
+
+//issuerTenant will return the tenant of the issuer iss of a token, and
+// false if iss is not an issuer of this server. The tenant is empty when
+// the tenants don't have their own issuers.
+func (a *Auth) issuerTenant(iss string) (string, bool) {
+	if !a.tenantIssuers() {
+		return "", iss == a.issuer.issuerURL()
+	}
+
+	var id string
+	if a.tenantFrom == TenantFromPath {
+		rest, ok := strings.CutPrefix(iss, a.issuer.conf.URL+"/")
+		if !ok {
+			return "", false
+		}
+		if id, ok = strings.CutSuffix(rest, issuerPath); !ok || id == "" || strings.Contains(id, "/") {
+			return "", false
+		}
+	} else {
+		u, err := url.Parse(iss)
+		if err != nil || u.Path != issuerPath {
+			return "", false
+		}
+		id = strings.ToLower(u.Host)
+	}
+	if a.tenantIssuerURL(id) != iss {
+		return "", false
+	}
+
+	_, ok, err := a.tenants.Get(id)
+	if err != nil {
+		a.logError("error: tenant store Get failed: ", err)
+		return "", false
+	}
+	return id, ok
+}
+
+//issuerTenantHandler will only call h for a known tenant when every
+// tenant has its own issuer, so unknown tenants get no issuer.
+func (a *Auth) issuerTenantHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if a.tenantIssuers() {
+			if _, ok := a.Tenant(r); !ok {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+//clientAllowed will return true if the client may use the issuer of the
+// request, which is only limited when every tenant has its own issuer.
+func (a *Auth) clientAllowed(r *http.Request, client OIDCClient) bool {
+	if !a.tenantIssuers() || len(client.Tenants) == 0 {
+		return true
+	}
+	return slices.Contains(client.Tenants, a.tenantID(r))
+}
+
+//VerifyAccessTokenFor will verify the access token given with the request
+// like VerifyAccessToken, and also check that the token was issued for
+// the audience, like the URL of the API, so a token issued for another
+// API is not accepted.
+func (a *Auth) VerifyAccessTokenFor(r *http.Request, audience string) (AccessToken, error) {
+	at, err := a.VerifyAccessToken(r)
+	if err != nil {
+		return AccessToken{}, err
+	}
+	if !slices.Contains(at.Audiences, audience) {
+		return AccessToken{}, errors.New("access token was issued for another audience")
+	}
+	return at, nil
+}
@@ -0,0 +1,113 @@
+package authsession
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+//testLoginCookie will return the cookie of a session logged in as the
+// user, for the tenant if not empty.
+func testLoginCookie(t *testing.T, a *Auth, email string, tenant string) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest("GET", "/", nil)
+	w := httptest.NewRecorder()
+	s, _ := a.store.Get(r, "cookie-name")
+	s.Values[sessionKeyAuthenticated] = true
+	s.Values[sessionKeyEmail] = email
+	s.Values[sessionKeySID] = "sid-" + email
+	if tenant != "" {
+		s.Values[sessionKeyTenant] = tenant
+	}
+	if err := s.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	if a.sessions != nil {
+		a.sessions.Add(SessionInfo{ID: "sid-" + email, Email: email})
+	}
+	return w.Result().Cookies()[0]
+}
+
+func TestTenantIssuerDPoPToken(t *testing.T) {
+	tests := []struct {
+		name       string
+		tenantFrom TenantFrom
+		host       string
+		path       string
+		htu        string
+	}{
+		{"tenant from path", TenantFromPath, "auth.example.com", "/t1", "https://auth.example.com/t1/oidc/token"},
+		{"tenant from host", TenantFromHost, "t1.example.com", "", "https://t1.example.com/oidc/token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			signingKey, err := rsa.GenerateKey(rand.Reader, 2048)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clientKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+			clients := NewFileClientStore("")
+			clients.Put(OIDCClient{ID: "app", Secret: "s", RedirectURIs: []string{"https://app/cb"}})
+			tenants := NewFileTenantStore("")
+			tenantID := "t1"
+			if tt.tenantFrom == TenantFromHost {
+				tenantID = tt.host
+			}
+			tenants.Put(Tenant{ID: tenantID})
+
+			a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret",
+				WithSessionStore(NewFileSessionStore("")), WithTenants(tenants, tt.tenantFrom),
+				WithIssuer(IssuerConfig{URL: "https://auth.example.com", SigningKey: signingKey, Clients: clients, TenantIssuers: true, RequireDPoP: true}))
+			mux := http.NewServeMux()
+			a.register(mux)
+			cookie := testLoginCookie(t, a, "u@example.com", tenantID)
+
+			r := httptest.NewRequest("GET", "https://"+tt.host+tt.path+"/oidc/authorize?client_id=app&redirect_uri=https://app/cb&response_type=code&scope=openid", nil)
+			r.AddCookie(cookie)
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			loc, _ := url.Parse(w.Header().Get("Location"))
+			code := loc.Query().Get("code")
+			if code == "" {
+				t.Fatalf("got no code, status %v, location %v", w.Code, w.Header().Get("Location"))
+			}
+
+			form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://app/cb"}}
+			r = httptest.NewRequest("POST", "https://"+tt.host+tt.path+"/oidc/token", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.SetBasicAuth("app", "s")
+			r.Header.Set("DPoP", dpopProof(t, clientKey, nil, map[string]interface{}{
+				"jti":   "j1",
+				"htm":   "POST",
+				"htu":   tt.htu,
+				"iat":   time.Now().Unix(),
+				"nonce": a.issuer.dpop.currentNonce(),
+			}))
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, r)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %v: %v", w.Code, w.Body.String())
+			}
+			var resp struct {
+				TokenType string `json:"token_type"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			if resp.TokenType != "DPoP" {
+				t.Fatalf("got token type %v, want DPoP", resp.TokenType)
+			}
+		})
+	}
+}
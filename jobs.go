@@ -0,0 +1,217 @@
+package authsession
+
+import (
+	"context"
+	"math/rand/v2"
+	"sort"
+	"sync"
+	"time"
+)
+
+//defaultCleanupInterval is how often the janitor removes the expired
+// entries of the stores, unless set with WithJanitor.
+const defaultCleanupInterval = 10 * time.Minute
+
+//job is a task run in the background by RunJobs, like the group sync.
+type job struct {
+	name     string
+	interval time.Duration
+	run      func(ctx context.Context) error
+	//clean is set for the cleanup jobs of the janitor instead of run, and
+	// returns the number of entries removed.
+	clean func(now time.Time) (int, error)
+}
+
+//addJob will add a job to be run every interval by RunJobs.
+func (a *Auth) addJob(name string, interval time.Duration, run func(ctx context.Context) error) {
+	a.jobs = append(a.jobs, job{name: name, interval: interval, run: run})
+}
+
+//Cleaner is implemented by stores which can remove their expired
+// entries, like the file stores of the package. The janitor run by
+// RunJobs calls Cleanup for the stores set which implement it.
+type Cleaner interface {
+	//Cleanup will remove the entries expired at now, and return the
+	// number removed.
+	Cleanup(now time.Time) (int, error)
+}
+
+//JanitorConfig is how the janitor run by RunJobs cleans up the stores,
+// set with WithJanitor.
+type JanitorConfig struct {
+	//Interval is how often the cleanup jobs are run, and 10 minutes if
+	// zero.
+	Interval time.Duration
+	//Intervals are the intervals of single cleanup jobs, by name, like
+	// "sessions", "bans", "refresh tokens", "pending logins", "codes",
+	// "token denylist" and "throttle".
+	Intervals map[string]time.Duration
+	//Jitter is the max random time added to every wait between the runs
+	// of all the jobs, so many instances don't run them at the same time.
+	Jitter time.Duration
+	//Disabled turns the cleanup jobs off.
+	Disabled bool
+}
+
+//JobStats are the counts of a background job.
+type JobStats struct {
+	Name     string `json:"name"`
+	Runs     int    `json:"runs"`
+	Failures int    `json:"failures"`
+	//Removed is the number of expired entries removed by a cleanup job.
+	Removed      int           `json:"removed"`
+	LastRun      time.Time     `json:"lastRun"`
+	LastDuration time.Duration `json:"lastDuration"`
+	LastError    string        `json:"lastError,omitempty"`
+}
+
+//jobStats keeps the stats of the jobs, by name.
+type jobStats struct {
+	mu    sync.Mutex
+	stats map[string]*JobStats
+}
+
+//record will record a run of the job.
+func (s *jobStats) record(name string, start time.Time, removed int, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.stats == nil {
+		s.stats = map[string]*JobStats{}
+	}
+	st, ok := s.stats[name]
+	if !ok {
+		st = &JobStats{Name: name}
+		s.stats[name] = st
+	}
+	st.Runs++
+	st.Removed += removed
+	st.LastRun = start
+	st.LastDuration = time.Since(start)
+	st.LastError = ""
+	if err != nil {
+		st.Failures++
+		st.LastError = err.Error()
+	}
+}
+
+//JobStats will return the stats of the background jobs run by RunJobs,
+// sorted by name.
+func (a *Auth) JobStats() []JobStats {
+	a.jobStats.mu.Lock()
+	defer a.jobStats.mu.Unlock()
+
+	var stats []JobStats
+	for _, st := range a.jobStats.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+	return stats
+}
+
+//cleanupJobs will return the jobs of the janitor, for the stores set
+// which can be cleaned up.
+func (a *Auth) cleanupJobs() []job {
+	if a.janitor.Disabled {
+		return nil
+	}
+
+	var jobs []job
+	add := func(name string, clean func(now time.Time) (int, error)) {
+		interval := a.janitor.Intervals[name]
+		if interval <= 0 {
+			interval = a.janitor.Interval
+		}
+		if interval <= 0 {
+			interval = defaultCleanupInterval
+		}
+		jobs = append(jobs, job{name: "cleanup " + name, interval: interval, clean: clean})
+	}
+
+	if c, ok := unwrapStore(a.sessions).(Cleaner); ok {
+		add("sessions", c.Cleanup)
+	}
+	if c, ok := unwrapStore(a.bans).(Cleaner); ok {
+		add("bans", c.Cleanup)
+	}
+	if a.issuer != nil {
+		if c, ok := a.issuer.conf.RefreshTokens.(Cleaner); ok {
+			add("refresh tokens", c.Cleanup)
+		}
+		if c, ok := a.issuer.conf.ReferenceTokens.(Cleaner); ok {
+			add("reference tokens", c.Cleanup)
+		}
+		add("codes", func(now time.Time) (int, error) {
+			return a.issuer.cleanupCodes(now), nil
+		})
+	}
+	add("pending logins", func(now time.Time) (int, error) {
+		return a.pending.cleanup(now, a.stateTTL), nil
+	})
+	if a.denylist != nil {
+		if c, ok := a.denylist.store.(Cleaner); ok {
+			add("token denylist", c.Cleanup)
+		}
+	}
+	if a.throttle != nil {
+		add("throttle", func(now time.Time) (int, error) {
+			return a.throttle.cleanup(now), nil
+		})
+	}
+	if a.users != nil && a.privacy.retains() {
+		add("personal data", a.purgePersonalData)
+	}
+	if a.honeypot != nil {
+		add("honeypot", func(now time.Time) (int, error) {
+			return a.honeypot.cleanup(now), nil
+		})
+	}
+	return jobs
+}
+
+//RunJobs will run the background jobs, like the group sync set with
+// WithGroupSync, and the janitor removing the expired entries of the
+// stores, until ctx is done. Each job is run at once, and then every
+// interval, and a run is never started before the last run of the same
+// job is done. Errors are logged, and the counts are given by JobStats.
+// RunJobs returns when all the jobs have stopped.
+func (a *Auth) RunJobs(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, j := range append(append([]job{}, a.jobs...), a.cleanupJobs()...) {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+
+			for {
+				start := time.Now()
+				var removed int
+				var err error
+				if j.clean != nil {
+					removed, err = j.clean(start)
+				} else {
+					err = j.run(ctx)
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				a.jobStats.record(j.name, start, removed, err)
+				if err != nil {
+					a.logError("error: job "+j.name+": ", err)
+				}
+
+				wait := j.interval
+				if a.janitor.Jitter > 0 {
+					wait += rand.N(a.janitor.Jitter)
+				}
+				timer := time.NewTimer(wait)
+				select {
+				case <-timer.C:
+				case <-ctx.Done():
+					timer.Stop()
+					return
+				}
+			}
+		}(j)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,80 @@
+package authsession
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+//KeyEncoding is how a KeyGenerator encodes the keys as strings.
+type KeyEncoding int
+
+const (
+	//KeyBase64URL is base64url without padding, as used in tokens.
+	KeyBase64URL KeyEncoding = iota
+	//KeyBase64URLPadded is base64url with padding.
+	KeyBase64URLPadded
+	//KeyHex is lower case hex.
+	KeyHex
+)
+
+//defaultKeySize is the size in bytes of the keys when no size is given.
+const defaultKeySize = 32
+
+//KeyGenerator makes random keys, like states, nonces, session IDs and API
+// keys. The zero KeyGenerator makes 32 byte keys encoded as base64url,
+// read from crypto/rand.
+type KeyGenerator struct {
+	//Size is the number of random bytes of the keys, and 32 if zero.
+	Size int
+	//Encoding is how the keys are encoded by Key.
+	Encoding KeyEncoding
+	//Rand is where the random bytes are read from, and crypto/rand if
+	// nil. Tests can give a reader with known bytes.
+	Rand io.Reader
+}
+
+//Bytes will return a key of random bytes.
+func (g KeyGenerator) Bytes() ([]byte, error) {
+	size := g.Size
+	if size <= 0 {
+		size = defaultKeySize
+	}
+	src := g.Rand
+	if src == nil {
+		src = rand.Reader
+	}
+
+	b := make([]byte, size)
+	if _, err := io.ReadFull(src, b); err != nil {
+		return nil, fmt.Errorf("failed reading random bytes: %v", err)
+	}
+	return b, nil
+}
+
+//Key will return a random key, encoded as set by Encoding.
+func (g KeyGenerator) Key() (string, error) {
+	b, err := g.Bytes()
+	if err != nil {
+		return "", err
+	}
+
+	switch g.Encoding {
+	case KeyBase64URL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	case KeyBase64URLPadded:
+		return base64.URLEncoding.EncodeToString(b), nil
+	case KeyHex:
+		return hex.EncodeToString(b), nil
+	default:
+		return "", fmt.Errorf("unknown key encoding %v", g.Encoding)
+	}
+}
+
+//newKey will return a random key of size bytes with the encoding, read
+// from the random source set with WithRandomSource.
+func (a *Auth) newKey(size int, enc KeyEncoding) (string, error) {
+	return KeyGenerator{Size: size, Encoding: enc, Rand: a.random}.Key()
+}
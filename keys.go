@@ -0,0 +1,91 @@
+package authsession
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/gorilla/securecookie"
+)
+
+//cookieMaxAge is the max age used when validating the cookies, and is
+// the same as the default used by sessions.NewCookieStore.
+const cookieMaxAge = 86400 * 30
+
+//rotatingCodec is a securecookie.Codec that holds the keys and codecs
+// used by the cookie store, so the keys can be rotated while the server
+// is running. The first codec is used to encode, and all of them are
+// tried when decoding.
+type rotatingCodec struct {
+	mu     sync.RWMutex
+	keys   [][]byte
+	codecs []securecookie.Codec
+}
+
+//newRotatingCodec will return a *rotatingCodec using keys, where the
+// first key is used for new cookies.
+func newRotatingCodec(keys [][]byte) *rotatingCodec {
+	r := &rotatingCodec{}
+	for _, k := range keys {
+		r.keys = append(r.keys, k)
+		r.codecs = append(r.codecs, securecookie.New(k, nil).MaxAge(cookieMaxAge))
+	}
+	return r
+}
+
+//cookieKeys will return a copy of the keys in use.
+func (r *rotatingCodec) cookieKeys() [][]byte {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return append([][]byte(nil), r.keys...)
+}
+
+//Encode will encode the value with the first codec.
+func (r *rotatingCodec) Encode(name string, value interface{}) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if len(r.codecs) == 0 {
+		return "", errors.New("no cookie keys")
+	}
+	return r.codecs[0].Encode(name, value)
+}
+
+//Decode will decode the value with the first codec that works.
+func (r *rotatingCodec) Decode(name, value string, dst interface{}) error {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return securecookie.DecodeMulti(name, value, dst, r.codecs...)
+}
+
+//rotate will put a new codec for key first, and keep at most keep
+// codecs in total. A keep less than 1 will keep all the codecs.
+func (r *rotatingCodec) rotate(key []byte, keep int) {
+	c := securecookie.New(key, nil).MaxAge(cookieMaxAge)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.keys = append([][]byte{key}, r.keys...)
+	r.codecs = append([]securecookie.Codec{c}, r.codecs...)
+	if keep > 0 && len(r.codecs) > keep {
+		r.keys = r.keys[:keep]
+		r.codecs = r.codecs[:keep]
+	}
+}
+
+//RotateCookieKey will start using key for all new cookies, while the
+// older keys are still used to decode existing cookies. At most keep
+// keys are kept in total, and a keep less than 1 will keep all the keys.
+// The new key is only kept in memory, so it must also be stored in the
+// config for the web server to use it after a restart.
+func (a *Auth) RotateCookieKey(key []byte, keep int) error {
+	if len(key) == 0 {
+		return errors.New("cookie key is empty")
+	}
+
+	a.codec.rotate(key, keep)
+
+	return nil
+}
@@ -0,0 +1,336 @@
+package authsession
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+//LDAPConfig is the configuration for authenticating users with an LDAP
+// or Active Directory server, by binding as the user.
+type LDAPConfig struct {
+	//URL is the address of the server, like ldaps://ldap.example.com:636
+	// or ldap://ldap.example.com:389.
+	URL string
+	//StartTLS will upgrade a ldap:// connection to TLS.
+	StartTLS bool
+	//TLSConfig is used for ldaps:// and StartTLS. The default config is
+	// used if nil.
+	TLSConfig *tls.Config
+	//BindDNTemplate is used to create the DN to bind with from the
+	// username, like uid=%s,ou=people,dc=example,dc=com for LDAP, or
+	// %s@corp.example.com for Active Directory.
+	BindDNTemplate string
+	//BaseDN is where the user is searched for after binding.
+	BaseDN string
+	//UserFilter finds the user after binding, like (uid=%s) for LDAP
+	// or (sAMAccountName=%s) for Active Directory.
+	UserFilter string
+	//IDAttribute, EmailAttribute and NameAttribute are the attributes
+	// for the user ID, email and full name. Defaults to uid, mail and cn.
+	IDAttribute    string
+	EmailAttribute string
+	NameAttribute  string
+	//GroupAttribute is the attribute listing the groups of the user.
+	// Defaults to memberOf.
+	GroupAttribute string
+	//GroupRoles maps the DN of a group to the role given to its members.
+	GroupRoles map[string]string
+	//PoolSize is the number of idle connections kept open. Defaults to 4.
+	PoolSize int
+	//Timeout is used for connecting and for each request. Defaults to 10s.
+	Timeout time.Duration
+}
+
+//LDAPAuthenticator will authenticate users by binding to the LDAP server
+// as the user, and read the attributes and the groups of the user.
+type LDAPAuthenticator struct {
+	conf LDAPConfig
+	pool chan *ldap.Conn
+}
+
+//NewLDAPAuthenticator will return a *LDAPAuthenticator using the config,
+// with the defaults filled in.
+func NewLDAPAuthenticator(c LDAPConfig) *LDAPAuthenticator {
+	if c.IDAttribute == "" {
+		c.IDAttribute = "uid"
+	}
+	if c.EmailAttribute == "" {
+		c.EmailAttribute = "mail"
+	}
+	if c.NameAttribute == "" {
+		c.NameAttribute = "cn"
+	}
+	if c.GroupAttribute == "" {
+		c.GroupAttribute = "memberOf"
+	}
+	if c.PoolSize <= 0 {
+		c.PoolSize = 4
+	}
+	if c.Timeout <= 0 {
+		c.Timeout = 10 * time.Second
+	}
+
+	return &LDAPAuthenticator{
+		conf: c,
+		pool: make(chan *ldap.Conn, c.PoolSize),
+	}
+}
+
+//conn will return an idle connection from the pool, or a new one.
+func (l *LDAPAuthenticator) conn() (*ldap.Conn, error) {
+	for {
+		select {
+		case c := <-l.pool:
+			if c.IsClosing() {
+				continue
+			}
+			return c, nil
+		default:
+			return l.dial()
+		}
+	}
+}
+
+//dial will open a new connection to the server.
+func (l *LDAPAuthenticator) dial() (*ldap.Conn, error) {
+	tlsConfig := l.conf.TLSConfig
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+
+	c, err := ldap.DialURL(l.conf.URL, ldap.DialWithTLSConfig(tlsConfig))
+	if err != nil {
+		return nil, fmt.Errorf("failed connecting to ldap server: %v", err)
+	}
+	c.SetTimeout(l.conf.Timeout)
+
+	if l.conf.StartTLS {
+		if err := c.StartTLS(tlsConfig); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("ldap StartTLS failed: %v", err)
+		}
+	}
+
+	return c, nil
+}
+
+//release will put the connection back in the pool, or close it if
+// the pool is full.
+func (l *LDAPAuthenticator) release(c *ldap.Conn) {
+	select {
+	case l.pool <- c:
+	default:
+		c.Close()
+	}
+}
+
+//Close will close the idle connections in the pool.
+func (l *LDAPAuthenticator) Close() error {
+	for {
+		select {
+		case c := <-l.pool:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+//ErrInvalidCredentials is returned when the username or password is wrong.
+var ErrInvalidCredentials = errors.New("invalid username or password")
+
+//Authenticate will bind to the server as the user, and return the user
+// with the roles given by the groups of the user.
+func (l *LDAPAuthenticator) Authenticate(username string, password string) (User, []string, error) {
+	var u User
+
+	//An empty password would do an unauthenticated bind, which will
+	// succeed for any username.
+	if username == "" || password == "" {
+		return u, nil, ErrInvalidCredentials
+	}
+
+	c, err := l.conn()
+	if err != nil {
+		return u, nil, err
+	}
+
+	bindDN := fmt.Sprintf(l.conf.BindDNTemplate, ldap.EscapeDN(username))
+	if err := c.Bind(bindDN, password); err != nil {
+		if ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+			l.release(c)
+			return u, nil, ErrInvalidCredentials
+		}
+		c.Close()
+		return u, nil, fmt.Errorf("ldap bind failed: %v", err)
+	}
+
+	req := ldap.NewSearchRequest(
+		l.conf.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(l.conf.Timeout.Seconds()), false,
+		fmt.Sprintf(l.conf.UserFilter, ldap.EscapeFilter(username)),
+		[]string{l.conf.IDAttribute, l.conf.EmailAttribute, l.conf.NameAttribute, l.conf.GroupAttribute},
+		nil,
+	)
+	res, err := c.Search(req)
+	if err != nil {
+		c.Close()
+		return u, nil, fmt.Errorf("ldap search for user failed: %v", err)
+	}
+	l.release(c)
+
+	if len(res.Entries) != 1 {
+		return u, nil, fmt.Errorf("ldap search for user %q returned %d entries", username, len(res.Entries))
+	}
+	e := res.Entries[0]
+
+	u = User{
+		ID:       e.GetAttributeValue(l.conf.IDAttribute),
+		Email:    e.GetAttributeValue(l.conf.EmailAttribute),
+		FullName: e.GetAttributeValue(l.conf.NameAttribute),
+	}
+	if u.ID == "" {
+		u.ID = e.DN
+	}
+
+	var roles []string
+	for _, g := range e.GetAttributeValues(l.conf.GroupAttribute) {
+		for dn, role := range l.conf.GroupRoles {
+			if strings.EqualFold(dn, g) {
+				roles = append(roles, role)
+			}
+		}
+	}
+
+	return u, roles, nil
+}
+
+//ldapLoginTemplate is the login form for LDAP users.
+var ldapLoginTemplate = template.Must(template.New("ldaplogin").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Login</title></head>
+<body>
+<form method="POST">
+{{if .Error}}<p>{{.Error}}</p>{{end}}
+<p><label>Username <input type="text" name="username" autocomplete="username" required></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password" required></label></p>
+<input type="hidden" name="login_token" value="{{.Token}}">
+<button type="submit">Login</button>
+</form>
+</body>
+</html>
+`))
+
+//ldapLogin will render the login form on GET, and authenticate the user
+// with the LDAP server on POST. The form carries a one time token stored
+// in the session, so other sites can't log users in with their own account.
+func (a *Auth) ldapLogin(w http.ResponseWriter, r *http.Request) {
+	if a.banned(r) {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if closed, msgKey, until := a.loginClosed("ldap", time.Now()); closed {
+		a.renderMaintenance(w, r, msgKey, until)
+		return
+	}
+
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in /slogin/ldap: ", err)
+	}
+
+	renderForm := func(status int, msg string) {
+		token, err := a.newKey(16, KeyBase64URLPadded)
+		if err != nil {
+			a.logRequestError(r, "error: failed to create login token: ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		session.Values["logintoken"] = token
+		a.setTenantCookiePath(r, session.Options)
+		if err := session.Save(r, w); err != nil {
+			a.logRequestError(r, "error: session.Save on /slogin/ldap: ", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		err = ldapLoginTemplate.Execute(w, struct {
+			Token string
+			Error string
+		}{token, msg})
+		if err != nil {
+			a.logRequestError(r, "error: executing ldap login template: ", err)
+		}
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		renderForm(http.StatusOK, "")
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _ := session.Values["logintoken"].(string)
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue("login_token"))) != 1 {
+		renderForm(http.StatusForbidden, a.message(r, "login_failed.form_expired"))
+		return
+	}
+	delete(session.Values, "logintoken")
+
+	username := r.PostFormValue("username")
+	if wait := a.loginWait(r, username); wait > 0 {
+		a.renderThrottled(w, r, wait)
+		return
+	}
+	u, roles, err := a.ldap.Authenticate(username, r.PostFormValue("password"))
+	if err != nil {
+		if !errors.Is(err, ErrInvalidCredentials) {
+			a.logRequestError(r, "error: ldap: ", err)
+		}
+		a.events.failure(r, username, "ldap: "+err.Error())
+		renderForm(http.StatusUnauthorized, a.message(r, "login_failed.credentials"))
+		return
+	}
+
+	if !a.loginAllowed(r, u.Email) {
+		a.events.failure(r, u.Email, "login not allowed")
+		a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+		return
+	}
+	if !a.postLogin(r, nil, Profile{User: u, Provider: "ldap"}) {
+		a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+		return
+	}
+
+	u.Roles = roles
+	a.rememberReturnTo(r, session)
+	returnTo := a.returnTo(r, session)
+	if err := a.startSession(w, r, session, u, "ldap"); errors.Is(err, ErrTooManySessions) {
+		a.events.failure(r, u.Email, err.Error())
+		a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{Message: a.message(r, "login_failed.too_many_sessions"), LoginURL: a.tenantPath(r, "/slogin/ldap")})
+		return
+	} else if errors.Is(err, ErrLoginRiskDenied) {
+		a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{Message: a.message(r, "login_failed.risk"), LoginURL: a.tenantPath(r, "/slogin/ldap")})
+		return
+	} else if err != nil {
+		a.logRequestError(r, "error: starting session on /slogin/ldap: ", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	a.loginSucceeded(w, r, session, u, returnTo)
+}
@@ -0,0 +1,189 @@
+package authsession
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//LoginWindow is a time of the week when logins are allowed, like from
+// 07:00 to 18:00 on weekdays.
+type LoginWindow struct {
+	//Days are the days of the window, and no days is every day.
+	Days []time.Weekday
+	//Start and End are the time of day the window starts and ends, like
+	// 7*time.Hour. An End before the Start ends the window the next day.
+	Start time.Duration
+	End   time.Duration
+	//Location is the time zone of the window, and nil is time.Local.
+	Location *time.Location
+}
+
+//location will return the time zone of the window.
+func (lw LoginWindow) location() *time.Location {
+	if lw.Location == nil {
+		return time.Local
+	}
+	return lw.Location
+}
+
+//startsOn will return true if the window starts on the day.
+func (lw LoginWindow) startsOn(day time.Weekday) bool {
+	if len(lw.Days) == 0 {
+		return true
+	}
+	for _, d := range lw.Days {
+		if d == day {
+			return true
+		}
+	}
+	return false
+}
+
+//contains will return true if t is within the window.
+func (lw LoginWindow) contains(t time.Time) bool {
+	t = t.In(lw.location())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for _, day := range []time.Time{midnight, midnight.AddDate(0, 0, -1)} {
+		if !lw.startsOn(day.Weekday()) {
+			continue
+		}
+		start, end := day.Add(lw.Start), day.Add(lw.End)
+		if lw.End <= lw.Start {
+			end = end.AddDate(0, 0, 1)
+		}
+		if !t.Before(start) && t.Before(end) {
+			return true
+		}
+	}
+	return false
+}
+
+//nextStart will return the next time after t the window starts.
+func (lw LoginWindow) nextStart(t time.Time) time.Time {
+	t = t.In(lw.location())
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	for i := 0; i <= 7; i++ {
+		day := midnight.AddDate(0, 0, i)
+		if start := day.Add(lw.Start); lw.startsOn(day.Weekday()) && start.After(t) {
+			return start
+		}
+	}
+	return time.Time{}
+}
+
+//MaintenanceWindow is a time when new logins are disabled.
+type MaintenanceWindow struct {
+	Start time.Time
+	End   time.Time
+}
+
+//LoginPolicy restricts when users can log in. It is set with
+// WithLoginPolicy.
+type LoginPolicy struct {
+	//LoginHours are the windows when logins are allowed, and no windows
+	// allows logins at any time.
+	LoginHours []LoginWindow
+	//ProviderLoginHours replaces LoginHours for the logins with the
+	// provider, keyed by the ID of the provider, where "" is the default
+	// provider and "ldap" is the LDAP login.
+	ProviderLoginHours map[string][]LoginWindow
+	//Maintenance are the windows when new logins are disabled. They can
+	// be replaced while running with SetMaintenance.
+	Maintenance []MaintenanceWindow
+	//FreezeSessions makes the sessions not accepted by IsAuthenticated
+	// during maintenance too, instead of letting users logged in continue.
+	FreezeSessions bool
+}
+
+//loginPolicy is the LoginPolicy in use, where the maintenance windows
+// can be changed while running.
+type loginPolicy struct {
+	mu     sync.RWMutex
+	policy LoginPolicy
+}
+
+//maintenance will return the maintenance window t is within, and false
+// if there is none.
+func (p *loginPolicy) maintenance(t time.Time) (MaintenanceWindow, bool) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	for _, m := range p.policy.Maintenance {
+		if !t.Before(m.Start) && t.Before(m.End) {
+			return m, true
+		}
+	}
+	return MaintenanceWindow{}, false
+}
+
+//SetMaintenance will replace the maintenance windows of the login policy,
+// like to disable new logins right away with a window from now. No
+// windows ends the maintenance.
+func (a *Auth) SetMaintenance(windows ...MaintenanceWindow) {
+	a.loginPolicy.mu.Lock()
+	defer a.loginPolicy.mu.Unlock()
+
+	a.loginPolicy.policy.Maintenance = append([]MaintenanceWindow(nil), windows...)
+}
+
+//loginClosed will return true if logins with the provider are not
+// allowed at t by the login policy, with the key of the message telling
+// why, and when logins are allowed again if known.
+func (a *Auth) loginClosed(providerID string, t time.Time) (bool, string, time.Time) {
+	if m, ok := a.loginPolicy.maintenance(t); ok {
+		return true, "maintenance.text", m.End
+	}
+
+	a.loginPolicy.mu.RLock()
+	windows, ok := a.loginPolicy.policy.ProviderLoginHours[providerID]
+	if !ok {
+		windows = a.loginPolicy.policy.LoginHours
+	}
+	a.loginPolicy.mu.RUnlock()
+	if len(windows) == 0 {
+		return false, "", time.Time{}
+	}
+
+	var next time.Time
+	for _, lw := range windows {
+		if lw.contains(t) {
+			return false, "", time.Time{}
+		}
+		if s := lw.nextStart(t); !s.IsZero() && (next.IsZero() || s.Before(next)) {
+			next = s
+		}
+	}
+	return true, "maintenance.login_hours", next
+}
+
+//sessionsFrozen will return true if the sessions are not accepted at t
+// because of maintenance, and when the maintenance ends.
+func (a *Auth) sessionsFrozen(t time.Time) (bool, time.Time) {
+	a.loginPolicy.mu.RLock()
+	freeze := a.loginPolicy.policy.FreezeSessions
+	a.loginPolicy.mu.RUnlock()
+	if !freeze {
+		return false, time.Time{}
+	}
+	m, ok := a.loginPolicy.maintenance(t)
+	return ok, m.End
+}
+
+//setRetryAfter will set the Retry-After header to the seconds until the
+// time, unless it is zero.
+func setRetryAfter(w http.ResponseWriter, until time.Time) {
+	if !until.IsZero() {
+		if s := int(time.Until(until).Seconds()); s > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(s))
+		}
+	}
+}
+
+//renderMaintenance will render the come back later page, with the
+// message and when to come back if known.
+func (a *Auth) renderMaintenance(w http.ResponseWriter, r *http.Request, msgKey string, until time.Time) {
+	setRetryAfter(w, until)
+	a.renderPage(w, r, http.StatusServiceUnavailable, pageMaintenance, PageData{Message: a.message(r, msgKey), Until: until})
+}
@@ -0,0 +1,67 @@
+package authsession
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+//LoginSuccessHandler is called as the last step of a successful login,
+// when the session is started, instead of the redirect to the page the
+// user came from. It can render JSON for a popup of a single-page app,
+// redirect to a deep link, or post a message to window.opener. Where the
+// user would have been redirected is given by LoginRedirect.
+type LoginSuccessHandler func(w http.ResponseWriter, r *http.Request, u User)
+
+//loginRedirectKey is the context key of the redirect after login.
+type loginRedirectKey struct{}
+
+//LoginRedirect will return where the user would be redirected after the
+// login, in the request given to a LoginSuccessHandler. It is the page
+// the user came from, or the terms page or the page of a profile step if
+// the user has to do them first.
+func LoginRedirect(ctx context.Context) string {
+	p, _ := ctx.Value(loginRedirectKey{}).(string)
+	return p
+}
+
+//afterLogin will return where to redirect the user after starting the
+// session, which is the terms page if the user has to accept the terms
+// first, the page of the first profile step not done, or returnTo.
+func (a *Auth) afterLogin(r *http.Request, session *sessions.Session, returnTo string) string {
+	if a.termsPending(r, session.Values) {
+		return a.termsURL(r, returnTo)
+	}
+	if s, pending := a.pendingProfileStep(r, session); pending {
+		return a.profileStepURL(r, s, returnTo)
+	}
+	return returnTo
+}
+
+//loginSucceeded will finish the login of u by posting the result to the
+// opener of a popup login, calling the handler set with
+// WithLoginSuccessHandler, or redirecting to returnTo or the pages
+// the user has to go through first.
+func (a *Auth) loginSucceeded(w http.ResponseWriter, r *http.Request, session *sessions.Session, u User, returnTo string) {
+	target := a.safeRedirectTarget(r, a.afterLogin(r, session, returnTo))
+	if popup, _ := session.Values["popup"].(bool); popup && a.popupOrigins != nil {
+		//Remove the popup from the session, so the pages shown later in
+		// the session are not rendered for a popup.
+		delete(session.Values, "popup")
+		a.setTenantCookiePath(r, session.Options)
+		if err := session.Save(r, w); err != nil {
+			a.logRequestError(r, "error: session.Save after popup login failed: ", err)
+		}
+		a.renderPopup(w, r, http.StatusOK, popupResult{Success: true, Email: u.Email, Redirect: target})
+		return
+	}
+	if a.loginSuccess != nil {
+		a.loginSuccess(w, r.WithContext(context.WithValue(r.Context(), loginRedirectKey{}, target)), u)
+		return
+	}
+
+	//Redirect with 303, so the code and state are replaced in the address
+	// bar and the history, and a POST callback is not sent again.
+	http.Redirect(w, r, target, http.StatusSeeOther)
+}
@@ -0,0 +1,50 @@
+package authsession
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+)
+
+//LogIdentifiers is how the users are named in the routine logs, set with
+// WithLogIdentifiers. The emails and user IDs are logged as keyed hashes by
+// default, like "user:1f0c3a9be27d4d51", so the lines of a user can be
+// followed without the logs holding the email. The events written to the
+// event sink keep the real values, for the audit.
+type LogIdentifiers struct {
+	//Salt is the secret of the deployment the identifiers are hashed
+	// with, so a user has the same hash in all the logs of the deployment,
+	// and the hashes can't be reversed by hashing known emails without it.
+	// If empty, a salt is derived from the first cookie key, which changes
+	// when the cookie keys are rotated.
+	Salt string
+	//Plain will log the identifiers as they are, like for development.
+	Plain bool
+}
+
+//logIdentifierPrefix is the prefix of the hashed identifiers in the logs.
+const logIdentifierPrefix = "user:"
+
+//setLogSalt will set the salt the identifiers in the logs are hashed with,
+// from the LogIdentifiers, or derived from the first cookie key.
+func (a *Auth) setLogSalt() {
+	if a.logIdentifiers.Salt != "" {
+		a.logSalt = []byte(a.logIdentifiers.Salt)
+		return
+	}
+	mac := hmac.New(sha256.New, a.codec.cookieKeys()[0])
+	mac.Write([]byte("authsession log identifiers"))
+	a.logSalt = mac.Sum(nil)
+}
+
+//LogIdentifier will return the user with the email or ID id as named in
+// the logs, like to find the log lines of a user from an audit event.
+func (a *Auth) LogIdentifier(id string) string {
+	if id == "" || a.logIdentifiers.Plain {
+		return id
+	}
+	mac := hmac.New(sha256.New, a.logSalt)
+	mac.Write([]byte(strings.ToLower(strings.TrimSpace(id))))
+	return logIdentifierPrefix + hex.EncodeToString(mac.Sum(nil)[:8])
+}
@@ -0,0 +1,177 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"log"
+	"net/mail"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+//Message is an email sent to users, like a magic link, a password reset
+// or a security notification.
+type Message struct {
+	To      []string `json:"to"`
+	Subject string   `json:"subject"`
+	//Text is the plain text body.
+	Text string `json:"text"`
+	//HTML is the HTML body, which is optional.
+	HTML string `json:"html,omitempty"`
+}
+
+//validate will check that the message has recipients with valid
+// addresses, and a subject and addresses without line breaks, so no
+// headers can be added through them.
+func (m Message) validate() error {
+	if len(m.To) == 0 {
+		return errors.New("the message has no recipients")
+	}
+	for _, to := range m.To {
+		if strings.ContainsAny(to, "\r\n") {
+			return fmt.Errorf("recipient %q has line breaks", to)
+		}
+		if _, err := mail.ParseAddress(to); err != nil {
+			return fmt.Errorf("recipient %q is not valid: %v", to, err)
+		}
+	}
+	if strings.ContainsAny(m.Subject, "\r\n") {
+		return errors.New("the subject has line breaks")
+	}
+	if m.Text == "" && m.HTML == "" {
+		return errors.New("the message has no body")
+	}
+	return nil
+}
+
+//Mailer sends the emails to users. It is set with WithMailer.
+type Mailer interface {
+	//Send will send the message.
+	Send(ctx context.Context, m Message) error
+}
+
+//MailTemplate makes the messages of a kind of email from the data given.
+// The HTML template is optional.
+type MailTemplate struct {
+	Subject *texttemplate.Template
+	Text    *texttemplate.Template
+	HTML    *htmltemplate.Template
+}
+
+//Message will execute the templates with data, and return the message to
+// send to the recipients.
+func (t MailTemplate) Message(data interface{}, to ...string) (Message, error) {
+	m := Message{To: to}
+
+	var b bytes.Buffer
+	if err := t.Subject.Execute(&b, data); err != nil {
+		return m, fmt.Errorf("failed executing the subject template: %v", err)
+	}
+	m.Subject = strings.TrimSpace(b.String())
+
+	b.Reset()
+	if err := t.Text.Execute(&b, data); err != nil {
+		return m, fmt.Errorf("failed executing the text template: %v", err)
+	}
+	m.Text = b.String()
+
+	if t.HTML != nil {
+		b.Reset()
+		if err := t.HTML.Execute(&b, data); err != nil {
+			return m, fmt.Errorf("failed executing the html template: %v", err)
+		}
+		m.HTML = b.String()
+	}
+
+	return m, nil
+}
+
+//permanentMailError is an error from a mail server or API which will not
+// go away by trying again, like a rejected recipient.
+type permanentMailError struct {
+	err error
+}
+
+func (e *permanentMailError) Error() string { return e.err.Error() }
+func (e *permanentMailError) Unwrap() error { return e.err }
+
+//retryMailer is a Mailer trying to send again with backoff when sending
+// fails, unless the error is permanent.
+type retryMailer struct {
+	mailer   Mailer
+	attempts int
+	backoff  time.Duration
+}
+
+//NewRetryMailer will return a Mailer sending with m, and trying again up to
+// attempts times in total when sending fails. The wait before the second
+// attempt is backoff, which is doubled for every attempt after. Messages
+// rejected by the server, like for an unknown recipient, are not retried.
+func NewRetryMailer(m Mailer, attempts int, backoff time.Duration) Mailer {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return &retryMailer{mailer: m, attempts: attempts, backoff: backoff}
+}
+
+//Send will send the message, and try again if it fails.
+func (r *retryMailer) Send(ctx context.Context, m Message) error {
+	var err error
+	wait := r.backoff
+	for attempt := 0; attempt < r.attempts; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(wait):
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			wait *= 2
+		}
+
+		err = r.mailer.Send(ctx, m)
+		var permanent *permanentMailError
+		if err == nil || errors.As(err, &permanent) || ctx.Err() != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("sending mail failed after %d attempts: %w", r.attempts, err)
+}
+
+//DryRunMailer is a Mailer which logs the messages and keeps them in
+// memory instead of sending them, for tests and development.
+type DryRunMailer struct {
+	mu       sync.Mutex
+	messages []Message
+}
+
+//NewDryRunMailer will return a *DryRunMailer.
+func NewDryRunMailer() *DryRunMailer {
+	return &DryRunMailer{}
+}
+
+//Send will log and keep the message.
+func (d *DryRunMailer) Send(ctx context.Context, m Message) error {
+	if err := m.validate(); err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log.Printf("info: dry run mail to %v: %v\n", strings.Join(m.To, ", "), m.Subject)
+	d.messages = append(d.messages, m)
+	return nil
+}
+
+//Messages will return the messages sent, oldest first.
+func (d *DryRunMailer) Messages() []Message {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return append([]Message{}, d.messages...)
+}
@@ -0,0 +1,103 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+//SendGridMailer is a Mailer sending with the SendGrid v3 mail send API.
+type SendGridMailer struct {
+	apiKey  string
+	from    string
+	client  *http.Client
+	baseURL string
+}
+
+//NewSendGridMailer will return a *SendGridMailer sending from the address
+// from, with the SendGrid API key.
+func NewSendGridMailer(apiKey string, from string) *SendGridMailer {
+	return &SendGridMailer{
+		apiKey:  apiKey,
+		from:    from,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		baseURL: "https://api.sendgrid.com",
+	}
+}
+
+//Send will send the message.
+func (s *SendGridMailer) Send(ctx context.Context, m Message) error {
+	if err := m.validate(); err != nil {
+		return &permanentMailError{err}
+	}
+
+	type address struct {
+		Email string `json:"email"`
+	}
+	type content struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	body := struct {
+		Personalizations []struct {
+			To []address `json:"to"`
+		} `json:"personalizations"`
+		From    address   `json:"from"`
+		Subject string    `json:"subject"`
+		Content []content `json:"content"`
+	}{
+		From:    address{s.from},
+		Subject: m.Subject,
+	}
+	body.Personalizations = make([]struct {
+		To []address `json:"to"`
+	}, 1)
+	for _, to := range m.To {
+		body.Personalizations[0].To = append(body.Personalizations[0].To, address{to})
+	}
+	if m.Text != "" {
+		body.Content = append(body.Content, content{"text/plain", m.Text})
+	}
+	if m.HTML != "" {
+		body.Content = append(body.Content, content{"text/html", m.HTML})
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return &permanentMailError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.baseURL+"/v3/mail/send", bytes.NewReader(b))
+	if err != nil {
+		return &permanentMailError{err}
+	}
+	req.Header.Set("Authorization", "Bearer "+s.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+
+	return doMailRequest(s.client, req, "sendgrid")
+}
+
+//doMailRequest will do the request to a mail API, and return an error if
+// it didn't succeed. Errors for 4xx statuses other than 429 are permanent.
+func doMailRequest(client *http.Client, req *http.Request, api string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("sending mail with %v failed: %v", api, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		io.Copy(io.Discard, resp.Body)
+		return nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	err = fmt.Errorf("sending mail with %v failed: %v: %s", api, resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode >= 400 && resp.StatusCode < 500 && resp.StatusCode != http.StatusTooManyRequests {
+		return &permanentMailError{err}
+	}
+	return err
+}
@@ -0,0 +1,143 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//SESMailer is a Mailer sending with the Amazon SES v2 API.
+type SESMailer struct {
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	from            string
+	client          *http.Client
+	endpoint        string
+}
+
+//NewSESMailer will return a *SESMailer sending from the address from,
+// which must be verified in SES, with the SES API in the AWS region. The
+// requests are signed with the access key. sessionToken is only needed
+// for temporary credentials, and can be empty.
+func NewSESMailer(region string, accessKeyID string, secretAccessKey string, sessionToken string, from string) *SESMailer {
+	return &SESMailer{
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    sessionToken,
+		from:            from,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		endpoint:        "https://email." + region + ".amazonaws.com",
+	}
+}
+
+//Send will send the message.
+func (s *SESMailer) Send(ctx context.Context, m Message) error {
+	if err := m.validate(); err != nil {
+		return &permanentMailError{err}
+	}
+
+	type data struct {
+		Data    string `json:"Data"`
+		Charset string `json:"Charset"`
+	}
+	body := map[string]interface{}{
+		"FromEmailAddress": s.from,
+		"Destination":      map[string]interface{}{"ToAddresses": m.To},
+	}
+	content := map[string]interface{}{}
+	if m.Text != "" {
+		content["Text"] = data{m.Text, "UTF-8"}
+	}
+	if m.HTML != "" {
+		content["Html"] = data{m.HTML, "UTF-8"}
+	}
+	body["Content"] = map[string]interface{}{
+		"Simple": map[string]interface{}{
+			"Subject": data{m.Subject, "UTF-8"},
+			"Body":    content,
+		},
+	}
+
+	b, err := json.Marshal(body)
+	if err != nil {
+		return &permanentMailError{err}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.endpoint+"/v2/email/outbound-emails", bytes.NewReader(b))
+	if err != nil {
+		return &permanentMailError{err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	signV4(req, b, s.region, "ses", s.accessKeyID, s.secretAccessKey, s.sessionToken, time.Now())
+
+	return doMailRequest(s.client, req, "ses")
+}
+
+//signV4 will sign the request with AWS Signature Version 4, setting the
+// X-Amz-Date, X-Amz-Security-Token and Authorization headers. The request
+// must not have a query.
+func signV4(req *http.Request, body []byte, region string, service string, accessKeyID string, secretAccessKey string, sessionToken string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for _, h := range []string{"Content-Type", "X-Amz-Date", "X-Amz-Security-Token"} {
+		if v := req.Header.Get(h); v != "" {
+			headers[strings.ToLower(h)] = strings.TrimSpace(v)
+		}
+	}
+	var names []string
+	for n := range headers {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, n := range names {
+		canonicalHeaders.WriteString(n + ":" + headers[n] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	hmacSHA256 := func(key []byte, data string) []byte {
+		h := hmac.New(sha256.New, key)
+		h.Write([]byte(data))
+		return h.Sum(nil)
+	}
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyID+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
@@ -0,0 +1,106 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/quotedprintable"
+	"net/smtp"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+//SMTPMailer is a Mailer sending with an SMTP server. STARTTLS is used
+// when the server supports it.
+type SMTPMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+//NewSMTPMailer will return a *SMTPMailer sending from the address from,
+// with the SMTP server at addr, like "smtp.example.com:587". auth can be
+// nil for servers not requiring authentication.
+func NewSMTPMailer(addr string, from string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{addr: addr, from: from, auth: auth}
+}
+
+//Send will send the message.
+func (s *SMTPMailer) Send(ctx context.Context, m Message) error {
+	if err := m.validate(); err != nil {
+		return &permanentMailError{err}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	msg, err := s.mime(m)
+	if err != nil {
+		return &permanentMailError{err}
+	}
+
+	err = smtp.SendMail(s.addr, s.auth, s.from, m.To, msg)
+	var tpErr *textproto.Error
+	if errors.As(err, &tpErr) && tpErr.Code >= 500 {
+		return &permanentMailError{fmt.Errorf("smtp server rejected the mail: %v", err)}
+	}
+	if err != nil {
+		return fmt.Errorf("sending mail with smtp failed: %v", err)
+	}
+	return nil
+}
+
+//mime will return the message as a MIME message, with both a text and a
+// HTML part if the message has a HTML body.
+func (s *SMTPMailer) mime(m Message) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", s.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.To, ", "))
+	fmt.Fprintf(&b, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", m.Subject))
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+
+	if m.HTML == "" {
+		if err := writeMIMEPart(&b, "text/plain", m.Text); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	}
+
+	boundaryRAW := make([]byte, 16)
+	if _, err := rand.Read(boundaryRAW); err != nil {
+		return nil, err
+	}
+	boundary := hex.EncodeToString(boundaryRAW)
+	fmt.Fprintf(&b, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", boundary)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain", m.Text},
+		{"text/html", m.HTML},
+	} {
+		fmt.Fprintf(&b, "--%s\r\n", boundary)
+		if err := writeMIMEPart(&b, part.contentType, part.body); err != nil {
+			return nil, err
+		}
+		b.WriteString("\r\n")
+	}
+	fmt.Fprintf(&b, "--%s--\r\n", boundary)
+
+	return b.Bytes(), nil
+}
+
+//writeMIMEPart will write the headers and the quoted-printable body of a
+// part.
+func writeMIMEPart(b *bytes.Buffer, contentType string, body string) error {
+	fmt.Fprintf(b, "Content-Type: %s; charset=utf-8\r\n", contentType)
+	b.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(b)
+	if _, err := w.Write([]byte(body)); err != nil {
+		return err
+	}
+	return w.Close()
+}
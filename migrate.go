@@ -0,0 +1,54 @@
+package authsession
+
+import (
+	"fmt"
+
+	"github.com/gorilla/sessions"
+)
+
+//sessionVersion is the version of the layout of the session values
+// written by this package. Sessions from before the version was added
+// have no version, and are version 0.
+const sessionVersion = 1
+
+//SessionMigration will upgrade the values of a session from one version
+// of the layout to the next, like renaming a key or filling in a new value.
+type SessionMigration func(values map[interface{}]interface{}) error
+
+//builtinMigrations are the migrations for the layout of this package,
+// where builtinMigrations[v] upgrades a session from version v to v+1.
+var builtinMigrations = map[int]SessionMigration{
+	//Version 1 only added the version value itself.
+	0: func(values map[interface{}]interface{}) error { return nil },
+}
+
+//migrateSession will upgrade the session to the current version with
+// the migrations, and return true if it was upgraded so it should be
+// saved. A session with a newer version than known, or with a missing
+// migration, gives an error instead of being misread.
+func (a *Auth) migrateSession(session *sessions.Session) (bool, error) {
+	if auth, _ := session.Values[sessionKeyAuthenticated].(bool); !auth {
+		return false, nil
+	}
+
+	version, _ := session.Values[sessionKeyVersion].(int)
+	if version == a.sessionVersion {
+		return false, nil
+	}
+	if version > a.sessionVersion {
+		return false, fmt.Errorf("session has version %d, newer than the known version %d", version, a.sessionVersion)
+	}
+
+	for ; version < a.sessionVersion; version++ {
+		m, ok := a.sessionMigrations[version]
+		if !ok {
+			return false, fmt.Errorf("no session migration from version %d", version)
+		}
+		if err := m(session.Values); err != nil {
+			return false, fmt.Errorf("session migration from version %d failed: %v", version, err)
+		}
+		session.Values[sessionKeyVersion] = version + 1
+	}
+
+	return true, nil
+}
@@ -0,0 +1,136 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	texttemplate "text/template"
+	"time"
+)
+
+//MailKind is a kind of email sent to users. Each kind has a template for
+// the subject, the text body and the HTML body, which can be replaced
+// with WithMailTemplates.
+type MailKind string
+
+const (
+	MailMagicLink     MailKind = "magic_link"
+	MailPasswordReset MailKind = "password_reset"
+	MailNewDevice     MailKind = "new_device"
+	MailInvitation    MailKind = "invitation"
+)
+
+//mailKinds are all the kinds of emails.
+var mailKinds = []MailKind{MailMagicLink, MailPasswordReset, MailNewDevice, MailInvitation}
+
+//MailData is the data given to the mail templates. The fields used depend
+// on the kind of email.
+type MailData struct {
+	//Email is the email of the user the mail is sent to.
+	Email string
+	//URL is the link in the mail, like the magic link, or the invitation.
+	URL string
+	//Expires is when the link expires, if it does.
+	Expires time.Time
+	//Device, Location, IP and Time are the login of a new device alert.
+	Device   string
+	Location string
+	IP       string
+	Time     time.Time
+	//Branding is set from WithBranding when the mail is sent.
+	Branding Branding
+}
+
+//mailTemplateFiles will return the names of the files of the subject, the
+// text and the HTML templates of the kind.
+func mailTemplateFiles(kind MailKind) (subject string, text string, html string) {
+	return string(kind) + ".subject.txt", string(kind) + ".txt", string(kind) + ".html"
+}
+
+//defaultMailTemplates are the built-in mail templates.
+var defaultMailTemplates = func() map[MailKind]MailTemplate {
+	t, err := parseMailTemplates(nil)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}()
+
+//parseMailTemplates will return the mail templates, where the files found
+// in fsys replace the built-in ones with the same name. fsys can be nil.
+func parseMailTemplates(fsys fs.FS) (map[MailKind]MailTemplate, error) {
+	read := func(name string) (string, error) {
+		if fsys != nil {
+			b, err := fs.ReadFile(fsys, name)
+			if err == nil {
+				return string(b), nil
+			}
+			if !errors.Is(err, fs.ErrNotExist) {
+				return "", fmt.Errorf("failed reading mail template %v: %v", name, err)
+			}
+		}
+		b, err := fs.ReadFile(templateFS, "templates/mail/"+name)
+		return string(b), err
+	}
+
+	templates := make(map[MailKind]MailTemplate)
+	for _, kind := range mailKinds {
+		subjectFile, textFile, htmlFile := mailTemplateFiles(kind)
+		var t MailTemplate
+
+		s, err := read(subjectFile)
+		if err != nil {
+			return nil, err
+		}
+		if t.Subject, err = texttemplate.New(subjectFile).Parse(s); err != nil {
+			return nil, fmt.Errorf("failed parsing mail template %v: %v", subjectFile, err)
+		}
+
+		s, err = read(textFile)
+		if err != nil {
+			return nil, err
+		}
+		if t.Text, err = texttemplate.New(textFile).Parse(s); err != nil {
+			return nil, fmt.Errorf("failed parsing mail template %v: %v", textFile, err)
+		}
+
+		s, err = read(htmlFile)
+		if err != nil {
+			return nil, err
+		}
+		if t.HTML, err = htmltemplate.New(htmlFile).Parse(s); err != nil {
+			return nil, fmt.Errorf("failed parsing mail template %v: %v", htmlFile, err)
+		}
+
+		templates[kind] = t
+	}
+
+	return templates, nil
+}
+
+//SendMail will send the email of the kind to the address, made from the
+// mail templates with data, with the mailer set with WithMailer.
+func (a *Auth) SendMail(ctx context.Context, kind MailKind, to string, data MailData) error {
+	if a.mailer == nil {
+		return errors.New("no mailer configured, see WithMailer")
+	}
+	t, ok := a.mailTemplates[kind]
+	if !ok {
+		return fmt.Errorf("unknown mail kind %q", kind)
+	}
+
+	if data.Email == "" {
+		data.Email = to
+	}
+	data.Branding = a.branding
+	m, err := t.Message(data, to)
+	if err != nil {
+		return fmt.Errorf("failed making %v mail: %v", kind, err)
+	}
+	if err := a.mailer.Send(ctx, m); err != nil {
+		return fmt.Errorf("failed sending %v mail: %w", kind, err)
+	}
+	return nil
+}
@@ -0,0 +1,404 @@
+package authsession
+
+import (
+	"net/http"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//openAPIPath is where the OpenAPI document of the endpoints is served.
+const openAPIPath = "/auth/openapi.json"
+
+//route is an endpoint registered with the mux, by its method and path.
+// The method is empty for a route registered for all methods.
+type route struct {
+	method string
+	path   string
+}
+
+//routeTable keeps the routes registered with the mux, so the OpenAPI
+// document lists the endpoints actually served.
+type routeTable struct {
+	mu     sync.Mutex
+	routes map[route]bool
+}
+
+//add will add the route of the mux pattern, like "GET /auth/session".
+func (t *routeTable) add(pattern string) {
+	rt := route{path: pattern}
+	if method, path, ok := strings.Cut(pattern, " "); ok {
+		rt = route{method: method, path: strings.TrimSpace(path)}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.routes == nil {
+		t.routes = make(map[route]bool)
+	}
+	t.routes[rt] = true
+}
+
+//list will return the routes, sorted by path and method.
+func (t *routeTable) list() []route {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	routes := make([]route, 0, len(t.routes))
+	for rt := range t.routes {
+		routes = append(routes, rt)
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].path != routes[j].path {
+			return routes[i].path < routes[j].path
+		}
+		return routes[i].method < routes[j].method
+	})
+	return routes
+}
+
+//routeMux is an http.ServeMux adding the routes registered to the
+// routeTable of Auth.
+type routeMux struct {
+	*http.ServeMux
+	routes *routeTable
+}
+
+//newRouteMux will return a *routeMux for the sub-handlers of the package,
+// like the admin API.
+func (a *Auth) newRouteMux() *routeMux {
+	return &routeMux{ServeMux: http.NewServeMux(), routes: &a.routes}
+}
+
+//HandleFunc will register the handler for the pattern, and add the route.
+func (m *routeMux) HandleFunc(pattern string, h func(http.ResponseWriter, *http.Request)) {
+	m.routes.add(pattern)
+	m.ServeMux.HandleFunc(pattern, h)
+}
+
+//apiOperation is the documentation of an endpoint in the OpenAPI document.
+type apiOperation struct {
+	summary string
+	//security is "session" for the session cookie, "admin" for the
+	// session cookie of an admin or a client certificate, "client" for
+	// the credentials of an issuer client, or empty for none.
+	security string
+	query    []string
+	//form are the fields of a form body.
+	form []string
+	//body is a value of the type of a JSON body.
+	body interface{}
+	//status is the status of success, which is 200 if not set.
+	status int
+	//response is a value of the type of the JSON response, or nil when
+	// the response is a page, a redirect, or has no body.
+	response interface{}
+	//contentType is the content type of a response which is not JSON.
+	contentType string
+}
+
+//apiOperations are the endpoints of the package, by the method and the
+// path without the tenant. The routes registered without a method are
+// documented with the methods found here.
+var apiOperations = map[string]apiOperation{
+	"GET /slogin": {summary: "Start a login, and redirect to the provider, or show the page to choose the provider.", query: []string{"provider", "return_to", "popup"}, status: http.StatusTemporaryRedirect, contentType: "text/html"},
+	"POST /slogin": {summary: "Start a login, and return the URL of the provider to send the user to.", body: struct {
+		Provider string `json:"provider"`
+		ReturnTo string `json:"return_to"`
+	}{}, response: loginStart{}},
+	"GET /slogout":         {summary: "Show the page confirming the logout.", contentType: "text/html"},
+	"POST /slogout":        {summary: "Log out, with the logout token of the confirmation page.", form: []string{"logout_token"}, status: http.StatusSeeOther},
+	"GET /callback":        {summary: "The callback of the provider, which creates the session.", query: []string{"state", "code", "error", "error_description"}, status: http.StatusSeeOther, contentType: "text/html"},
+	"POST /callback":       {summary: "The callback of the provider with response_mode form_post.", form: []string{"state", "code", "error", "error_description"}, status: http.StatusSeeOther, contentType: "text/html"},
+	"GET " + providersPath: {summary: "List the providers to log in with.", query: []string{"return_to", "popup"}, response: []ProviderLink{}},
+	"GET " + signedURLPath: {summary: "Verify the signed URL in the X-Original-URI header, for a proxy. The user is returned in the X-Auth-User header."},
+	"GET /slogin/ldap":     {summary: "Show the LDAP login form.", contentType: "text/html"},
+	"POST /slogin/ldap":    {summary: "Log in with LDAP.", form: []string{"login_token", "username", "password"}, status: http.StatusSeeOther},
+	"GET " + termsPath:     {summary: "Show the terms to accept.", security: "session", query: []string{"return_to"}, contentType: "text/html"},
+	"POST " + termsPath:    {summary: "Accept the terms.", security: "session", form: []string{"terms_token"}, status: http.StatusSeeOther},
+	"GET " + readyPath: {summary: "The health of the stores, for a readiness probe. The status is 503 if a store is down.", response: struct {
+		Ready  bool          `json:"ready"`
+		Stores []StoreHealth `json:"stores"`
+	}{}},
+	"GET " + assetsPath + "{name}": {summary: "The JavaScript helpers for frontends, like session.js.", contentType: "text/javascript"},
+	"GET " + openAPIPath:           {summary: "This OpenAPI document.", response: map[string]interface{}{}},
+
+	"GET " + sessionPath:              {summary: "The status of the session, and when it expires.", response: SessionStatus{}},
+	"POST " + sessionPath + "/extend": {summary: "Extend the session.", security: "session", body: struct{}{}, response: SessionStatus{}},
+	"GET " + sessionPath + "/list":    {summary: "List the sessions of the user.", security: "session", response: []UserSession{}},
+	"POST " + sessionPath + "/name": {summary: "Name the session of the request.", security: "session", body: struct {
+		Name string `json:"name"`
+	}{}, status: http.StatusNoContent},
+	"GET " + sessionPath + "/events": {summary: "Server-Sent Events with the status of the session, ending with an expired or a revoked event.", security: "session", contentType: "text/event-stream"},
+
+	"GET /auth/admin/sessions":                 {summary: "List the sessions.", security: "admin", response: []SessionInfo{}},
+	"DELETE /auth/admin/sessions/{id}":         {summary: "Revoke a session.", security: "admin", status: http.StatusNoContent},
+	"DELETE /auth/admin/users/{user}/sessions": {summary: "Revoke all the sessions of a user.", security: "admin", response: map[string]int{}},
+	"GET /auth/admin/users":                    {summary: "List the users.", security: "admin", response: []UserRecord{}},
+	"POST /auth/admin/users/{email}/disable":   {summary: "Disable a user, and revoke the sessions.", security: "admin", response: UserRecord{}},
+	"POST /auth/admin/users/{email}/enable":    {summary: "Enable a user.", security: "admin", response: UserRecord{}},
+	"GET /auth/admin/allowlist":                {summary: "List the allowlist.", security: "admin", response: []string{}},
+	"POST /auth/admin/allowlist": {summary: "Add an entry to the allowlist.", security: "admin", body: struct {
+		Entry string `json:"entry"`
+	}{}, status: http.StatusNoContent},
+	"DELETE /auth/admin/allowlist/{entry}": {summary: "Remove an entry from the allowlist.", security: "admin", status: http.StatusNoContent},
+	"POST /auth/admin/keys/rotate": {summary: "Rotate the cookie key.", security: "admin", body: struct {
+		Keep int `json:"keep"`
+	}{}, response: map[string]bool{}},
+	"GET /auth/admin/dashboard": {summary: "The admin dashboard.", security: "admin", contentType: "text/html"},
+	"GET /auth/admin/debug":     {summary: "The counts and the recent errors, for operational triage.", security: "admin", response: DebugInfo{}},
+	"POST /auth/admin/inspect": {summary: "Inspect a session cookie or a session ID.", security: "admin", body: struct {
+		Cookie    string `json:"cookie"`
+		SessionID string `json:"sessionID"`
+	}{}, response: SessionInspection{}},
+	"GET /auth/admin/providers":         {summary: "List the providers registered at runtime.", security: "admin", response: []Provider{}},
+	"POST /auth/admin/providers":        {summary: "Register a provider.", security: "admin", body: Provider{}, status: http.StatusCreated, response: Provider{}},
+	"DELETE /auth/admin/providers/{id}": {summary: "Remove a provider.", security: "admin", status: http.StatusNoContent},
+
+	"GET " + issuerPath + "/.well-known/openid-configuration": {summary: "The OpenID Connect discovery document of the issuer.", response: map[string]interface{}{}},
+	"GET " + issuerPath + "/authorize":                        {summary: "The authorization endpoint of the issuer.", query: []string{"client_id", "redirect_uri", "response_type", "scope", "state", "nonce", "code_challenge", "code_challenge_method", "resource"}, status: http.StatusFound},
+	"POST " + issuerPath + "/token":                           {summary: "The token endpoint of the issuer.", security: "client", form: []string{"grant_type", "code", "redirect_uri", "code_verifier", "refresh_token", "scope", "resource", "subject_token", "subject_token_type", "audience"}, response: map[string]interface{}{}},
+	"GET " + issuerPath + "/jwks":                             {summary: "The public keys of the issuer.", response: map[string]interface{}{}},
+	"POST " + issuerPath + "/introspect":                      {summary: "Introspect an access token or a refresh token.", security: "client", form: []string{"token", "token_type_hint"}, response: map[string]interface{}{}},
+	"GET " + jwksPath:                                         {summary: "The public keys of the issuer.", response: map[string]interface{}{}},
+}
+
+//apiMethods are the methods of the routes registered for all methods, in
+// the order they are documented.
+var apiMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE"}
+
+//pathParam matches the wildcards of the paths of the mux, like {id} and
+// {path...}.
+var pathParam = regexp.MustCompile(`\{([^}.]+)(\.\.\.)?\}`)
+
+//OpenAPI will return the OpenAPI 3 document of the endpoints of the
+// package, made from the routes registered with the mux, so it lists the
+// endpoints served with the options given. It is served at
+// /auth/openapi.json, and can be merged into the document of an app.
+func (a *Auth) OpenAPI() map[string]interface{} {
+	g := schemaGen{schemas: map[string]interface{}{}}
+	paths := map[string]map[string]interface{}{}
+
+	routes := a.routes.list()
+	methods := map[string]bool{}
+	for _, rt := range routes {
+		if rt.method != "" {
+			methods[rt.path] = true
+		}
+	}
+
+	for _, rt := range routes {
+		//Trees like /auth/admin/ are served by sub-handlers with their own
+		// routes, and the paths registered for all methods are left out
+		// when the sub-handler has routes for them.
+		if strings.HasSuffix(rt.path, "/") || (rt.method == "" && methods[rt.path]) {
+			continue
+		}
+		key := strings.TrimPrefix(rt.path, "/{tenant}")
+
+		ops := map[string]apiOperation{}
+		if rt.method != "" {
+			ops[rt.method] = apiOperations[rt.method+" "+key]
+		} else {
+			for _, m := range apiMethods {
+				if op, ok := apiOperations[m+" "+key]; ok {
+					ops[m] = op
+				}
+			}
+			if len(ops) == 0 {
+				ops["GET"] = apiOperation{}
+			}
+		}
+
+		path := pathParam.ReplaceAllString(rt.path, "{$1}")
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		for m, op := range ops {
+			paths[path][strings.ToLower(m)] = g.operation(rt.path, op)
+		}
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "authsession",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]interface{}{
+				"session":          map[string]interface{}{"type": "apiKey", "in": "cookie", "name": "cookie-name"},
+				"client":           map[string]interface{}{"type": "http", "scheme": "basic", "description": "The client ID and secret of an issuer client, or a client assertion in the form."},
+				"adminCertificate": map[string]interface{}{"type": "mutualTLS"},
+			},
+		},
+	}
+	if u, err := url.Parse(a.googleOauthConfig.RedirectURL); err == nil && u.Host != "" {
+		doc["servers"] = []map[string]interface{}{{"url": u.Scheme + "://" + u.Host}}
+	}
+	return doc
+}
+
+//serveOpenAPI will serve the OpenAPI document of the endpoints.
+func (a *Auth) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		a.writeJSONMessage(w, r, http.StatusMethodNotAllowed, "error.method_not_allowed")
+		return
+	}
+	writeJSON(w, http.StatusOK, a.OpenAPI())
+}
+
+//schemaGen makes the JSON schemas of the Go types of the bodies, with
+// the named types in schemas.
+type schemaGen struct {
+	schemas map[string]interface{}
+}
+
+//operation will return the OpenAPI operation of the path for op.
+func (g schemaGen) operation(path string, op apiOperation) map[string]interface{} {
+	o := map[string]interface{}{}
+	if op.summary != "" {
+		o["summary"] = op.summary
+	}
+
+	var params []map[string]interface{}
+	for _, m := range pathParam.FindAllStringSubmatch(path, -1) {
+		params = append(params, map[string]interface{}{"name": m[1], "in": "path", "required": true, "schema": map[string]string{"type": "string"}})
+	}
+	for _, q := range op.query {
+		params = append(params, map[string]interface{}{"name": q, "in": "query", "schema": map[string]string{"type": "string"}})
+	}
+	if len(params) > 0 {
+		o["parameters"] = params
+	}
+
+	switch {
+	case op.body != nil:
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.body))}},
+		}
+	case len(op.form) > 0:
+		props := map[string]interface{}{}
+		for _, f := range op.form {
+			props[f] = map[string]string{"type": "string"}
+		}
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  map[string]interface{}{"application/x-www-form-urlencoded": map[string]interface{}{"schema": map[string]interface{}{"type": "object", "properties": props}}},
+		}
+	}
+
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	resp := map[string]interface{}{"description": http.StatusText(status)}
+	switch {
+	case op.response != nil:
+		resp["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": g.schema(reflect.TypeOf(op.response))}}
+	case op.contentType != "":
+		resp["content"] = map[string]interface{}{op.contentType: map[string]interface{}{}}
+	}
+	o["responses"] = map[string]interface{}{
+		strconv.Itoa(status): resp,
+		"default":            map[string]interface{}{"description": "An error, with a JSON body with the error for the JSON endpoints."},
+	}
+
+	switch op.security {
+	case "session":
+		o["security"] = []map[string][]string{{"session": {}}}
+	case "admin":
+		o["security"] = []map[string][]string{{"session": {}}, {"adminCertificate": {}}}
+	case "client":
+		o["security"] = []map[string][]string{{"client": {}}, {}}
+	}
+	return o
+}
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+)
+
+//schema will return the JSON schema of the type t, as encoded by
+// encoding/json. Named structs are put in schemas and referred to.
+func (g schemaGen) schema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t {
+	case timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case durationType:
+		return map[string]interface{}{"type": "integer", "description": "nanoseconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]interface{}{"type": "string", "format": "byte"}
+		}
+		return map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.object(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			//Set first, so a type referring to itself ends.
+			g.schemas[t.Name()] = map[string]interface{}{}
+			g.schemas[t.Name()] = g.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
+
+//object will return the JSON schema of the struct t, with the fields of
+// embedded structs put in.
+func (g schemaGen) object(t reflect.Type) map[string]interface{} {
+	props := map[string]interface{}{}
+	var fields func(t reflect.Type)
+	fields = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := f.Tag.Get("json")
+			if tag == "-" {
+				continue
+			}
+			name, _, _ := strings.Cut(tag, ",")
+			if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+				fields(f.Type)
+				continue
+			}
+			if !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = g.schema(f.Type)
+		}
+	}
+	fields(t)
+	return map[string]interface{}{"type": "object", "properties": props}
+}
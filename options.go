@@ -0,0 +1,793 @@
+package authsession
+
+import (
+	"crypto/rsa"
+	"crypto/tls"
+	"html/template"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/securecookie"
+)
+
+//Option is used to set the optional settings of Auth, and are given
+// as the last arguments to NewAuth.
+type Option func(*Auth)
+
+//WithSessionStore will keep track of the active sessions in s, so they
+// can be listed and revoked. A session cookie is only accepted as long
+// as its session is found in s.
+func WithSessionStore(s SessionStore) Option {
+	return func(a *Auth) {
+		a.sessions = s
+	}
+}
+
+//WithBanStore will refuse login and access to protected handlers for
+// the IP addresses banned in b.
+func WithBanStore(b BanStore) Option {
+	return func(a *Auth) {
+		a.bans = b
+	}
+}
+
+//WithTrustedProxies will take the IP of the client from the
+// X-Forwarded-For header when the request comes from the reverse proxies
+// or load balancers in the networks, given as CIDRs like "10.0.0.0/8" or
+// as IPs. The IP is used for the bans, the throttling, the pending logins
+// and the events.
+func WithTrustedProxies(networks ...string) Option {
+	return func(a *Auth) {
+		for _, s := range networks {
+			if !strings.Contains(s, "/") {
+				if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+					s += "/32"
+				} else {
+					s += "/128"
+				}
+			}
+			_, n, err := net.ParseCIDR(s)
+			if err != nil {
+				a.logError("error: WithTrustedProxies: ", err)
+				continue
+			}
+			a.trustedProxies = append(a.trustedProxies, n)
+		}
+	}
+}
+
+//WithInvitationStore will only allow users with a valid invitation in
+// i to log in. The invitation is accepted on the first login.
+func WithInvitationStore(i InvitationStore) Option {
+	return func(a *Auth) {
+		a.invitations = i
+	}
+}
+
+//WithUserStore will keep the users that have logged in in u, and refuse
+// login and access to protected handlers for users disabled in u.
+func WithUserStore(u UserStore) Option {
+	return func(a *Auth) {
+		a.users = u
+	}
+}
+
+//WithDataResidency will resolve the region of the user at login with c,
+// and keep it in the session, and in the session, user, refresh token
+// and reference token records, so stores like RegionalSessionStore and
+// RegionalUserStore keep them in the stores of the region. The region is
+// put first in the session IDs.
+func WithDataResidency(c ResidencyConfig) Option {
+	return func(a *Auth) {
+		a.residency = &c
+	}
+}
+
+//WithPrivacyPolicy will tag the personal fields kept in the user store,
+// the email, the name and the picture, with the purpose and retention of
+// p, and the source they came from. With a retention, the janitor run by
+// RunJobs purges the values not collected again within it, like by a
+// login, and deletes the users with an expired email.
+func WithPrivacyPolicy(p PrivacyPolicy) Option {
+	return func(a *Auth) {
+		a.privacy = p
+	}
+}
+
+//WithAllowList will only allow the users allowed by l to log in.
+func WithAllowList(l AllowList) Option {
+	return func(a *Auth) {
+		a.allowList = l
+	}
+}
+
+//WithAdminRoles will give the authenticated users with one of the roles
+// in their session access to the admin API served under /auth/admin/.
+// Only the users logged in with the built-in provider are admins, not the
+// users of the providers registered at runtime, since those providers
+// could give any roles.
+func WithAdminRoles(roles ...string) Option {
+	return func(a *Auth) {
+		a.adminRoles = append(a.adminRoles, roles...)
+	}
+}
+
+//WithAdminClientCerts will give requests with a verified TLS client
+// certificate, with one of the common names, access to the admin API
+// served under /auth/admin/. The http.Server must be set up to request
+// and verify client certificates.
+func WithAdminClientCerts(commonNames ...string) Option {
+	return func(a *Auth) {
+		a.adminCertNames = append(a.adminCertNames, commonNames...)
+	}
+}
+
+//WithCookieKeyRotated will call fn with the new key when the cookie key
+// is rotated with the admin API, so it can be stored for later use. The
+// key is base64 text, which is put first in Config.CookieStoreKeys as
+// string(key). The rotation is cancelled if fn returns an error.
+func WithCookieKeyRotated(fn func(key []byte) error) Option {
+	return func(a *Auth) {
+		a.cookieKeyRotated = fn
+	}
+}
+
+//WithDashboardTemplate will use t instead of the built-in template for
+// the admin dashboard at /auth/admin/dashboard. The template is executed
+// with DashboardData.
+func WithDashboardTemplate(t *template.Template) Option {
+	return func(a *Auth) {
+		a.dashboardTemplate = t
+	}
+}
+
+//WithTenants will resolve the tenant for every request from the host
+// name or the path as given with from, and use the oauth app and the
+// allowlist of the tenant found in t. Sessions are only valid for the
+// tenant they were created for.
+func WithTenants(t TenantStore, from TenantFrom) Option {
+	return func(a *Auth) {
+		a.tenants = t
+		a.tenantFrom = from
+	}
+}
+
+//WithProviderStore will keep the OpenID Connect providers registered at
+// runtime with RegisterProvider, or the admin API, in p.
+func WithProviderStore(p ProviderStore) Option {
+	return func(a *Auth) {
+		a.providers = p
+	}
+}
+
+//WithLDAP will add a login form at /slogin/ldap where users log in with
+// their username and password, checked by binding to the LDAP or Active
+// Directory server with l. The roles of the user are stored in the session.
+func WithLDAP(l *LDAPAuthenticator) Option {
+	return func(a *Auth) {
+		a.ldap = l
+	}
+}
+
+//WithIssuer will make the server an OpenID Connect provider for the
+// internal apps in c.Clients, so users logged in here are also logged in
+// to those apps. The endpoints are served below /oidc/. Without a
+// SigningKey or a Signer with a public key, the issuer is not enabled.
+func WithIssuer(c IssuerConfig) Option {
+	return func(a *Auth) {
+		if c.Signer == nil && c.SigningKey == nil {
+			a.logError("error: WithIssuer: no SigningKey or Signer given, the issuer is not enabled")
+			return
+		}
+		if c.Signer != nil && c.Signer.PublicKey() == nil {
+			a.logError("error: WithIssuer: the Signer has no public key, the issuer is not enabled")
+			return
+		}
+		if c.TokenFormat == TokenFormatPASETO && c.PASETOKey == nil {
+			a.logError("error: WithIssuer: no PASETOKey given, issuing JWT access tokens")
+			c.TokenFormat = TokenFormatJWT
+		}
+		if c.TokenFormat == TokenFormatReference && c.ReferenceTokens == nil {
+			a.logError("error: WithIssuer: no ReferenceTokens store given, issuing JWT access tokens")
+			c.TokenFormat = TokenFormatJWT
+		}
+		a.issuer = newIssuer(c)
+	}
+}
+
+//WithClientSigningKey will sign the request objects sent to providers
+// using JAR, and the client assertions sent to providers using
+// private_key_jwt, with key. The public key must be registered with the
+// provider.
+func WithClientSigningKey(key *rsa.PrivateKey) Option {
+	return func(a *Auth) {
+		a.clientSigner = KeySigner(key)
+	}
+}
+
+//WithClientSigner will sign the request objects and the client
+// assertions like WithClientSigningKey, with s, like with a key in a key
+// management service.
+func WithClientSigner(s Signer) Option {
+	return func(a *Auth) {
+		a.clientSigner = s
+	}
+}
+
+//WithClientCertificate will present cert to the token endpoint of
+// providers using tls_client_auth.
+func WithClientCertificate(cert tls.Certificate) Option {
+	return func(a *Auth) {
+		a.clientCert = &cert
+	}
+}
+
+//WithTokenIntrospection will check access tokens not issued here, like
+// the opaque tokens of some providers, with the introspection endpoint in
+// c when verified with VerifyAccessToken or RequireAccessToken.
+func WithTokenIntrospection(c IntrospectionConfig) Option {
+	return func(a *Auth) {
+		a.introspection = newIntrospector(c)
+	}
+}
+
+//WithEpochStore will keep an epoch for every user in e, shared by all
+// the instances of the server. Incrementing the epoch of a user, like
+// with RevokeUserSessions, will revoke all the session cookies of the user
+// without keeping the sessions server side.
+func WithEpochStore(e EpochStore) Option {
+	return func(a *Auth) {
+		a.epochs = e
+	}
+}
+
+//WithSessionMigration will upgrade sessions of version from to version
+// from+1 with m, when an application changes the layout of the values it
+// keeps in the session. The versions of the application continue after
+// the version of this package, which is 1, so the first migration of an
+// application is from version 1. Sessions are upgraded when read, and
+// sessions with an unknown version are not accepted instead of misread.
+func WithSessionMigration(from int, m SessionMigration) Option {
+	return func(a *Auth) {
+		a.sessionMigrations[from] = m
+		if from+1 > a.sessionVersion {
+			a.sessionVersion = from + 1
+		}
+	}
+}
+
+//WithSessionLimit will limit the number of active sessions a user can
+// have to max, and use strategy when a user with max sessions logs in.
+// The sessions are counted in the session store, so WithSessionStore is
+// also needed.
+func WithSessionLimit(max int, strategy SessionLimitStrategy) Option {
+	return func(a *Auth) {
+		a.sessionLimit = &sessionLimit{max: max, strategy: strategy}
+	}
+}
+
+//WithPageTemplates will use the page templates found in fsys instead of
+// the built-in ones, for the pages shown to users on login and when
+// their session has expired. The pages are choose_provider.html,
+// access_denied.html, login_failed.html, login_cancelled.html and
+// session_expired.html, and are executed with PageData. They can use the style, header and footer
+// templates defined in layout.html. Pages missing in fsys use the built-in
+// template. If a template fails to parse the error is logged, and the
+// built-in templates are used.
+func WithPageTemplates(fsys fs.FS) Option {
+	return func(a *Auth) {
+		t, err := parsePageTemplates(fsys)
+		if err != nil {
+			a.logError("error: WithPageTemplates: ", err)
+			return
+		}
+		a.pageTemplates = t
+	}
+}
+
+//WithDefaultProvider will set the name and the icon shown for the
+// default provider given to NewAuth on the login page, and by
+// /auth/providers. The name is Google if not set.
+func WithDefaultProvider(name string, iconURL string) Option {
+	return func(a *Auth) {
+		a.providerName = name
+		a.providerIcon = iconURL
+	}
+}
+
+//WithMessageCatalog will use the messages in c for the languages it has,
+// on the built-in pages and in the JSON error bodies. The language is
+// negotiated from the Accept-Language header of the request, and the
+// built-in English messages are used for messages missing in c.
+func WithMessageCatalog(c MessageCatalog) Option {
+	return func(a *Auth) {
+		a.messages = c
+	}
+}
+
+//WithBranding will show the product name, the logo, the colors and the
+// footer links of b on the built-in pages. The values set in the branding
+// of a tenant replace them for the tenant. The branding is given to the
+// page templates in PageData too.
+func WithBranding(b Branding) Option {
+	return func(a *Auth) {
+		a.branding = b
+	}
+}
+
+//WithSessionLocation will use fn to find the location of the IP address
+// of the user at login, like "Oslo" from a GeoIP database, which is shown
+// together with the device in the lists of sessions.
+func WithSessionLocation(fn func(ip string) string) Option {
+	return func(a *Auth) {
+		a.location = fn
+	}
+}
+
+//WithScopes will request the scopes from the default provider given to
+// NewAuth, instead of the Google email and profile scopes. The scopes are
+// trimmed and duplicates removed. The email must still be given by the
+// user info endpoint. If a scope is not valid the error is logged, and
+// the default scopes are used. Providers registered at runtime have their
+// own scopes.
+func WithScopes(scopes ...string) Option {
+	return func(a *Auth) {
+		s, err := normalizeScopes(scopes)
+		if err != nil {
+			a.logError("error: WithScopes: ", err)
+			return
+		}
+		c := *a.googleOauthConfig
+		c.Scopes = s
+		a.googleOauthConfig = &c
+	}
+}
+
+//WithLoginCancelledHandler will use h instead of the built-in page when
+// the user cancels the login at the provider, like by denying the consent.
+func WithLoginCancelledHandler(h http.Handler) Option {
+	return func(a *Auth) {
+		a.loginCancelled = h
+	}
+}
+
+//WithLoginSuccessHandler will call h as the last step of a successful
+// login, instead of redirecting the user to the page they came from.
+func WithLoginSuccessHandler(h LoginSuccessHandler) Option {
+	return func(a *Auth) {
+		a.loginSuccess = h
+	}
+}
+
+//WithProviderRetry will set how the requests to the providers for the
+// code exchange and the user info are retried, and when they fail at once
+// since the provider is failing. By default requests are tried 3 times,
+// and fail at once for 30 seconds after 5 requests in a row have failed.
+func WithProviderRetry(c RetryConfig) Option {
+	return func(a *Auth) {
+		a.retry = newRetrier(c)
+	}
+}
+
+//WithClockSkew will set how much the clocks of the servers can differ
+// when checking the exp, iat and nbf of access tokens and the iat of DPoP
+// proofs, so small clock drift doesn't make tokens fail. The default is
+// 2 minutes.
+func WithClockSkew(d time.Duration) Option {
+	return func(a *Auth) {
+		a.clockSkew = d
+	}
+}
+
+//WithExternalURL will set the URL the clients reach this server on, like
+// https://api.example.com, when it is behind a proxy terminating TLS or
+// serving it under another host. The htu of the DPoP proofs sent with the
+// access tokens is checked against it, with the path of the request
+// added, instead of against the scheme and host of the request.
+func WithExternalURL(u string) Option {
+	return func(a *Auth) {
+		p, err := url.Parse(u)
+		if err != nil || (p.Scheme != "http" && p.Scheme != "https") || p.Host == "" {
+			a.logError("error: WithExternalURL: not an absolute http or https URL: ", u)
+			return
+		}
+		a.externalURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+//WithStateTTL will set how long a user has to log in with the provider,
+// from the login is started until the callback. A callback after this
+// gets a page telling the user to try again. The default is 10 minutes.
+func WithStateTTL(d time.Duration) Option {
+	return func(a *Auth) {
+		a.stateTTL = d
+	}
+}
+
+//WithLoginStateStore will keep the states of the logins started in s,
+// like a *RedisLoginStateStore, so the callback can be served by another
+// instance of the server than the one the login was started on. The
+// states are then not capped by WithPendingLoginLimits, and are expired
+// by the store.
+func WithLoginStateStore(s LoginStateStore) Option {
+	return func(a *Auth) {
+		a.loginStates = s
+	}
+}
+
+//WithPendingLoginLimits will set the max number of logins started and
+// not finished, overall and for each IP. When full, the oldest pending
+// login is evicted, so spamming the login can't use up the memory. The
+// defaults are 10000 overall and 20 for each IP. Behind a reverse proxy,
+// set it with WithTrustedProxies, or all its users share its IP.
+func WithPendingLoginLimits(total int, perIP int) Option {
+	return func(a *Auth) {
+		if total <= 0 || perIP <= 0 {
+			a.logError("error: WithPendingLoginLimits: the limits must be positive, using the defaults")
+			return
+		}
+		a.pending = newPendingLogins(total, perIP)
+	}
+}
+
+//WithPostLoginHook will call h when a user has logged in and passed all
+// the checks, before the session is started. The login is denied if h
+// returns an error.
+func WithPostLoginHook(h PostLoginHook) Option {
+	return func(a *Auth) {
+		a.postLoginHook = h
+	}
+}
+
+//WithGoogleProfile will fetch the locale, the organizations and the phone
+// numbers of Google users from the People API into the Profile given to
+// the post login hook. The scopes needed to read them are added to the
+// scopes asked for at login, so the user is asked to consent to them.
+// It must be given after WithScopes.
+func WithGoogleProfile() Option {
+	return func(a *Auth) {
+		c := *a.googleOauthConfig
+		s, err := normalizeScopes(append(append([]string{}, c.Scopes...), peopleAPIScopes...))
+		if err != nil {
+			a.logError("error: WithGoogleProfile: ", err)
+			return
+		}
+		c.Scopes = s
+		a.googleOauthConfig = &c
+		a.peopleAPI = true
+	}
+}
+
+//WithGroupSync will resolve the groups of the users with an active
+// session every c.Interval with c.Resolver, like from Google Groups with
+// NewGoogleGroupsResolver or Azure AD with NewAzureADGroupsResolver. When
+// the groups of a user have changed since the login or the last sync, the
+// sessions of the user are revoked, so removed group access takes effect
+// without waiting for the session to expire. It needs a session store,
+// and is run by RunJobs.
+func WithGroupSync(c GroupSyncConfig) Option {
+	return func(a *Auth) {
+		if c.Resolver == nil {
+			a.logError("error: WithGroupSync: no resolver given")
+			return
+		}
+		if c.Interval <= 0 {
+			c.Interval = defaultGroupSyncInterval
+		}
+		a.groupSync = &groupSync{resolver: c.Resolver, known: make(map[string]string)}
+		a.addJob("group sync", c.Interval, a.syncGroups)
+	}
+}
+
+//WithMailer will send the emails to users with m, like with
+// NewSMTPMailer, NewSendGridMailer or NewSESMailer. Wrap it with
+// NewRetryMailer to try again when sending fails, and use NewDryRunMailer
+// in tests.
+func WithMailer(m Mailer) Option {
+	return func(a *Auth) {
+		a.mailer = m
+	}
+}
+
+//WithMailTemplates will use the mail templates found in fsys instead of
+// the built-in ones. Each kind of mail has three templates, like
+// magic_link.subject.txt and magic_link.txt which are text templates, and
+// magic_link.html which is a HTML template, all executed with MailData.
+// The kinds are magic_link, password_reset, new_device and invitation.
+// Templates missing in fsys use the built-in template. If a template fails
+// to parse the error is logged, and the built-in templates are used.
+func WithMailTemplates(fsys fs.FS) Option {
+	return func(a *Auth) {
+		t, err := parseMailTemplates(fsys)
+		if err != nil {
+			a.logError("error: WithMailTemplates: ", err)
+			return
+		}
+		a.mailTemplates = t
+	}
+}
+
+//WithEventSink will write the login and security events to s as they
+// happen, like to a SIEM with NewWriterEventSink in the CEF or ECS format.
+func WithEventSink(s EventSink) Option {
+	return func(a *Auth) {
+		a.events.sink = s
+	}
+}
+
+//WithAuditChain will chain the events written to the event sinks with
+// hashes, where every event carries the hash of the event before, and
+// write a checkpoint signed by c.Signer every CheckpointEvery events and
+// every CheckpointInterval, so tampering with the audit trail is found by
+// VerifyAuditChain.
+func WithAuditChain(c AuditChainConfig) Option {
+	return func(a *Auth) {
+		if c.Signer == nil {
+			a.logError("error: WithAuditChain: no Signer given, the events are not chained")
+			return
+		}
+		a.events.chain = newAuditChain(c)
+		a.addJob("audit checkpoint", a.events.chain.conf.CheckpointInterval, a.events.auditCheckpoint)
+	}
+}
+
+//WithCriticalEventSink will write the critical events, like the reuse of
+// a refresh token or many failed logins in a row from an IP, to s as well,
+// so they can be routed to alerting.
+func WithCriticalEventSink(s EventSink) Option {
+	return func(a *Auth) {
+		a.events.critical = s
+	}
+}
+
+//WithSecurityHeaders will set the HSTS, Cache-Control: no-store,
+// Referrer-Policy and X-Content-Type-Options headers on the responses of
+// the handlers of the package, so the auth responses are never cached and
+// don't leak codes in the Referer header. The zero SecurityHeaderConfig
+// uses the defaults.
+func WithSecurityHeaders(c SecurityHeaderConfig) Option {
+	return func(a *Auth) {
+		a.securityHeaders = &c
+	}
+}
+
+//WithFormPostCallback will ask the provider to POST the code to the
+// callback with response_mode=form_post, instead of putting it in the
+// query of the redirect, so codes never end up in proxy logs or the
+// browser history. The provider must support the form_post response mode.
+func WithFormPostCallback() Option {
+	return func(a *Auth) {
+		a.formPost = true
+	}
+}
+
+//WithLoginPolicy will only allow logins during the login hours of the
+// policy, and disable new logins during its maintenance windows, where
+// users get the maintenance.html page asking them to come back later.
+func WithLoginPolicy(p LoginPolicy) Option {
+	return func(a *Auth) {
+		a.loginPolicy.policy = p
+	}
+}
+
+//WithGeoIP will find the location of the users with r, and only allow
+// the logins from the countries and ASNs allowed by the policy. The
+// location is recorded in the session, the session store and the events.
+func WithGeoIP(r GeoIPResolver, p GeoPolicy) Option {
+	return func(a *Auth) {
+		a.geoIP = &geoIP{resolver: r, policy: p}
+	}
+}
+
+//WithTerms will make users accept the terms of service after their first
+// login, and again when the version is changed, before their session can
+// be used. The version accepted is kept in the user store, which must be
+// set with WithUserStore.
+func WithTerms(t Terms) Option {
+	return func(a *Auth) {
+		a.terms = &t
+	}
+}
+
+//WithProfileSteps will check the steps in order after login and for the
+// handlers wrapped with IsAuthenticated, and send users to the page of
+// the first step they have not done. When all the steps are done it is
+// kept in the session, so they are not checked again for the session.
+func WithProfileSteps(steps ...ProfileStep) Option {
+	return func(a *Auth) {
+		a.profileSteps = append(a.profileSteps, steps...)
+	}
+}
+
+//WithPopupLogin will let a login started with /slogin?popup=1 in a popup
+// window finish with a small page which posts the result to the window
+// that opened it with postMessage, and closes the popup. The message is
+// only posted to the origins, which defaults to the origin of the app.
+func WithPopupLogin(origins ...string) Option {
+	return func(a *Auth) {
+		a.popupOrigins = append([]string{}, origins...)
+	}
+}
+
+//WithRedirectAllowlist will only let users be redirected to the paths in
+// the allowlist after login, logout and errors, like with return_to, and
+// to the start page instead of anything else.
+func WithRedirectAllowlist(l RedirectAllowlist) Option {
+	return func(a *Auth) {
+		a.redirectAllowlist = &l
+	}
+}
+
+//WithBasicAuth will let requests with HTTP basic auth matching one of the
+// credentials through IsAuthenticated, for the paths of the credential,
+// like monitoring probes and scripts which can't log in with OAuth. The
+// requests are recorded in the events with the method "basic".
+func WithBasicAuth(creds ...BasicCredential) Option {
+	return func(a *Auth) {
+		a.basicAuth = &basicAuth{creds: creds, verified: map[[32]byte]bool{}}
+	}
+}
+
+//WithLoginThrottle will refuse logins from an IP, or for a user, for a
+// while after too many failed logins, with a 429 and a page telling how
+// long to wait.
+func WithLoginThrottle(t LoginThrottle) Option {
+	return func(a *Auth) {
+		a.throttle = newLoginThrottle(t)
+	}
+}
+
+//WithRandomSource will read the random bytes of the states, session IDs
+// and tokens from r instead of crypto/rand, like for tests needing known
+// values. It must never be used with a source not cryptographically
+// secure outside of tests.
+func WithRandomSource(r io.Reader) Option {
+	return func(a *Auth) {
+		a.random = r
+	}
+}
+
+//WithRolesResolver will set the roles and the permissions of the users
+// logging in with f, which are kept in the session and given by
+// CurrentUser. An error from f refuses the login.
+func WithRolesResolver(f RolesResolver) Option {
+	return func(a *Auth) {
+		a.rolesResolver = f
+	}
+}
+
+//WithJanitor will set how the janitor run by RunJobs removes the expired
+// entries of the stores, like the sessions, the bans and the refresh
+// tokens.
+func WithJanitor(c JanitorConfig) Option {
+	return func(a *Auth) {
+		a.janitor = c
+	}
+}
+
+//WithStoreObservability will set the threshold for logging slow
+// operations of the stores, and a function observing every operation, like
+// to export metrics or tracing spans.
+func WithStoreObservability(c StoreObservability) Option {
+	return func(a *Auth) {
+		a.storeObserver.conf = c
+	}
+}
+
+//WithLoginFunnel will give every step of the logins with a provider to
+// the Observer of c, from /login to the session created, with the reason
+// when a login is dropped, so product teams can see where the users give
+// up. The events have no personal data. The counts are kept even without
+// the option, and given by LoginFunnelStats and the debug endpoint.
+func WithLoginFunnel(c LoginFunnelConfig) Option {
+	return func(a *Auth) {
+		a.funnel.conf = c
+	}
+}
+
+//WithSessionReplication will publish the changes of the session store and
+// the epoch store with r, like created and revoked sessions, and apply the
+// changes of the other instances when RunReplication is running, so each
+// region can keep its own stores.
+func WithSessionReplication(r SessionReplicator, c ReplicationConfig) Option {
+	return func(a *Auth) {
+		a.replication = &replication{replicator: r, conf: c}
+	}
+}
+
+//WithStatelessSessions will keep the whole session in an encrypted token
+// in the cookie, with the user, the roles, the epoch and the expiry, so
+// no session store is needed, like for edge and serverless deployments.
+// Sessions are revoked with an EpochStore, or an EpochFunc. Cookies made
+// before are still accepted until they expire.
+func WithStatelessSessions(c StatelessConfig) Option {
+	return func(a *Auth) {
+		codec, err := newStatelessCodec(c)
+		if err != nil {
+			a.logError("error: WithStatelessSessions: ", err)
+			return
+		}
+		a.stateless = codec
+		a.statelessHeader = c.Header
+		a.store.Codecs = []securecookie.Codec{codec, a.codec}
+	}
+}
+
+//WithTokenDenylist will check the access tokens issued in issuer mode
+// against the denylist d, so they can be revoked before they expire with
+// RevokeAccessToken. A bloom filter in memory, sized by c, is put in front
+// of the denylist, so only the tokens which might be revoked are looked
+// up. The filter is filled from the denylist by RunJobs, at once and then
+// every RefreshInterval, and every token is looked up until then.
+func WithTokenDenylist(d TokenDenylist, c TokenDenylistConfig) Option {
+	return func(a *Auth) {
+		a.denylist = newTokenDenylist(d, c)
+		a.addJob("token denylist", a.denylist.conf.RefreshInterval, a.denylist.refresh)
+	}
+}
+
+//WithRiskScoring will score the risk of every login, and of the sessions
+// again every Interval of p, with the Scorer of p, given signals like a
+// changed IP or user agent, travel too fast between two locations and the
+// failed logins. The score can ask the user to authenticate again, notify
+// the user, or deny the login and end the session. The scores are kept in
+// the sessions and the login events.
+func WithRiskScoring(p RiskPolicy) Option {
+	return func(a *Auth) {
+		if p.Scorer == nil {
+			a.logError("error: WithRiskScoring: no Scorer given")
+			return
+		}
+		if p.Interval <= 0 {
+			p.Interval = defaultRiskInterval
+		}
+		a.risk = &p
+	}
+}
+
+//WithHoneypot will serve decoy login endpoints, like /wp-login.php, with
+// the mux given to Register. Clients probing them are held in a tarpit
+// before they get a decoy login form, and are banned in the ban store set
+// with WithBanStore, so they are refused by the real login. The counts
+// are given by HoneypotStats and the debug endpoint.
+func WithHoneypot(c HoneypotConfig) Option {
+	return func(a *Auth) {
+		a.honeypot = newHoneypot(c)
+	}
+}
+
+//WithProductionMode will make Serve and NewAuthFromConfig refuse to start
+// when SelfCheck finds obviously bad secrets, like the example values
+// from the documentation, instead of only logging them.
+func WithProductionMode() Option {
+	return func(a *Auth) {
+		a.production = true
+	}
+}
+
+//WithLogIdentifiers will set how the users are named in the routine
+// logs, which are hashes of the emails and user IDs with the salt of the
+// deployment by default. The event sink keeps the real values.
+func WithLogIdentifiers(l LogIdentifiers) Option {
+	return func(a *Auth) {
+		a.logIdentifiers = l
+	}
+}
+
+//WithCryptoProfile will restrict the algorithms used to the profile p,
+// like CryptoProfileFIPS for regulated deployments. What the profile
+// doesn't allow is logged and reported as an error by SelfCheck, whatever
+// order the options are given in, and bcrypt basic auth passwords are
+// refused. The default is CryptoProfileFIPS when the Go FIPS
+// 140-3 mode is on, with GOFIPS140 at build or GODEBUG=fips140=on, and
+// CryptoProfileDefault otherwise.
+func WithCryptoProfile(p CryptoProfile) Option {
+	return func(a *Auth) {
+		a.cryptoProfile = p
+	}
+}
@@ -0,0 +1,243 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"time"
+)
+
+//The names of the page templates. An FS given with WithPageTemplates can
+// replace any of them by having a file with the same name.
+const (
+	pageChooseProvider  = "choose_provider.html"
+	pageAccessDenied    = "access_denied.html"
+	pageLoginFailed     = "login_failed.html"
+	pageSessionExpired  = "session_expired.html"
+	pageLoginCancelled  = "login_cancelled.html"
+	pageMaintenance     = "maintenance.html"
+	pageTerms           = "terms.html"
+	pageTooManyAttempts = "too_many_attempts.html"
+	//pageLayout defines the style, header and footer templates used by
+	// the pages.
+	pageLayout = "layout.html"
+)
+
+//pageNames are all the page templates.
+var pageNames = []string{pageChooseProvider, pageAccessDenied, pageLoginFailed, pageSessionExpired, pageLoginCancelled, pageMaintenance, pageTerms, pageTooManyAttempts, pageLayout}
+
+//defaultPageTemplates are the built-in templates for the pages.
+var defaultPageTemplates = template.Must(template.ParseFS(templateFS, pageTemplatesGlob))
+
+//pageTemplatesGlob matches the built-in page templates in templateFS.
+const pageTemplatesGlob = "templates/pages/*.html"
+
+//PageData is the data given to the page templates.
+type PageData struct {
+	//Lang is the language negotiated for the request, like "en".
+	Lang string
+	//Message tells the user what happened in the language of the request,
+	// and is empty if the template should use its own text.
+	Message string
+	//LoginURL is where the user can log in again.
+	LoginURL string
+	//Providers are the providers the user can choose between on the
+	// choose_provider.html page.
+	Providers []ProviderLink
+	//Flashes are the flash messages of the session.
+	Flashes []Flash
+	//Branding is the branding set with WithBranding, with the branding
+	// of the tenant of the request on top.
+	Branding Branding
+	//RequestID is the ID of the request on the error pages, for the user
+	// to quote to support.
+	RequestID string
+	//Until is when the user can log in again on the maintenance.html and
+	// the too_many_attempts.html pages, and is zero if not known.
+	Until time.Time
+	//RetryAfter is the seconds the user must wait before logging in again
+	// on the too_many_attempts.html page.
+	RetryAfter int
+	//TermsURL and TermsVersion are the terms to accept on the terms.html
+	// page, and FormToken is the one time token the form must post back
+	// in terms_token.
+	TermsURL     string
+	TermsVersion string
+	FormToken    string
+
+	translate func(key string) string
+}
+
+//T will return the message with the key in the language of the request,
+// from the catalog set with WithMessageCatalog or the built-in messages.
+// It is used in the templates like {{.T "login_failed.title"}}.
+func (d PageData) T(key string) string {
+	if d.translate == nil {
+		if msg, ok := defaultMessages[key]; ok {
+			return msg
+		}
+		return key
+	}
+	return d.translate(key)
+}
+
+//ProviderLink is a provider to log in with, as listed on the login page
+// and by /auth/providers.
+type ProviderLink struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	IconURL string `json:"iconURL,omitempty"`
+	//URL is where to send the user to log in with the provider.
+	URL string `json:"url"`
+}
+
+//parsePageTemplates will return the built-in page templates, where the
+// pages found in fsys replace the built-in ones.
+func parsePageTemplates(fsys fs.FS) (*template.Template, error) {
+	//Parse the built-in templates again, since templates can't be cloned
+	// after they have been executed.
+	t, err := template.ParseFS(templateFS, pageTemplatesGlob)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, name := range pageNames {
+		b, err := fs.ReadFile(fsys, name)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed reading page template %v: %v", name, err)
+		}
+		//Keep the new template, since it replaces t in the set if it has
+		// the same name.
+		t, err = t.New(name).Parse(string(b))
+		if err != nil {
+			return nil, fmt.Errorf("failed parsing page template %v: %v", name, err)
+		}
+	}
+
+	return t, nil
+}
+
+//renderPage will write the page with the status code.
+func (a *Auth) renderPage(w http.ResponseWriter, r *http.Request, status int, name string, data PageData) {
+	if a.popupFailure(w, r, status, name, data) {
+		return
+	}
+	if data.LoginURL == "" {
+		data.LoginURL = a.tenantPath(r, "/slogin")
+	}
+	data.Lang = a.language(r)
+	data.Branding = a.branding
+	if t, ok := a.Tenant(r); ok {
+		data.Branding = data.Branding.merge(t.Branding)
+	}
+	data.translate = func(key string) string { return a.translate(data.Lang, key) }
+	if status >= 400 {
+		data.RequestID = RequestID(r.Context())
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Language", data.Lang)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	if err := a.pageTemplates.ExecuteTemplate(w, name, data); err != nil {
+		a.logRequestError(r, "error: executing page template "+name+": ", err)
+	}
+}
+
+//providerLinks will return the default provider followed by the
+// providers registered at runtime, sorted by name, with the urls to log
+// in with them. The return_to of the request is kept in the urls.
+func (a *Auth) providerLinks(r *http.Request) ([]ProviderLink, error) {
+	loginURL := func(id string) string {
+		q := url.Values{"provider": {id}}
+		if rt := r.URL.Query().Get("return_to"); rt != "" {
+			q.Set("return_to", rt)
+		}
+		if r.URL.Query().Get("popup") == "1" {
+			q.Set("popup", "1")
+		}
+		return a.tenantPath(r, "/slogin") + "?" + q.Encode()
+	}
+	links := []ProviderLink{{
+		ID:      "",
+		Name:    a.providerName,
+		IconURL: a.providerIcon,
+		URL:     loginURL(""),
+	}}
+
+	if a.providers == nil {
+		return links, nil
+	}
+	providers, err := a.providers.List()
+	if err != nil {
+		return links, fmt.Errorf("provider store List failed: %v", err)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Name < providers[j].Name
+	})
+	for _, p := range providers {
+		name := p.Name
+		if name == "" {
+			name = p.ID
+		}
+		links = append(links, ProviderLink{
+			ID:      p.ID,
+			Name:    name,
+			IconURL: p.IconURL,
+			URL:     loginURL(p.ID),
+		})
+	}
+
+	return links, nil
+}
+
+//chooseProvider will render the page where the user chooses between the
+// default provider and the providers registered at runtime. It returns
+// false if no providers are registered, so there is nothing to choose.
+func (a *Auth) chooseProvider(w http.ResponseWriter, r *http.Request) bool {
+	links, err := a.providerLinks(r)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+		return false
+	}
+	if len(links) < 2 {
+		return false
+	}
+
+	data := PageData{Providers: links}
+	data.Flashes, err = a.Flashes(w, r)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+	}
+
+	a.renderPage(w, r, http.StatusOK, pageChooseProvider, data)
+	return true
+}
+
+//providersPath is where the providers to log in with are listed as JSON,
+// for frontends making their own login page.
+const providersPath = "/auth/providers"
+
+//listProviders will write the providers to log in with as JSON.
+func (a *Auth) listProviders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		a.writeJSONMessage(w, r, http.StatusMethodNotAllowed, "error.method_not_allowed")
+		return
+	}
+
+	links, err := a.providerLinks(r)
+	if err != nil {
+		a.logRequestError(r, "error: "+providersPath+": ", err)
+		a.writeJSONMessage(w, r, http.StatusInternalServerError, "error.providers")
+		return
+	}
+	writeJSON(w, http.StatusOK, links)
+}
@@ -0,0 +1,156 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//authCodeURL will return the url to redirect the user to for logging in
+// with the provider. For providers using PAR the parameters are pushed
+// to the provider first, and for providers using JAR the parameters are
+// sent as a signed request object, so the url is kept free of them.
+func (a *Auth) authCodeURL(ctx context.Context, providerID string, oauthConfig *oauth2.Config, state string) (string, error) {
+	var opts []oauth2.AuthCodeOption
+	if a.formPost {
+		opts = append(opts, oauth2.SetAuthURLParam("response_mode", "form_post"))
+	}
+	authURL := oauthConfig.AuthCodeURL(state, opts...)
+	if providerID == "" || a.providers == nil {
+		return authURL, nil
+	}
+
+	p, ok, err := a.providers.Get(providerID)
+	if err != nil {
+		return "", fmt.Errorf("provider store Get failed: %v", err)
+	}
+	if !ok || (!p.UsePAR && !p.UseJAR) {
+		return authURL, nil
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		return "", err
+	}
+	params := u.Query()
+
+	if p.UseJAR {
+		params, err = a.requestObject(p, params)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if p.UsePAR {
+		requestURI, err := a.pushAuthorizationRequest(ctx, p, params)
+		if err != nil {
+			return "", err
+		}
+		params = url.Values{}
+		params.Set("client_id", p.ClientID)
+		params.Set("request_uri", requestURI)
+	}
+
+	u.RawQuery = params.Encode()
+	return u.String(), nil
+}
+
+//requestObject will put the authorization request parameters in a
+// signed request object, and return the parameters to send instead.
+// The client_id, response_type and scope are kept outside the request
+// object too, since OpenID Connect requires them.
+func (a *Auth) requestObject(p Provider, params url.Values) (url.Values, error) {
+	if a.clientSigner == nil {
+		return nil, errors.New("no client signing key configured, see WithClientSigningKey")
+	}
+
+	jti, err := a.newKey(16, KeyBase64URL)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss": p.ClientID,
+		"aud": p.Issuer,
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(5 * time.Minute).Unix(),
+		"jti": jti,
+	}
+	for k := range params {
+		claims[k] = params.Get(k)
+	}
+
+	request, err := signJWT(a.clientSigner, "oauth-authz-req+jwt", claims)
+	if err != nil {
+		return nil, fmt.Errorf("failed to sign request object: %v", err)
+	}
+
+	v := url.Values{}
+	v.Set("client_id", p.ClientID)
+	v.Set("response_type", params.Get("response_type"))
+	v.Set("scope", params.Get("scope"))
+	v.Set("request", request)
+	return v, nil
+}
+
+//parResponse is the response from the pushed authorization request endpoint.
+type parResponse struct {
+	RequestURI string `json:"request_uri"`
+	ExpiresIn  int    `json:"expires_in"`
+}
+
+//pushAuthorizationRequest will push the authorization request parameters
+// to the PAR endpoint of the provider, and return the request_uri to use
+// in the login redirect.
+func (a *Auth) pushAuthorizationRequest(ctx context.Context, p Provider, params url.Values) (string, error) {
+	if p.PARURL == "" {
+		return "", fmt.Errorf("provider %q has no pushed authorization request endpoint", p.ID)
+	}
+
+	//The PAR endpoint authenticates us the same way as the token endpoint.
+	authParams, err := a.clientAuthParams(p, p.Issuer)
+	if err != nil {
+		return "", err
+	}
+	for k := range authParams {
+		params.Set(k, authParams.Get(k))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.PARURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if authParams == nil {
+		req.SetBasicAuth(url.QueryEscape(p.ClientID), url.QueryEscape(p.ClientSecret))
+	}
+
+	resp, err := a.providerHTTPClient(p).Do(req)
+	if err != nil {
+		return "", fmt.Errorf("pushed authorization request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("pushed authorization request failed: %v returned %v", p.PARURL, resp.Status)
+	}
+
+	var pr parResponse
+	if err := json.NewDecoder(resp.Body).Decode(&pr); err != nil {
+		return "", fmt.Errorf("failed parsing pushed authorization response: %v", err)
+	}
+	if pr.RequestURI == "" {
+		return "", errors.New("pushed authorization response is missing the request_uri")
+	}
+
+	return pr.RequestURI, nil
+}
@@ -0,0 +1,225 @@
+package authsession
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+//TokenFormat is the format of the tokens made by the package. The zero
+// value is the default format, which is a JWT for the access tokens of
+// the issuer, and the own compact format for stateless sessions.
+type TokenFormat string
+
+const (
+	//TokenFormatJWT is a JSON Web Token.
+	TokenFormatJWT TokenFormat = "jwt"
+	//TokenFormatPASETO is a PASETO v4 token, which has a single fixed
+	// algorithm for each purpose, so there is no algorithm header to get
+	// wrong: v4.public tokens signed with Ed25519 for access tokens, and
+	// v4.local tokens encrypted with XChaCha20 and BLAKE2b for sessions.
+	TokenFormatPASETO TokenFormat = "paseto"
+	//TokenFormatReference is an opaque reference token of the issuer,
+	// with the claims kept in the ReferenceTokens store of the
+	// IssuerConfig. It is checked by the APIs at the introspection
+	// endpoint, and is revoked at once when deleted from the store.
+	TokenFormatReference TokenFormat = "reference"
+)
+
+const (
+	pasetoLocalHeader  = "v4.local."
+	pasetoPublicHeader = "v4.public."
+	//pasetoNonceSize is the size of the nonce of a v4.local token.
+	pasetoNonceSize = 32
+	//pasetoTagSize is the size of the MAC of a v4.local token.
+	pasetoTagSize = 32
+)
+
+//pae will return the pre-authentication encoding of the pieces, which is
+// what is authenticated, so the pieces can't be moved between each other.
+func pae(pieces ...[]byte) []byte {
+	b := binary.LittleEndian.AppendUint64(nil, uint64(len(pieces)))
+	for _, p := range pieces {
+		b = binary.LittleEndian.AppendUint64(b, uint64(len(p)))
+		b = append(b, p...)
+	}
+	return b
+}
+
+//pasetoSplit will return the payload and the footer of the token, after
+// checking the header.
+func pasetoSplit(token string, header string) ([]byte, []byte, error) {
+	rest, ok := strings.CutPrefix(token, header)
+	if !ok {
+		return nil, nil, fmt.Errorf("token is not a %vtoken", header)
+	}
+	payload, footer, _ := strings.Cut(rest, ".")
+
+	p, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, nil, fmt.Errorf("token payload is not valid base64: %v", err)
+	}
+	f, err := base64.RawURLEncoding.DecodeString(footer)
+	if err != nil {
+		return nil, nil, fmt.Errorf("token footer is not valid base64: %v", err)
+	}
+	return p, f, nil
+}
+
+//pasetoJoin will return the token of the header, the payload and the
+// footer.
+func pasetoJoin(header string, payload []byte, footer []byte) string {
+	token := header + base64.RawURLEncoding.EncodeToString(payload)
+	if len(footer) > 0 {
+		token += "." + base64.RawURLEncoding.EncodeToString(footer)
+	}
+	return token
+}
+
+//pasetoKeys will return the encryption key, the nonce for XChaCha20, and
+// the authentication key of a v4.local token, derived from the key and
+// the nonce of the token.
+func pasetoKeys(key []byte, nonce []byte) ([]byte, []byte, []byte, error) {
+	h, err := blake2b.New(56, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-encryption-key"))
+	h.Write(nonce)
+	tmp := h.Sum(nil)
+
+	h, err = blake2b.New(32, key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	h.Write([]byte("paseto-auth-key-for-aead"))
+	h.Write(nonce)
+	return tmp[:32], tmp[32:], h.Sum(nil), nil
+}
+
+//pasetoTag will return the MAC of a v4.local token.
+func pasetoTag(authKey []byte, nonce []byte, ct []byte, footer []byte, implicit []byte) ([]byte, error) {
+	h, err := blake2b.New(pasetoTagSize, authKey)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(pae([]byte(pasetoLocalHeader), nonce, ct, footer, implicit))
+	return h.Sum(nil), nil
+}
+
+//pasetoEncrypt will return the message as a v4.local token encrypted with
+// the 32 byte key, with the footer, and the implicit assertion which is
+// authenticated but not put in the token.
+func pasetoEncrypt(key []byte, message []byte, footer []byte, implicit []byte) (string, error) {
+	if len(key) != 32 {
+		return "", errors.New("a PASETO v4.local key must be 32 bytes")
+	}
+	nonce := make([]byte, pasetoNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return pasetoEncryptNonce(key, nonce, message, footer, implicit)
+}
+
+//pasetoEncryptNonce will encrypt like pasetoEncrypt with the given nonce,
+// which must never be used twice with the same key.
+func pasetoEncryptNonce(key []byte, nonce []byte, message []byte, footer []byte, implicit []byte) (string, error) {
+	encKey, encNonce, authKey, err := pasetoKeys(key, nonce)
+	if err != nil {
+		return "", err
+	}
+	c, err := chacha20.NewUnauthenticatedCipher(encKey, encNonce)
+	if err != nil {
+		return "", err
+	}
+	ct := make([]byte, len(message))
+	c.XORKeyStream(ct, message)
+
+	tag, err := pasetoTag(authKey, nonce, ct, footer, implicit)
+	if err != nil {
+		return "", err
+	}
+	payload := append(append(append([]byte{}, nonce...), ct...), tag...)
+	return pasetoJoin(pasetoLocalHeader, payload, footer), nil
+}
+
+//pasetoDecrypt will return the message of a v4.local token made by
+// pasetoEncrypt with the key and the implicit assertion.
+func pasetoDecrypt(key []byte, token string, implicit []byte) ([]byte, error) {
+	if len(key) != 32 {
+		return nil, errors.New("a PASETO v4.local key must be 32 bytes")
+	}
+	payload, footer, err := pasetoSplit(token, pasetoLocalHeader)
+	if err != nil {
+		return nil, err
+	}
+	if len(payload) < pasetoNonceSize+pasetoTagSize {
+		return nil, errors.New("token is too short")
+	}
+	nonce := payload[:pasetoNonceSize]
+	ct := payload[pasetoNonceSize : len(payload)-pasetoTagSize]
+
+	encKey, encNonce, authKey, err := pasetoKeys(key, nonce)
+	if err != nil {
+		return nil, err
+	}
+	tag, err := pasetoTag(authKey, nonce, ct, footer, implicit)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare(tag, payload[len(payload)-pasetoTagSize:]) != 1 {
+		return nil, errors.New("token is not valid for the key")
+	}
+
+	c, err := chacha20.NewUnauthenticatedCipher(encKey, encNonce)
+	if err != nil {
+		return nil, err
+	}
+	message := make([]byte, len(ct))
+	c.XORKeyStream(message, ct)
+	return message, nil
+}
+
+//pasetoSign will return the message as a v4.public token signed with the
+// key, with the footer, and the implicit assertion which is signed but
+// not put in the token.
+func pasetoSign(key ed25519.PrivateKey, message []byte, footer []byte, implicit []byte) string {
+	sig := ed25519.Sign(key, pae([]byte(pasetoPublicHeader), message, footer, implicit))
+	return pasetoJoin(pasetoPublicHeader, append(append([]byte{}, message...), sig...), footer)
+}
+
+//pasetoVerify will return the message and the footer of a v4.public token
+// signed with the key matching the public key.
+func pasetoVerify(key ed25519.PublicKey, token string, implicit []byte) ([]byte, []byte, error) {
+	payload, footer, err := pasetoSplit(token, pasetoPublicHeader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(payload) < ed25519.SignatureSize {
+		return nil, nil, errors.New("token is too short")
+	}
+	message := payload[:len(payload)-ed25519.SignatureSize]
+	sig := payload[len(payload)-ed25519.SignatureSize:]
+	if !ed25519.Verify(key, pae([]byte(pasetoPublicHeader), message, footer, implicit), sig) {
+		return nil, nil, errors.New("token signature is not valid")
+	}
+	return message, footer, nil
+}
+
+//pasetoFooter will return the footer of a token without verifying it,
+// like to find the key ID before verifying.
+func pasetoFooter(token string) ([]byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) < 4 {
+		return nil, nil
+	}
+	return base64.RawURLEncoding.DecodeString(parts[3])
+}
@@ -0,0 +1,251 @@
+package authsession
+
+import (
+	"crypto/ed25519"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+//The known-answer tests use the official PASETO v4 test vectors from
+// https://github.com/paseto-standard/test-vectors/blob/master/v4.json.
+
+const (
+	pasetoVectorLocalKey  = "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f"
+	pasetoVectorNonce     = "df654812bac492663825520ba2f6e67cf5ca5bdc13d4e7507a98cc4c2fcc3ad8"
+	pasetoVectorSecretKey = "b4cbfb43df4ce210727d953e4a713307fa19bb7d9f85041438d9e11b942a37741eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+	pasetoVectorPublicKey = "1eb9dbbbbc047c03fd70604e0071f0987e16b28b757225c11f00415d0e20b1a2"
+
+	pasetoVectorSecret = `{"data":"this is a secret message","exp":"2022-01-01T00:00:00+00:00"}`
+	pasetoVectorHidden = `{"data":"this is a hidden message","exp":"2022-01-01T00:00:00+00:00"}`
+	pasetoVectorSigned = `{"data":"this is a signed message","exp":"2022-01-01T00:00:00+00:00"}`
+	pasetoVectorKid    = `{"kid":"zVhMiPBP9fRf2snEcT7gFTioeA9COcNy9DfgL1W60haN"}`
+)
+
+type pasetoVector struct {
+	name     string
+	message  string
+	footer   string
+	implicit string
+	token    string
+}
+
+var pasetoLocalVectors = []pasetoVector{
+	{
+		name:    "4-E-3",
+		message: pasetoVectorSecret,
+		token:   "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6-tyebyWG6Ov7kKvBdkrrAJ837lKP3iDag2hzUPHuMKA",
+	},
+	{
+		name:    "4-E-4",
+		message: pasetoVectorHidden,
+		token:   "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t4gt6TiLm55vIH8c_lGxxZpE3AWlH4WTR0v45nsWoU3gQ",
+	},
+	{
+		name:    "4-E-5",
+		message: pasetoVectorSecret,
+		footer:  pasetoVectorKid,
+		token:   "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t4x-RMNXtQNbz7FvFZ_G-lFpk5RG3EOrwDL6CgDqcerSQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+	},
+	{
+		name:    "4-E-6",
+		message: pasetoVectorHidden,
+		footer:  pasetoVectorKid,
+		token:   "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6pWSA5HX2wjb3P-xLQg5K5feUCX4P2fpVK3ZLWFbMSxQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+	},
+	{
+		name:     "4-E-7",
+		message:  pasetoVectorSecret,
+		footer:   pasetoVectorKid,
+		implicit: `{"test-vector":"4-E-7"}`,
+		token:    "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WkwMsYXw6FSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t40KCCWLA7GYL9KFHzKlwY9_RnIfRrMQpueydLEAZGGcA.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+	},
+	{
+		name:     "4-E-8",
+		message:  pasetoVectorHidden,
+		footer:   pasetoVectorKid,
+		implicit: `{"test-vector":"4-E-8"}`,
+		token:    "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t5uvqQbMGlLLNYBc7A6_x7oqnpUK5WLvj24eE4DVPDZjw.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+	},
+	{
+		name:     "4-E-9",
+		message:  pasetoVectorHidden,
+		footer:   "arbitrary-string-that-isn't-json",
+		implicit: `{"test-vector":"4-E-9"}`,
+		token:    "v4.local.32VIErrEkmY4JVILovbmfPXKW9wT1OdQepjMTC_MOtjA4kiqw7_tcaOM5GNEcnTxl60WiA8rd3wgFSNb_UdJPXjpzm0KW9ojM5f4O2mRvE2IcweP-PRdoHjd5-RHCiExR1IK6t6tybdlmnMwcDMw0YxA_gFSE_IUWl78aMtOepFYSWYfQA.YXJiaXRyYXJ5LXN0cmluZy10aGF0LWlzbid0LWpzb24",
+	},
+}
+
+var pasetoPublicVectors = []pasetoVector{
+	{
+		name:    "4-S-1",
+		message: pasetoVectorSigned,
+		token:   "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9bg_XBBzds8lTZShVlwwKSgeKpLT3yukTw6JUz3W4h_ExsQV-P0V54zemZDcAxFaSeef1QlXEFtkqxT1ciiQEDA",
+	},
+	{
+		name:    "4-S-2",
+		message: pasetoVectorSigned,
+		footer:  pasetoVectorKid,
+		token:   "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9v3Jt8mx_TdM2ceTGoqwrh4yDFn0XsHvvV_D0DtwQxVrJEBMl0F2caAdgnpKlt4p7xBnx1HcO-SPo8FPp214HDw.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+	},
+	{
+		name:     "4-S-3",
+		message:  pasetoVectorSigned,
+		footer:   pasetoVectorKid,
+		implicit: `{"test-vector":"4-S-3"}`,
+		token:    "v4.public.eyJkYXRhIjoidGhpcyBpcyBhIHNpZ25lZCBtZXNzYWdlIiwiZXhwIjoiMjAyMi0wMS0wMVQwMDowMDowMCswMDowMCJ9NPWciuD3d0o5eXJXG5pJy-DiVEoyPYWs1YSTwWHNJq6DZD3je5gf-0M4JR9ipdUSJbIovzmBECeaWmaqcaP0DQ.eyJraWQiOiJ6VmhNaVBCUDlmUmYyc25FY1Q3Z0ZUaW9lQTlDT2NOeTlEZmdMMVc2MGhhTiJ9",
+	},
+}
+
+func mustHex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+//tamper will return the token with the character at i changed.
+func tamper(token string, i int) string {
+	c := byte('A')
+	if token[i] == 'A' {
+		c = 'B'
+	}
+	return token[:i] + string(c) + token[i+1:]
+}
+
+func TestPASETOLocalVectors(t *testing.T) {
+	key := mustHex(t, pasetoVectorLocalKey)
+	nonce := mustHex(t, pasetoVectorNonce)
+
+	for _, v := range pasetoLocalVectors {
+		t.Run(v.name, func(t *testing.T) {
+			token, err := pasetoEncryptNonce(key, nonce, []byte(v.message), []byte(v.footer), []byte(v.implicit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if token != v.token {
+				t.Fatalf("got token %v, want %v", token, v.token)
+			}
+
+			message, err := pasetoDecrypt(key, v.token, []byte(v.implicit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != v.message {
+				t.Fatalf("got message %s, want %s", message, v.message)
+			}
+		})
+	}
+}
+
+func TestPASETOPublicVectors(t *testing.T) {
+	secret := ed25519.PrivateKey(mustHex(t, pasetoVectorSecretKey))
+	public := ed25519.PublicKey(mustHex(t, pasetoVectorPublicKey))
+
+	for _, v := range pasetoPublicVectors {
+		t.Run(v.name, func(t *testing.T) {
+			token := pasetoSign(secret, []byte(v.message), []byte(v.footer), []byte(v.implicit))
+			if token != v.token {
+				t.Fatalf("got token %v, want %v", token, v.token)
+			}
+
+			message, footer, err := pasetoVerify(public, v.token, []byte(v.implicit))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(message) != v.message || string(footer) != v.footer {
+				t.Fatalf("got message %s and footer %s, want %s and %s", message, footer, v.message, v.footer)
+			}
+		})
+	}
+}
+
+func TestPASETOLocalRejected(t *testing.T) {
+	key := mustHex(t, pasetoVectorLocalKey)
+	v := pasetoLocalVectors[4] // 4-E-7, with a footer and an implicit assertion.
+	payload, footer, _ := strings.Cut(strings.TrimPrefix(v.token, pasetoLocalHeader), ".")
+
+	otherKey := append([]byte{}, key...)
+	otherKey[0] ^= 1
+
+	tests := []struct {
+		name     string
+		key      []byte
+		token    string
+		implicit string
+	}{
+		{"tampered tag", key, pasetoLocalHeader + tamper(payload, len(payload)-2) + "." + footer, v.implicit},
+		{"tampered ciphertext", key, pasetoLocalHeader + tamper(payload, 60) + "." + footer, v.implicit},
+		{"tampered nonce", key, pasetoLocalHeader + tamper(payload, 0) + "." + footer, v.implicit},
+		{"tampered footer", key, pasetoLocalHeader + payload + "." + tamper(footer, 10), v.implicit},
+		{"footer removed", key, pasetoLocalHeader + payload, v.implicit},
+		{"other implicit assertion", key, v.token, `{"test-vector":"4-E-8"}`},
+		{"implicit assertion missing", key, v.token, ""},
+		{"other key", otherKey, v.token, v.implicit},
+		{"public header", key, pasetoPublicHeader + payload + "." + footer, v.implicit},
+		{"too short", key, pasetoLocalHeader + payload[:50], v.implicit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := pasetoDecrypt(tt.key, tt.token, []byte(tt.implicit)); err == nil {
+				t.Fatal("token was accepted")
+			}
+		})
+	}
+
+	if _, err := pasetoEncrypt(key[:16], []byte(v.message), nil, nil); err == nil {
+		t.Fatal("a 16 byte key was accepted")
+	}
+}
+
+func TestPASETOPublicRejected(t *testing.T) {
+	public := ed25519.PublicKey(mustHex(t, pasetoVectorPublicKey))
+	v := pasetoPublicVectors[2] // 4-S-3, with a footer and an implicit assertion.
+	payload, footer, _ := strings.Cut(strings.TrimPrefix(v.token, pasetoPublicHeader), ".")
+
+	otherPublic, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		key      ed25519.PublicKey
+		token    string
+		implicit string
+	}{
+		{"tampered signature", public, pasetoPublicHeader + tamper(payload, len(payload)-2) + "." + footer, v.implicit},
+		{"tampered message", public, pasetoPublicHeader + tamper(payload, 10) + "." + footer, v.implicit},
+		{"tampered footer", public, pasetoPublicHeader + payload + "." + tamper(footer, 10), v.implicit},
+		{"footer removed", public, pasetoPublicHeader + payload, v.implicit},
+		{"other implicit assertion", public, v.token, `{"test-vector":"4-S-2"}`},
+		{"implicit assertion missing", public, v.token, ""},
+		{"other key", otherPublic, v.token, v.implicit},
+		{"local header", public, pasetoLocalHeader + payload + "." + footer, v.implicit},
+		{"too short", public, pasetoPublicHeader + payload[:50], v.implicit},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, _, err := pasetoVerify(tt.key, tt.token, []byte(tt.implicit)); err == nil {
+				t.Fatal("token was accepted")
+			}
+		})
+	}
+}
+
+func TestPASETOFooter(t *testing.T) {
+	footer, err := pasetoFooter(pasetoPublicVectors[1].token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(footer) != pasetoVectorKid {
+		t.Fatalf("got footer %s, want %s", footer, pasetoVectorKid)
+	}
+
+	footer, err = pasetoFooter(pasetoPublicVectors[0].token)
+	if err != nil || footer != nil {
+		t.Fatalf("got footer %s and error %v for a token without a footer", footer, err)
+	}
+}
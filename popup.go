@@ -0,0 +1,120 @@
+package authsession
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+//popupResult is the message posted to the window that opened the login
+// popup.
+type popupResult struct {
+	Type     string `json:"type"`
+	Success  bool   `json:"success"`
+	Email    string `json:"email,omitempty"`
+	Redirect string `json:"redirect,omitempty"`
+	Error    string `json:"error,omitempty"`
+	Message  string `json:"message,omitempty"`
+}
+
+//popupTemplate is the page rendered in the login popup, which posts the
+// result to the window that opened it, and closes the popup.
+var popupTemplate = template.Must(template.New("popup").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Login</title></head>
+<body>
+<script>
+(function() {
+	var result = {{.Result}};
+	var origins = {{.Origins}};
+	if (window.opener) {
+		for (var i = 0; i < origins.length; i++) {
+			window.opener.postMessage(result, origins[i]);
+		}
+		window.close();
+	}
+})();
+</script>
+<noscript>{{.Result.Message}}</noscript>
+</body>
+</html>
+`))
+
+//popupOriginsDefault will return the origin of the callback url of the
+// default provider, which is used when WithPopupLogin is given no origins.
+func (a *Auth) popupOriginsDefault() []string {
+	u, err := url.Parse(a.googleOauthConfig.RedirectURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	return []string{u.Scheme + "://" + u.Host}
+}
+
+//rememberPopup will store in the session if the login is done in a popup,
+// asked for with popup=1 in the query of /slogin.
+func (a *Auth) rememberPopup(r *http.Request, session *sessions.Session) {
+	if a.popupOrigins != nil && r.URL.Query().Get("popup") == "1" {
+		session.Values["popup"] = true
+		return
+	}
+	delete(session.Values, "popup")
+}
+
+//popupLogin will return true if the login of the request is done in a
+// popup.
+func (a *Auth) popupLogin(r *http.Request) bool {
+	if a.popupOrigins == nil {
+		return false
+	}
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		return false
+	}
+	popup, _ := session.Values["popup"].(bool)
+	return popup
+}
+
+//renderPopup will render the page posting the result to the window that
+// opened the popup.
+func (a *Auth) renderPopup(w http.ResponseWriter, r *http.Request, status int, result popupResult) {
+	result.Type = "authsession.login"
+	origins := a.popupOrigins
+	if len(origins) == 0 {
+		origins = a.popupOriginsDefault()
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	err := popupTemplate.Execute(w, struct {
+		Result  popupResult
+		Origins []string
+	}{result, origins})
+	if err != nil {
+		a.logRequestError(r, "error: executing popup template: ", err)
+	}
+}
+
+//popupFailure will render the failed login page name in a popup as a
+// failed result posted to the opener, and return false if the login is
+// not done in a popup.
+func (a *Auth) popupFailure(w http.ResponseWriter, r *http.Request, status int, name string, data PageData) bool {
+	switch name {
+	case pageLoginFailed, pageAccessDenied, pageLoginCancelled, pageTooManyAttempts:
+	default:
+		return false
+	}
+	if !a.popupLogin(r) {
+		return false
+	}
+
+	msg := data.Message
+	if msg == "" {
+		msg = a.message(r, strings.TrimSuffix(name, ".html")+".text")
+	}
+	a.renderPopup(w, r, status, popupResult{Error: strings.TrimSuffix(name, ".html"), Message: msg})
+	return true
+}
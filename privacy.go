@@ -0,0 +1,177 @@
+package authsession
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+//The personal fields of a UserRecord, as the keys of its Privacy.
+const (
+	PersonalFieldEmail   = "email"
+	PersonalFieldName    = "fullName"
+	PersonalFieldPicture = "picture"
+)
+
+//PersonalData is the privacy metadata of a personal field of a
+// UserRecord, telling where the value came from, why it is kept, and
+// until when, for privacy audits.
+type PersonalData struct {
+	//Source is where the value came from, like the ID of the provider,
+	// "google", "ldap", or "admin" for a user added by the admin API.
+	Source string `json:"source"`
+	//Purpose is why the value is kept, from the PrivacyPolicy.
+	Purpose string `json:"purpose,omitempty"`
+	//Collected is when the value was last given by the source, like at
+	// the last login.
+	Collected time.Time `json:"collected"`
+	//Expires is when the value will be purged by the retention sweeper,
+	// with the retention of the PrivacyPolicy when it was collected, or
+	// zero if it is kept.
+	Expires time.Time `json:"expires"`
+}
+
+//FieldPolicy is the purpose and retention of a personal field.
+type FieldPolicy struct {
+	//Purpose is why the value is kept, like "login" or "display name".
+	Purpose string
+	//Retention is how long the value is kept after it was last collected,
+	// like after the last login of the user. Zero keeps it.
+	Retention time.Duration
+}
+
+//PrivacyPolicy is the purpose and retention of the personal fields kept
+// in the user store, set with WithPrivacyPolicy.
+type PrivacyPolicy struct {
+	//Email is the policy of the email. When it expires the whole user is
+	// deleted from the user store, unless disabled, so a disabled user
+	// stays disabled.
+	Email FieldPolicy
+	//Name is the policy of the full name.
+	Name FieldPolicy
+	//Picture is the policy of the picture URL. The picture is only kept
+	// when a Purpose is given.
+	Picture FieldPolicy
+}
+
+//UserDeleter is implemented by user stores which can delete users, like
+// FileUserStore. It is needed by the retention sweeper to purge the users
+// with an expired email.
+type UserDeleter interface {
+	//Delete will delete the user with the email.
+	Delete(email string) error
+}
+
+//retains will return true if any of the fields has a retention, so the
+// retention sweeper is needed.
+func (p PrivacyPolicy) retains() bool {
+	return p.Email.Retention > 0 || p.Name.Retention > 0 || p.Picture.Retention > 0
+}
+
+//personalField is a personal field of a UserRecord, with its policy.
+type personalField struct {
+	name   string
+	value  *string
+	policy FieldPolicy
+}
+
+//personalFields will return the personal fields of u, with their policy.
+func (p PrivacyPolicy) personalFields(u *UserRecord) []personalField {
+	return []personalField{
+		{PersonalFieldEmail, &u.Email, p.Email},
+		{PersonalFieldName, &u.FullName, p.Name},
+		{PersonalFieldPicture, &u.Picture, p.Picture},
+	}
+}
+
+//tagPersonalData will set the privacy metadata of the fields of u with a
+// value, as collected from the source at now, and remove it for the
+// fields without a value.
+func (p PrivacyPolicy) tagPersonalData(u *UserRecord, source string, now time.Time) {
+	if u.Privacy == nil {
+		u.Privacy = map[string]PersonalData{}
+	}
+	for _, f := range p.personalFields(u) {
+		if *f.value == "" {
+			delete(u.Privacy, f.name)
+			continue
+		}
+		pd := PersonalData{Source: source, Purpose: f.policy.Purpose, Collected: now}
+		if f.policy.Retention > 0 {
+			pd.Expires = now.Add(f.policy.Retention)
+		}
+		u.Privacy[f.name] = pd
+	}
+}
+
+//collected will return when the field of u was last collected. Users
+// stored before the metadata was kept count from their last login.
+func (u UserRecord) collected(field string) time.Time {
+	if pd, ok := u.Privacy[field]; ok {
+		return pd.Collected
+	}
+	if !u.LastLogin.IsZero() {
+		return u.LastLogin
+	}
+	return u.Created
+}
+
+//personalDataSource will return the source of the personal data of a
+// login with the provider, which is empty for Google.
+func personalDataSource(provider string) string {
+	if provider == "" {
+		return "google"
+	}
+	return provider
+}
+
+//purgePersonalData will purge the personal fields of the users kept for
+// longer than the retention of the PrivacyPolicy after they were last
+// collected, and return the number of values purged. A user with an
+// expired email is deleted. The current policy is used, so a shorter
+// retention also applies to the values already kept.
+func (a *Auth) purgePersonalData(now time.Time) (int, error) {
+	users, err := a.users.List()
+	if err != nil {
+		return 0, fmt.Errorf("user store List failed: %v", err)
+	}
+
+	var n int
+	for _, u := range users {
+		expired := func(field string, p FieldPolicy) bool {
+			return p.Retention > 0 && now.Sub(u.collected(field)) > p.Retention
+		}
+
+		if u.Email != "" && !u.Disabled && expired(PersonalFieldEmail, a.privacy.Email) {
+			d, ok := unwrapStore(a.users).(UserDeleter)
+			if !ok {
+				return n, fmt.Errorf("user store %T can't delete users", unwrapStore(a.users))
+			}
+			if err := d.Delete(u.Email); err != nil {
+				return n, fmt.Errorf("user store Delete failed: %v", err)
+			}
+			n++
+			continue
+		}
+
+		changed := false
+		for _, f := range a.privacy.personalFields(&u) {
+			if f.name == PersonalFieldEmail || *f.value == "" || !expired(f.name, f.policy) {
+				continue
+			}
+			*f.value = ""
+			delete(u.Privacy, f.name)
+			changed = true
+			n++
+		}
+		if changed {
+			if err := a.users.Put(u); err != nil {
+				return n, fmt.Errorf("user store Put failed: %v", err)
+			}
+		}
+	}
+	if n > 0 {
+		log.Printf("info: privacy: purged %d personal values past their retention\n", n)
+	}
+	return n, nil
+}
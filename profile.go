@@ -0,0 +1,106 @@
+package authsession
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"golang.org/x/oauth2"
+)
+
+//peopleAPIURL is the Google People API for the user logged in, with the
+// fields fetched for the Profile.
+const peopleAPIURL = "https://people.googleapis.com/v1/people/me?personFields=locales,organizations,phoneNumbers"
+
+//peopleAPIScopes are the scopes needed to read the organizations and the
+// phone numbers of the user with the People API.
+var peopleAPIScopes = []string{
+	"https://www.googleapis.com/auth/user.organization.read",
+	"https://www.googleapis.com/auth/user.phonenumbers.read",
+}
+
+//Profile is the user logged in, given to the post login hook. The fields
+// after the User are only filled in for Google users when the People API
+// is turned on with WithGoogleProfile.
+type Profile struct {
+	User
+	//Provider is the id of the provider the user logged in with, "ldap"
+	// for LDAP, or empty for Google.
+	Provider      string         `json:"provider"`
+	Locale        string         `json:"locale,omitempty"`
+	Organizations []Organization `json:"organizations,omitempty"`
+	PhoneNumbers  []string       `json:"phoneNumbers,omitempty"`
+}
+
+//Organization is an organization the user is a member of, as given by
+// the Google People API.
+type Organization struct {
+	Name       string `json:"name"`
+	Title      string `json:"title"`
+	Department string `json:"department"`
+}
+
+//PostLoginHook is called when a user has logged in and passed all the
+// checks, before the session is started. Returning an error denies the
+// login.
+type PostLoginHook func(r *http.Request, p Profile) error
+
+//googleProfile will fill in the fields of p from the Google People API.
+func (a *Auth) googleProfile(ctx context.Context, token *oauth2.Token, p *Profile) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, peopleAPIURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+
+	response, err := a.providerClient().Do(req)
+	if err != nil {
+		return fmt.Errorf("failed getting the people api profile: %w", err)
+	}
+	defer response.Body.Close()
+
+	var person struct {
+		Locales []struct {
+			Value string `json:"value"`
+		} `json:"locales"`
+		Organizations []Organization `json:"organizations"`
+		PhoneNumbers  []struct {
+			Value string `json:"value"`
+		} `json:"phoneNumbers"`
+	}
+	if err := decodeUserInfo(response, &person); err != nil {
+		return err
+	}
+
+	if len(person.Locales) > 0 {
+		p.Locale = person.Locales[0].Value
+	}
+	p.Organizations = person.Organizations
+	for _, n := range person.PhoneNumbers {
+		p.PhoneNumbers = append(p.PhoneNumbers, n.Value)
+	}
+	return nil
+}
+
+//postLogin will call the post login hook with the profile of the user,
+// and return false if the hook denied the login. For Google users the
+// profile is enriched from the People API first, if turned on. A failing
+// People API request is logged, and the hook gets the profile without it.
+func (a *Auth) postLogin(r *http.Request, token *oauth2.Token, p Profile) bool {
+	if a.postLoginHook == nil {
+		return true
+	}
+
+	if a.peopleAPI && p.Provider == "" && token != nil {
+		if err := a.googleProfile(r.Context(), token, &p); err != nil {
+			a.logRequestError(r, "error: people api: ", err)
+		}
+	}
+
+	if err := a.postLoginHook(r, p); err != nil {
+		logRequestf(r, "info: login of %v denied by the post login hook: %v\n", a.LogIdentifier(p.Email), err)
+		a.events.failure(r, p.Email, "post login hook: "+err.Error())
+		return false
+	}
+	return true
+}
@@ -0,0 +1,126 @@
+package authsession
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+)
+
+//ProfileStep is a check done after login, like if the email is verified,
+// the profile is complete or MFA is enrolled. Users who have not done
+// the step are sent to the page of the step before they reach the
+// handlers wrapped with IsAuthenticated. The steps are set with
+// WithProfileSteps.
+type ProfileStep struct {
+	//Name is the name of the step, like "mfa", used in the logs.
+	Name string
+	//Done will return true if the user with the email has done the step.
+	Done func(r *http.Request, email string) (bool, error)
+	//URL is the local path of the page where the user does the step. It is
+	// given a signed return_to, so the page can send the user back with
+	// the path from VerifyReturnTo when the step is done.
+	URL string
+}
+
+//profileStepsKey will return the key of the steps stored in the session
+// when all of them are done, so adding a step checks the sessions again.
+func profileStepsKey(steps []ProfileStep) string {
+	var names []string
+	for _, s := range steps {
+		names = append(names, s.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+//pendingProfileStep will return the first step not done by the user of
+// the session, and false if all of them are done. When all the steps are
+// done it is stored in the session, so the steps are not checked again
+// for every request.
+func (a *Auth) pendingProfileStep(r *http.Request, session *sessions.Session) (ProfileStep, bool) {
+	if len(a.profileSteps) == 0 {
+		return ProfileStep{}, false
+	}
+	key := profileStepsKey(a.profileSteps)
+	if done, _ := session.Values["profilesteps"].(string); done == key {
+		return ProfileStep{}, false
+	}
+
+	email, _ := session.Values[sessionKeyEmail].(string)
+	for _, s := range a.profileSteps {
+		done, err := s.Done(r, email)
+		if err != nil {
+			a.logRequestError(r, "error: profile step "+s.Name+": ", err)
+		}
+		if !done {
+			return s, true
+		}
+	}
+
+	session.Values["profilesteps"] = key
+	return ProfileStep{}, false
+}
+
+//profileStepURL will return the url of the page of the step, which can
+// bring the user back to the local path p.
+func (a *Auth) profileStepURL(r *http.Request, s ProfileStep, p string) string {
+	return a.signedReturnToURL(r, s.URL, p)
+}
+
+//signedReturnToURL will return the url of a page with a signed return_to
+// of the local path p added, so the page can bring the user back.
+func (a *Auth) signedReturnToURL(r *http.Request, u string, p string) string {
+	value, err := a.SignReturnTo(p)
+	if err != nil {
+		a.logRequestError(r, "error: failed to sign return to: ", err)
+		return u
+	}
+	sep := "?"
+	if strings.Contains(u, "?") {
+		sep = "&"
+	}
+	return u + sep + url.Values{"return_to": {value}}.Encode()
+}
+
+//profileStepsDone will return true if the user of the session has done
+// all the profile steps, or the request is for the page of a step. If not,
+// the user is redirected to the page of the first step not done, and
+// brought back after for GET requests.
+func (a *Auth) profileStepsDone(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	if len(a.profileSteps) == 0 || a.isProfileStepPage(r) {
+		return true
+	}
+
+	before, _ := session.Values["profilesteps"].(string)
+	s, pending := a.pendingProfileStep(r, session)
+	if pending {
+		email, _ := session.Values[sessionKeyEmail].(string)
+		logRequestf(r, "info: %v has not done the profile step %v\n", a.LogIdentifier(email), s.Name)
+		target := s.URL
+		if r.Method == http.MethodGet {
+			target = a.profileStepURL(r, s, r.URL.RequestURI())
+		}
+		a.safeRedirect(w, r, target, http.StatusSeeOther)
+		return false
+	}
+
+	if after, _ := session.Values["profilesteps"].(string); after != before {
+		a.setTenantCookiePath(r, session.Options)
+		if err := session.Save(r, w); err != nil {
+			a.logRequestError(r, "error: session.Save after profile steps failed: ", err)
+		}
+	}
+	return true
+}
+
+//isProfileStepPage will return true if the request is for the page of a
+// step, which must be reachable while the steps are not done.
+func (a *Auth) isProfileStepPage(r *http.Request) bool {
+	for _, s := range a.profileSteps {
+		if u, err := url.Parse(s.URL); err == nil && u.Path == r.URL.Path {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,120 @@
+package authsession
+
+import (
+	"net/http"
+	"path"
+	"strings"
+)
+
+//ProtectRule tells Protect how requests matching the pattern and the
+// methods are protected.
+type ProtectRule struct {
+	//Pattern is the path matched. A pattern ending in / matches all the
+	// paths below it, like "/static/", and other patterns are matched
+	// with path.Match, like "/about" or "/docs/*".
+	Pattern string
+	//Methods are the methods matched, like "POST", and no methods match
+	// all of them.
+	Methods []string
+	//Public lets the requests through without login. The user of a valid
+	// session is still given in the request context, like with
+	// MaybeAuthenticated.
+	Public bool
+	//Roles are the roles of which the user must have at least one, like
+	// the roles given by LDAP. No roles only require a login.
+	Roles []string
+}
+
+//matches will return true if the rule is for the request.
+func (p ProtectRule) matches(r *http.Request) bool {
+	if len(p.Methods) > 0 {
+		found := false
+		for _, m := range p.Methods {
+			if strings.EqualFold(m, r.Method) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	return matchPath(p.Pattern, r.URL.Path)
+}
+
+//matchPath will return true if the path p matches the pattern, which is
+// a prefix if it ends in /, and else matched with path.Match.
+func matchPath(pattern string, p string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		return strings.HasPrefix(p, pattern)
+	}
+	ok, err := path.Match(pattern, p)
+	return err == nil && ok
+}
+
+//Protect will wrap h, like the mux of the app, so the requests are
+// protected by the first of the rules matching them. Requests no rule
+// matches require a login like with IsAuthenticated, so new pages are
+// protected until they are made public. The paths of the package, like
+// /slogin and /callback, are served by the package itself, and not by h.
+func (a *Auth) Protect(h http.Handler, rules ...ProtectRule) http.Handler {
+	own := http.NewServeMux()
+	a.register(own)
+
+	handlers := make([]http.Handler, len(rules))
+	for i, rule := range rules {
+		switch {
+		case rule.Public:
+			handlers[i] = a.MaybeAuthenticated(h.ServeHTTP)
+		case len(rule.Roles) > 0:
+			handlers[i] = a.IsAuthenticated(a.requireRoles(rule.Roles, h))
+		default:
+			handlers[i] = a.IsAuthenticated(h.ServeHTTP)
+		}
+	}
+	protected := a.IsAuthenticated(h.ServeHTTP)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, pattern := own.Handler(r); pattern != "" && a.ownPath(r, pattern) {
+			own.ServeHTTP(w, r)
+			return
+		}
+		for i, rule := range rules {
+			if rule.matches(r) {
+				handlers[i].ServeHTTP(w, r)
+				return
+			}
+		}
+		protected(w, r)
+	})
+}
+
+//ownPath will return true if the request matching the pattern of the
+// package is for the package. The tenant patterns, like /{tenant}/slogin,
+// also match the paths of the app, like /reports/slogin, so they are only
+// for the package when the tenant exists.
+func (a *Auth) ownPath(r *http.Request, pattern string) bool {
+	if !strings.HasPrefix(pattern, "/{tenant}/") {
+		return true
+	}
+	_, found := a.Tenant(r)
+	return found
+}
+
+//requireRoles will return a handler calling h if the user in the request
+// context has one of the roles, and showing the access denied page if
+// not.
+func (a *Auth) requireRoles(roles []string, h http.Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		su, _ := r.Context().Value(sessionUserKey{}).(sessionUser)
+		for _, role := range roles {
+			if su.hasRole(role) {
+				h.ServeHTTP(w, r)
+				return
+			}
+		}
+		logRequestf(r, "info: %v does not have any of the roles %v for %v\n", a.LogIdentifier(su.user.Email), roles, r.URL.Path)
+		a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+	}
+}
@@ -0,0 +1,87 @@
+package authsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+//testApp will return a mux of an app answering "app" on every path.
+func testApp() *http.ServeMux {
+	app := http.NewServeMux()
+	app.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("app")) })
+	return app
+}
+
+func TestProtectRules(t *testing.T) {
+	a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret", WithSessionStore(NewFileSessionStore("")))
+	h := a.Protect(testApp(),
+		ProtectRule{Pattern: "/static/", Public: true},
+		ProtectRule{Pattern: "/about", Methods: []string{"GET"}, Public: true},
+		ProtectRule{Pattern: "/admin/*", Roles: []string{"admin"}},
+	)
+	cookie := testLoginCookie(t, a, "u@example.com", "")
+
+	tests := []struct {
+		method   string
+		path     string
+		loggedIn bool
+		status   int
+	}{
+		{"GET", "/static/x.css", false, http.StatusOK},
+		{"GET", "/about", false, http.StatusOK},
+		{"POST", "/about", false, http.StatusForbidden},
+		{"GET", "/other", false, http.StatusForbidden},
+		{"GET", "/other", true, http.StatusOK},
+		{"GET", "/admin/x", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.loggedIn {
+			r.AddCookie(cookie)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%v %v, logged in %v: got status %v, want %v", tt.method, tt.path, tt.loggedIn, w.Code, tt.status)
+		}
+	}
+}
+
+func TestProtectOwnPaths(t *testing.T) {
+	tenants := NewFileTenantStore("")
+	tenants.Put(Tenant{ID: "t1", ClientID: "id", ClientSecret: "secret"})
+	a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret",
+		WithSessionStore(NewFileSessionStore("")), WithTenants(tenants, TenantFromPath),
+		WithHoneypot(HoneypotConfig{Paths: []string{"/wp-login.php"}, TarpitDelay: time.Millisecond}))
+	h := a.Protect(testApp(), ProtectRule{Pattern: "/public/", Public: true})
+
+	tests := []struct {
+		name  string
+		path  string
+		toApp bool
+	}{
+		{"login", "/slogin", false},
+		{"login of a tenant", "/t1/slogin", false},
+		{"honeypot", "/wp-login.php", false},
+		{"app path matching a tenant pattern", "/reports/slogin", false},
+		{"public app path matching a tenant pattern", "/public/slogin", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+			if got := w.Body.String() == "app"; got != tt.toApp {
+				t.Fatalf("got status %v and body %q, want served by the app %v", w.Code, w.Body.String(), tt.toApp)
+			}
+		})
+	}
+
+	//The app path is protected by the rules, not let through.
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/reports/slogin", nil))
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got status %v for /reports/slogin without login, want %v", w.Code, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,384 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//Provider is an OpenID Connect provider registered at runtime, like the
+// Okta or Azure AD of a customer. The endpoints are filled in from the
+// discovery document of the issuer when registered with RegisterProvider.
+// Users log in with a provider with /slogin?provider=<id>, or choose it
+// on the login page where it is shown with the Name and the IconURL.
+type Provider struct {
+	ID           string   `json:"id"`
+	Name         string   `json:"name"`
+	IconURL      string   `json:"iconURL"`
+	Issuer       string   `json:"issuer"`
+	ClientID     string   `json:"clientID"`
+	ClientSecret string   `json:"clientSecret"`
+	RedirectURL  string   `json:"redirectURL"`
+	Scopes       []string `json:"scopes"`
+
+	AuthURL     string `json:"authURL"`
+	TokenURL    string `json:"tokenURL"`
+	UserInfoURL string `json:"userInfoURL"`
+	JWKSURI     string `json:"jwksURI"`
+	PARURL      string `json:"parURL"`
+
+	//UsePAR will push the authorization request to the provider (RFC 9126),
+	// so the login redirect only carries a request_uri. It is turned on by
+	// RegisterProvider if the provider requires it.
+	UsePAR bool `json:"usePAR"`
+	//UseJAR will send the authorization request as a request object (RFC
+	// 9101), signed with the key given with WithClientSigningKey.
+	UseJAR bool `json:"useJAR"`
+	//TokenAuthMethod is how we authenticate to the token endpoint, one of
+	// client_secret_basic (the default), private_key_jwt or tls_client_auth.
+	TokenAuthMethod string `json:"tokenAuthMethod"`
+}
+
+//oauthConfig will return the oauth config for the provider.
+func (p Provider) oauthConfig() *oauth2.Config {
+	scopes := p.Scopes
+	if len(scopes) == 0 {
+		scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &oauth2.Config{
+		ClientID:     p.ClientID,
+		ClientSecret: p.ClientSecret,
+		RedirectURL:  p.RedirectURL,
+		Scopes:       scopes,
+		Endpoint: oauth2.Endpoint{
+			AuthURL:  p.AuthURL,
+			TokenURL: p.TokenURL,
+		},
+	}
+}
+
+//ProviderStore keeps the providers registered at runtime.
+type ProviderStore interface {
+	//Put will add, or replace a provider.
+	Put(p Provider) error
+	//Get will return the provider with the id, and false if not found.
+	Get(id string) (Provider, bool, error)
+	//Delete will delete the provider with the id.
+	Delete(id string) error
+	//List will return all the providers.
+	List() ([]Provider, error)
+}
+
+//FileProviderStore is a ProviderStore keeping the providers in a JSON file.
+type FileProviderStore struct {
+	m *jsonFileMap[Provider]
+}
+
+//NewFileProviderStore will return a *FileProviderStore storing the
+// providers in the file at path. If path is empty the providers are
+// only kept in memory.
+func NewFileProviderStore(path string) *FileProviderStore {
+	return &FileProviderStore{
+		m: newJSONFileMap[Provider](path),
+	}
+}
+
+//Put will add, or replace a provider.
+func (f *FileProviderStore) Put(p Provider) error {
+	return f.m.update(func(m map[string]Provider) error {
+		m[p.ID] = p
+		return nil
+	})
+}
+
+//Get will return the provider with the id, and false if not found.
+func (f *FileProviderStore) Get(id string) (Provider, bool, error) {
+	var p Provider
+	var ok bool
+	err := f.m.view(func(m map[string]Provider) error {
+		p, ok = m[id]
+		return nil
+	})
+	return p, ok, err
+}
+
+//Delete will delete the provider with the id.
+func (f *FileProviderStore) Delete(id string) error {
+	return f.m.update(func(m map[string]Provider) error {
+		delete(m, id)
+		return nil
+	})
+}
+
+//List will return all the providers.
+func (f *FileProviderStore) List() ([]Provider, error) {
+	var providers []Provider
+	err := f.m.view(func(m map[string]Provider) error {
+		for _, p := range m {
+			providers = append(providers, p)
+		}
+		return nil
+	})
+	return providers, err
+}
+
+//discoveryDocument is the part of the OpenID Connect discovery document used.
+type discoveryDocument struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	UserInfoEndpoint      string `json:"userinfo_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+	PAREndpoint           string `json:"pushed_authorization_request_endpoint"`
+	RequirePAR            bool   `json:"require_pushed_authorization_requests"`
+}
+
+//fetchDiscovery will get the discovery document for the issuer, and
+// check that it is for the same issuer.
+func fetchDiscovery(ctx context.Context, issuer string) (discoveryDocument, error) {
+	var doc discoveryDocument
+
+	discoveryURL := strings.TrimSuffix(issuer, "/") + "/.well-known/openid-configuration"
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return doc, err
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return doc, fmt.Errorf("failed getting discovery document: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return doc, fmt.Errorf("failed getting discovery document: %v returned %v", discoveryURL, resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return doc, fmt.Errorf("failed parsing discovery document: %v", err)
+	}
+
+	if strings.TrimSuffix(doc.Issuer, "/") != strings.TrimSuffix(issuer, "/") {
+		return doc, fmt.Errorf("discovery document is for issuer %q, not %q", doc.Issuer, issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return doc, errors.New("discovery document is missing the authorization or token endpoint")
+	}
+
+	return doc, nil
+}
+
+//validateRedirectURL will check that u is an absolute url to a callback
+// handler, using https for anything else than localhost.
+func validateRedirectURL(u string) error {
+	pu, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("redirect url %q is not valid: %v", u, err)
+	}
+	if !pu.IsAbs() || pu.Host == "" {
+		return fmt.Errorf("redirect url %q must be absolute", u)
+	}
+	if pu.Scheme != "https" && !(pu.Scheme == "http" && (pu.Hostname() == "localhost" || pu.Hostname() == "127.0.0.1")) {
+		return fmt.Errorf("redirect url %q must use https", u)
+	}
+	if pu.Fragment != "" || pu.RawQuery != "" {
+		return fmt.Errorf("redirect url %q can't have a query or fragment", u)
+	}
+	if !strings.HasSuffix(pu.Path, "/callback") {
+		return fmt.Errorf("redirect url %q must point to the /callback handler", u)
+	}
+	return nil
+}
+
+//validateIconURL will check that u is empty, a local path, or an https url.
+func validateIconURL(u string) error {
+	if u == "" {
+		return nil
+	}
+	pu, err := url.Parse(u)
+	if err != nil {
+		return fmt.Errorf("icon url %q is not valid: %v", u, err)
+	}
+	if pu.Scheme == "https" && pu.Host != "" {
+		return nil
+	}
+	if pu.Scheme == "" && pu.Host == "" && strings.HasPrefix(pu.Path, "/") {
+		return nil
+	}
+	return fmt.Errorf("icon url %q must be a local path or use https", u)
+}
+
+//providerUserSep separates the ID of a provider registered at runtime
+// from the ID and the email of its users.
+const providerUserSep = ":"
+
+//providerUser will return the user logged in with the provider registered
+// at runtime with the id, with the ID and the email prefixed by the id of
+// the provider, like "acme:alice@example.com". These providers are run by
+// customers, who can give any email, so their users are kept apart from
+// the users of the built-in provider and of the other providers, in the
+// user store, the allowlists, the epochs and the admins.
+func providerUser(id string, u User) User {
+	u.ID = id + providerUserSep + u.ID
+	u.Email = id + providerUserSep + u.Email
+	return u
+}
+
+//splitProviderUser will return the provider and the email of the user,
+// as made by providerUser. The provider is empty for the users of the
+// built-in provider.
+func splitProviderUser(user string) (provider string, email string) {
+	at := strings.LastIndex(user, "@")
+	if i := strings.Index(user, providerUserSep); i >= 0 && (at < 0 || i < at) {
+		return user[:i], user[i+len(providerUserSep):]
+	}
+	return "", user
+}
+
+//RegisterProvider will fetch the discovery document for the issuer of
+// the provider, fill in the endpoints, validate the redirect URL, and
+// add the provider to the provider store. An empty redirect URL will use
+// the redirect URL given to NewAuth.
+func (a *Auth) RegisterProvider(ctx context.Context, p Provider) (Provider, error) {
+	if a.providers == nil {
+		return p, errors.New("no provider store configured")
+	}
+	if p.ID == "" || p.Issuer == "" || p.ClientID == "" {
+		return p, errors.New("id, issuer and clientID are required")
+	}
+	if strings.ContainsAny(p.ID, providerUserSep+"@") {
+		return p, fmt.Errorf("id can't contain %q or @", providerUserSep)
+	}
+
+	if p.RedirectURL == "" {
+		p.RedirectURL = a.googleOauthConfig.RedirectURL
+	}
+	if err := validateRedirectURL(p.RedirectURL); err != nil {
+		return p, err
+	}
+	if err := validateIconURL(p.IconURL); err != nil {
+		return p, err
+	}
+	scopes, err := normalizeScopes(p.Scopes)
+	if err != nil {
+		return p, err
+	}
+	p.Scopes = scopes
+
+	doc, err := fetchDiscovery(ctx, p.Issuer)
+	if err != nil {
+		return p, err
+	}
+	p.AuthURL = doc.AuthorizationEndpoint
+	p.TokenURL = doc.TokenEndpoint
+	p.UserInfoURL = doc.UserInfoEndpoint
+	p.JWKSURI = doc.JWKSURI
+	p.PARURL = doc.PAREndpoint
+	if doc.RequirePAR {
+		p.UsePAR = true
+	}
+	if p.UsePAR && p.PARURL == "" {
+		return p, errors.New("provider has no pushed authorization request endpoint")
+	}
+	if p.UseJAR && a.clientSigner == nil {
+		return p, errors.New("no client signing key configured, see WithClientSigningKey")
+	}
+	if err := a.checkTokenAuthMethod(p); err != nil {
+		return p, err
+	}
+
+	if err := a.providers.Put(p); err != nil {
+		return p, fmt.Errorf("provider store Put failed: %v", err)
+	}
+
+	return p, nil
+}
+
+//RemoveProvider will remove the provider with the id from the provider store.
+func (a *Auth) RemoveProvider(id string) error {
+	if a.providers == nil {
+		return errors.New("no provider store configured")
+	}
+	return a.providers.Delete(id)
+}
+
+//providerOauthConfig will return the oauth config for the provider with
+// the id, or the default config for the request if id is empty.
+func (a *Auth) providerOauthConfig(r *http.Request, id string) (*oauth2.Config, error) {
+	if id == "" {
+		return a.oauthConfig(r)
+	}
+	if a.providers == nil {
+		return nil, fmt.Errorf("unknown provider %q", id)
+	}
+
+	p, ok, err := a.providers.Get(id)
+	if err != nil {
+		return nil, fmt.Errorf("provider store Get failed: %v", err)
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown provider %q", id)
+	}
+
+	return p.oauthConfig(), nil
+}
+
+//adminListProviders will list the providers, without the client secrets.
+func (a *Auth) adminListProviders(w http.ResponseWriter, r *http.Request) {
+	if a.providers == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no provider store configured")
+		return
+	}
+
+	providers, err := a.providers.List()
+	if err != nil {
+		a.logRequestError(r, "error: admin: provider store List failed: ", err)
+		writeJSONError(w, http.StatusInternalServerError, "failed to list providers")
+		return
+	}
+	for i := range providers {
+		providers[i].ClientSecret = ""
+	}
+
+	writeJSON(w, http.StatusOK, providers)
+}
+
+//adminRegisterProvider will register the provider given as JSON in the body.
+func (a *Auth) adminRegisterProvider(w http.ResponseWriter, r *http.Request) {
+	if a.providers == nil {
+		writeJSONError(w, http.StatusNotImplemented, "no provider store configured")
+		return
+	}
+
+	var p Provider
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "expected a JSON body with the provider")
+		return
+	}
+
+	p, err := a.RegisterProvider(r.Context(), p)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	p.ClientSecret = ""
+
+	writeJSON(w, http.StatusCreated, p)
+}
+
+func (a *Auth) adminRemoveProvider(w http.ResponseWriter, r *http.Request) {
+	if err := a.RemoveProvider(r.PathValue("id")); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,35 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+//recoverPanic will recover a panic in a handler, log it with the stack
+// and the request ID, count it, and write a 500 error page, so the user
+// doesn't get the connection closed in the middle of a login. It must be
+// called deferred.
+func (a *Auth) recoverPanic(w http.ResponseWriter, r *http.Request) {
+	v := recover()
+	if v == nil {
+		return
+	}
+	//ErrAbortHandler is used to abort a response on purpose.
+	if err, ok := v.(error); ok && errors.Is(err, http.ErrAbortHandler) {
+		panic(v)
+	}
+
+	a.panics.Add(1)
+	a.logRequestError(r, fmt.Sprintf("error: panic in handler for %v %v: %v\n%s", r.Method, r.URL.Path, v, debug.Stack()))
+	a.renderPage(w, r, http.StatusInternalServerError, pageLoginFailed, PageData{Message: a.message(r, "error.internal")})
+}
+
+//recoverHandler will recover panics in h with recoverPanic.
+func (a *Auth) recoverHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer a.recoverPanic(w, r)
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package authsession
+
+import (
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+//RedirectAllowlist is the local paths users can be redirected to after
+// login, logout and errors, set with WithRedirectAllowlist. Redirects to
+// anything else go to the start page instead. The start page, the terms
+// page, the pages of the profile steps and the authorization endpoint of
+// the issuer are always allowed.
+type RedirectAllowlist struct {
+	//Paths are the paths allowed, like "/dashboard". The query of the
+	// redirect is not part of the match.
+	Paths []string
+	//Patterns are the paths allowed matched with path.Match, like
+	// "/docs/*", where * does not match a /.
+	Patterns []string
+}
+
+//allows will return true if the path is in the allowlist.
+func (l *RedirectAllowlist) allows(p string) bool {
+	for _, allowed := range l.Paths {
+		if p == allowed {
+			return true
+		}
+	}
+	for _, pattern := range l.Patterns {
+		if ok, err := path.Match(pattern, p); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
+
+//redirectAllowed will return true if users can be redirected to the
+// target, which must be a local path, and in the allowlist if one is set.
+func (a *Auth) redirectAllowed(target string) bool {
+	if !isLocalPath(target) {
+		return false
+	}
+	if a.redirectAllowlist == nil {
+		return true
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return false
+	}
+	if u.Path == "/" || u.Path == termsPath || strings.HasPrefix(u.Path, issuerPath+"/") || a.redirectAllowlist.allows(u.Path) {
+		return true
+	}
+	for _, s := range a.profileSteps {
+		if su, err := url.Parse(s.URL); err == nil && su.Path == u.Path {
+			return true
+		}
+	}
+	return false
+}
+
+//safeRedirectTarget will return the target if users can be redirected
+// there, or the start page.
+func (a *Auth) safeRedirectTarget(r *http.Request, target string) string {
+	if a.redirectAllowed(target) {
+		return target
+	}
+	logRequestf(r, "info: redirect to %q is not allowed, redirecting to the start page\n", target)
+	return a.tenantPath(r, "/")
+}
+
+//safeRedirect will redirect to the target if users can be redirected
+// there, or to the start page.
+func (a *Auth) safeRedirect(w http.ResponseWriter, r *http.Request, target string, code int) {
+	http.Redirect(w, r, a.safeRedirectTarget(r, target), code)
+}
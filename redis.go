@@ -0,0 +1,85 @@
+package authsession
+
+import (
+	"crypto/tls"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//RedisConfig is how to connect to Redis for the Redis stores, like
+// RedisEpochStore, with NewRedisClient. A single node, Sentinel and
+// Cluster are supported.
+type RedisConfig struct {
+	//Addrs are the host:port addresses of the node for a single node, of
+	// the sentinels when MasterName is set, or of the cluster nodes when
+	// Cluster is set.
+	Addrs []string
+	//MasterName is the name of the master monitored by the sentinels,
+	// which makes the client follow the master through failovers.
+	MasterName string
+	//Cluster will use Redis Cluster, also when only a single node is
+	// given in Addrs.
+	Cluster bool
+	//Username and Password are for the AUTH of the nodes.
+	Username string
+	Password string
+	//SentinelUsername and SentinelPassword are for the AUTH of the
+	// sentinels, when they differ from the nodes.
+	SentinelUsername string
+	SentinelPassword string
+	//DB is the database used, which must be 0 for Cluster.
+	DB int
+	//TLS will connect with TLS using the config when set.
+	TLS *tls.Config
+	//MaxRetries is the max number of retries of a command failing with a
+	// network error, or because of a failover, like a READONLY error from
+	// a master turned into a replica, or CLUSTERDOWN. The default is 5,
+	// and -1 turns off the retries.
+	MaxRetries int
+	//MinRetryBackoff and MaxRetryBackoff are the bounds of the wait
+	// between the retries, which grows for every retry. The defaults are
+	// 100ms and 2 seconds, so the retries last through most failovers.
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+}
+
+//NewRedisClient will return a client for the Redis stores, connecting
+// to a single node, to the master given by the sentinels, or to the
+// cluster, as set in c.
+func NewRedisClient(c RedisConfig) (redis.UniversalClient, error) {
+	if len(c.Addrs) == 0 {
+		return nil, errors.New("no Redis addresses given")
+	}
+	if c.Cluster && c.MasterName != "" {
+		return nil, errors.New("both Cluster and MasterName set for Redis")
+	}
+	if c.Cluster && c.DB != 0 {
+		return nil, errors.New("DB must be 0 for Redis Cluster")
+	}
+	if c.MaxRetries == 0 {
+		c.MaxRetries = 5
+	}
+	if c.MinRetryBackoff <= 0 {
+		c.MinRetryBackoff = 100 * time.Millisecond
+	}
+	if c.MaxRetryBackoff <= 0 {
+		c.MaxRetryBackoff = 2 * time.Second
+	}
+
+	return redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:            c.Addrs,
+		MasterName:       c.MasterName,
+		IsClusterMode:    c.Cluster,
+		Username:         c.Username,
+		Password:         c.Password,
+		SentinelUsername: c.SentinelUsername,
+		SentinelPassword: c.SentinelPassword,
+		DB:               c.DB,
+		TLSConfig:        c.TLS,
+		MaxRetries:       c.MaxRetries,
+		MinRetryBackoff:  c.MinRetryBackoff,
+		MaxRetryBackoff:  c.MaxRetryBackoff,
+	}), nil
+}
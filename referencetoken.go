@@ -0,0 +1,254 @@
+package authsession
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+//referenceTokenPrefix is the start of the opaque reference tokens, so
+// they are told apart from the other formats without a lookup.
+const referenceTokenPrefix = "rt."
+
+//ReferenceToken is an opaque access token kept server side, for the
+// reference token format of the issuer. The token itself is never
+// stored, only its hash as the ID.
+type ReferenceToken struct {
+	ID string `json:"id"`
+	//Subject is the user ID, or the client ID for a token of the client
+	// credentials grant.
+	Subject string `json:"subject"`
+	//Claims are the claims of the token, like they would be in a JWT.
+	Claims  json.RawMessage `json:"claims"`
+	Expires time.Time       `json:"expires"`
+	//Region is the region of the user, when data residency is set with
+	// WithDataResidency.
+	Region string `json:"region,omitempty"`
+}
+
+//ReferenceTokenStore keeps the reference tokens of the issuer. A token is
+// revoked at once by deleting it.
+type ReferenceTokenStore interface {
+	//Add will add a reference token.
+	Add(t ReferenceToken) error
+	//Get will return the reference token with the id, and false if not
+	// found or expired.
+	Get(id string) (ReferenceToken, bool, error)
+	//Delete will delete the reference token with the id.
+	Delete(id string) error
+	//DeleteSubject will delete all the reference tokens of the subject,
+	// and return the number deleted.
+	DeleteSubject(subject string) (int, error)
+}
+
+//FileReferenceTokenStore is a ReferenceTokenStore keeping the reference
+// tokens in a JSON file.
+type FileReferenceTokenStore struct {
+	m *jsonFileMap[ReferenceToken]
+}
+
+//NewFileReferenceTokenStore will return a *FileReferenceTokenStore
+// storing the reference tokens in the file at path. If path is empty the
+// reference tokens are only kept in memory.
+func NewFileReferenceTokenStore(path string) *FileReferenceTokenStore {
+	return &FileReferenceTokenStore{
+		m: newJSONFileMap[ReferenceToken](path),
+	}
+}
+
+//Add will add a reference token.
+func (f *FileReferenceTokenStore) Add(t ReferenceToken) error {
+	return f.m.update(func(m map[string]ReferenceToken) error {
+		m[t.ID] = t
+		return nil
+	})
+}
+
+//Get will return the reference token with the id, and false if not found
+// or expired.
+func (f *FileReferenceTokenStore) Get(id string) (ReferenceToken, bool, error) {
+	var t ReferenceToken
+	var ok bool
+	err := f.m.view(func(m map[string]ReferenceToken) error {
+		t, ok = m[id]
+		if ok && time.Now().After(t.Expires) {
+			ok = false
+		}
+		return nil
+	})
+	return t, ok, err
+}
+
+//Delete will delete the reference token with the id.
+func (f *FileReferenceTokenStore) Delete(id string) error {
+	return f.m.update(func(m map[string]ReferenceToken) error {
+		delete(m, id)
+		return nil
+	})
+}
+
+//DeleteSubject will delete all the reference tokens of the subject, and
+// return the number deleted.
+func (f *FileReferenceTokenStore) DeleteSubject(subject string) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]ReferenceToken) error {
+		for id, t := range m {
+			if t.Subject == subject {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//Cleanup will remove the reference tokens expired at now, and return the
+// number removed.
+func (f *FileReferenceTokenStore) Cleanup(now time.Time) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]ReferenceToken) error {
+		for id, t := range m {
+			if now.After(t.Expires) {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//newReferenceToken will store the claims, and return the opaque token
+// referring to them, in the region of the user. The jti of the token is
+// its ID in the store, so it can be revoked by RevokeAccessToken.
+func (i *issuer) newReferenceToken(claims map[string]interface{}, region string) (string, error) {
+	raw, err := createRandomKey(32)
+	if err != nil {
+		return "", err
+	}
+	token := referenceTokenPrefix + base64.RawURLEncoding.EncodeToString(raw)
+	id := refreshTokenID(token)
+
+	rc := make(map[string]interface{}, len(claims))
+	for k, v := range claims {
+		rc[k] = v
+	}
+	rc["jti"] = id
+	b, err := json.Marshal(rc)
+	if err != nil {
+		return "", err
+	}
+
+	t := ReferenceToken{ID: id, Claims: b, Region: region}
+	t.Subject, _ = claims["sub"].(string)
+	if exp, ok := claims["exp"].(int64); ok {
+		t.Expires = time.Unix(exp, 0)
+	}
+	if err := i.conf.ReferenceTokens.Add(t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//lookupReferenceToken will return the claims of the reference token from
+// the store.
+func (i *issuer) lookupReferenceToken(token string) (accessTokenClaims, error) {
+	if i.conf.ReferenceTokens == nil {
+		return accessTokenClaims{}, errNotIssuedHere
+	}
+	t, ok, err := i.conf.ReferenceTokens.Get(refreshTokenID(token))
+	if err != nil {
+		return accessTokenClaims{}, fmt.Errorf("reference token store Get failed: %v", err)
+	}
+	if !ok {
+		return accessTokenClaims{}, errors.New("access token is not active")
+	}
+	var claims accessTokenClaims
+	if err := json.Unmarshal(t.Claims, &claims); err != nil {
+		return accessTokenClaims{}, fmt.Errorf("reference token claims are not valid: %v", err)
+	}
+	return claims, nil
+}
+
+//referenceTokenRegion will return the region of the reference token, or
+// an empty string if it is not a stored reference token.
+func (i *issuer) referenceTokenRegion(token string) string {
+	if !isReferenceToken(token) || i.conf.ReferenceTokens == nil {
+		return ""
+	}
+	t, _, err := i.conf.ReferenceTokens.Get(refreshTokenID(token))
+	if err != nil {
+		return ""
+	}
+	return t.Region
+}
+
+//RevokeUserAccessTokens will revoke all the reference access tokens of the
+// user with the id, or of the client for the tokens of the client
+// credentials grant, at once. It needs the ReferenceTokens of the
+// IssuerConfig, and returns the number of tokens revoked.
+func (a *Auth) RevokeUserAccessTokens(subject string) (int, error) {
+	if a.issuer == nil || a.issuer.conf.ReferenceTokens == nil {
+		return 0, errors.New("no reference token store configured")
+	}
+	return a.issuer.conf.ReferenceTokens.DeleteSubject(subject)
+}
+
+//issuerIntrospect is the token introspection endpoint of RFC 7662, where
+// the APIs check the access tokens issued here, like the reference
+// tokens, authenticated with their client credentials. A token is only
+// told active to the client it was issued for, found by its client ID or
+// its Resources, so one API can't learn about the tokens of another.
+func (a *Auth) issuerIntrospect(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	client, ok := a.authenticateClient(w, r)
+	if !ok {
+		return
+	}
+
+	at, claims, err := a.parseIssuedToken(r.PostFormValue("token"))
+	if err != nil || at.Issuer != a.requestIssuerURL(r) || (claims.Aud != client.ID && !slices.Contains(client.Resources, claims.Aud)) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{"active": false})
+		return
+	}
+
+	resp := map[string]interface{}{
+		"active":     true,
+		"iss":        claims.Iss,
+		"sub":        claims.Sub,
+		"aud":        claims.Aud,
+		"client_id":  at.ClientID,
+		"exp":        claims.Exp,
+		"iat":        claims.Iat,
+		"jti":        claims.Jti,
+		"token_type": "Bearer",
+	}
+	if claims.Cnf != nil {
+		resp["token_type"] = "DPoP"
+		resp["cnf"] = claims.Cnf
+	}
+	if claims.Scope != "" {
+		resp["scope"] = claims.Scope
+	}
+	if claims.Email != "" {
+		resp["email"] = claims.Email
+		resp["username"] = claims.Name
+	}
+	if claims.Act != nil {
+		resp["act"] = claims.Act
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+//isReferenceToken will return true if the token is an opaque reference
+// token of the issuer.
+func isReferenceToken(token string) bool {
+	return strings.HasPrefix(token, referenceTokenPrefix)
+}
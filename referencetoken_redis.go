@@ -0,0 +1,125 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//RedisReferenceTokenStore is a ReferenceTokenStore keeping the reference
+// tokens in Redis, expiring with the tokens, so they are shared by all the
+// instances of the server. The IDs of the tokens of every subject are kept
+// in a set, so they can all be revoked at once.
+type RedisReferenceTokenStore struct {
+	client  redis.UniversalClient
+	prefix  string
+	timeout time.Duration
+}
+
+//NewRedisReferenceTokenStore will return a *RedisReferenceTokenStore using
+// client, with the keys starting with prefix, like "authsession:rt:".
+func NewRedisReferenceTokenStore(client redis.UniversalClient, prefix string) *RedisReferenceTokenStore {
+	return &RedisReferenceTokenStore{
+		client:  client,
+		prefix:  prefix,
+		timeout: 5 * time.Second,
+	}
+}
+
+func (r *RedisReferenceTokenStore) tokenKey(id string) string {
+	return r.prefix + "token:" + id
+}
+
+func (r *RedisReferenceTokenStore) subjectKey(subject string) string {
+	return r.prefix + "subject:" + subject
+}
+
+//Add will add a reference token.
+func (r *RedisReferenceTokenStore) Add(t ReferenceToken) error {
+	ttl := time.Until(t.Expires)
+	if ttl <= 0 {
+		return nil
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	pipe := r.client.TxPipeline()
+	pipe.Set(ctx, r.tokenKey(t.ID), b, ttl)
+	pipe.SAdd(ctx, r.subjectKey(t.Subject), t.ID)
+	pipe.ExpireGT(ctx, r.subjectKey(t.Subject), ttl)
+	pipe.ExpireNX(ctx, r.subjectKey(t.Subject), ttl)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//Get will return the reference token with the id, and false if not found
+// or expired.
+func (r *RedisReferenceTokenStore) Get(id string) (ReferenceToken, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	b, err := r.client.Get(ctx, r.tokenKey(id)).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return ReferenceToken{}, false, nil
+	}
+	if err != nil {
+		return ReferenceToken{}, false, err
+	}
+	var t ReferenceToken
+	if err := json.Unmarshal(b, &t); err != nil {
+		return ReferenceToken{}, false, err
+	}
+	return t, time.Now().Before(t.Expires), nil
+}
+
+//Delete will delete the reference token with the id.
+func (r *RedisReferenceTokenStore) Delete(id string) error {
+	t, ok, err := r.Get(id)
+	if err != nil || !ok {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	pipe := r.client.TxPipeline()
+	pipe.Del(ctx, r.tokenKey(id))
+	pipe.SRem(ctx, r.subjectKey(t.Subject), id)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+//DeleteSubject will delete all the reference tokens of the subject, and
+// return the number deleted.
+func (r *RedisReferenceTokenStore) DeleteSubject(subject string) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	ids, err := r.client.SMembers(ctx, r.subjectKey(subject)).Result()
+	if err != nil {
+		return 0, err
+	}
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		keys = append(keys, r.tokenKey(id))
+	}
+
+	pipe := r.client.TxPipeline()
+	del := pipe.Del(ctx, keys...)
+	pipe.Del(ctx, r.subjectKey(subject))
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return int(del.Val()), nil
+}
@@ -0,0 +1,263 @@
+package authsession
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+//RefreshToken is a refresh token given to a client in issuer mode. The
+// token itself is never stored, only its hash as the ID. Every use of a
+// refresh token replaces it with a new token in the same family, and the
+// used token is kept as superseded until it expires, so a reuse can be
+// detected.
+type RefreshToken struct {
+	ID       string `json:"id"`
+	Family   string `json:"family"`
+	ClientID string `json:"clientID"`
+	//Issuer is the issuer that gave the token, when every tenant has its
+	// own issuer.
+	Issuer   string `json:"issuer,omitempty"`
+	UserID   string `json:"userID"`
+	Email    string `json:"email"`
+	FullName string `json:"fullName"`
+	//Scope are the API scopes granted, space separated.
+	Scope string `json:"scope,omitempty"`
+	//JKT is the thumbprint of the DPoP key the token is bound to, if any.
+	JKT string `json:"jkt,omitempty"`
+	//Region is the region of the user, when data residency is set with
+	// WithDataResidency.
+	Region     string    `json:"region,omitempty"`
+	Superseded bool      `json:"superseded"`
+	Created    time.Time `json:"created"`
+	Expires    time.Time `json:"expires"`
+}
+
+//ErrRefreshTokenReused is returned by Rotate when the refresh token was
+// already superseded by another token.
+var ErrRefreshTokenReused = errors.New("refresh token already used")
+
+//RefreshTokenStore keeps the refresh tokens given to the clients.
+type RefreshTokenStore interface {
+	//Add will add a refresh token.
+	Add(t RefreshToken) error
+	//Get will return the refresh token with the id, and false if not
+	// found or expired.
+	Get(id string) (RefreshToken, bool, error)
+	//Rotate will mark the token with the id as superseded and add next.
+	// It returns ErrRefreshTokenReused if the token was already superseded.
+	Rotate(id string, next RefreshToken) error
+	//RevokeFamily will delete all the tokens in the family, and return
+	// the number of tokens deleted.
+	RevokeFamily(family string) (int, error)
+}
+
+//FileRefreshTokenStore is a RefreshTokenStore keeping the refresh tokens
+// in a JSON file.
+type FileRefreshTokenStore struct {
+	m *jsonFileMap[RefreshToken]
+}
+
+//NewFileRefreshTokenStore will return a *FileRefreshTokenStore storing
+// the refresh tokens in the file at path. If path is empty the refresh
+// tokens are only kept in memory.
+func NewFileRefreshTokenStore(path string) *FileRefreshTokenStore {
+	return &FileRefreshTokenStore{
+		m: newJSONFileMap[RefreshToken](path),
+	}
+}
+
+//Add will add a refresh token. Expired tokens are removed at the same time.
+func (f *FileRefreshTokenStore) Add(t RefreshToken) error {
+	return f.m.update(func(m map[string]RefreshToken) error {
+		now := time.Now()
+		for id, v := range m {
+			if now.After(v.Expires) {
+				delete(m, id)
+			}
+		}
+		m[t.ID] = t
+		return nil
+	})
+}
+
+//Cleanup will remove the refresh tokens expired at now, and return the
+// number removed.
+func (f *FileRefreshTokenStore) Cleanup(now time.Time) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]RefreshToken) error {
+		for id, v := range m {
+			if now.After(v.Expires) {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//Get will return the refresh token with the id, and false if not found
+// or expired.
+func (f *FileRefreshTokenStore) Get(id string) (RefreshToken, bool, error) {
+	var t RefreshToken
+	var ok bool
+	err := f.m.view(func(m map[string]RefreshToken) error {
+		t, ok = m[id]
+		if ok && time.Now().After(t.Expires) {
+			ok = false
+		}
+		return nil
+	})
+	return t, ok, err
+}
+
+//Rotate will mark the token with the id as superseded and add next. It
+// returns ErrRefreshTokenReused if the token was already superseded.
+func (f *FileRefreshTokenStore) Rotate(id string, next RefreshToken) error {
+	return f.m.update(func(m map[string]RefreshToken) error {
+		t, ok := m[id]
+		if !ok {
+			return fmt.Errorf("refresh token not found")
+		}
+		if t.Superseded {
+			return ErrRefreshTokenReused
+		}
+		t.Superseded = true
+		m[id] = t
+		m[next.ID] = next
+		return nil
+	})
+}
+
+//RevokeFamily will delete all the tokens in the family, and return the
+// number of tokens deleted.
+func (f *FileRefreshTokenStore) RevokeFamily(family string) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]RefreshToken) error {
+		for id, v := range m {
+			if v.Family == family {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//refreshTokenID will return the ID a refresh token is stored with.
+func refreshTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+//newRefreshToken will return a new random refresh token, and the
+// RefreshToken to store for it.
+func (i *issuer) newRefreshToken(family string, clientID string, iss string, scope string, user User, jkt string, region string) (string, RefreshToken, error) {
+	tokenRAW, err := createRandomKey(32)
+	if err != nil {
+		return "", RefreshToken{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(tokenRAW)
+
+	now := time.Now()
+	return token, RefreshToken{
+		ID:       refreshTokenID(token),
+		Family:   family,
+		ClientID: clientID,
+		Issuer:   iss,
+		UserID:   user.ID,
+		Email:    user.Email,
+		FullName: user.FullName,
+		Scope:    scope,
+		JKT:      jkt,
+		Region:   region,
+		Created:  now,
+		Expires:  now.Add(i.conf.RefreshTokenTTL),
+	}, nil
+}
+
+//newRefreshTokenFamily will store and return the first refresh token of
+// a new family, given together with an authorization code.
+func (i *issuer) newRefreshTokenFamily(clientID string, iss string, scope string, user User, jkt string, region string) (string, error) {
+	familyRAW, err := createRandomKey(16)
+	if err != nil {
+		return "", err
+	}
+
+	token, t, err := i.newRefreshToken(base64.RawURLEncoding.EncodeToString(familyRAW), clientID, iss, scope, user, jkt, region)
+	if err != nil {
+		return "", err
+	}
+	if err := i.conf.RefreshTokens.Add(t); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+//refreshGrant will handle the refresh_token grant at the token endpoint,
+// replacing the refresh token with a new one. If a superseded token is
+// used the token has most likely been stolen, and the whole family of
+// tokens is revoked. The user, the scope granted, the new refresh token
+// and the region of the family are returned, and false if an error was
+// written to w.
+func (a *Auth) refreshGrant(w http.ResponseWriter, r *http.Request, client OIDCClient, iss string, jkt string) (User, string, string, string, bool) {
+	store := a.issuer.conf.RefreshTokens
+
+	old, ok, err := store.Get(refreshTokenID(r.PostFormValue("refresh_token")))
+	if err != nil {
+		a.logRequestError(r, "error: issuer: refresh token store Get failed: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to get refresh token")
+		return User{}, "", "", "", false
+	}
+	//Tokens given before every tenant had its own issuer have no issuer,
+	// and are only accepted by the issuer of the server.
+	oldIssuer := old.Issuer
+	if oldIssuer == "" {
+		oldIssuer = a.issuer.issuerURL()
+	}
+	if !ok || old.ClientID != client.ID || oldIssuer != iss {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is not valid")
+		return User{}, "", "", "", false
+	}
+	if old.JKT != "" && subtle.ConstantTimeCompare([]byte(old.JKT), []byte(jkt)) != 1 {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is bound to another DPoP key")
+		return User{}, "", "", "", false
+	}
+
+	user := User{ID: old.UserID, Email: old.Email, FullName: old.FullName}
+	token, next, err := a.issuer.newRefreshToken(old.Family, client.ID, iss, old.Scope, user, old.JKT, old.Region)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to create refresh token: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to create refresh token")
+		return User{}, "", "", "", false
+	}
+
+	err = ErrRefreshTokenReused
+	if !old.Superseded {
+		err = store.Rotate(old.ID, next)
+	}
+	if errors.Is(err, ErrRefreshTokenReused) {
+		n, rerr := store.RevokeFamily(old.Family)
+		if rerr != nil {
+			a.logRequestError(r, "error: issuer: refresh token store RevokeFamily failed: ", rerr)
+		}
+		a.logRequestError(r, fmt.Sprintf("error: issuer: reuse of refresh token for %v by client %v, revoked %d tokens in the family", a.LogIdentifier(old.Email), client.ID, n))
+		a.events.criticalFailure(r, old.Email, "refresh token reused, token family revoked")
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the refresh token is not valid")
+		return User{}, "", "", "", false
+	}
+	if err != nil {
+		a.logRequestError(r, "error: issuer: refresh token store Rotate failed: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to rotate refresh token")
+		return User{}, "", "", "", false
+	}
+
+	return user, old.Scope, token, old.Region, true
+}
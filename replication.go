@@ -0,0 +1,272 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+//SessionEventType is the kind of change of a SessionEvent.
+type SessionEventType string
+
+const (
+	//SessionCreated is a session added, or replaced in the session store.
+	SessionCreated SessionEventType = "created"
+	//SessionRevoked is a session deleted from the session store, like at
+	// logout.
+	SessionRevoked SessionEventType = "revoked"
+	//UserSessionsRevoked is all the sessions of a user revoked, like with
+	// RevokeUserSessions.
+	UserSessionsRevoked SessionEventType = "user_revoked"
+)
+
+//SessionEvent is a change of the sessions done by one instance, which is
+// replicated to the instances in the other regions.
+type SessionEvent struct {
+	Type SessionEventType `json:"type"`
+	//Origin is the ID of the instance making the change, so an instance
+	// can skip its own events.
+	Origin string    `json:"origin"`
+	Time   time.Time `json:"time"`
+	//Session is the session created, for SessionCreated.
+	Session *SessionInfo `json:"session,omitempty"`
+	//SessionID is the ID of the session revoked, for SessionRevoked.
+	SessionID string `json:"sessionID,omitempty"`
+	//User is the user ID or the email of the user, for
+	// UserSessionsRevoked.
+	User string `json:"user,omitempty"`
+	//Epoch is the new epoch of the user, for UserSessionsRevoked when an
+	// epoch store is used, and 0 if not.
+	Epoch int64 `json:"epoch,omitempty"`
+}
+
+//SessionReplicator sends the session events between the regions of a
+// globally distributed deployment, like over a message bus, so each
+// region can keep its own session store and epoch store, and still honor
+// a logout everywhere within seconds. It is set with
+// WithSessionReplication.
+type SessionReplicator interface {
+	//Publish will send the event to the other instances.
+	Publish(ctx context.Context, e SessionEvent) error
+	//Subscribe will call handle with the events sent by all the
+	// instances, until ctx is done or the subscription fails.
+	Subscribe(ctx context.Context, handle func(e SessionEvent)) error
+}
+
+//ReplicationConfig is how the session events are replicated. Zero values
+// use the defaults.
+type ReplicationConfig struct {
+	//Origin is the ID of this instance in the events. The default is a
+	// random ID.
+	Origin string
+	//PublishTimeout is how long publishing an event can take. The
+	// default is 5 seconds.
+	PublishTimeout time.Duration
+}
+
+//replication keeps the replicator, and the stores changed by the events
+// of the other instances, which are not wrapped, so the events are not
+// published again.
+type replication struct {
+	replicator SessionReplicator
+	conf       ReplicationConfig
+	sessions   SessionStore
+	epochs     EpochStore
+	logError   func(v ...interface{})
+}
+
+//publish will publish the event with the origin and the time set. The
+// change is already done in the local store, so a failure is logged and
+// not returned, and the other regions see the change when the sessions
+// expire.
+func (r *replication) publish(e SessionEvent) {
+	e.Origin = r.conf.Origin
+	e.Time = time.Now()
+
+	ctx, cancel := context.WithTimeout(context.Background(), r.conf.PublishTimeout)
+	defer cancel()
+	if err := r.replicator.Publish(ctx, e); err != nil {
+		r.logError("error: publishing session event "+string(e.Type)+" failed: ", err)
+	}
+}
+
+//replicateStores will wrap the session store and the epoch store, so
+// their changes are published to the other instances.
+func (a *Auth) replicateStores() {
+	r := a.replication
+	if r == nil {
+		return
+	}
+	if r.conf.Origin == "" {
+		origin, err := a.newKey(16, KeyHex)
+		if err != nil {
+			a.logError("error: creating the replication origin failed: ", err)
+		}
+		r.conf.Origin = origin
+	}
+	if r.conf.PublishTimeout <= 0 {
+		r.conf.PublishTimeout = 5 * time.Second
+	}
+	r.logError = a.logError
+
+	if a.sessions != nil {
+		r.sessions = a.sessions
+		a.sessions = &replicatedSessionStore{store: a.sessions, r: r}
+	}
+	if a.epochs != nil {
+		r.epochs = a.epochs
+		a.epochs = &replicatedEpochStore{store: a.epochs, r: r}
+	}
+}
+
+//RunReplication will apply the session events of the other instances to
+// the local stores, until ctx is done. A created session is added to the
+// session store, so the user can move between regions, and revoked
+// sessions are deleted, the epoch of the user is raised to the epoch
+// given, and the open session event streams of the user are told. Errors
+// applying an event are logged. RunReplication returns the error of the
+// subscription, and nil when ctx is done.
+func (a *Auth) RunReplication(ctx context.Context) error {
+	if a.replication == nil {
+		return errors.New("no session replicator configured")
+	}
+	err := a.replication.replicator.Subscribe(ctx, a.applySessionEvent)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+//applySessionEvent will apply the event of another instance to the local
+// stores. Events of this instance are skipped.
+func (a *Auth) applySessionEvent(e SessionEvent) {
+	r := a.replication
+	if e.Origin == r.conf.Origin {
+		return
+	}
+
+	switch e.Type {
+	case SessionCreated:
+		if r.sessions != nil && e.Session != nil {
+			if err := r.sessions.Add(*e.Session); err != nil {
+				a.logError("error: replicating created session failed: ", err)
+			}
+		}
+	case SessionRevoked:
+		if r.sessions != nil && e.SessionID != "" {
+			if err := r.sessions.Delete(e.SessionID); err != nil {
+				a.logError("error: replicating revoked session failed: ", err)
+			}
+		}
+	case UserSessionsRevoked:
+		if e.User == "" {
+			return
+		}
+		if r.sessions != nil {
+			if _, err := r.sessions.DeleteUser(e.User); err != nil {
+				a.logError("error: replicating revoked user sessions failed: ", err)
+			}
+		}
+		if r.epochs != nil && e.Epoch > 0 {
+			if err := raiseEpoch(r.epochs, epochUser(e.User), e.Epoch); err != nil {
+				a.logError("error: replicating the epoch of a user failed: ", err)
+			}
+		}
+		a.watchers.notify(e.User, "revoked")
+	}
+}
+
+//raiseEpoch will increment the epoch of the user until it is at least
+// epoch, so cookies made in the region of the event with an older epoch
+// are refused here too. An epoch already higher is kept.
+func raiseEpoch(epochs EpochStore, user string, epoch int64) error {
+	current, err := epochs.Get(user)
+	if err != nil {
+		return err
+	}
+	for current < epoch {
+		if current, err = epochs.Increment(user); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//replicatedSessionStore is a SessionStore publishing the changes of
+// another SessionStore.
+type replicatedSessionStore struct {
+	store SessionStore
+	r     *replication
+}
+
+//unwrapStore will return the store replicated.
+func (s *replicatedSessionStore) unwrapStore() interface{} { return s.store }
+
+//Add will call Add of the store, and publish the created session.
+func (s *replicatedSessionStore) Add(si SessionInfo) error {
+	if err := s.store.Add(si); err != nil {
+		return err
+	}
+	s.r.publish(SessionEvent{Type: SessionCreated, Session: &si})
+	return nil
+}
+
+//Get will call Get of the store.
+func (s *replicatedSessionStore) Get(id string) (SessionInfo, bool, error) {
+	return s.store.Get(id)
+}
+
+//List will call List of the store.
+func (s *replicatedSessionStore) List() ([]SessionInfo, error) {
+	return s.store.List()
+}
+
+//ListUser will call ListUser of the store.
+func (s *replicatedSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	return s.store.ListUser(user)
+}
+
+//Delete will call Delete of the store, and publish the revoked session.
+func (s *replicatedSessionStore) Delete(id string) error {
+	if err := s.store.Delete(id); err != nil {
+		return err
+	}
+	s.r.publish(SessionEvent{Type: SessionRevoked, SessionID: id})
+	return nil
+}
+
+//DeleteUser will call DeleteUser of the store, and publish the revoked
+// sessions of the user.
+func (s *replicatedSessionStore) DeleteUser(user string) (int, error) {
+	n, err := s.store.DeleteUser(user)
+	if err != nil {
+		return n, err
+	}
+	s.r.publish(SessionEvent{Type: UserSessionsRevoked, User: user})
+	return n, nil
+}
+
+//replicatedEpochStore is an EpochStore publishing the increments of
+// another EpochStore.
+type replicatedEpochStore struct {
+	store EpochStore
+	r     *replication
+}
+
+//unwrapStore will return the store replicated.
+func (s *replicatedEpochStore) unwrapStore() interface{} { return s.store }
+
+//Get will call Get of the store.
+func (s *replicatedEpochStore) Get(user string) (int64, error) {
+	return s.store.Get(user)
+}
+
+//Increment will call Increment of the store, and publish the new epoch.
+func (s *replicatedEpochStore) Increment(user string) (int64, error) {
+	epoch, err := s.store.Increment(user)
+	if err != nil {
+		return epoch, err
+	}
+	s.r.publish(SessionEvent{Type: UserSessionsRevoked, User: user, Epoch: epoch})
+	return epoch, nil
+}
@@ -0,0 +1,64 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//RedisSessionReplicator is a SessionReplicator sending the session events
+// over a Redis pub/sub channel, like of a Redis reachable from all the
+// regions. Events sent while an instance is not subscribed are lost.
+type RedisSessionReplicator struct {
+	client  redis.UniversalClient
+	channel string
+}
+
+//NewRedisSessionReplicator will return a *RedisSessionReplicator using
+// client, with the events sent on channel, like "authsession:sessions".
+func NewRedisSessionReplicator(client redis.UniversalClient, channel string) *RedisSessionReplicator {
+	return &RedisSessionReplicator{
+		client:  client,
+		channel: channel,
+	}
+}
+
+//Publish will send the event on the channel.
+func (r *RedisSessionReplicator) Publish(ctx context.Context, e SessionEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return r.client.Publish(ctx, r.channel, b).Err()
+}
+
+//Subscribe will call handle with the events sent on the channel, until
+// ctx is done. The subscription is reconnected by the client when the
+// connection is lost.
+func (r *RedisSessionReplicator) Subscribe(ctx context.Context, handle func(e SessionEvent)) error {
+	sub := r.client.Subscribe(ctx, r.channel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		return err
+	}
+
+	ch := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case msg, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			var e SessionEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				log.Printf("error: decoding session event failed: %v\n", err)
+				continue
+			}
+			handle(e)
+		}
+	}
+}
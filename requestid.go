@@ -0,0 +1,93 @@
+package authsession
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+)
+
+//requestIDHeader is the header a request ID is adopted from, and set on
+// the responses.
+const requestIDHeader = "X-Request-ID"
+
+//maxRequestIDLength is the max length of a request ID adopted.
+const maxRequestIDLength = 128
+
+//requestIDKey is the context key of the request ID.
+type requestIDKey struct{}
+
+//RequestID will return the ID of the request the context is for, or an
+// empty string if the request didn't go through the handlers of the
+// package. The ID is adopted from the X-Request-ID header if valid, and
+// generated if not.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+//validRequestID will return true if id is not too long, and only has
+// characters safe to put in logs and headers.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+//withRequestID will return the request with a request ID in the context,
+// and set it on the response. A request already having an ID is returned
+// as it is.
+func withRequestID(w http.ResponseWriter, r *http.Request) *http.Request {
+	if RequestID(r.Context()) != "" {
+		return r
+	}
+
+	id := r.Header.Get(requestIDHeader)
+	if !validRequestID(id) {
+		idRAW, err := createRandomKey(16)
+		if err != nil {
+			return r
+		}
+		id = hex.EncodeToString(idRAW)
+	}
+
+	w.Header().Set(requestIDHeader, id)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+//requestIDHandler will give the requests to h a request ID.
+func requestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, withRequestID(w, r))
+	})
+}
+
+//logRequestError will log the error like logError, with the ID of the
+// request. r can be nil for checks done outside of a request.
+func (a *Auth) logRequestError(r *http.Request, v ...interface{}) {
+	if r == nil {
+		a.logError(v...)
+		return
+	}
+	if id := RequestID(r.Context()); id != "" {
+		v = append(v, "request_id="+id)
+	}
+	a.logError(v...)
+}
+
+//logRequestf will log like log.Printf, with the ID of the request.
+func logRequestf(r *http.Request, format string, v ...interface{}) {
+	msg := strings.TrimSuffix(fmt.Sprintf(format, v...), "\n")
+	if id := RequestID(r.Context()); id != "" {
+		msg += " request_id=" + id
+	}
+	log.Println(msg)
+}
@@ -0,0 +1,489 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+//regionSeparator separates the region from the random part of the session
+// IDs, when data residency is used, so the store of a session is found
+// from its ID alone.
+const regionSeparator = "~"
+
+//ResidencyConfig is how the region of a user is resolved at login, set
+// with WithDataResidency. The region is kept in the session, and given to
+// the session, user, refresh token and reference token records, so the
+// Regional stores keep them in the stores of the region, like to keep the
+// data of the EU users in EU hosted stores.
+type ResidencyConfig struct {
+	//Resolve will return the region of the user logging in, like "eu"
+	// from a claim of the provider, the domain of the email, or a lookup
+	// in a directory. An error refuses the login, since the data of the
+	// user can't be placed. An empty region is the Default.
+	Resolve func(r *http.Request, u User) (string, error)
+	//Default is the region of the users without one, and of the records
+	// not made for a user, like the tokens of the client credentials grant.
+	Default string
+}
+
+//ErrUnknownRegion is returned by the Regional stores for a record of a
+// region without a store, so it is never kept in another region.
+var ErrUnknownRegion = errors.New("no store for the region")
+
+//loginRegion will return the region of the user logging in, or an empty
+// string if data residency is not used.
+func (a *Auth) loginRegion(r *http.Request, u User) (string, error) {
+	if a.residency == nil {
+		return "", nil
+	}
+	var region string
+	if a.residency.Resolve != nil {
+		var err error
+		if region, err = a.residency.Resolve(r, u); err != nil {
+			return "", fmt.Errorf("resolving the region of %v failed: %v", u.Email, err)
+		}
+	}
+	if region == "" {
+		region = a.residency.Default
+	}
+	if strings.Contains(region, regionSeparator) {
+		return "", fmt.Errorf("region %q of %v is not valid", region, u.Email)
+	}
+	return region, nil
+}
+
+//regionalSessionID will return the session ID with the region put first,
+// or the ID as it is for no region.
+func regionalSessionID(region string, id string) string {
+	if region == "" {
+		return id
+	}
+	return region + regionSeparator + id
+}
+
+//sessionIDRegion will return the region of a session ID, or an empty
+// string for an ID without one, like made before data residency was used.
+func sessionIDRegion(id string) string {
+	region, _, ok := strings.Cut(id, regionSeparator)
+	if !ok {
+		return ""
+	}
+	return region
+}
+
+//regional are the stores of the regions, with the store of the default
+// region used for the records without a region.
+type regional[S any] struct {
+	stores  map[string]S
+	regions []string
+	def     string
+}
+
+//newRegional will return a *regional for the stores, by region.
+func newRegional[S any](stores map[string]S, defaultRegion string) (*regional[S], error) {
+	if len(stores) == 0 {
+		return nil, errors.New("no regional stores given")
+	}
+	if _, ok := stores[defaultRegion]; !ok {
+		return nil, fmt.Errorf("no store given for the default region %q", defaultRegion)
+	}
+	rs := &regional[S]{stores: make(map[string]S, len(stores)), def: defaultRegion}
+	for region, s := range stores {
+		rs.stores[region] = s
+		rs.regions = append(rs.regions, region)
+	}
+	sort.Strings(rs.regions)
+	return rs, nil
+}
+
+//store will return the store of the region, or of the default region if
+// empty, and ErrUnknownRegion if the region has no store.
+func (rs *regional[S]) store(region string) (S, error) {
+	if region == "" {
+		region = rs.def
+	}
+	s, ok := rs.stores[region]
+	if !ok {
+		var zero S
+		return zero, fmt.Errorf("%w %q", ErrUnknownRegion, region)
+	}
+	return s, nil
+}
+
+//each will call fn with the store of every region, in order, and stop at
+// the first error.
+func (rs *regional[S]) each(fn func(region string, s S) error) error {
+	for _, region := range rs.regions {
+		if err := fn(region, rs.stores[region]); err != nil {
+			return fmt.Errorf("region %v: %v", region, err)
+		}
+	}
+	return nil
+}
+
+//cleanup will remove the expired records of the stores implementing
+// Cleaner.
+func (rs *regional[S]) cleanup(now time.Time) (int, error) {
+	var n int
+	var errs []error
+	for _, region := range rs.regions {
+		if c, ok := any(rs.stores[region]).(Cleaner); ok {
+			removed, err := c.Cleanup(now)
+			n += removed
+			if err != nil {
+				errs = append(errs, fmt.Errorf("region %v: %v", region, err))
+			}
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+//close will close the stores implementing io.Closer.
+func (rs *regional[S]) close() error {
+	var errs []error
+	for _, region := range rs.regions {
+		if c, ok := any(rs.stores[region]).(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("region %v: %v", region, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//RegionalSessionStore is a SessionStore keeping the sessions in the store
+// of their region, set by WithDataResidency. The region is part of the
+// session ID, so a session is read from its region only. Sessions without
+// a region are kept in the default region. Lists ask every region.
+type RegionalSessionStore struct {
+	r *regional[SessionStore]
+}
+
+//NewRegionalSessionStore will return a *RegionalSessionStore with the
+// stores by region, like {"eu": euStore, "us": usStore}, where the store
+// of defaultRegion must be given.
+func NewRegionalSessionStore(stores map[string]SessionStore, defaultRegion string) (*RegionalSessionStore, error) {
+	r, err := newRegional(stores, defaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return &RegionalSessionStore{r: r}, nil
+}
+
+//Add will add, or replace a session in the store of its region.
+func (s *RegionalSessionStore) Add(si SessionInfo) error {
+	region := si.Region
+	if region == "" {
+		region = sessionIDRegion(si.ID)
+	}
+	store, err := s.r.store(region)
+	if err != nil {
+		return err
+	}
+	return store.Add(si)
+}
+
+//Get will return the session with the id from the store of the region
+// of the id, and false if not found.
+func (s *RegionalSessionStore) Get(id string) (SessionInfo, bool, error) {
+	store, err := s.r.store(sessionIDRegion(id))
+	if errors.Is(err, ErrUnknownRegion) {
+		return SessionInfo{}, false, nil
+	}
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	return store.Get(id)
+}
+
+//list will return the sessions of all the regions given by fn.
+func (s *RegionalSessionStore) list(fn func(store SessionStore) ([]SessionInfo, error)) ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	err := s.r.each(func(region string, store SessionStore) error {
+		l, err := fn(store)
+		sessions = append(sessions, l...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+//List will return all the sessions that are not expired, from all the
+// regions.
+func (s *RegionalSessionStore) List() ([]SessionInfo, error) {
+	return s.list(func(store SessionStore) ([]SessionInfo, error) {
+		return store.List()
+	})
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user, from all the regions.
+func (s *RegionalSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	return s.list(func(store SessionStore) ([]SessionInfo, error) {
+		return store.ListUser(user)
+	})
+}
+
+//Delete will delete the session with the id from the store of its region.
+func (s *RegionalSessionStore) Delete(id string) error {
+	store, err := s.r.store(sessionIDRegion(id))
+	if errors.Is(err, ErrUnknownRegion) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return store.Delete(id)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user from all the regions, and return the number deleted.
+func (s *RegionalSessionStore) DeleteUser(user string) (int, error) {
+	var n int
+	err := s.r.each(func(region string, store SessionStore) error {
+		deleted, err := store.DeleteUser(user)
+		n += deleted
+		return err
+	})
+	return n, err
+}
+
+//Cleanup will remove the expired sessions of the regions implementing
+// Cleaner.
+func (s *RegionalSessionStore) Cleanup(now time.Time) (int, error) {
+	return s.r.cleanup(now)
+}
+
+//Close will close the stores of the regions implementing io.Closer.
+func (s *RegionalSessionStore) Close() error {
+	return s.r.close()
+}
+
+//RegionalUserStore is a UserStore keeping the users in the store of
+// their region. A user is looked up in every region, in order, since the
+// email doesn't tell the region.
+type RegionalUserStore struct {
+	r *regional[UserStore]
+}
+
+//NewRegionalUserStore will return a *RegionalUserStore with the stores
+// by region, where the store of defaultRegion must be given.
+func NewRegionalUserStore(stores map[string]UserStore, defaultRegion string) (*RegionalUserStore, error) {
+	r, err := newRegional(stores, defaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return &RegionalUserStore{r: r}, nil
+}
+
+//Put will add, or replace the user in the store of its region.
+func (s *RegionalUserStore) Put(u UserRecord) error {
+	store, err := s.r.store(u.Region)
+	if err != nil {
+		return err
+	}
+	return store.Put(u)
+}
+
+//Get will return the user with the email from the first region having
+// it, and false if not found.
+func (s *RegionalUserStore) Get(email string) (UserRecord, bool, error) {
+	var u UserRecord
+	var found bool
+	err := s.r.each(func(region string, store UserStore) error {
+		if found {
+			return nil
+		}
+		var err error
+		u, found, err = store.Get(email)
+		return err
+	})
+	if err != nil {
+		return UserRecord{}, false, err
+	}
+	return u, found, nil
+}
+
+//List will return the users of all the regions.
+func (s *RegionalUserStore) List() ([]UserRecord, error) {
+	var users []UserRecord
+	err := s.r.each(func(region string, store UserStore) error {
+		l, err := store.List()
+		users = append(users, l...)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+//Delete will delete the user with the email from all the regions, which
+// must implement UserDeleter.
+func (s *RegionalUserStore) Delete(email string) error {
+	return s.r.each(func(region string, store UserStore) error {
+		d, ok := store.(UserDeleter)
+		if !ok {
+			return fmt.Errorf("user store %T can't delete users", store)
+		}
+		return d.Delete(email)
+	})
+}
+
+//Close will close the stores of the regions implementing io.Closer.
+func (s *RegionalUserStore) Close() error {
+	return s.r.close()
+}
+
+//RegionalRefreshTokenStore is a RefreshTokenStore keeping the refresh
+// tokens in the store of the region of their user. A token is looked up
+// in every region, in order, since its ID doesn't tell the region.
+type RegionalRefreshTokenStore struct {
+	r *regional[RefreshTokenStore]
+}
+
+//NewRegionalRefreshTokenStore will return a *RegionalRefreshTokenStore
+// with the stores by region, where the store of defaultRegion must be
+// given.
+func NewRegionalRefreshTokenStore(stores map[string]RefreshTokenStore, defaultRegion string) (*RegionalRefreshTokenStore, error) {
+	r, err := newRegional(stores, defaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return &RegionalRefreshTokenStore{r: r}, nil
+}
+
+//Add will add a refresh token to the store of its region.
+func (s *RegionalRefreshTokenStore) Add(t RefreshToken) error {
+	store, err := s.r.store(t.Region)
+	if err != nil {
+		return err
+	}
+	return store.Add(t)
+}
+
+//Get will return the refresh token with the id from the first region
+// having it, and false if not found or expired.
+func (s *RegionalRefreshTokenStore) Get(id string) (RefreshToken, bool, error) {
+	var t RefreshToken
+	var found bool
+	err := s.r.each(func(region string, store RefreshTokenStore) error {
+		if found {
+			return nil
+		}
+		var err error
+		t, found, err = store.Get(id)
+		return err
+	})
+	if err != nil {
+		return RefreshToken{}, false, err
+	}
+	return t, found, nil
+}
+
+//Rotate will rotate the token with the id in the store of the region of
+// next, which is the region of the whole family.
+func (s *RegionalRefreshTokenStore) Rotate(id string, next RefreshToken) error {
+	store, err := s.r.store(next.Region)
+	if err != nil {
+		return err
+	}
+	return store.Rotate(id, next)
+}
+
+//RevokeFamily will delete all the tokens in the family from all the
+// regions, and return the number of tokens deleted.
+func (s *RegionalRefreshTokenStore) RevokeFamily(family string) (int, error) {
+	var n int
+	err := s.r.each(func(region string, store RefreshTokenStore) error {
+		deleted, err := store.RevokeFamily(family)
+		n += deleted
+		return err
+	})
+	return n, err
+}
+
+//Cleanup will remove the expired tokens of the regions implementing
+// Cleaner.
+func (s *RegionalRefreshTokenStore) Cleanup(now time.Time) (int, error) {
+	return s.r.cleanup(now)
+}
+
+//RegionalReferenceTokenStore is a ReferenceTokenStore keeping the
+// reference tokens in the store of the region of their user. A token is
+// looked up in every region, in order, since its ID doesn't tell the
+// region.
+type RegionalReferenceTokenStore struct {
+	r *regional[ReferenceTokenStore]
+}
+
+//NewRegionalReferenceTokenStore will return a *RegionalReferenceTokenStore
+// with the stores by region, where the store of defaultRegion must be
+// given.
+func NewRegionalReferenceTokenStore(stores map[string]ReferenceTokenStore, defaultRegion string) (*RegionalReferenceTokenStore, error) {
+	r, err := newRegional(stores, defaultRegion)
+	if err != nil {
+		return nil, err
+	}
+	return &RegionalReferenceTokenStore{r: r}, nil
+}
+
+//Add will add a reference token to the store of its region.
+func (s *RegionalReferenceTokenStore) Add(t ReferenceToken) error {
+	store, err := s.r.store(t.Region)
+	if err != nil {
+		return err
+	}
+	return store.Add(t)
+}
+
+//Get will return the reference token with the id from the first region
+// having it, and false if not found or expired.
+func (s *RegionalReferenceTokenStore) Get(id string) (ReferenceToken, bool, error) {
+	var t ReferenceToken
+	var found bool
+	err := s.r.each(func(region string, store ReferenceTokenStore) error {
+		if found {
+			return nil
+		}
+		var err error
+		t, found, err = store.Get(id)
+		return err
+	})
+	if err != nil {
+		return ReferenceToken{}, false, err
+	}
+	return t, found, nil
+}
+
+//Delete will delete the reference token with the id from all the regions.
+func (s *RegionalReferenceTokenStore) Delete(id string) error {
+	return s.r.each(func(region string, store ReferenceTokenStore) error {
+		return store.Delete(id)
+	})
+}
+
+//DeleteSubject will delete all the reference tokens of the subject from
+// all the regions, and return the number deleted.
+func (s *RegionalReferenceTokenStore) DeleteSubject(subject string) (int, error) {
+	var n int
+	err := s.r.each(func(region string, store ReferenceTokenStore) error {
+		deleted, err := store.DeleteSubject(subject)
+		n += deleted
+		return err
+	})
+	return n, err
+}
+
+//Cleanup will remove the expired tokens of the regions implementing
+// Cleaner.
+func (s *RegionalReferenceTokenStore) Cleanup(now time.Time) (int, error) {
+	return s.r.cleanup(now)
+}
@@ -0,0 +1,178 @@
+package authsession
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//ErrProviderUnavailable is returned for requests to a provider while it
+// is failing, so users get a page telling them to try again later instead
+// of waiting for requests that will most likely fail.
+var ErrProviderUnavailable = errors.New("login provider unavailable")
+
+//RetryConfig is how requests to the providers are retried, for the code
+// exchange and the user info. Zero values use the defaults.
+type RetryConfig struct {
+	//Attempts is the max number of attempts for a request failing with a
+	// network error or a 5xx status. The default is 3, and 1 turns off
+	// the retries.
+	Attempts int
+	//Backoff is the wait before the second attempt, which is doubled for
+	// every attempt after, with jitter. The default is 200ms.
+	Backoff time.Duration
+	//BreakerFailures is the number of requests in a row failing to a
+	// provider before requests to it fail at once with
+	// ErrProviderUnavailable. The default is 5.
+	BreakerFailures int
+	//BreakerCooldown is how long requests fail at once, before a request
+	// is let through to try the provider again. The default is 30 seconds.
+	BreakerCooldown time.Duration
+}
+
+//retrier retries the requests to the providers, and keeps a circuit
+// breaker for each provider host.
+type retrier struct {
+	conf RetryConfig
+
+	mu    sync.Mutex
+	hosts map[string]*breaker
+}
+
+//breaker is the state of the circuit breaker for a host.
+type breaker struct {
+	failures  int
+	openUntil time.Time
+}
+
+//newRetrier will return a *retrier with the defaults set for the zero
+// values of conf.
+func newRetrier(conf RetryConfig) *retrier {
+	if conf.Attempts <= 0 {
+		conf.Attempts = 3
+	}
+	if conf.Backoff <= 0 {
+		conf.Backoff = 200 * time.Millisecond
+	}
+	if conf.BreakerFailures <= 0 {
+		conf.BreakerFailures = 5
+	}
+	if conf.BreakerCooldown <= 0 {
+		conf.BreakerCooldown = 30 * time.Second
+	}
+	return &retrier{conf: conf, hosts: make(map[string]*breaker)}
+}
+
+//open will return true if the breaker for the host is open.
+func (rt *retrier) open(host string) bool {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	b, ok := rt.hosts[host]
+	return ok && time.Now().Before(b.openUntil)
+}
+
+//record will record the result of a request to the host, and open the
+// breaker when too many requests in a row have failed.
+func (rt *retrier) record(host string, failed bool) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+
+	if !failed {
+		delete(rt.hosts, host)
+		return
+	}
+
+	b, ok := rt.hosts[host]
+	if !ok {
+		b = &breaker{}
+		rt.hosts[host] = b
+	}
+	b.failures++
+	if b.failures >= rt.conf.BreakerFailures {
+		b.openUntil = time.Now().Add(rt.conf.BreakerCooldown)
+	}
+}
+
+//backoff will return the wait before the attempt, with jitter so many
+// clients don't retry at the same time.
+func (rt *retrier) backoff(attempt int) time.Duration {
+	d := rt.conf.Backoff << (attempt - 1)
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+//transport will return a http.RoundTripper doing the requests with base,
+// retrying them and using the circuit breakers of rt.
+func (rt *retrier) transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return retryTransport{rt: rt, base: base}
+}
+
+//retryTransport is a http.RoundTripper retrying the requests.
+type retryTransport struct {
+	rt   *retrier
+	base http.RoundTripper
+}
+
+//RoundTrip will do the request, and retry it if it fails with a network
+// error or a 5xx status. Requests with a body that can't be read again
+// are not retried.
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+	if t.rt.open(host) {
+		return nil, ErrProviderUnavailable
+	}
+
+	attempts := t.rt.conf.Attempts
+	if req.Body != nil && req.GetBody == nil {
+		attempts = 1
+	}
+
+	var resp *http.Response
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		r := req
+		if attempt > 0 {
+			select {
+			case <-time.After(t.rt.backoff(attempt)):
+			case <-req.Context().Done():
+				return nil, req.Context().Err()
+			}
+
+			r = req.Clone(req.Context())
+			if req.GetBody != nil {
+				if r.Body, err = req.GetBody(); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		resp, err = t.base.RoundTrip(r)
+		failed := err != nil || resp.StatusCode >= 500
+		if !failed || req.Context().Err() != nil || attempt == attempts-1 {
+			//Requests cancelled by us are not the fault of the provider.
+			t.rt.record(host, failed && req.Context().Err() == nil)
+			return resp, err
+		}
+		if resp != nil {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	return resp, err
+}
+
+//providerClient will return the http client for the back channel
+// requests to the default provider.
+func (a *Auth) providerClient() *http.Client {
+	return &http.Client{
+		Timeout:   10 * time.Second,
+		Transport: a.retry.transport(http.DefaultTransport),
+	}
+}
@@ -0,0 +1,107 @@
+package authsession
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+//returnToTTL is how long a signed return-to value is valid, which is the
+// time the user has to get through the login and any extra steps.
+const returnToTTL = 15 * time.Minute
+
+//returnToValue is the value signed by SignReturnTo.
+type returnToValue struct {
+	Path    string
+	Expires int64
+}
+
+//isLocalPath will return true if p is a path on this site, so we can't be
+// used to redirect users elsewhere.
+func isLocalPath(p string) bool {
+	return strings.HasPrefix(p, "/") && !strings.HasPrefix(p, "//") && !strings.HasPrefix(p, "/\\")
+}
+
+//SignReturnTo will return a signed value holding the local path p, so it
+// can be carried through the login and the pages of extra steps like a
+// second factor, in links and forms, without being changed to send the
+// user elsewhere. The value is valid for 15 minutes, and is given to
+// /slogin with the return_to query parameter.
+func (a *Auth) SignReturnTo(p string) (string, error) {
+	if !isLocalPath(p) {
+		return "", errors.New("return to must be a local path")
+	}
+	if !a.redirectAllowed(p) {
+		return "", errors.New("return to is not in the redirect allowlist")
+	}
+	return a.codec.Encode("returnto", returnToValue{
+		Path:    p,
+		Expires: time.Now().Add(returnToTTL).Unix(),
+	})
+}
+
+//VerifyReturnTo will return the path in the value signed by SignReturnTo,
+// and false if the value is not valid or has expired.
+func (a *Auth) VerifyReturnTo(value string) (string, bool) {
+	var v returnToValue
+	if err := a.codec.Decode("returnto", value, &v); err != nil {
+		return "", false
+	}
+	if time.Now().Unix() > v.Expires || !a.redirectAllowed(v.Path) {
+		return "", false
+	}
+	return v.Path, true
+}
+
+//loginURLReturningTo will return the url to the login page, which brings
+// the user back to the page of the request after the login. Only GET
+// requests are brought back to, since the body of other requests is lost.
+func (a *Auth) loginURLReturningTo(r *http.Request) string {
+	loginURL := a.tenantPath(r, "/slogin")
+	if r.Method != http.MethodGet {
+		return loginURL
+	}
+
+	value, err := a.SignReturnTo(r.URL.RequestURI())
+	if err != nil {
+		a.logRequestError(r, "error: failed to sign return to: ", err)
+		return loginURL
+	}
+	return loginURL + "?" + url.Values{"return_to": {value}}.Encode()
+}
+
+//rememberReturnTo will store the path signed in the return_to query
+// parameter of the request in the session, so the user is sent there
+// after the login. Values not valid are ignored.
+func (a *Auth) rememberReturnTo(r *http.Request, session *sessions.Session) {
+	value := r.URL.Query().Get("return_to")
+	if value == "" {
+		return
+	}
+	p, ok := a.VerifyReturnTo(value)
+	if !ok {
+		a.logRequestError(r, "error: return_to not valid or expired")
+		return
+	}
+	session.Values["returnto"] = p
+}
+
+//returnTo will return where to redirect the user after a login, which
+// is the page stored by the issuer authorization endpoint or given with
+// return_to to /slogin if any, or the start page. The stored page is
+// removed from the session.
+func (a *Auth) returnTo(r *http.Request, session *sessions.Session) string {
+	p, _ := session.Values["returnto"].(string)
+	delete(session.Values, "returnto")
+
+	//Only follow local paths allowed as redirects, so we can't be used to
+	// redirect elsewhere.
+	if p == "" {
+		return a.tenantPath(r, "/")
+	}
+	return a.safeRedirectTarget(r, p)
+}
@@ -0,0 +1,416 @@
+package authsession
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	//defaultRiskInterval is how often the risk of a session is scored
+	// again if not set in the RiskPolicy.
+	defaultRiskInterval = 5 * time.Minute
+	//riskFailuresWindow is how far back the failed logins are counted for
+	// the RecentFailures of the signals.
+	riskFailuresWindow = 24 * time.Hour
+	//earthRadiusKM is the mean radius of the earth, for the distance
+	// between two locations.
+	earthRadiusKM = 6371.0
+)
+
+//ErrLoginRiskDenied is returned when a login is denied because its risk
+// score reached the DenyAt of the RiskPolicy.
+var ErrLoginRiskDenied = errors.New("login denied by the risk score")
+
+//RiskSignals are what is known about a login or a request of a session
+// when its risk is scored.
+type RiskSignals struct {
+	//Login is true when a login is scored, and false when a session is
+	// scored again.
+	Login     bool
+	Email     string
+	IP        string
+	UserAgent string
+	//Location is where the IP is, when WithGeoIP is used.
+	Location GeoLocation
+	//IPChanged and UserAgentChanged are true when the IP or the user agent
+	// is not the one of the last time the session was scored, or at login
+	// of the last session of the user in the session store.
+	IPChanged        bool
+	UserAgentChanged bool
+	//Speed is how fast in km/h the user must have traveled from the
+	// location of the last time to Location, and 0 if not known. A speed
+	// faster than a plane tells the account is used from two places.
+	Speed float64
+	//RecentFailures is the number of failed logins of the user, or from
+	// the IP, within the last 24 hours, of the login events kept in memory.
+	RecentFailures int
+	//PreviousScore is the score of the last time.
+	PreviousScore int
+}
+
+//RiskScorer scores the risk of logins and sessions, like with rules or an
+// external fraud service. It is set with WithRiskScoring.
+type RiskScorer interface {
+	//Score will return the risk score of the signals, where a higher score
+	// is a higher risk.
+	Score(ctx context.Context, s RiskSignals) (int, error)
+}
+
+//RiskScorerFunc is a RiskScorer as a function.
+type RiskScorerFunc func(ctx context.Context, s RiskSignals) (int, error)
+
+//Score will call f.
+func (f RiskScorerFunc) Score(ctx context.Context, s RiskSignals) (int, error) {
+	return f(ctx, s)
+}
+
+//RiskPolicy is the RiskScorer and what is done at which score. A score of
+// 0 for an action turns it off.
+type RiskPolicy struct {
+	Scorer RiskScorer
+	//Interval is how often a session is scored again, which defaults to 5
+	// minutes. A session is also scored at once when its IP changes.
+	Interval time.Duration
+	//NotifyAt is the score from which a critical event is written, and the
+	// user is sent the new device mail if a mailer is set with WithMailer.
+	NotifyAt int
+	//StepUpAt is the score from which the user must authenticate again at
+	// StepUpURL, like with MFA, before the session can be used. The page
+	// calls StepUpDone when done. Without a StepUpURL a session is ended,
+	// so the user must log in again, and a login is let through.
+	StepUpAt  int
+	StepUpURL string
+	//DenyAt is the score from which a login is denied, and a session is
+	// ended.
+	DenyAt int
+}
+
+//riskAction is what is done at a risk score.
+type riskAction int
+
+const (
+	riskAllow riskAction = iota
+	riskStepUp
+	riskDeny
+)
+
+//action will return what to do at the score, and true if the user should
+// also be notified.
+func (p RiskPolicy) action(score int) (riskAction, bool) {
+	notify := p.NotifyAt > 0 && score >= p.NotifyAt
+	switch {
+	case p.DenyAt > 0 && score >= p.DenyAt:
+		return riskDeny, notify
+	case p.StepUpAt > 0 && score >= p.StepUpAt:
+		return riskStepUp, notify
+	}
+	return riskAllow, notify
+}
+
+//riskState is the risk of a session, kept as JSON in the session, with
+// what was seen the last time it was scored.
+type riskState struct {
+	Score   int    `json:"score"`
+	Checked int64  `json:"checked"`
+	IP      string `json:"ip,omitempty"`
+	//UA is a hash of the user agent, to keep the cookie small.
+	UA  string  `json:"ua,omitempty"`
+	Lat float64 `json:"lat,omitempty"`
+	Lon float64 `json:"lon,omitempty"`
+	//StepUp is set while the user must authenticate again.
+	StepUp bool `json:"stepUp,omitempty"`
+}
+
+//sessionRisk will return the risk state of the session values.
+func sessionRisk(values map[interface{}]interface{}) riskState {
+	var st riskState
+	if s, ok := values[sessionKeyRisk].(string); ok {
+		json.Unmarshal([]byte(s), &st)
+	}
+	return st
+}
+
+//set will put the risk state in the session values.
+func (st riskState) set(values map[interface{}]interface{}) {
+	b, err := json.Marshal(st)
+	if err != nil {
+		return
+	}
+	values[sessionKeyRisk] = string(b)
+}
+
+//Risk will return the risk score of the session from the RiskScorer set
+// with WithRiskScoring, and 0 if not scored.
+func (s *Session) Risk() int {
+	return sessionRisk(s.s.Values).Score
+}
+
+//userAgentHash will return a short hash of the user agent.
+func userAgentHash(ua string) string {
+	sum := sha256.Sum256([]byte(ua))
+	return hex.EncodeToString(sum[:8])
+}
+
+//travelSpeed will return the speed in km/h needed to travel between the
+// coordinates in the time, using the great-circle distance. Times below a
+// minute count as a minute, so a small move right away is not too fast.
+func travelSpeed(lat1, lon1, lat2, lon2 float64, d time.Duration) float64 {
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(lat2 - lat1)
+	dLon := rad(lon2 - lon1)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(lat1))*math.Cos(rad(lat2))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	km := 2 * earthRadiusKM * math.Asin(math.Sqrt(h))
+	if d < time.Minute {
+		d = time.Minute
+	}
+	return km / d.Hours()
+}
+
+//riskSignals will return the signals of the request compared to the
+// previous risk state, and the new state to keep.
+func (a *Auth) riskSignals(r *http.Request, email string, prev riskState, login bool) (RiskSignals, riskState) {
+	now := time.Now()
+	ip := a.clientIP(r)
+	g := a.geoLocation(ip)
+	s := RiskSignals{
+		Login:          login,
+		Email:          email,
+		IP:             ip,
+		UserAgent:      r.UserAgent(),
+		Location:       g,
+		RecentFailures: a.events.failures(email, ip, now.Add(-riskFailuresWindow)),
+		PreviousScore:  prev.Score,
+	}
+	next := riskState{
+		Score:   prev.Score,
+		Checked: now.Unix(),
+		IP:      ip,
+		UA:      userAgentHash(r.UserAgent()),
+		Lat:     g.Latitude,
+		Lon:     g.Longitude,
+		StepUp:  prev.StepUp,
+	}
+	if prev.Checked != 0 {
+		s.IPChanged = prev.IP != next.IP
+		s.UserAgentChanged = prev.UA != next.UA
+		if (prev.Lat != 0 || prev.Lon != 0) && (next.Lat != 0 || next.Lon != 0) {
+			s.Speed = travelSpeed(prev.Lat, prev.Lon, next.Lat, next.Lon, now.Sub(time.Unix(prev.Checked, 0)))
+		}
+	}
+	return s, next
+}
+
+//lastSessionRisk will return the risk state of the newest session of the
+// user in the session store, so a login is compared to the last one.
+func (a *Auth) lastSessionRisk(email string) riskState {
+	if a.sessions == nil {
+		return riskState{}
+	}
+	list, err := a.sessions.ListUser(email)
+	if err != nil {
+		a.logError("error: session store ListUser failed: ", err)
+		return riskState{}
+	}
+	var last SessionInfo
+	for _, s := range list {
+		if s.Created.After(last.Created) {
+			last = s
+		}
+	}
+	if last.ID == "" {
+		return riskState{}
+	}
+	g := a.geoLocation(last.IP)
+	return riskState{
+		Score:   last.Risk,
+		Checked: last.Created.Unix(),
+		IP:      last.IP,
+		UA:      userAgentHash(last.UserAgent),
+		Lat:     g.Latitude,
+		Lon:     g.Longitude,
+	}
+}
+
+//loginRisk will score the login of the user, and return the risk state
+// for the new session. ErrLoginRiskDenied is returned if the login is
+// denied. A login is let through if the scorer fails.
+func (a *Auth) loginRisk(r *http.Request, email string) (riskState, error) {
+	if a.risk == nil {
+		return riskState{}, nil
+	}
+	signals, st := a.riskSignals(r, email, a.lastSessionRisk(email), true)
+	st.Score = 0
+	score, err := a.risk.Scorer.Score(r.Context(), signals)
+	if err != nil {
+		a.logRequestError(r, "error: risk scorer failed at login: ", err)
+		return st, nil
+	}
+	st.Score = score
+
+	action, notify := a.risk.action(score)
+	if notify {
+		a.notifyRisk(r, signals, score)
+	}
+	switch {
+	case action == riskDeny:
+		a.events.risk(r, email, score, fmt.Sprintf("login denied by risk score %d", score), SeverityCritical)
+		return st, ErrLoginRiskDenied
+	case action == riskStepUp && a.risk.StepUpURL != "":
+		logRequestf(r, "info: risk score %d at login of %v, step-up required\n", score, a.LogIdentifier(email))
+		st.StepUp = true
+	}
+	return st, nil
+}
+
+//sessionRiskOK will score the session again when the Interval has passed
+// or the IP has changed, and return true if the request can go on. If not,
+// the user is sent to the step-up page, or the session is ended.
+func (a *Auth) sessionRiskOK(w http.ResponseWriter, r *http.Request, session *sessions.Session) bool {
+	if a.risk == nil {
+		return true
+	}
+	st := sessionRisk(session.Values)
+	if st.StepUp {
+		return a.stepUpPending(w, r)
+	}
+	if st.Checked != 0 && time.Since(time.Unix(st.Checked, 0)) < a.risk.Interval && a.clientIP(r) == st.IP {
+		return true
+	}
+
+	email, _ := session.Values[sessionKeyEmail].(string)
+	signals, next := a.riskSignals(r, email, st, false)
+	score, err := a.risk.Scorer.Score(r.Context(), signals)
+	if err != nil {
+		a.logRequestError(r, "error: risk scorer failed: ", err)
+		return true
+	}
+	next.Score = score
+
+	action, notify := a.risk.action(score)
+	if notify {
+		a.notifyRisk(r, signals, score)
+	}
+	if action == riskDeny || (action == riskStepUp && a.risk.StepUpURL == "") {
+		a.events.risk(r, email, score, fmt.Sprintf("session ended by risk score %d", score), SeverityCritical)
+		a.endRiskySession(w, r, session)
+		if action == riskDeny {
+			a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+			return false
+		}
+		a.renderPage(w, r, http.StatusUnauthorized, pageSessionExpired, PageData{LoginURL: a.loginURLReturningTo(r)})
+		return false
+	}
+	if action == riskStepUp {
+		a.events.risk(r, email, score, fmt.Sprintf("step-up required by risk score %d", score), SeverityInfo)
+		next.StepUp = true
+	}
+
+	next.set(session.Values)
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		a.logRequestError(r, "error: session.Save after risk scoring failed: ", err)
+	}
+	if a.sessions != nil && score != st.Score {
+		sid, _ := session.Values[sessionKeySID].(string)
+		if info, ok, err := a.sessions.Get(sid); err == nil && ok {
+			info.Risk = score
+			if err := a.sessions.Add(info); err != nil {
+				a.logRequestError(r, "error: session store Add failed: ", err)
+			}
+		}
+	}
+	if next.StepUp {
+		return a.stepUpPending(w, r)
+	}
+	return true
+}
+
+//stepUpPending will send the user to the StepUpURL, and back here after
+// for GET requests, and return false. The step-up page itself is let
+// through.
+func (a *Auth) stepUpPending(w http.ResponseWriter, r *http.Request) bool {
+	if u, err := url.Parse(a.risk.StepUpURL); err == nil && u.Path == r.URL.Path {
+		return true
+	}
+	target := a.risk.StepUpURL
+	if r.Method == http.MethodGet {
+		target = a.signedReturnToURL(r, target, r.URL.RequestURI())
+	}
+	a.safeRedirect(w, r, target, http.StatusSeeOther)
+	return false
+}
+
+//endRiskySession will delete the session from the session store and
+// clear the cookie.
+func (a *Auth) endRiskySession(w http.ResponseWriter, r *http.Request, session *sessions.Session) {
+	if a.sessions != nil {
+		sid, _ := session.Values[sessionKeySID].(string)
+		if err := a.sessions.Delete(sid); err != nil {
+			a.logRequestError(r, "error: session store Delete failed: ", err)
+		}
+	}
+	clearSession(session)
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		a.logRequestError(r, "error: session.Save after ending a risky session failed: ", err)
+	}
+}
+
+//notifyRisk will write a critical event about the risk score, and send
+// the user the new device mail if a mailer is set.
+func (a *Auth) notifyRisk(r *http.Request, s RiskSignals, score int) {
+	where := "session"
+	if s.Login {
+		where = "login"
+	}
+	a.events.risk(r, s.Email, score, fmt.Sprintf("risk score %d at %v", score, where), SeverityCritical)
+	if a.mailer == nil || s.Email == "" {
+		return
+	}
+
+	data := MailData{
+		Device:   deviceName(s.UserAgent),
+		Location: s.Location.String(),
+		IP:       s.IP,
+		Time:     time.Now(),
+	}
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+		defer cancel()
+		_, to := splitProviderUser(s.Email)
+		if err := a.SendMail(ctx, MailNewDevice, to, data); err != nil {
+			a.logError("error: risk notification to "+a.LogIdentifier(s.Email)+" failed: ", err)
+		}
+	}()
+}
+
+//StepUpDone will mark the step-up asked for by the risk score as done,
+// when the user has authenticated again at the StepUpURL of the
+// RiskPolicy. The page should then send the user back with the path
+// from VerifyReturnTo.
+func (a *Auth) StepUpDone(w http.ResponseWriter, r *http.Request) error {
+	session, ok := a.authenticated(r)
+	if !ok {
+		return errors.New("the request has no valid session")
+	}
+	st := sessionRisk(session.Values)
+	st.StepUp = false
+	st.set(session.Values)
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		return fmt.Errorf("session.Save failed: %v", err)
+	}
+	email, _ := session.Values[sessionKeyEmail].(string)
+	logRequestf(r, "info: step-up done by %v\n", a.LogIdentifier(email))
+	return nil
+}
@@ -0,0 +1,94 @@
+package authsession
+
+import (
+	"context"
+	"net/http"
+)
+
+//maxSessionRolesSize is the max size in bytes of the roles and the
+// permissions kept in the session cookie. Cookies are limited to about
+// 4 KB, so larger sets are kept in the session store instead.
+const maxSessionRolesSize = 1024
+
+//RolesResolver gives the roles and the permissions of the user logging
+// in, like from a database, set with WithRolesResolver. The roles and
+// permissions given by the provider or LDAP are in u.
+type RolesResolver func(ctx context.Context, u User) (roles []string, permissions []string, err error)
+
+//rolesSize will return about how many bytes the roles and permissions
+// take in the session.
+func rolesSize(roles []string, permissions []string) int {
+	size := 0
+	for _, s := range append(append([]string{}, roles...), permissions...) {
+		size += len(s) + 1
+	}
+	return size
+}
+
+//truncateRoles will drop the last roles and permissions until they fit
+// within max bytes, and return the ones kept.
+func truncateRoles(roles []string, permissions []string, max int) ([]string, []string) {
+	for rolesSize(roles, permissions) > max {
+		if len(permissions) > 0 {
+			permissions = permissions[:len(permissions)-1]
+			continue
+		}
+		roles = roles[:len(roles)-1]
+	}
+	return roles, permissions
+}
+
+//resolveRoles will set the roles and the permissions of u from the roles
+// resolver, if set.
+func (a *Auth) resolveRoles(r *http.Request, u *User) error {
+	if a.rolesResolver == nil {
+		return nil
+	}
+	roles, permissions, err := a.rolesResolver(r.Context(), *u)
+	if err != nil {
+		return err
+	}
+	u.Roles, u.Permissions = roles, permissions
+	return nil
+}
+
+//guardRolesSize will move the roles and the permissions of the session
+// to the session store when they are too large for the cookie, and
+// return the ones to put in the SessionInfo. Without a session store they
+// are truncated.
+func (a *Auth) guardRolesSize(r *http.Request, s *Session, u User) (roles []string, permissions []string) {
+	if rolesSize(u.Roles, u.Permissions) <= maxSessionRolesSize {
+		return nil, nil
+	}
+
+	if a.sessions != nil {
+		delete(s.s.Values, sessionKeyRoles)
+		delete(s.s.Values, sessionKeyPermissions)
+		s.s.Values[sessionKeyRolesInStore] = true
+		return u.Roles, u.Permissions
+	}
+
+	roles, permissions = truncateRoles(u.Roles, u.Permissions, maxSessionRolesSize)
+	logRequestf(r, "warning: the roles and permissions of %v are too large for the session cookie, and were truncated from %v to %v\n", a.LogIdentifier(u.Email), len(u.Roles)+len(u.Permissions), len(roles)+len(permissions))
+	s.s.Values[sessionKeyRoles] = roles
+	s.s.Values[sessionKeyPermissions] = permissions
+	return nil, nil
+}
+
+//sessionRoles will return the user of the session values with the roles
+// and the permissions, read from the session store if they were too
+// large for the cookie.
+func (a *Auth) sessionRoles(r *http.Request, values map[interface{}]interface{}, u User) User {
+	if inStore, _ := values[sessionKeyRolesInStore].(bool); !inStore || a.sessions == nil {
+		return u
+	}
+	sid, _ := values[sessionKeySID].(string)
+	si, found, err := a.sessions.Get(sid)
+	if err != nil {
+		a.logRequestError(r, "error: session store Get failed: ", err)
+	}
+	if found {
+		u.Roles, u.Permissions = si.Roles, si.Permissions
+	}
+	return u
+}
@@ -0,0 +1,84 @@
+package authsession
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+//normalizeScopes will trim the scopes, remove duplicates and check that
+// they only have the characters allowed in a scope by RFC 6749.
+func normalizeScopes(scopes []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, s := range scopes {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			return nil, fmt.Errorf("scope can't be empty")
+		}
+		for _, c := range s {
+			if c < 0x21 || c > 0x7e || c == '"' || c == '\\' {
+				return nil, fmt.Errorf("scope %q has characters not allowed", s)
+			}
+		}
+		if seen[s] {
+			continue
+		}
+		seen[s] = true
+		normalized = append(normalized, s)
+	}
+	return normalized, nil
+}
+
+//grantedScopes will return the scopes granted in the token response. The
+// provider may leave out the scope when all the requested scopes are
+// granted, so then the requested scopes are returned.
+func grantedScopes(token *oauth2.Token, requested []string) []string {
+	scope, _ := token.Extra("scope").(string)
+	if scope == "" {
+		return requested
+	}
+	return strings.Fields(scope)
+}
+
+//ScopeGrant is the scopes requested from the provider at login, and the
+// scopes granted by the user.
+type ScopeGrant struct {
+	Requested []string `json:"requested"`
+	Granted   []string `json:"granted"`
+}
+
+//Missing will return the requested scopes not granted, so the app can
+// tell if the user only gave a part of the consent.
+func (g ScopeGrant) Missing() []string {
+	granted := make(map[string]bool)
+	for _, s := range g.Granted {
+		granted[s] = true
+	}
+
+	var missing []string
+	for _, s := range g.Requested {
+		if !granted[s] {
+			missing = append(missing, s)
+		}
+	}
+	return missing
+}
+
+//Scopes will return the scopes requested and granted at the login of the
+// user of the request, and false if the request has no valid session, or
+// the user didn't log in with an oauth provider.
+func (a *Auth) Scopes(r *http.Request) (ScopeGrant, bool) {
+	session, ok := a.authenticated(r)
+	if !ok {
+		return ScopeGrant{}, false
+	}
+	requested, ok := session.Values["requestedscopes"].([]string)
+	if !ok {
+		return ScopeGrant{}, false
+	}
+	granted, _ := session.Values[sessionKeyScopes].([]string)
+	return ScopeGrant{Requested: requested, Granted: granted}, true
+}
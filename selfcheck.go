@@ -0,0 +1,139 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+//The example values of the secrets from the documentation, which must
+// never be used.
+const (
+	exampleCookieKey    = "some-cookie-store-key-here"
+	exampleClientID     = "some-google-key-here"
+	exampleClientSecret = "some-google-secret-here"
+)
+
+//secretParams are the names of query parameters, in lower case, which
+// should never carry a secret in a redirect URL.
+var secretParams = []string{"client_secret", "secret", "password", "passwd", "token", "access_token", "api_key", "apikey"}
+
+//checkSecrets will check for the copy-paste mistakes with the secrets,
+// like the client secret being the example value, a cookie key used as
+// a client secret, or a secret in a redirect URL. It does no requests,
+// so it is done at startup.
+func (a *Auth) checkSecrets() []Finding {
+	var findings []Finding
+
+	//The secrets of the issuer clients are checked like the client secret.
+	secrets := []namedValue{{"client secret", a.googleOauthConfig.ClientSecret}}
+	redirects := []namedValue{{"redirect url", a.googleOauthConfig.RedirectURL}}
+	if a.issuer != nil && a.issuer.conf.Clients != nil {
+		clients, err := a.issuer.conf.Clients.List()
+		if err != nil {
+			findings = append(findings, Finding{"issuer clients", FindingError, fmt.Sprintf("failed to read client store: %v", err)})
+		}
+		for _, c := range clients {
+			secrets = append(secrets, namedValue{"secret of issuer client " + c.ID, c.Secret})
+			for i, u := range c.RedirectURIs {
+				redirects = append(redirects, namedValue{fmt.Sprintf("redirect uri %d of issuer client %v", i, c.ID), u})
+			}
+		}
+	}
+
+	if a.googleOauthConfig.ClientID == exampleClientID {
+		findings = append(findings, Finding{"client id", FindingError, "client id is the example value from the documentation"})
+	}
+	var all []string
+	for _, s := range secrets {
+		all = append(all, s.value)
+		if s.value == exampleClientSecret {
+			findings = append(findings, Finding{"client secret", FindingError, s.name + " is the example value from the documentation"})
+		}
+	}
+
+	for i, k := range a.codec.cookieKeys() {
+		all = append(all, string(k))
+		for _, s := range secrets {
+			if s.value != "" && string(k) == s.value {
+				findings = append(findings, Finding{"cookie key", FindingError, fmt.Sprintf("cookie key %d is also used as the %v, use a separate random key", i, s.name)})
+			}
+		}
+	}
+
+	for _, u := range redirects {
+		if reason := secretInURL(u.value, all); reason != "" {
+			findings = append(findings, Finding{"redirect url", FindingError, fmt.Sprintf("%v has %v, secrets must not be put in URLs", u.name, reason)})
+		}
+	}
+
+	if len(findings) == 0 {
+		findings = append(findings, Finding{"secrets", FindingOK, "no misuse of the secrets found"})
+	}
+	return findings
+}
+
+//secretInURL will return what secret was found in the URL, or an empty
+// string if none.
+func secretInURL(raw string, secrets []string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	if _, ok := u.User.Password(); ok {
+		return "a password"
+	}
+	for k := range u.Query() {
+		for _, p := range secretParams {
+			if strings.ToLower(k) == p {
+				return "the query parameter " + k
+			}
+		}
+	}
+	for _, s := range secrets {
+		//Short values like a test secret would match by chance.
+		if len(s) >= 8 && strings.Contains(raw, s) {
+			return "a secret in it"
+		}
+	}
+	return ""
+}
+
+//namedValue is a secret or a URL checked, with the name it is told by.
+type namedValue struct {
+	name  string
+	value string
+}
+
+//SelfCheck will check the configuration for obviously bad secrets, like
+// the client secret being the example from the documentation, a cookie
+// key reused as the client secret, or a secret in a redirect URL, and
+// return an error with all the problems found, and the algorithms used
+// which are not allowed by the FIPS crypto profile. It does no requests.
+// Serve and NewAuthFromConfig do it at startup, and refuse to start in
+// production mode.
+func (a *Auth) SelfCheck() error {
+	var errs []error
+	for _, f := range append(a.checkSecrets(), a.checkCryptoProfile()...) {
+		if f.Level == FindingError {
+			errs = append(errs, fmt.Errorf("%v: %v", f.Check, f.Message))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//startupCheck will do the SelfCheck, and return the error in production
+// mode. Otherwise the problems are only logged.
+func (a *Auth) startupCheck() error {
+	err := a.SelfCheck()
+	if err == nil {
+		return nil
+	}
+	if a.production {
+		return fmt.Errorf("refusing to start in production mode: %w", err)
+	}
+	log.Printf("warning: self check found problems, which will stop the start in production mode: %v\n", strings.ReplaceAll(err.Error(), "\n", "; "))
+	return nil
+}
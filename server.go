@@ -0,0 +1,139 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+//shutdownTimeout is how long Serve waits for the requests in progress to
+// finish when shutting down.
+const shutdownTimeout = 30 * time.Second
+
+//Handler will return a handler serving the handlers of the package, the
+// same as Run registers with the http.DefaultServeMux, for apps using
+// their own mux or server.
+func (a *Auth) Handler() http.Handler {
+	mux := http.NewServeMux()
+	a.register(mux)
+	return mux
+}
+
+//Serve will serve the handlers of the package, and app for all other
+// paths, on addr with an http.Server with timeouts set, until ctx is
+// done. app can be nil to use the http.DefaultServeMux. The background
+// jobs are run while serving. When ctx is done the server is shut down
+// gracefully, waiting up to 30 seconds for the requests in progress, and
+// Close is called. In production mode Serve refuses to start when
+// SelfCheck finds a problem.
+func (a *Auth) Serve(ctx context.Context, addr string, app http.Handler) error {
+	if err := a.startupCheck(); err != nil {
+		return err
+	}
+	if app == nil {
+		app = http.DefaultServeMux
+	}
+	mux := http.NewServeMux()
+	a.register(mux)
+	mux.Handle("/", app)
+
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      60 * time.Second,
+		IdleTimeout:       120 * time.Second,
+	}
+
+	jobsCtx, stopJobs := context.WithCancel(ctx)
+	defer stopJobs()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		a.RunJobs(jobsCtx)
+	}()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+	log.Printf("info: serving on %v\n", addr)
+
+	var err error
+	select {
+	case err = <-serveErr:
+		err = fmt.Errorf("serving on %v failed: %v", addr, err)
+	case <-ctx.Done():
+		log.Printf("info: shutting down the server on %v\n", addr)
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if serr := srv.Shutdown(shutdownCtx); serr != nil {
+			err = fmt.Errorf("shutting down the server failed: %v", serr)
+		}
+	}
+
+	stopJobs()
+	wg.Wait()
+	if cerr := a.Close(); cerr != nil {
+		err = errors.Join(err, cerr)
+	}
+	return err
+}
+
+//Close will flush the event sinks, and close the stores, the event
+// sinks, the mailer and the LDAP connections, when they have a Flush or
+// Close method. It is called by Serve when shutting down, and should be
+// called by apps using Run or Handler when they stop.
+func (a *Auth) Close() error {
+	var errs []error
+	closed := make(map[interface{}]bool)
+	closeAll := func(vs ...interface{}) {
+		for _, v := range vs {
+			if v == nil {
+				continue
+			}
+			//The same value can be given for several things, like both
+			// event sinks, and is only closed once.
+			if reflect.TypeOf(v).Comparable() {
+				if closed[v] {
+					continue
+				}
+				closed[v] = true
+			}
+			if f, ok := v.(interface{ Flush() error }); ok {
+				if err := f.Flush(); err != nil {
+					errs = append(errs, fmt.Errorf("flush failed: %v", err))
+				}
+			}
+			if c, ok := v.(io.Closer); ok {
+				if err := c.Close(); err != nil {
+					errs = append(errs, fmt.Errorf("close failed: %v", err))
+				}
+			}
+		}
+	}
+
+	//The last events are signed before the sinks are closed.
+	if a.events.chain != nil {
+		if err := a.events.auditCheckpoint(context.Background()); err != nil {
+			errs = append(errs, fmt.Errorf("audit checkpoint failed: %v", err))
+		}
+	}
+	closeAll(a.events.sink, a.events.critical, a.mailer)
+	closeAll(unwrapStore(a.sessions), unwrapStore(a.users), unwrapStore(a.bans), a.invitations, a.allowList, unwrapStore(a.epochs), a.tenants, a.providers)
+	if a.ldap != nil {
+		closeAll(a.ldap)
+	}
+	if a.replication != nil {
+		closeAll(a.replication.replicator)
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,194 @@
+package authsession
+
+import (
+	"container/list"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+//CachedSessionStore is a SessionStore keeping the sessions read from
+// another SessionStore in memory for a short time, so a remote store,
+// like Redis, DynamoDB or memcached, is not asked for every request. The
+// cache is a LRU cache of a fixed size. Adding or deleting a session
+// through the cache removes it from the cache at once, but a session
+// revoked by another instance can be used until it leaves the cache, so
+// the TTL should be short. Lists are always read from the store.
+type CachedSessionStore struct {
+	store SessionStore
+	size  int
+	ttl   time.Duration
+
+	mu      sync.Mutex
+	order   *list.List
+	entries map[string]*list.Element
+	//gen is incremented for every invalidation, which is done after the
+	// change of the store, so a session read from the store while it was
+	// changed is not put in the cache.
+	gen uint64
+}
+
+//cachedSession is a session in the cache.
+type cachedSession struct {
+	session SessionInfo
+	read    time.Time
+}
+
+//NewCachedSessionStore will return a *CachedSessionStore in front of
+// store, keeping at most size sessions for ttl. The defaults are 10000
+// sessions and 5 seconds.
+func NewCachedSessionStore(store SessionStore, size int, ttl time.Duration) *CachedSessionStore {
+	if size <= 0 {
+		size = 10000
+	}
+	if ttl <= 0 {
+		ttl = 5 * time.Second
+	}
+	return &CachedSessionStore{
+		store:   store,
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+//cached will return the session with the id from the cache, and false if
+// not cached or too old, together with the generation of the cache.
+func (c *CachedSessionStore) cached(id string, now time.Time) (SessionInfo, bool, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[id]
+	if !ok {
+		return SessionInfo{}, false, c.gen
+	}
+	s := e.Value.(*cachedSession)
+	if now.Sub(s.read) >= c.ttl || (!s.session.Expires.IsZero() && now.After(s.session.Expires)) {
+		c.order.Remove(e)
+		delete(c.entries, id)
+		return SessionInfo{}, false, c.gen
+	}
+	c.order.MoveToFront(e)
+	return s.session, true, c.gen
+}
+
+//put will add the session read at now to the cache, and remove the least
+// recently used session if full. The session is not added if the cache
+// has been invalidated since the generation gen.
+func (c *CachedSessionStore) put(s SessionInfo, now time.Time, gen uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if gen != c.gen {
+		return
+	}
+	if e, ok := c.entries[s.ID]; ok {
+		e.Value = &cachedSession{session: s, read: now}
+		c.order.MoveToFront(e)
+		return
+	}
+	for c.order.Len() >= c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedSession).session.ID)
+	}
+	c.entries[s.ID] = c.order.PushFront(&cachedSession{session: s, read: now})
+}
+
+//invalidate will remove the sessions matching fn from the cache.
+func (c *CachedSessionStore) invalidate(fn func(s SessionInfo) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	for id, e := range c.entries {
+		if fn(e.Value.(*cachedSession).session) {
+			c.order.Remove(e)
+			delete(c.entries, id)
+		}
+	}
+}
+
+//invalidateID will remove the session with the id from the cache.
+func (c *CachedSessionStore) invalidateID(id string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.gen++
+	if e, ok := c.entries[id]; ok {
+		c.order.Remove(e)
+		delete(c.entries, id)
+	}
+}
+
+//Add will add, or replace a session in the store, and remove it from the
+// cache.
+func (c *CachedSessionStore) Add(s SessionInfo) error {
+	defer c.invalidateID(s.ID)
+	return c.store.Add(s)
+}
+
+//Get will return the session with the id from the cache, or else from
+// the store. Sessions not found are not cached, so a session just added
+// by another instance is found at once.
+func (c *CachedSessionStore) Get(id string) (SessionInfo, bool, error) {
+	now := time.Now()
+	s, ok, gen := c.cached(id, now)
+	if ok {
+		return s, true, nil
+	}
+
+	s, ok, err := c.store.Get(id)
+	if err != nil || !ok {
+		return s, ok, err
+	}
+	c.put(s, now, gen)
+	return s, true, nil
+}
+
+//List will return all the sessions that are not expired, from the store.
+func (c *CachedSessionStore) List() ([]SessionInfo, error) {
+	return c.store.List()
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user, from the store.
+func (c *CachedSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	return c.store.ListUser(user)
+}
+
+//Delete will delete the session with the id from the store and the cache.
+func (c *CachedSessionStore) Delete(id string) error {
+	defer c.invalidateID(id)
+	return c.store.Delete(id)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user from the store and the cache, and return the number of
+// sessions deleted.
+func (c *CachedSessionStore) DeleteUser(user string) (int, error) {
+	defer c.invalidate(func(s SessionInfo) bool {
+		return s.UserID == user || strings.EqualFold(s.Email, user)
+	})
+	return c.store.DeleteUser(user)
+}
+
+//Cleanup will remove the expired sessions of the store, if it implements
+// Cleaner.
+func (c *CachedSessionStore) Cleanup(now time.Time) (int, error) {
+	cl, ok := c.store.(Cleaner)
+	if !ok {
+		return 0, nil
+	}
+	return cl.Cleanup(now)
+}
+
+//Close will close the store, if it implements io.Closer.
+func (c *CachedSessionStore) Close() error {
+	if cl, ok := c.store.(io.Closer); ok {
+		return cl.Close()
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package authsession
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//encryptedPrefix marks a value encrypted by EncryptedSessionStore, or
+// EncryptedUserStore.
+const encryptedPrefix = "enc1:"
+
+//EncryptedSessionStore is a SessionStore encrypting the personal data of
+// the sessions, the email, IP address, user agent, name and location,
+// before they are stored in another SessionStore. The values are encrypted with AES-GCM,
+// using the user ID as associated data, so a leaked copy of the store
+// does not expose them, and an encrypted value can't be moved to the
+// session of another user.
+type EncryptedSessionStore struct {
+	store SessionStore
+	fieldCipher
+}
+
+//NewEncryptedSessionStore will return an *EncryptedSessionStore storing
+// the sessions in store. The keys must be 16, 24 or 32 bytes. Values are
+// encrypted with the first key, and decrypted with any of the keys, so a
+// new key can be put first while the old keys are still needed.
+func NewEncryptedSessionStore(store SessionStore, keys ...[]byte) (*EncryptedSessionStore, error) {
+	c, err := newFieldCipher("session", keys)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedSessionStore{store: store, fieldCipher: c}, nil
+}
+
+//fieldCipher encrypts the personal fields of the records kept in a store,
+// with AES-GCM.
+type fieldCipher struct {
+	aeads []cipher.AEAD
+}
+
+//newFieldCipher will return a fieldCipher with the keys, named by what in
+// the errors.
+func newFieldCipher(what string, keys [][]byte) (fieldCipher, error) {
+	var c fieldCipher
+	if len(keys) == 0 {
+		return c, fmt.Errorf("no %v encryption keys given", what)
+	}
+
+	for i, k := range keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return c, fmt.Errorf("%v encryption key %d: %v", what, i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return c, fmt.Errorf("%v encryption key %d: %v", what, i, err)
+		}
+		c.aeads = append(c.aeads, aead)
+	}
+
+	return c, nil
+}
+
+//additionalData will return the associated data for the field of the
+// user, so encrypted values can't be swapped between fields or users.
+func additionalData(field string, userID string) []byte {
+	return []byte(field + "\x00" + userID)
+}
+
+//encrypt will encrypt the value with the first key.
+func (e fieldCipher) encrypt(field string, userID string, value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	aead := e.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	ct := aead.Seal(nonce, nonce, []byte(value), additionalData(field, userID))
+
+	return encryptedPrefix + base64.RawStdEncoding.EncodeToString(ct), nil
+}
+
+//decrypt will decrypt the value with the first key that works. Values
+// stored before encryption was turned on are returned as they are.
+func (e fieldCipher) decrypt(field string, userID string, value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+
+	ct, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", fmt.Errorf("failed decoding encrypted %v: %v", field, err)
+	}
+	for _, aead := range e.aeads {
+		if len(ct) < aead.NonceSize() {
+			continue
+		}
+		pt, err := aead.Open(nil, ct[:aead.NonceSize()], ct[aead.NonceSize():], additionalData(field, userID))
+		if err == nil {
+			return string(pt), nil
+		}
+	}
+	return "", fmt.Errorf("failed decrypting %v, no key matched", field)
+}
+
+//seal will return the session with the personal data encrypted.
+func (e *EncryptedSessionStore) seal(s SessionInfo) (SessionInfo, error) {
+	var err error
+	if s.Email, err = e.encrypt("email", s.UserID, s.Email); err != nil {
+		return s, err
+	}
+	if s.IP, err = e.encrypt("ip", s.UserID, s.IP); err != nil {
+		return s, err
+	}
+	if s.UserAgent, err = e.encrypt("userAgent", s.UserID, s.UserAgent); err != nil {
+		return s, err
+	}
+	if s.Name, err = e.encrypt("name", s.UserID, s.Name); err != nil {
+		return s, err
+	}
+	if s.Location, err = e.encrypt("location", s.UserID, s.Location); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+//open will return the session with the personal data decrypted.
+func (e *EncryptedSessionStore) open(s SessionInfo) (SessionInfo, error) {
+	var err error
+	if s.Email, err = e.decrypt("email", s.UserID, s.Email); err != nil {
+		return s, err
+	}
+	if s.IP, err = e.decrypt("ip", s.UserID, s.IP); err != nil {
+		return s, err
+	}
+	if s.UserAgent, err = e.decrypt("userAgent", s.UserID, s.UserAgent); err != nil {
+		return s, err
+	}
+	if s.Name, err = e.decrypt("name", s.UserID, s.Name); err != nil {
+		return s, err
+	}
+	if s.Location, err = e.decrypt("location", s.UserID, s.Location); err != nil {
+		return s, err
+	}
+	return s, nil
+}
+
+//Add will encrypt and add, or replace a session.
+func (e *EncryptedSessionStore) Add(s SessionInfo) error {
+	s, err := e.seal(s)
+	if err != nil {
+		return err
+	}
+	return e.store.Add(s)
+}
+
+//Get will return the decrypted session with the id, and false if not found.
+func (e *EncryptedSessionStore) Get(id string) (SessionInfo, bool, error) {
+	s, ok, err := e.store.Get(id)
+	if err != nil || !ok {
+		return s, ok, err
+	}
+	s, err = e.open(s)
+	return s, err == nil, err
+}
+
+//List will return all the decrypted sessions that are not expired.
+// Sessions that can't be decrypted are left out.
+func (e *EncryptedSessionStore) List() ([]SessionInfo, error) {
+	list, err := e.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var sessions []SessionInfo
+	var errs []error
+	for _, s := range list {
+		s, err := e.open(s)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("session %v: %v", s.ID, err))
+			continue
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, errors.Join(errs...)
+}
+
+//ListUser will return the decrypted sessions that are not expired where
+// the user ID or the email matches user. Since the emails are encrypted
+// all the sessions are decrypted to find the matches.
+func (e *EncryptedSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	list, err := e.List()
+
+	var sessions []SessionInfo
+	for _, s := range list {
+		if s.UserID == user || strings.EqualFold(s.Email, user) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, err
+}
+
+//Cleanup will remove the expired sessions of the wrapped store, if it
+// implements Cleaner.
+func (e *EncryptedSessionStore) Cleanup(now time.Time) (int, error) {
+	c, ok := e.store.(Cleaner)
+	if !ok {
+		return 0, nil
+	}
+	return c.Cleanup(now)
+}
+
+//Delete will delete the session with the id.
+func (e *EncryptedSessionStore) Delete(id string) error {
+	return e.store.Delete(id)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user, and return the number of sessions deleted. Since the
+// emails are encrypted the sessions are decrypted to find the matches.
+func (e *EncryptedSessionStore) DeleteUser(user string) (int, error) {
+	n, err := e.store.DeleteUser(user)
+	if err != nil {
+		return n, err
+	}
+
+	list, err := e.List()
+	for _, s := range list {
+		if strings.EqualFold(s.Email, user) {
+			if err := e.store.Delete(s.ID); err != nil {
+				return n, err
+			}
+			n++
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,142 @@
+package authsession
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+//The keys of the session values. Use them, or the accessors of Session,
+// instead of writing the keys as strings, so a typo can't make a check
+// silently fail.
+const (
+	sessionKeyAuthenticated = "authenticated"
+	sessionKeyVersion       = "version"
+	sessionKeyID            = "id"
+	sessionKeyFullName      = "fullname"
+	sessionKeyEmail         = "email"
+	sessionKeySID           = "sid"
+	sessionKeyTenant        = "tenant"
+	sessionKeyEpoch         = "epoch"
+	sessionKeyLocation      = "location"
+	sessionKeyExpires       = "expires"
+	sessionKeyRoles         = "roles"
+	sessionKeyPermissions   = "permissions"
+	sessionKeyScopes        = "scopes"
+	sessionKeyProvider      = "provider"
+	sessionKeyState         = "state"
+	sessionKeyRisk          = "risk"
+	sessionKeyRegion        = "region"
+	//sessionKeyRolesInStore is set when the roles and the permissions are
+	// too large for the cookie, and kept in the session store.
+	sessionKeyRolesInStore = "rolesinstore"
+)
+
+//Session is the session of a request, with typed accessors for the values
+// set by the package, so apps don't have to read them from the values of
+// the *sessions.Session as strings and type assertions.
+type Session struct {
+	s *sessions.Session
+}
+
+//Session will return the session of the request. A new empty session is
+// returned with the error if the cookie could not be decoded.
+func (a *Auth) Session(r *http.Request) (*Session, error) {
+	s, err := a.store.Get(r, "cookie-name")
+	return &Session{s: s}, err
+}
+
+//Raw will return the *sessions.Session, for the values of the app.
+func (s *Session) Raw() *sessions.Session {
+	return s.s
+}
+
+//Authenticated will return true if the session has been logged in. It
+// does not check if the session has expired or is revoked, which is done
+// by IsAuthenticated.
+func (s *Session) Authenticated() bool {
+	auth, _ := s.s.Values[sessionKeyAuthenticated].(bool)
+	return auth
+}
+
+//Email will return the email of the user, or an empty string.
+func (s *Session) Email() string {
+	email, _ := s.s.Values[sessionKeyEmail].(string)
+	return email
+}
+
+//ID will return the ID of the session in the session store, or an empty
+// string.
+func (s *Session) ID() string {
+	sid, _ := s.s.Values[sessionKeySID].(string)
+	return sid
+}
+
+//Tenant will return the ID of the tenant the session is for, or an empty
+// string.
+func (s *Session) Tenant() string {
+	tenant, _ := s.s.Values[sessionKeyTenant].(string)
+	return tenant
+}
+
+//Region will return the region of the user, resolved at login when data
+// residency is set with WithDataResidency.
+func (s *Session) Region() string {
+	region, _ := s.s.Values[sessionKeyRegion].(string)
+	return region
+}
+
+//Roles will return the roles of the user, like from LDAP. Roles too
+// large for the cookie are kept in the session store, and given by
+// CurrentUser instead.
+func (s *Session) Roles() []string {
+	roles, _ := s.s.Values[sessionKeyRoles].([]string)
+	return roles
+}
+
+//Permissions will return the permissions of the user. Like the roles,
+// permissions too large for the cookie are given by CurrentUser.
+func (s *Session) Permissions() []string {
+	permissions, _ := s.s.Values[sessionKeyPermissions].([]string)
+	return permissions
+}
+
+//Expires will return when the session expires, and the zero time if not
+// known.
+func (s *Session) Expires() time.Time {
+	exp, ok := s.s.Values[sessionKeyExpires].(int64)
+	if !ok {
+		return time.Time{}
+	}
+	return time.Unix(exp, 0)
+}
+
+//User will return the user of the session, with the ID, Email,
+// FullName, Roles and Permissions set.
+func (s *Session) User() User {
+	var u User
+	u.ID, _ = s.s.Values[sessionKeyID].(string)
+	u.Email = s.Email()
+	u.FullName, _ = s.s.Values[sessionKeyFullName].(string)
+	u.Roles = s.Roles()
+	u.Permissions = s.Permissions()
+	return u
+}
+
+//SetUser will mark the session as logged in by the user. The session
+// must be saved with Save.
+func (s *Session) SetUser(u User) {
+	s.s.Values[sessionKeyAuthenticated] = true
+	s.s.Values[sessionKeyID] = u.ID
+	s.s.Values[sessionKeyFullName] = u.FullName
+	s.s.Values[sessionKeyEmail] = u.Email
+	s.s.Values[sessionKeyRoles] = u.Roles
+	s.s.Values[sessionKeyPermissions] = u.Permissions
+	delete(s.s.Values, sessionKeyRolesInStore)
+}
+
+//Save will save the session in the response.
+func (s *Session) Save(r *http.Request, w http.ResponseWriter) error {
+	return s.s.Save(r, w)
+}
@@ -0,0 +1,62 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+//SessionLimitStrategy tells what to do when a user logs in and already
+// has the max number of sessions.
+type SessionLimitStrategy int
+
+const (
+	//RejectNewSession will refuse the new login.
+	RejectNewSession SessionLimitStrategy = iota
+	//EvictOldestSession will revoke the oldest sessions of the user to
+	// make room for the new session.
+	EvictOldestSession
+)
+
+//ErrTooManySessions is returned when a user has the max number of
+// sessions, and the strategy is RejectNewSession.
+var ErrTooManySessions = errors.New("too many active sessions for the user")
+
+//sessionLimit is the max number of sessions per user, set with WithSessionLimit.
+type sessionLimit struct {
+	max      int
+	strategy SessionLimitStrategy
+}
+
+//enforceSessionLimit will make room for a new session for the user, by
+// the strategy of the session limit. It returns ErrTooManySessions if
+// the new session should be refused.
+func (a *Auth) enforceSessionLimit(user string) error {
+	if a.sessionLimit == nil || a.sessionLimit.max <= 0 || a.sessions == nil {
+		return nil
+	}
+
+	list, err := a.sessions.ListUser(user)
+	if err != nil {
+		return fmt.Errorf("session store ListUser failed: %v", err)
+	}
+	if len(list) < a.sessionLimit.max {
+		return nil
+	}
+
+	if a.sessionLimit.strategy == RejectNewSession {
+		return ErrTooManySessions
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	for _, s := range list[:len(list)-a.sessionLimit.max+1] {
+		if err := a.sessions.Delete(s.ID); err != nil {
+			return fmt.Errorf("session store Delete failed: %v", err)
+		}
+	}
+	a.watchers.notify(user, "session_limit")
+
+	return nil
+}
@@ -1,40 +1,118 @@
 package authsession
 
 import (
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"crypto/subtle"
+	"errors"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"html/template"
+	"io"
+	"net"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/google"
 
-	"crypto/rand"
+	"crypto/tls"
 
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 )
 
 //createRandomKey will create a random []byte with the size taken as input.
 func createRandomKey(size int) ([]byte, error) {
-	b := make([]byte, size)
-
-	//rand.Read() will read random values from the crypto package,
-	// and read them into the []byte b.
-	_, err := rand.Read(b)
-	if err != nil {
-		return nil, err
-	}
-	return b, nil
+	return KeyGenerator{Size: size}.Bytes()
 }
 
+//sessionMaxAge is the max age in seconds of the session cookie set at login.
+const sessionMaxAge = 60 * 60 * 8
+
 //Auth is used for the authentication handlers, and hold all the
 // values needed for authentication.
 type Auth struct {
 	googleOauthConfig *oauth2.Config
-	oauthStateString  string
 	store             *sessions.CookieStore
+	sessions          SessionStore
+	bans              BanStore
+	invitations       InvitationStore
+	users             UserStore
+	allowList         AllowList
+	adminRoles        []string
+	adminCertNames    []string
+	codec             *rotatingCodec
+	cookieKeyRotated  func(key []byte) error
+	events            *loginEvents
+	errors            *errorSamples
+	dashboardTemplate *template.Template
+	pageTemplates     *template.Template
+	providerName      string
+	providerIcon      string
+	messages          MessageCatalog
+	branding          Branding
+	location          func(ip string) string
+	loginCancelled    http.Handler
+	retry             *retrier
+	clockSkew         time.Duration
+	externalURL       string
+	pending           *pendingLogins
+	stateTTL          time.Duration
+	userInfoMu        sync.Mutex
+	userInfoURL       string
+	postLoginHook     PostLoginHook
+	peopleAPI         bool
+	jobs              []job
+	groupSync         *groupSync
+	mailer            Mailer
+	mailTemplates     map[MailKind]MailTemplate
+	panics            atomic.Int64
+	securityHeaders   *SecurityHeaderConfig
+	formPost          bool
+	watchers          *sessionWatchers
+	loginPolicy       *loginPolicy
+	geoIP             *geoIP
+	terms             *Terms
+	profileSteps      []ProfileStep
+	loginSuccess      LoginSuccessHandler
+	popupOrigins      []string
+	redirectAllowlist *RedirectAllowlist
+	basicAuth         *basicAuth
+	throttle          *loginThrottle
+	random            io.Reader
+	rolesResolver     RolesResolver
+	janitor           JanitorConfig
+	jobStats          jobStats
+	storeObserver     storeObserver
+	replication       *replication
+	stateless         *statelessCodec
+	statelessHeader   bool
+	denylist          *tokenDenylist
+	tenants           TenantStore
+	tenantFrom        TenantFrom
+	providers         ProviderStore
+	ldap              *LDAPAuthenticator
+	issuer            *issuer
+	clientSigner      Signer
+	clientCert        *tls.Certificate
+	introspection     *introspector
+	epochs            EpochStore
+	sessionVersion    int
+	sessionMigrations map[int]SessionMigration
+	sessionLimit      *sessionLimit
+	risk              *RiskPolicy
+	honeypot          *honeypot
+	production        bool
+	cryptoProfile     CryptoProfile
+	privacy           PrivacyPolicy
+	residency         *ResidencyConfig
+	logIdentifiers    LogIdentifiers
+	logSalt           []byte
+	funnel            loginFunnel
+	routes            routeTable
+	trustedProxies    []*net.IPNet
+	loginStates       LoginStateStore
 }
 
 //NewAuth will return *auth and a *sessions.CookieStore, with a prepared OauthConfig
@@ -44,82 +122,623 @@ type Auth struct {
 // port, for example :8080,
 // cookieStoreKey, is the secret key used for the cookie storage,
 // clientIDKey, is the Client ID key found in the google developer console for your oauth app,
-// clientSecret, is the client secret found in the google developer console for your oauth app.
-func NewAuth(proto string, host string, port string, cookieStoreKey string, clientIDKey string, clientSecret string) (*Auth, *sessions.CookieStore) {
+// clientSecret, is the client secret found in the google developer console for your oauth app,
+// opts, are optional settings like WithSessionStore.
+func NewAuth(proto string, host string, port string, cookieStoreKey string, clientIDKey string, clientSecret string, opts ...Option) (*Auth, *sessions.CookieStore) {
 	store := sessions.NewCookieStore([]byte(cookieStoreKey))
-	return &Auth{
-		googleOauthConfig: newOauthConfig(proto, host, port, clientIDKey, clientSecret),
+	return newAuth(newOauthConfig(proto, host, port, clientIDKey, clientSecret), store, [][]byte{[]byte(cookieStoreKey)}, opts), store
+}
+
+//newAuth will return *Auth with the oauth config and store set, and
+// the opts applied. cookieKeys are the keys used by the store, where
+// the first key is used for new cookies.
+func newAuth(oauthConfig *oauth2.Config, store *sessions.CookieStore, cookieKeys [][]byte, opts []Option) *Auth {
+	a := &Auth{
+		googleOauthConfig: oauthConfig,
 		store:             store,
-	}, store
+		codec:             newRotatingCodec(cookieKeys),
+		events:            newLoginEvents(100),
+		errors:            newErrorSamples(50),
+		dashboardTemplate: defaultDashboardTemplate,
+		pageTemplates:     defaultPageTemplates,
+		providerName:      "Google",
+		retry:             newRetrier(RetryConfig{}),
+		clockSkew:         defaultClockSkew,
+		pending:           newPendingLogins(defaultPendingLogins, defaultPendingLoginsPerIP),
+		stateTTL:          defaultStateTTL,
+		mailTemplates:     defaultMailTemplates,
+		watchers:          newSessionWatchers(),
+		loginPolicy:       &loginPolicy{},
+		sessionVersion:    sessionVersion,
+		sessionMigrations: make(map[int]SessionMigration),
+	}
+	a.events.location = a.sessionLocation
+	a.events.failed = a.throttleFailure
+	a.events.clientIP = a.clientIP
+	for v, m := range builtinMigrations {
+		a.sessionMigrations[v] = m
+	}
+	//Let the store use the rotating codec, so the cookie keys can
+	// be rotated while running.
+	store.Codecs = []securecookie.Codec{a.codec}
+
+	for _, opt := range opts {
+		opt(a)
+	}
+	a.setLogSalt()
+	a.enforceCryptoProfile()
+	a.replicateStores()
+	a.observeStores()
+	return a
 }
 
 //Run will start the auth, which basically is to run the HandleFunc's needed.
 func (a *Auth) Run() {
-	http.HandleFunc("/slogin", a.login)
-	http.HandleFunc("/slogout", a.logout)
-	http.HandleFunc("/callback", a.handleGoogleCallback)
+	a.register(http.DefaultServeMux)
+}
+
+//register will register the handlers of the package with mux.
+func (a *Auth) register(mux *http.ServeMux) {
+	//All the handlers get a request ID, for the logs, the events and the
+	// error pages, and panics are recovered.
+	serve := func(pattern string, h http.Handler) {
+		if a.securityHeaders != nil {
+			h = a.SecurityHeaders(h)
+		}
+		mux.Handle(pattern, requestIDHandler(a.recoverHandler(h)))
+	}
+	//The routes are kept for the OpenAPI document.
+	handle := func(pattern string, h http.Handler) {
+		a.routes.add(pattern)
+		serve(pattern, h)
+	}
+
+	handle("/slogin", http.HandlerFunc(a.login))
+	handle("/slogout", http.HandlerFunc(a.logout))
+	handle("/callback", http.HandlerFunc(a.handleGoogleCallback))
+
+	if a.tenants != nil && a.tenantFrom == TenantFromPath {
+		handle("/{tenant}/slogin", http.HandlerFunc(a.login))
+		handle("/{tenant}/slogout", http.HandlerFunc(a.logout))
+		handle("/{tenant}/callback", http.HandlerFunc(a.handleGoogleCallback))
+		handle("/{tenant}"+providersPath, http.HandlerFunc(a.listProviders))
+	}
+	handle(providersPath, http.HandlerFunc(a.listProviders))
+	handle(signedURLPath, http.HandlerFunc(a.signedURLAuth))
+
+	if a.ldap != nil {
+		handle("/slogin/ldap", http.HandlerFunc(a.ldapLogin))
+		if a.tenants != nil && a.tenantFrom == TenantFromPath {
+			handle("/{tenant}/slogin/ldap", http.HandlerFunc(a.ldapLogin))
+		}
+	}
+
+	if a.adminEnabled() {
+		handle(adminPath, a.adminHandler())
+	}
+
+	if a.issuer != nil {
+		if a.tenantIssuers() && a.tenantFrom == TenantFromPath {
+			handle("/{tenant}"+issuerPath+"/", a.issuerHandler())
+		} else {
+			handle(issuerPath+"/", a.issuerHandler())
+		}
+		handle(jwksPath, http.HandlerFunc(a.issuerJWKS))
+	}
+
+	if a.terms != nil {
+		handle(termsPath, http.HandlerFunc(a.acceptTerms))
+	}
+
+	if a.honeypot != nil {
+		//The honeypot paths are left out of the OpenAPI document.
+		for _, p := range a.honeypot.conf.Paths {
+			serve(p, http.HandlerFunc(a.honeypotHandler))
+		}
+	}
+
+	handle(readyPath, http.HandlerFunc(a.ready))
+	handle(assetsPath+"{name}", http.HandlerFunc(a.serveAsset))
+	handle(openAPIPath, http.HandlerFunc(a.serveOpenAPI))
+
+	sessionHandler := a.sessionHandler()
+	handle(sessionPath, sessionHandler)
+	handle(sessionPath+"/", sessionHandler)
 }
 
 func (a *Auth) login(w http.ResponseWriter, r *http.Request) {
-	//The idea here is to generate a new state string for each user
-	// who choose to login to the page.
-	// NB: There should be no reason to set this value to zero after
-	// an authentication process is attemped, since the the only place
-	// this value is used is in the //callback handler. All other places
-	// where the tokenString might be needed after a user is logged in
-	// should get it's value from the session token.
-	stateStringRAW, err := createRandomKey(16)
+	providerID := r.URL.Query().Get("provider")
+	if a.banned(r) {
+		a.funnelStep(FunnelStarted, providerID, "")
+		a.funnelDrop(FunnelStarted, providerID, "", FunnelDropBanned)
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodPost {
+		a.loginJSON(w, r)
+		return
+	}
+	if wait := a.loginWait(r, ""); wait > 0 {
+		a.funnelStep(FunnelStarted, providerID, "")
+		a.funnelDrop(FunnelStarted, providerID, "", FunnelDropThrottled)
+		a.renderThrottled(w, r, wait)
+		return
+	}
+
+	//Let the user choose the provider if none is given, and there are
+	// providers registered at runtime to choose between.
+	if !r.URL.Query().Has("provider") && a.chooseProvider(w, r) {
+		return
+	}
+	a.funnelStep(FunnelStarted, providerID, "")
+
+	//Use the provider registered at runtime if given, or the default.
+	if closed, msgKey, until := a.loginClosed(providerID, time.Now()); closed {
+		a.funnelDrop(FunnelStarted, providerID, "", FunnelDropLoginClosed)
+		a.renderMaintenance(w, r, msgKey, until)
+		return
+	}
+	oauthConfig, err := a.providerOauthConfig(r, providerID)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+		a.funnelDrop(FunnelStarted, providerID, "", FunnelDropUnknownProvider)
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
+	}
+
+	//Remember the provider for the callback.
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in /login: ", err)
+	}
+	session.Values[sessionKeyProvider] = providerID
+	a.rememberReturnTo(r, session)
+	a.rememberPopup(r, session)
+
+	//Generate a new state for each login, which is only valid for the
+	// callback of this login in this browser.
+	state, err := a.newState(r, session)
 	if err != nil {
-		log.Println("error: failed to create state string: ", err)
+		a.logRequestError(r, "error: login: ", err)
+		a.funnelDrop(FunnelStarted, providerID, "", FunnelDropInternalError)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
 	}
 
-	a.oauthStateString = base64.URLEncoding.EncodeToString(stateStringRAW)
+	a.setTenantCookiePath(r, session.Options)
+	if err := session.Save(r, w); err != nil {
+		a.logRequestError(r, "error: session.Save in /login: ", err)
+		a.funnelDrop(FunnelStarted, providerID, state, FunnelDropInternalError)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
 
 	// Authentication goes here
 	// ...
-	url := a.googleOauthConfig.AuthCodeURL(a.oauthStateString)
+	url, err := a.authCodeURL(r.Context(), providerID, oauthConfig, state)
+	if err != nil {
+		a.logRequestError(r, "error: login: ", err)
+		a.funnelDrop(FunnelStarted, providerID, state, FunnelDropProviderUnavailable)
+		a.renderPage(w, r, http.StatusBadGateway, pageLoginFailed, PageData{Message: a.message(r, "login_failed.provider")})
+		return
+	}
+	a.funnelStep(FunnelRedirected, providerID, state)
 	//??? Will redirect to / if authentication fails
 	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
 }
 
+//logoutConfirmTemplate is the small confirmation page rendered when
+// /slogout is requested with GET. The form will POST back to the same
+// url together with the one time logout token stored in the session.
+var logoutConfirmTemplate = template.Must(template.New("logout").Parse(`<!DOCTYPE html>
+<html>
+<head><title>Logout</title></head>
+<body>
+<form method="POST">
+<p>Do you want to log out ?</p>
+<input type="hidden" name="logout_token" value="{{.}}">
+<button type="submit">Logout</button>
+</form>
+</body>
+</html>
+`))
+
 //logout will logout the user, and invalidate the session cookie
-// by setting the 'authenticated' key to false.
+// by deleting all the session values, and expiring the cookie.
+// Only POST requests carrying the logout token from the confirmation
+// page are allowed to log out, so a logout can't be triggered from
+// other sites by just linking to /slogout (like with an <img> tag).
+// A GET request will render the confirmation page.
 func (a *Auth) logout(w http.ResponseWriter, r *http.Request) {
 	var err error
 	session, err := a.store.Get(r, "cookie-name")
 	if err != nil {
-		log.Println("error: store.Get in /logout: ", err)
+		a.logRequestError(r, "error: store.Get in /logout: ", err)
 	}
 
-	// Revoke users authentication
-	session.Values["authenticated"] = false
+	switch r.Method {
+	case http.MethodGet:
+		token, err := a.newKey(16, KeyBase64URLPadded)
+		if err != nil {
+			a.logRequestError(r, "error: failed to create logout token: ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		session.Values["logouttoken"] = token
+		a.setTenantCookiePath(r, session.Options)
+		err = session.Save(r, w)
+		if err != nil {
+			a.logRequestError(r, "error: session.Save on /logout: ", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err = logoutConfirmTemplate.Execute(w, token)
+		if err != nil {
+			a.logRequestError(r, "error: executing logout template: ", err)
+		}
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	token, _ := session.Values["logouttoken"].(string)
+	formToken := r.PostFormValue("logout_token")
+	if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(formToken)) != 1 {
+		a.logRequestError(r, "error: logout token missing or not valid")
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	// Revoke users authentication, and expire the cookie.
+	if sid, ok := session.Values[sessionKeySID].(string); ok && a.sessions != nil {
+		if err := a.sessions.Delete(sid); err != nil {
+			a.logRequestError(r, "error: deleting session from session store on /logout: ", err)
+		}
+		email, _ := session.Values[sessionKeyEmail].(string)
+		a.watchers.notify(email, "logout")
+	}
+	clearSession(session)
+	a.setTenantCookiePath(r, session.Options)
 
 	err = session.Save(r, w)
 	if err != nil {
-		log.Println("error: session.Save on /logout: ", err)
+		a.logRequestError(r, "error: session.Save on /logout: ", err)
 		return
 	}
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	http.Redirect(w, r, a.tenantPath(r, "/"), http.StatusSeeOther)
+}
+
+//clearSession will delete all the values stored in the session, so no
+// stale identity data like email, id, fullname or state is left behind,
+// and set MaxAge to -1 so the cookie is expired. Stores keeping the
+// session data server side will delete the record with the session ID
+// when saved with a negative MaxAge, so a new session and ID will be
+// created on the next login.
+func clearSession(session *sessions.Session) {
+	for k := range session.Values {
+		delete(session.Values, k)
+	}
+	session.Options.MaxAge = -1
 }
 
 //IsAuthenticated is a wrapper to put around handlers you want
 // to protect with an authenticated user.
 func (a *Auth) IsAuthenticated(h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
+		defer a.recoverPanic(w, r)
+		if a.banned(r) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if frozen, until := a.sessionsFrozen(time.Now()); frozen {
+			a.renderMaintenance(w, r, "maintenance.text", until)
+			return
+		}
+		if a.geoIP != nil && a.geoIP.policy.PerRequest {
+			if ok, _ := a.geoAllowed(r); !ok {
+				a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+				return
+			}
+		}
+
+		//Let probes and scripts through with basic auth, if set.
+		if br, ok := a.basicAuthenticated(w, r); ok || br == nil {
+			if ok {
+				h(w, br)
+			}
+			return
+		}
+
+		//Upgrade sessions with an older layout, and save them so they are
+		// only upgraded once.
 		session, _ := a.store.Get(r, "cookie-name")
-		email, _ := session.Values["email"]
+		migrated, err := a.migrateSession(session)
+		if err != nil {
+			a.logRequestError(r, "error: ", err)
+		}
+		if migrated {
+			if err := session.Save(r, w); err != nil {
+				a.logRequestError(r, "error: session.Save after migration failed: ", err)
+			}
+		}
 
-		// Check if user is authenticated
-		if auth, ok := session.Values["authenticated"].(bool); !ok || !auth {
+		session, ok := a.authenticated(r)
+		if !ok {
+			//Send users who have to accept the terms to the terms page,
+			// and back here after.
+			if a.termsPending(r, session.Values) && r.Method == http.MethodGet {
+				http.Redirect(w, r, a.termsURL(r, r.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			//Tell users who were logged in that they need to log in again.
+			if auth, _ := session.Values[sessionKeyAuthenticated].(bool); auth {
+				a.renderPage(w, r, http.StatusUnauthorized, pageSessionExpired, PageData{LoginURL: a.loginURLReturningTo(r)})
+				return
+			}
 			http.Error(w, "Forbidden", http.StatusForbidden)
 			return
 		}
+		if !a.profileStepsDone(w, r, session) {
+			return
+		}
+		if !a.sessionRiskOK(w, r, session) {
+			return
+		}
+		h(w, a.withSessionUser(r, session.Values))
+	}
+}
+
+//MaybeAuthenticated is a wrapper to put around handlers that can be used
+// both with and without login, like pages showing more to logged in
+// users. The user of the session is given to h in the request context,
+// read with CurrentUser, and requests without a valid session, or with
+// basic auth not valid, are let through without it.
+func (a *Auth) MaybeAuthenticated(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
+		defer a.recoverPanic(w, r)
+
+		if a.banned(r) {
+			h(w, r)
+			return
+		}
+		if frozen, _ := a.sessionsFrozen(time.Now()); frozen {
+			h(w, r)
+			return
+		}
+		if a.geoIP != nil && a.geoIP.policy.PerRequest {
+			if ok, _ := a.geoAllowed(r); !ok {
+				h(w, r)
+				return
+			}
+		}
+
+		//Basic auth not valid is let through without the user, like a
+		// session not valid.
+		if a.hasBasicAuth(r) {
+			if br, ok, _ := a.basicAuthUser(r); ok {
+				h(w, br)
+				return
+			}
+			h(w, r)
+			return
+		}
+
+		session, ok := a.authenticated(r)
+		if !ok {
+			h(w, r)
+			return
+		}
+		if _, pending := a.pendingProfileStep(r, session); pending {
+			h(w, r)
+			return
+		}
+		if a.risk != nil && sessionRisk(session.Values).StepUp {
+			h(w, r)
+			return
+		}
+
+		h(w, a.withSessionUser(r, session.Values))
+	}
+}
+
+//authenticated will return the session, and true if the user of the
+// request is authenticated, the session is not revoked, and the user
+// is not disabled.
+func (a *Auth) authenticated(r *http.Request) (*sessions.Session, bool) {
+	session, _ := a.store.Get(r, "cookie-name")
+	if session.IsNew && a.statelessHeader {
+		if s, ok := a.headerSession(r); ok {
+			session = s
+		}
+	}
 
-		log.Printf("\n--- Authenticated user accessing page is : %v ---\n", email)
+	if _, err := a.migrateSession(session); err != nil {
+		a.logRequestError(r, "error: ", err)
+		return session, false
+	}
+
+	ok, _ := a.checkSession(r, session.Values)
+	if !ok {
+		return session, false
+	}
 
-		h(w, r)
+	// Check that the session belongs to the tenant of the request.
+	if a.tenants != nil {
+		if tenant, _ := session.Values[sessionKeyTenant].(string); tenant != a.tenantID(r) {
+			return session, false
+		}
 	}
+
+	return session, true
+}
+
+//checkSession will check the session values, and return true if the
+// user is authenticated, the session is not revoked, and the user is
+// not disabled. If not, the reason is returned. r is the request the
+// session came with, or nil when checked outside of a request.
+func (a *Auth) checkSession(r *http.Request, values map[interface{}]interface{}) (bool, string) {
+	// Check if user is authenticated
+	if auth, ok := values[sessionKeyAuthenticated].(bool); !ok || !auth {
+		return false, "not authenticated"
+	}
+
+	// Check if the session has expired. The cookie expires in the browser
+	// too, but a copy of the cookie could still be used.
+	if expires, ok := sessionExpiry(values); ok && time.Now().After(expires) {
+		return false, "session is expired"
+	}
+
+	// Check if the session is still active, and not revoked.
+	if a.sessions != nil {
+		sid, _ := values[sessionKeySID].(string)
+		_, ok, err := a.sessions.Get(sid)
+		if err != nil {
+			a.logRequestError(r, "error: session store Get failed: ", err)
+		}
+		if !ok {
+			return false, "session is revoked or expired in the session store"
+		}
+	}
+
+	// Check if the sessions of the user has been revoked after this
+	// session was created.
+	if a.epochs != nil {
+		email, _ := values[sessionKeyEmail].(string)
+		sessionEpoch, _ := values[sessionKeyEpoch].(int64)
+		epoch, err := a.epochs.Get(epochUser(email))
+		if err != nil {
+			a.logRequestError(r, "error: epoch store Get failed: ", err)
+			return false, "failed to get the epoch of the user"
+		}
+		if sessionEpoch < epoch {
+			return false, "session is revoked by the epoch of the user"
+		}
+	}
+
+	// Check if the user is disabled.
+	if a.users != nil {
+		email, _ := values[sessionKeyEmail].(string)
+		u, ok, err := a.users.Get(email)
+		if err != nil {
+			a.logRequestError(r, "error: user store Get failed: ", err)
+		}
+		if ok && u.Disabled {
+			return false, "user is disabled"
+		}
+		if a.terms != nil && (!ok || u.TermsVersion != a.terms.Version) {
+			return false, reasonTermsNotAccepted
+		}
+	}
+
+	return true, ""
+}
+
+//loginAllowed will check the invitations, the allowlist, the user
+// store and the allowlist of the tenant if they are set, and return
+// true if the user with the email is allowed to log in.
+func (a *Auth) loginAllowed(r *http.Request, email string) bool {
+	if ok, _ := a.geoAllowed(r); !ok {
+		logRequestf(r, "info: login refused for %v, location not allowed\n", a.LogIdentifier(email))
+		return false
+	}
+
+	//If invitations are used, only users with a valid invitation for
+	// their email are allowed to log in.
+	if a.invitations != nil {
+		inv, ok, err := a.invitations.Get(email)
+		if err != nil {
+			a.logRequestError(r, "error: invitation store Get failed: ", err)
+		}
+		if !ok || !inv.Valid(time.Now()) {
+			logRequestf(r, "info: login refused for %v, no valid invitation\n", a.LogIdentifier(email))
+			return false
+		}
+		if err := a.invitations.Accept(email); err != nil {
+			a.logRequestError(r, "error: invitation store Accept failed: ", err)
+		}
+	}
+
+	if a.allowList != nil {
+		allowed, err := a.allowList.Allowed(email)
+		if err != nil {
+			a.logRequestError(r, "error: allowlist Allowed failed: ", err)
+		}
+		if !allowed {
+			logRequestf(r, "info: login refused for %v, not on allowlist\n", a.LogIdentifier(email))
+			return false
+		}
+	}
+
+	if a.users != nil {
+		u, ok, err := a.users.Get(email)
+		if err != nil {
+			a.logRequestError(r, "error: user store Get failed: ", err)
+		}
+		if ok && u.Disabled {
+			logRequestf(r, "info: login refused for %v, user is disabled\n", a.LogIdentifier(email))
+			return false
+		}
+	}
+
+	if t, ok := a.Tenant(r); ok && !t.allowed(email) {
+		logRequestf(r, "info: login refused for %v, not on allowlist for tenant %v\n", a.LogIdentifier(email), t.ID)
+		return false
+	}
+
+	return true
+}
+
+//recordLogin will add or update the user in the user store if set, with
+// the personal data tagged as collected from the provider, and the region
+// of the user.
+func (a *Auth) recordLogin(user User, provider string, region string) {
+	if a.users == nil {
+		return
+	}
+
+	now := time.Now()
+	u, ok, err := a.users.Get(user.Email)
+	if err != nil {
+		a.logError("error: user store Get failed: ", err)
+		return
+	}
+	if !ok {
+		u = UserRecord{Email: user.Email, Created: now}
+	}
+	u.ID = user.ID
+	u.FullName = user.FullName
+	u.LastLogin = now
+	u.Region = region
+	if a.privacy.Picture.Purpose != "" {
+		u.Picture = user.Picture
+	}
+	a.privacy.tagPersonalData(&u, personalDataSource(provider), now)
+
+	if err := a.users.Put(u); err != nil {
+		a.logError("error: user store Put failed: ", err)
+	}
+}
+
+//banned will return true if a BanStore is set, and the client IP
+// of the request is banned.
+func (a *Auth) banned(r *http.Request) bool {
+	if a.bans == nil {
+		return false
+	}
+
+	banned, err := a.bans.IsBanned(a.clientIP(r))
+	if err != nil {
+		a.logRequestError(r, "error: ban store IsBanned failed: ", err)
+	}
+	return banned
 }
 
 //newOauthConfig will return a *oauth2.Config with callback url
@@ -143,89 +762,341 @@ func newOauthConfig(proto string, host string, port string, clientIDKey string,
 // We can then check later if that value is present in the cookie to grant
 // access to handlers.
 func (a *Auth) handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
+	//The URL of the callback has the code, so it must not be cached or
+	// sent as the Referer.
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
 	state := r.FormValue("state")
 	code := r.FormValue("code")
 
-	token, err := a.googleOauthConfig.Exchange(oauth2.NoContext, code)
+	//The provider redirects back with an error instead of a code when the
+	// login was not completed, like when the user cancelled the consent.
+	if providerErr := r.FormValue("error"); providerErr != "" {
+		a.funnelStep(FunnelCallback, a.funnelProvider(r), state)
+		a.providerError(w, r, providerErr, r.FormValue("error_description"))
+		return
+	}
+	if a.formPostHandoff(w, r) {
+		return
+	}
+
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in /callback failed: ", err)
+	}
+
+	//Browsers may request the callback again, like on a refresh or a
+	// prefetch. If the session was logged in with the state, the login is
+	// already done, so redirect again instead of using the code twice.
+	if returnTo, ok := a.repeatedCallback(r, session, state); ok {
+		a.safeRedirect(w, r, returnTo, http.StatusSeeOther)
+		return
+	}
+	providerID, _ := session.Values[sessionKeyProvider].(string)
+	a.funnelStep(FunnelCallback, providerID, state)
+
+	//The state can only be used once, by the browser that started the
+	// login, and only within the state TTL.
+	if err := a.consumeState(session, state); err != nil {
+		a.logRequestError(r, "error: callback: ", err)
+		a.events.failure(r, "", err.Error())
+		msg := ""
+		if errors.Is(err, errStateExpired) {
+			msg = a.message(r, "login_failed.state_expired")
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropStateExpired)
+		} else {
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropStateInvalid)
+		}
+		a.renderPage(w, r, http.StatusBadRequest, pageLoginFailed, PageData{Message: msg})
+		return
+	}
+
+	oauthConfig, err := a.providerOauthConfig(r, providerID)
 	if err != nil {
-		log.Println("code exchange failed: ", err.Error())
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+		a.logRequestError(r, "error: callback: ", err)
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropUnknownProvider)
+		http.Error(w, "Not Found", http.StatusNotFound)
+		return
 	}
 
-	fmt.Println("--- state : ", state)
-	fmt.Println("--- code : ", code)
+	token, err := a.exchange(r.Context(), providerID, oauthConfig, code)
+	if err != nil {
+		a.logRequestError(r, "error: code exchange failed: ", err.Error())
+		a.events.failure(r, "", "code exchange failed")
+		if errors.Is(err, ErrProviderUnavailable) {
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropProviderUnavailable)
+			a.renderPage(w, r, http.StatusServiceUnavailable, pageLoginFailed, PageData{Message: a.message(r, "login_failed.provider")})
+			return
+		}
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropExchangeFailed)
+		a.renderPage(w, r, http.StatusUnauthorized, pageLoginFailed, PageData{})
+		return
+	}
 
 	if !token.Valid() {
-		log.Println("error: token not valid in callback function. Token value = ", token.Valid())
+		a.logRequestError(r, "error: token not valid in callback function. Token value = ", token.Valid())
+		a.events.failure(r, "", "token not valid")
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropTokenInvalid)
+		a.renderPage(w, r, http.StatusUnauthorized, pageLoginFailed, PageData{})
 		return
 	}
 
-	//Get information from Google about user logged in.
-	rawUserInfo, err := a.getUserInfo(state, token)
+	//Get information from the provider about user logged in.
+	userInfo, err := a.user(r.Context(), token, providerID)
 	if err != nil {
-		log.Println("error: getUserInfo failed: ", err)
+		a.logRequestError(r, "error: getUserInfo failed: ", err)
+		a.events.failure(r, "", err.Error())
+		switch {
+		case errors.Is(err, ErrProviderUnavailable):
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropProviderUnavailable)
+			a.renderPage(w, r, http.StatusServiceUnavailable, pageLoginFailed, PageData{Message: a.message(r, "login_failed.provider")})
+		case errors.Is(err, ErrInsufficientScope):
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropInsufficientScope)
+			a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{Message: a.message(r, "login_failed.scope")})
+		case errors.Is(err, ErrEmailNotVerified):
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropEmailNotVerified)
+			a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{Message: a.message(r, "login_failed.unverified")})
+		default:
+			a.funnelDrop(FunnelCallback, providerID, state, FunnelDropUserInfoFailed)
+			a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{})
+		}
+		return
 	}
 
-	userInfo := struct {
-		ID            string `json:"id"`
-		Email         string `json:"email"`
-		VerifiedEmail bool   `json:"verified_email"`
-		Picture       string `json:"picture"`
-		FullName      string `json:"name"`
-		FirstName     string `json:"given_name"`
-		LastName      string `json:"family_name"`
-	}{}
-
-	if err := json.Unmarshal(rawUserInfo, &userInfo); err != nil {
-		log.Println("error: marshall of the userInfo failed: ", err)
+	if !a.loginAllowed(r, userInfo.Email) {
+		a.events.failure(r, userInfo.Email, "login not allowed")
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropNotAllowed)
+		a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+		return
+	}
+	if !a.postLogin(r, token, Profile{User: userInfo, Provider: providerID}) {
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropPostLoginRefused)
+		a.renderPage(w, r, http.StatusForbidden, pageAccessDenied, PageData{})
+		return
 	}
-	fmt.Printf("%#v\n", userInfo)
 
 	//If all  checks above were ok, we know the the authentication went ok,
 	// and we can create a session cookie to use from here.
-	session, err := a.store.Get(r, "cookie-name")
+	session.Values[sessionKeyState] = state
+	session.Values["requestedscopes"] = oauthConfig.Scopes
+	session.Values[sessionKeyScopes] = grantedScopes(token, oauthConfig.Scopes)
+	returnTo := a.returnTo(r, session)
+	session.Values["loginreturnto"] = returnTo
+	if err := a.startSession(w, r, session, userInfo, providerID); errors.Is(err, ErrTooManySessions) {
+		a.events.failure(r, userInfo.Email, err.Error())
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropTooManySessions)
+		a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{Message: a.message(r, "login_failed.too_many_sessions")})
+		return
+	} else if errors.Is(err, ErrLoginRiskDenied) {
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropRiskDenied)
+		a.renderPage(w, r, http.StatusForbidden, pageLoginFailed, PageData{Message: a.message(r, "login_failed.risk")})
+		return
+	} else if err != nil {
+		a.logRequestError(r, "error: starting session on /callback: ", err)
+		a.funnelDrop(FunnelCallback, providerID, state, FunnelDropInternalError)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	a.funnelStep(FunnelSessionCreated, providerID, state)
+
+	a.loginSucceeded(w, r, session, userInfo, returnTo)
+
+}
+
+//providerError will handle a redirect back from the provider with an
+// error instead of a code. A cancelled login is sent to the handler set
+// with WithLoginCancelledHandler, or gets the login cancelled page, and
+// other errors get the login failed page.
+func (a *Auth) providerError(w http.ResponseWriter, r *http.Request, code string, description string) {
+	switch code {
+	case "access_denied":
+		logRequestf(r, "info: login cancelled at the provider: %v\n", description)
+		a.events.failure(r, "", "login cancelled")
+		a.funnelDrop(FunnelCallback, a.funnelProvider(r), r.FormValue("state"), FunnelDropCancelled)
+		if a.loginCancelled != nil {
+			a.loginCancelled.ServeHTTP(w, r)
+			return
+		}
+		a.renderPage(w, r, http.StatusOK, pageLoginCancelled, PageData{})
+	case "server_error", "temporarily_unavailable":
+		a.logRequestError(r, "error: provider returned error: ", code, ": ", description)
+		a.events.failure(r, "", "provider error: "+code)
+		a.funnelDrop(FunnelCallback, a.funnelProvider(r), r.FormValue("state"), FunnelDropProviderUnavailable)
+		a.renderPage(w, r, http.StatusBadGateway, pageLoginFailed, PageData{Message: a.message(r, "login_failed.provider")})
+	default:
+		a.logRequestError(r, "error: provider returned error: ", code, ": ", description)
+		a.events.failure(r, "", "provider error: "+code)
+		a.funnelDrop(FunnelCallback, a.funnelProvider(r), r.FormValue("state"), FunnelDropProviderError)
+		a.renderPage(w, r, http.StatusUnauthorized, pageLoginFailed, PageData{})
+	}
+}
+
+//startSession will mark the session as authenticated for the user, save
+// it, and add it to the session store. It is called when the user has
+// logged in with the provider, and all the checks are done.
+func (a *Auth) startSession(w http.ResponseWriter, r *http.Request, session *sessions.Session, userInfo User, provider string) error {
+	if err := a.enforceSessionLimit(userInfo.Email); err != nil {
+		return err
+	}
+	risk, err := a.loginRisk(r, userInfo.Email)
+	if err != nil {
+		return err
+	}
+	region, err := a.loginRegion(r, userInfo)
+	if err != nil {
+		return err
+	}
+
+	//Create an ID for the session, so it can be found in the session store.
+	sid, err := a.newKey(16, KeyBase64URLPadded)
 	if err != nil {
-		log.Println("error: store.Get in /login failed: ", err)
+		return fmt.Errorf("failed to create session id: %v", err)
 	}
+	sid = regionalSessionID(region, sid)
 
 	//set the session values to put into the cookie.
-	session.Values["authenticated"] = true
-	session.Values["id"] = userInfo.ID
-	session.Values["fullname"] = userInfo.FullName
-	session.Values["email"] = userInfo.Email
-	session.Values["state"] = state
+	if err := a.resolveRoles(r, &userInfo); err != nil {
+		return fmt.Errorf("roles resolver failed: %v", err)
+	}
+	s := &Session{s: session}
+	s.SetUser(userInfo)
+	storeRoles, storePermissions := a.guardRolesSize(r, s, userInfo)
+	session.Values[sessionKeyVersion] = a.sessionVersion
+	session.Values[sessionKeySID] = sid
+	if a.tenants != nil {
+		session.Values[sessionKeyTenant] = a.tenantID(r)
+	}
+	if a.epochs != nil {
+		epoch, err := a.epochs.Get(epochUser(userInfo.Email))
+		if err != nil {
+			return fmt.Errorf("epoch store Get failed: %v", err)
+		}
+		session.Values[sessionKeyEpoch] = epoch
+	}
+	location := a.sessionLocation(a.clientIP(r))
+	if location != "" {
+		session.Values[sessionKeyLocation] = location
+	}
+	if region != "" {
+		session.Values[sessionKeyRegion] = region
+	}
+	if a.risk != nil {
+		risk.set(session.Values)
+	}
 
 	//set token expire to 8 hours.
-	session.Options = &sessions.Options{MaxAge: 60 * 60 * 8}
+	session.Options = &sessions.Options{MaxAge: sessionMaxAge}
+	session.Values[sessionKeyExpires] = time.Now().Add(sessionMaxAge * time.Second).Unix()
+	a.setTenantCookiePath(r, session.Options)
 	err = session.Save(r, w)
 	if err != nil {
-		log.Println("error: session.Save on /login: ", err)
-		return
+		return fmt.Errorf("session.Save failed: %v", err)
 	}
 
-	http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
+	if a.sessions != nil {
+		now := time.Now()
+		tenant, _ := session.Values[sessionKeyTenant].(string)
+		err := a.sessions.Add(SessionInfo{
+			ID:          sid,
+			UserID:      userInfo.ID,
+			Email:       userInfo.Email,
+			IP:          a.clientIP(r),
+			UserAgent:   r.UserAgent(),
+			Tenant:      tenant,
+			Created:     now,
+			Expires:     now.Add(time.Duration(session.Options.MaxAge) * time.Second),
+			Device:      deviceName(r.UserAgent()),
+			Location:    location,
+			Roles:       storeRoles,
+			Permissions: storePermissions,
+			Risk:        risk.Score,
+			Region:      region,
+		})
+		if err != nil {
+			a.logRequestError(r, "error: session store Add failed: ", err)
+		}
+	}
 
-}
+	a.recordLogin(userInfo, provider, region)
+	a.events.success(r, userInfo.Email, risk.Score)
 
-//getUserInfo will get the information defined in 'scopes',
-// and return the values as a []byte.
-func (a *Auth) getUserInfo(state string, token *oauth2.Token) ([]byte, error) {
-	if state != a.oauthStateString {
-		return nil, fmt.Errorf("invalid oauth state")
+	//Keep the groups at login in the background, so a change before the
+	// next group sync is found without slowing down the login.
+	if a.groupSync != nil {
+		go func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := a.groupSync.remember(ctx, userInfo.Email); err != nil {
+				a.logRequestError(r, "error: group sync: resolving the groups of "+a.LogIdentifier(userInfo.Email)+" failed: ", err)
+			}
+		}()
 	}
 
-	fmt.Println("Token expire, ", token.Expiry)
+	return nil
+}
 
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
-	if err != nil {
-		return nil, fmt.Errorf("failed getting user info: %s", err.Error())
+//User is the information about the user logged in, as given by the provider.
+type User struct {
+	ID            string `json:"id"`
+	Email         string `json:"email"`
+	VerifiedEmail bool   `json:"verified_email"`
+	Picture       string `json:"picture"`
+	FullName      string `json:"name"`
+	FirstName     string `json:"given_name"`
+	LastName      string `json:"family_name"`
+	//Roles and Permissions are given by the provider in the roles and
+	// permissions claims, by LDAP, or by the resolver set with
+	// WithRolesResolver. They are kept in the session.
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+}
+
+//user will get the information about the user logged in from the
+// provider with the id, or from Google if id is empty. The email must be
+// verified by the provider, and the users of providers registered at
+// runtime are prefixed with the id of the provider.
+func (a *Auth) user(ctx context.Context, token *oauth2.Token, providerID string) (User, error) {
+	if providerID == "" {
+		u, err := a.getUserInfo(ctx, token)
+		if err == nil && !u.VerifiedEmail {
+			return User{}, ErrEmailNotVerified
+		}
+		return u, err
 	}
 
-	defer response.Body.Close()
-	contents, err := ioutil.ReadAll(response.Body)
+	u, err := a.getProviderUserInfo(ctx, token, providerID)
 	if err != nil {
-		return nil, fmt.Errorf("failed reading response body: %s", err.Error())
+		return User{}, err
+	}
+	if !u.VerifiedEmail {
+		return User{}, ErrEmailNotVerified
+	}
+	return providerUser(providerID, u), nil
+}
+
+//getProviderUserInfo will get the claims about the user from the OpenID
+// Connect UserInfo endpoint of the provider with the id.
+func (a *Auth) getProviderUserInfo(ctx context.Context, token *oauth2.Token, providerID string) (User, error) {
+	p, ok, err := a.providers.Get(providerID)
+	if err != nil || !ok {
+		return User{}, fmt.Errorf("unknown provider %q: %v", providerID, err)
+	}
+	if p.UserInfoURL == "" {
+		return User{}, fmt.Errorf("provider %q has no userinfo endpoint", providerID)
 	}
 
-	return contents, nil
+	return fetchUserInfo(ctx, a.providerHTTPClient(p), p.UserInfoURL, token)
+}
+
+//getUserInfo will get the claims about the user from the OpenID Connect
+// UserInfo endpoint of Google, found in the discovery document.
+func (a *Auth) getUserInfo(ctx context.Context, token *oauth2.Token) (User, error) {
+	return fetchUserInfo(ctx, a.providerClient(), a.googleUserInfoEndpoint(ctx), token)
 }
@@ -0,0 +1,60 @@
+package authsession
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMaybeAuthenticatedBasicAuth(t *testing.T) {
+	hash, err := PBKDF2PasswordHash("pw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret",
+		WithBasicAuth(BasicCredential{User: "probe", PasswordHash: hash, Paths: []string{"/metrics"}}))
+
+	tests := []struct {
+		name     string
+		path     string
+		password string
+		user     string
+	}{
+		{"valid", "/metrics", "pw", "probe"},
+		{"wrong password", "/metrics", "wrong", ""},
+		{"other path", "/other", "pw", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			var user string
+			h := a.MaybeAuthenticated(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				u, _ := CurrentUser(r.Context())
+				user = u.Email
+			})
+
+			r := httptest.NewRequest("GET", tt.path, nil)
+			r.SetBasicAuth("probe", tt.password)
+			w := httptest.NewRecorder()
+			h(w, r)
+			if !called {
+				t.Fatalf("h was not called, got status %v", w.Code)
+			}
+			if w.Code != http.StatusOK || user != tt.user {
+				t.Fatalf("got status %v and user %q, want 200 and %q", w.Code, user, tt.user)
+			}
+		})
+	}
+
+	//IsAuthenticated still refuses the credentials not valid.
+	r := httptest.NewRequest("GET", "/metrics", nil)
+	r.SetBasicAuth("probe", "wrong")
+	w := httptest.NewRecorder()
+	a.IsAuthenticated(func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("h was called")
+	})(w, r)
+	if w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Fatalf("got status %v", w.Code)
+	}
+}
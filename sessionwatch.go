@@ -0,0 +1,168 @@
+package authsession
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//sessionWatchInterval is how often a watched session is checked again,
+// which is also how soon a revoke done by another instance is seen.
+const sessionWatchInterval = 30 * time.Second
+
+//sessionWatchers keeps the open session event streams of each user, so
+// they can be told to check the session again right away when the
+// sessions of the user are revoked by this instance.
+type sessionWatchers struct {
+	mu       sync.Mutex
+	watchers map[string]map[chan string]struct{}
+}
+
+func newSessionWatchers() *sessionWatchers {
+	return &sessionWatchers{watchers: make(map[string]map[chan string]struct{})}
+}
+
+//add will return a channel getting the reason when the sessions of the
+// user with the email change.
+func (s *sessionWatchers) add(email string) chan string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ch := make(chan string, 1)
+	key := strings.ToLower(email)
+	if s.watchers[key] == nil {
+		s.watchers[key] = make(map[chan string]struct{})
+	}
+	s.watchers[key][ch] = struct{}{}
+	return ch
+}
+
+//remove will remove the channel added with add.
+func (s *sessionWatchers) remove(email string, ch chan string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := strings.ToLower(email)
+	delete(s.watchers[key], ch)
+	if len(s.watchers[key]) == 0 {
+		delete(s.watchers, key)
+	}
+}
+
+//notify will tell the streams of the user with the email to check the
+// session again, with the reason for the change. Streams already told
+// are not waited for.
+func (s *sessionWatchers) notify(email string, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for ch := range s.watchers[strings.ToLower(email)] {
+		select {
+		case ch <- reason:
+		default:
+		}
+	}
+}
+
+//sessionEvents will stream Server-Sent Events about the session of the
+// request to a frontend, so open tabs can lock the UI right away. A
+// status event with the SessionStatus is sent at the start and when the
+// session is extended, and the stream ends with an expired event when the
+// session expires, or a revoked event with the reason when the session is
+// revoked, the user is disabled, or the groups of the user have changed.
+func (a *Auth) sessionEvents(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	session, ok := a.authenticated(r)
+	if !ok {
+		a.writeJSONMessage(w, r, http.StatusUnauthorized, "error.no_session")
+		return
+	}
+	rc := http.NewResponseController(w)
+	email, _ := session.Values[sessionKeyEmail].(string)
+	sid, _ := session.Values[sessionKeySID].(string)
+
+	ch := a.watchers.add(email)
+	defer a.watchers.remove(email, ch)
+
+	//The stream is kept open longer than the write timeout of the server.
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	send := func(event string, data interface{}) bool {
+		b, err := json.Marshal(data)
+		if err != nil {
+			a.logRequestError(r, "error: session events: ", err)
+			return false
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	//The session values are the ones of the cookie when the stream was
+	// opened, so the expiry is read from the session store when used,
+	// since the session can be extended by other tabs.
+	expires, _ := sessionExpiry(session.Values)
+	currentExpiry := func() time.Time {
+		if a.sessions != nil {
+			si, ok, err := a.sessions.Get(sid)
+			if err == nil && ok && !si.Expires.IsZero() {
+				return si.Expires.Truncate(time.Second)
+			}
+		}
+		return expires
+	}
+
+	status := func() SessionStatus {
+		if expires.IsZero() {
+			return SessionStatus{Authenticated: true}
+		}
+		return newSessionStatus(expires)
+	}
+	if !send("status", status()) {
+		return
+	}
+
+	ticker := time.NewTicker(sessionWatchInterval)
+	defer ticker.Stop()
+	for {
+		reason := ""
+		select {
+		case <-r.Context().Done():
+			return
+		case reason = <-ch:
+		case <-ticker.C:
+		}
+
+		if e := currentExpiry(); !e.Equal(expires) {
+			expires = e
+			session.Values[sessionKeyExpires] = e.Unix()
+			if !send("status", status()) {
+				return
+			}
+		}
+		if !expires.IsZero() && time.Now().After(expires) {
+			send("expired", map[string]string{})
+			return
+		}
+		if ok, why := a.checkSession(r, session.Values); !ok {
+			if reason == "" {
+				reason = why
+			}
+			send("revoked", map[string]string{"reason": reason})
+			return
+		}
+
+		if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil || rc.Flush() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,164 @@
+package authsession
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//signedURLPath is where the signed URLs are verified for a proxy, like
+// with the auth_request of nginx.
+const signedURLPath = "/auth/signed-url"
+
+//signedURLParam is the query parameter holding the signature of a
+// signed URL. It is always the last parameter of the URL.
+const signedURLParam = "sig"
+
+//signedURLValue is the value signed by SignURL.
+type signedURLValue struct {
+	Path    string
+	User    string
+	Epoch   int64
+	Expires int64
+}
+
+//SignURL will return the local path p with a signature for the user
+// added, so the file or asset at p can be downloaded by the user for the
+// ttl, without a session cookie and without the app serving it. The
+// signed URL stops working when the sessions of the user are revoked
+// with the epoch store, or the user is disabled. p is signed as it is,
+// so it must be escaped as it will be requested, and can have a query.
+func (a *Auth) SignURL(user string, p string, ttl time.Duration) (string, error) {
+	if !isLocalPath(p) || strings.Contains(p, "#") {
+		return "", errors.New("signed url must be a local path")
+	}
+	if ttl <= 0 || ttl > cookieMaxAge*time.Second {
+		return "", errors.New("signed url ttl must be more than 0 and at most 30 days")
+	}
+
+	var epoch int64
+	if a.epochs != nil {
+		var err error
+		epoch, err = a.epochs.Get(epochUser(user))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	value, err := a.codec.Encode("signedurl", signedURLValue{
+		Path:    p,
+		User:    user,
+		Epoch:   epoch,
+		Expires: time.Now().Add(ttl).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	sep := "?"
+	if strings.Contains(p, "?") {
+		sep = "&"
+	}
+	return p + sep + signedURLParam + "=" + url.QueryEscape(value), nil
+}
+
+//VerifySignedURL will return the user of the request uri signed with
+// SignURL, and false if the signature is not valid, has expired, or the
+// user is revoked or disabled.
+func (a *Auth) VerifySignedURL(uri string) (string, bool) {
+	return a.verifySignedURL(nil, uri)
+}
+
+//verifySignedURL will verify the signed uri like VerifySignedURL, with
+// the errors logged for the request r, which can be nil.
+func (a *Auth) verifySignedURL(r *http.Request, uri string) (string, bool) {
+	i := strings.LastIndex(uri, signedURLParam+"=")
+	if i < 1 || (uri[i-1] != '?' && uri[i-1] != '&') {
+		return "", false
+	}
+	value, err := url.QueryUnescape(uri[i+len(signedURLParam)+1:])
+	if err != nil {
+		return "", false
+	}
+
+	var v signedURLValue
+	if err := a.codec.Decode("signedurl", value, &v); err != nil {
+		return "", false
+	}
+	if time.Now().Unix() > v.Expires || v.Path != uri[:i-1] {
+		return "", false
+	}
+
+	if a.userRevoked(r, v.User, v.Epoch) {
+		return "", false
+	}
+
+	return v.User, true
+}
+
+//userRevoked will return true if the sessions of the user have been
+// revoked after the epoch, or the user is disabled, for the values
+// signed for a user that are used without the session. The errors are
+// logged for the request r, which can be nil.
+func (a *Auth) userRevoked(r *http.Request, user string, epoch int64) bool {
+	if a.epochs != nil {
+		current, err := a.epochs.Get(epochUser(user))
+		if err != nil {
+			a.logRequestError(r, "error: epoch store Get failed: ", err)
+			return true
+		}
+		if epoch < current {
+			return true
+		}
+	}
+	if a.users != nil {
+		u, ok, err := a.users.Get(user)
+		if err != nil {
+			a.logRequestError(r, "error: user store Get failed: ", err)
+		}
+		if ok && u.Disabled {
+			return true
+		}
+	}
+	return false
+}
+
+//RequireSignedURL is a wrapper to put around handlers serving files or
+// assets that are only to be given to the URLs signed with SignURL. The
+// user the URL was signed for is in the X-Auth-User header of the request.
+func (a *Auth) RequireSignedURL(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = withRequestID(w, r)
+		defer a.recoverPanic(w, r)
+
+		user, ok := a.verifySignedURL(r, r.URL.RequestURI())
+		if !ok {
+			a.logRequestError(r, "error: signed url not valid or expired: ", r.URL.Path)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		r.Header.Set("X-Auth-User", user)
+		h.ServeHTTP(w, r)
+	})
+}
+
+//signedURLAuth will verify the signed URL in the X-Original-URI header,
+// for a proxy serving the files, like nginx with auth_request. The status
+// is 200 with the user in the X-Auth-User header if valid, and 403 if not.
+func (a *Auth) signedURLAuth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	uri := r.Header.Get("X-Original-URI")
+	user, ok := a.verifySignedURL(r, uri)
+	if !ok {
+		a.logRequestError(r, "error: signed url not valid or expired")
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	w.Header().Set("X-Auth-User", user)
+	w.WriteHeader(http.StatusOK)
+}
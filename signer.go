@@ -0,0 +1,68 @@
+package authsession
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+)
+
+//Signer signs the JWTs made by the package with RS256, like the ID
+// tokens and access tokens of the issuer, the client assertions and the
+// request objects. It lets the key be kept in a key management service,
+// like Google Cloud KMS, AWS KMS or the Vault transit engine, so the
+// private key never is in the memory of the process or on disk.
+type Signer interface {
+	//PublicKey will return the public key of the signing key, which is
+	// published in the JWKS of the issuer.
+	PublicKey() *rsa.PublicKey
+	//Sign will return the RSASSA-PKCS1-v1_5 signature of the SHA-256
+	// digest.
+	Sign(digest []byte) ([]byte, error)
+}
+
+//keySigner is a Signer using a private key in memory.
+type keySigner struct {
+	key *rsa.PrivateKey
+}
+
+//KeySigner will return a Signer signing with the private key in memory.
+func KeySigner(key *rsa.PrivateKey) Signer {
+	return keySigner{key: key}
+}
+
+//PublicKey will return the public key of the key.
+func (k keySigner) PublicKey() *rsa.PublicKey {
+	return &k.key.PublicKey
+}
+
+//Sign will return the signature of the digest.
+func (k keySigner) Sign(digest []byte) ([]byte, error) {
+	return rsa.SignPKCS1v15(rand.Reader, k.key, crypto.SHA256, digest)
+}
+
+//parseRSAPublicKey will return the RSA public key of the PKIX DER, like
+// given by a key management service.
+func parseRSAPublicKey(der []byte) (*rsa.PublicKey, error) {
+	pub, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing public key: %v", err)
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key is a %T, and not an RSA key", pub)
+	}
+	return rsaPub, nil
+}
+
+//parseRSAPublicKeyPEM will return the RSA public key of the PEM.
+func parseRSAPublicKeyPEM(s string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(s))
+	if block == nil {
+		return nil, errors.New("public key is not PEM")
+	}
+	return parseRSAPublicKey(block.Bytes)
+}
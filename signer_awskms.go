@@ -0,0 +1,127 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//AWSKMSSigner is a Signer signing with an asymmetric key in AWS KMS,
+// using the KMS API. The key must be an RSA key with the key usage
+// SIGN_VERIFY.
+type AWSKMSSigner struct {
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	keyID           string
+	client          *http.Client
+	endpoint        string
+	timeout         time.Duration
+	public          *rsa.PublicKey
+}
+
+//NewAWSKMSSigner will return an *AWSKMSSigner signing with the key with
+// the keyID, which can be the ID, the ARN or an alias of the key, in the
+// AWS region. The requests are signed with the access key. sessionToken
+// is only needed for temporary credentials, and can be empty. The public
+// key is read at once.
+func NewAWSKMSSigner(region string, accessKeyID string, secretAccessKey string, sessionToken string, keyID string) (*AWSKMSSigner, error) {
+	k := &AWSKMSSigner{
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    sessionToken,
+		keyID:           keyID,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		endpoint:        "https://kms." + region + ".amazonaws.com",
+		timeout:         10 * time.Second,
+	}
+
+	var resp struct {
+		PublicKey string `json:"PublicKey"`
+	}
+	if err := k.call("GetPublicKey", map[string]interface{}{}, &resp); err != nil {
+		return nil, err
+	}
+	der, err := base64.StdEncoding.DecodeString(resp.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("aws kms key %v: public key is not valid base64: %v", keyID, err)
+	}
+	if k.public, err = parseRSAPublicKey(der); err != nil {
+		return nil, fmt.Errorf("aws kms key %v: %v", keyID, err)
+	}
+	return k, nil
+}
+
+//call will do the KMS API action with the body, and decode the response
+// into v.
+func (k *AWSKMSSigner) call(action string, body map[string]interface{}, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), k.timeout)
+	defer cancel()
+
+	body["KeyId"] = k.keyID
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, k.endpoint+"/", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	signV4(req, b, k.region, "kms", k.accessKeyID, k.secretAccessKey, k.sessionToken, time.Now())
+
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("aws kms %s failed: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		rb, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(rb, &e)
+		_, typ, _ := strings.Cut(e.Type, "#")
+		if typ == "" {
+			typ = e.Type
+		}
+		return fmt.Errorf("aws kms %s failed: %v: %v %v", action, resp.Status, typ, e.Message)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed parsing aws kms %s response: %v", action, err)
+	}
+	return nil
+}
+
+//PublicKey will return the public key of the key.
+func (k *AWSKMSSigner) PublicKey() *rsa.PublicKey {
+	return k.public
+}
+
+//Sign will return the signature of the digest, made by KMS.
+func (k *AWSKMSSigner) Sign(digest []byte) ([]byte, error) {
+	var resp struct {
+		Signature string `json:"Signature"`
+	}
+	body := map[string]interface{}{
+		"Message":          base64.StdEncoding.EncodeToString(digest),
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "RSASSA_PKCS1_V1_5_SHA_256",
+	}
+	if err := k.call("Sign", body, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
@@ -0,0 +1,107 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//GCPKMSSigner is a Signer signing with a key version in Google Cloud KMS,
+// using the Cloud KMS REST API. The key must have the algorithm
+// RSA_SIGN_PKCS1_2048_SHA256, or the 3072 or 4096 bit variant.
+type GCPKMSSigner struct {
+	client  *http.Client
+	name    string
+	public  *rsa.PublicKey
+	timeout time.Duration
+}
+
+//NewGCPKMSSigner will return a *GCPKMSSigner signing with the key version
+// name, like
+// "projects/p/locations/global/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+// doing the requests with tokens from ts, which must have the cloudkms
+// scope. The public key is read at once.
+func NewGCPKMSSigner(ts oauth2.TokenSource, name string) (*GCPKMSSigner, error) {
+	g := &GCPKMSSigner{
+		client:  oauth2.NewClient(context.Background(), ts),
+		name:    name,
+		timeout: 10 * time.Second,
+	}
+
+	var resp struct {
+		PEM string `json:"pem"`
+	}
+	if err := g.do(http.MethodGet, "/publicKey", nil, &resp); err != nil {
+		return nil, err
+	}
+	pub, err := parseRSAPublicKeyPEM(resp.PEM)
+	if err != nil {
+		return nil, fmt.Errorf("cloud kms key %v: %v", name, err)
+	}
+	g.public = pub
+	return g, nil
+}
+
+//do will do the request for the key version to the Cloud KMS API, and
+// decode the response into v.
+func (g *GCPKMSSigner) do(method string, path string, body interface{}, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, "https://cloudkms.googleapis.com/v1/"+g.name+path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := g.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("cloud kms request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cloud kms request failed: %v", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed parsing cloud kms response: %v", err)
+	}
+	return nil
+}
+
+//PublicKey will return the public key of the key version.
+func (g *GCPKMSSigner) PublicKey() *rsa.PublicKey {
+	return g.public
+}
+
+//Sign will return the signature of the digest, made by Cloud KMS.
+func (g *GCPKMSSigner) Sign(digest []byte) ([]byte, error) {
+	var resp struct {
+		Signature string `json:"signature"`
+	}
+	body := map[string]interface{}{
+		"digest": map[string]string{"sha256": base64.StdEncoding.EncodeToString(digest)},
+	}
+	if err := g.do(http.MethodPost, ":asymmetricSign", body, &resp); err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Signature)
+}
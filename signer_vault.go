@@ -0,0 +1,144 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//VaultTransitSigner is a Signer signing with a key in the transit secrets
+// engine of HashiCorp Vault. The key must be of the type rsa-2048,
+// rsa-3072 or rsa-4096. The latest version of the key is used, so the key
+// must be read again with a new signer when rotated in Vault.
+type VaultTransitSigner struct {
+	client  *http.Client
+	addr    string
+	token   string
+	mount   string
+	key     string
+	version int
+	public  *rsa.PublicKey
+	timeout time.Duration
+}
+
+//NewVaultTransitSigner will return a *VaultTransitSigner signing with the
+// key of the transit engine at mount, like "transit", of the Vault at
+// addr, like "https://vault.example.com:8200", authenticated with token.
+// The public key of the latest version is read at once.
+func NewVaultTransitSigner(addr string, token string, mount string, key string) (*VaultTransitSigner, error) {
+	v := &VaultTransitSigner{
+		client:  &http.Client{Timeout: 10 * time.Second},
+		addr:    strings.TrimSuffix(addr, "/"),
+		token:   token,
+		mount:   strings.Trim(mount, "/"),
+		key:     key,
+		timeout: 10 * time.Second,
+	}
+
+	var resp struct {
+		Data struct {
+			LatestVersion int `json:"latest_version"`
+			Keys          map[string]struct {
+				PublicKey string `json:"public_key"`
+			} `json:"keys"`
+		} `json:"data"`
+	}
+	if err := v.do(http.MethodGet, "/keys/"+url.PathEscape(key), nil, &resp); err != nil {
+		return nil, err
+	}
+	latest, ok := resp.Data.Keys[strconv.Itoa(resp.Data.LatestVersion)]
+	if !ok {
+		return nil, fmt.Errorf("vault transit key %v: no public key for the latest version", key)
+	}
+	pub, err := parseRSAPublicKeyPEM(latest.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("vault transit key %v: %v", key, err)
+	}
+	v.version = resp.Data.LatestVersion
+	v.public = pub
+	return v, nil
+}
+
+//do will do the request to the transit engine, and decode the response
+// into out.
+func (v *VaultTransitSigner) do(method string, path string, body interface{}, out interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), v.timeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, v.addr+"/v1/"+v.mount+path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", v.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := v.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("vault request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Errors []string `json:"errors"`
+		}
+		rb, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(rb, &e)
+		return fmt.Errorf("vault request failed: %v %v", resp.Status, strings.Join(e.Errors, ", "))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed parsing vault response: %v", err)
+	}
+	return nil
+}
+
+//PublicKey will return the public key of the latest version of the key.
+func (v *VaultTransitSigner) PublicKey() *rsa.PublicKey {
+	return v.public
+}
+
+//Sign will return the signature of the digest, made by Vault with the
+// version of the key read when the signer was made.
+func (v *VaultTransitSigner) Sign(digest []byte) ([]byte, error) {
+	var resp struct {
+		Data struct {
+			Signature string `json:"signature"`
+		} `json:"data"`
+	}
+	body := map[string]interface{}{
+		"input":               base64.StdEncoding.EncodeToString(digest),
+		"prehashed":           true,
+		"signature_algorithm": "pkcs1v15",
+		"key_version":         v.version,
+	}
+	if err := v.do(http.MethodPost, "/sign/"+url.PathEscape(v.key)+"/sha2-256", body, &resp); err != nil {
+		return nil, err
+	}
+
+	//The signature is like "vault:v1:base64".
+	parts := strings.SplitN(resp.Data.Signature, ":", 3)
+	if len(parts) != 3 || parts[0] != "vault" {
+		return nil, errors.New("vault signature has an unknown format")
+	}
+	return base64.StdEncoding.DecodeString(parts[2])
+}
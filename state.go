@@ -0,0 +1,282 @@
+package authsession
+
+import (
+	"container/list"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	//defaultPendingLogins is the max number of logins pending overall,
+	// set with WithPendingLoginLimits.
+	defaultPendingLogins = 10000
+	//defaultPendingLoginsPerIP is the max number of logins pending for
+	// each IP, set with WithPendingLoginLimits.
+	defaultPendingLoginsPerIP = 20
+)
+
+//defaultStateTTL is how long the user has to log in with the provider,
+// from /slogin to the callback, set with WithStateTTL.
+const defaultStateTTL = 10 * time.Minute
+
+var (
+	//errStateInvalid is returned when the state of the callback is not
+	// the state of the login started in the browser, or has been used.
+	errStateInvalid = errors.New("oauth state is not valid, or has already been used")
+	//errStateExpired is returned when the login took longer than the TTL.
+	errStateExpired = errors.New("oauth state has expired")
+)
+
+//LoginStateStore keeps the states of the logins started and not finished
+// yet, set with WithLoginStateStore, so each state can only be used once
+// by a callback on any instance of the server. Without it the states are
+// kept in the memory of the instance, and the callback must be served by
+// the instance the login was started on, like with sticky sessions.
+type LoginStateStore interface {
+	//Add will add the state of a login started, expiring after ttl.
+	Add(state string, ttl time.Duration) error
+	//Consume will remove the state, and return true if it was pending.
+	// Only one of concurrent calls for a state can return true.
+	Consume(state string) (bool, error)
+}
+
+//pendingLogins are the states of the logins started and not finished
+// yet, so each state can only be used once by a callback. The number of
+// pending logins is capped for each IP and overall, and the oldest are
+// evicted when full, so abandoned logins can't use up the memory.
+type pendingLogins struct {
+	mu     sync.Mutex
+	total  int
+	perIP  int
+	order  *list.List
+	states map[string]*list.Element
+	ips    map[string]int
+	stats  PendingLoginStats
+}
+
+//pendingLogin is a login started, kept in the order they were started.
+type pendingLogin struct {
+	state   string
+	ip      string
+	created time.Time
+}
+
+//PendingLoginStats are the counts of the logins started and not finished,
+// returned by the debug endpoint.
+type PendingLoginStats struct {
+	//Pending is the number of logins started, where the callback is not
+	// yet done.
+	Pending int `json:"pending"`
+	//Started is the number of logins started.
+	Started uint64 `json:"started"`
+	//Expired is the number of logins removed since the callback was not
+	// done within the state TTL.
+	Expired uint64 `json:"expired"`
+	//EvictedIP is the number of logins evicted since the IP had too many
+	// logins pending.
+	EvictedIP uint64 `json:"evictedIP"`
+	//EvictedTotal is the number of logins evicted since too many logins
+	// were pending overall.
+	EvictedTotal uint64 `json:"evictedTotal"`
+}
+
+//newPendingLogins will return a *pendingLogins keeping at most total
+// logins, and at most perIP logins for each IP.
+func newPendingLogins(total int, perIP int) *pendingLogins {
+	return &pendingLogins{
+		total:  total,
+		perIP:  perIP,
+		order:  list.New(),
+		states: make(map[string]*list.Element),
+		ips:    make(map[string]int),
+	}
+}
+
+//add will add the state of a login started from the ip, and remove the
+// states older than ttl. If the ip or the store is full, the oldest login
+// of the ip, or the oldest login overall, is evicted. An empty ip, when
+// a trusted proxy doesn't tell the client, is not capped, since it would
+// be shared by all the users behind the proxy.
+func (p *pendingLogins) add(state string, ip string, ttl time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	for e := p.order.Front(); e != nil && now.Sub(e.Value.(*pendingLogin).created) > ttl; e = p.order.Front() {
+		p.remove(e)
+		p.stats.Expired++
+	}
+
+	if ip != "" && p.ips[ip] >= p.perIP {
+		for e := p.order.Front(); e != nil; e = e.Next() {
+			if e.Value.(*pendingLogin).ip == ip {
+				p.remove(e)
+				p.stats.EvictedIP++
+				break
+			}
+		}
+	}
+	for p.order.Len() >= p.total && p.order.Len() > 0 {
+		p.remove(p.order.Front())
+		p.stats.EvictedTotal++
+	}
+
+	p.states[state] = p.order.PushBack(&pendingLogin{state: state, ip: ip, created: now})
+	if ip != "" {
+		p.ips[ip]++
+	}
+	p.stats.Started++
+}
+
+//cleanup will remove the logins older than ttl at now, and return the
+// number removed.
+func (p *pendingLogins) cleanup(now time.Time, ttl time.Duration) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var n int
+	for e := p.order.Front(); e != nil && now.Sub(e.Value.(*pendingLogin).created) > ttl; e = p.order.Front() {
+		p.remove(e)
+		p.stats.Expired++
+		n++
+	}
+	return n
+}
+
+//remove will remove the login. The lock must be held.
+func (p *pendingLogins) remove(e *list.Element) {
+	l := p.order.Remove(e).(*pendingLogin)
+	delete(p.states, l.state)
+	if l.ip == "" {
+		return
+	}
+	p.ips[l.ip]--
+	if p.ips[l.ip] <= 0 {
+		delete(p.ips, l.ip)
+	}
+}
+
+//consume will remove the state, and return when it was created and true
+// if it was pending.
+func (p *pendingLogins) consume(state string) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e, ok := p.states[state]
+	if !ok {
+		return time.Time{}, false
+	}
+	created := e.Value.(*pendingLogin).created
+	p.remove(e)
+	return created, true
+}
+
+//len will return the number of pending logins.
+func (p *pendingLogins) len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.order.Len()
+}
+
+//statistics will return the counts of the pending logins.
+func (p *pendingLogins) statistics() PendingLoginStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.Pending = p.order.Len()
+	return stats
+}
+
+//newState will create the state for a login, remember it as pending, and
+// store it in the session so the callback is bound to the browser that
+// started the login.
+func (a *Auth) newState(r *http.Request, session *sessions.Session) (string, error) {
+	state, err := a.newKey(16, KeyBase64URLPadded)
+	if err != nil {
+		return "", fmt.Errorf("failed to create state string: %v", err)
+	}
+
+	if a.loginStates != nil {
+		if err := a.loginStates.Add(state, a.stateTTL); err != nil {
+			return "", fmt.Errorf("login state store Add failed: %v", err)
+		}
+	} else {
+		//When a trusted proxy doesn't tell the client, all its users
+		// would share its IP, and could evict the logins of each other.
+		ip, ok := a.resolveClientIP(r)
+		if !ok {
+			ip = ""
+		}
+		a.pending.add(state, ip, a.stateTTL)
+	}
+	session.Values["loginstate"] = state
+	session.Values["loginstarted"] = time.Now().Unix()
+	return state, nil
+}
+
+//consumeState will check that the state given to the callback is the
+// state of the login started in the session, that it is not too old, and
+// that it has not been used before. The state is removed, so it can never
+// be used again.
+func (a *Auth) consumeState(session *sessions.Session, state string) error {
+	expected, _ := session.Values["loginstate"].(string)
+	started, _ := session.Values["loginstarted"].(int64)
+	delete(session.Values, "loginstate")
+	delete(session.Values, "loginstarted")
+
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(expected)) != 1 {
+		return errStateInvalid
+	}
+	pending, err := a.consumePending(state)
+	if err != nil {
+		return err
+	}
+	if time.Since(time.Unix(started, 0)) > a.stateTTL {
+		return errStateExpired
+	}
+	if !pending {
+		return errStateInvalid
+	}
+	return nil
+}
+
+//consumePending will remove the state of a pending login, from the
+// LoginStateStore if set, and return true if it was pending.
+func (a *Auth) consumePending(state string) (bool, error) {
+	if a.loginStates == nil {
+		_, ok := a.pending.consume(state)
+		return ok, nil
+	}
+	ok, err := a.loginStates.Consume(state)
+	if err != nil {
+		return false, fmt.Errorf("login state store Consume failed: %v", err)
+	}
+	return ok, nil
+}
+
+//repeatedCallback will return the URL redirected to after the login and
+// true, if the session is logged in and the login was done with the state,
+// so the callback was requested again for a login already done.
+func (a *Auth) repeatedCallback(r *http.Request, session *sessions.Session, state string) (string, bool) {
+	loggedIn, _ := session.Values[sessionKeyState].(string)
+	if state == "" || subtle.ConstantTimeCompare([]byte(state), []byte(loggedIn)) != 1 {
+		return "", false
+	}
+	if _, ok := a.authenticated(r); !ok {
+		return "", false
+	}
+
+	returnTo, _ := session.Values["loginreturnto"].(string)
+	if !isLocalPath(returnTo) {
+		returnTo = a.tenantPath(r, "/")
+	}
+	return returnTo, true
+}
@@ -0,0 +1,45 @@
+package authsession
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+//RedisLoginStateStore is a LoginStateStore keeping the states of the
+// logins pending in Redis, expiring with the state TTL, so the callback
+// can be served by any instance of the server.
+type RedisLoginStateStore struct {
+	client  redis.UniversalClient
+	prefix  string
+	timeout time.Duration
+}
+
+//NewRedisLoginStateStore will return a *RedisLoginStateStore using client,
+// with the keys starting with prefix, like "authsession:state:".
+func NewRedisLoginStateStore(client redis.UniversalClient, prefix string) *RedisLoginStateStore {
+	return &RedisLoginStateStore{
+		client:  client,
+		prefix:  prefix,
+		timeout: 5 * time.Second,
+	}
+}
+
+//Add will add the state of a login started, expiring after ttl.
+func (r *RedisLoginStateStore) Add(state string, ttl time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	return r.client.Set(ctx, r.prefix+state, 1, ttl).Err()
+}
+
+//Consume will remove the state, and return true if it was pending. The
+// state is removed with one DEL, so only one callback can use it.
+func (r *RedisLoginStateStore) Consume(state string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.timeout)
+	defer cancel()
+
+	n, err := r.client.Del(ctx, r.prefix+state).Result()
+	return n == 1, err
+}
@@ -0,0 +1,106 @@
+package authsession
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPendingLoginsCaps(t *testing.T) {
+	p := newPendingLogins(4, 2)
+	p.add("a1", "1.1.1.1", time.Hour)
+	p.add("a2", "1.1.1.1", time.Hour)
+	p.add("a3", "1.1.1.1", time.Hour)
+	if _, ok := p.consume("a1"); ok {
+		t.Fatal("the oldest login of the IP was not evicted")
+	}
+	if st := p.statistics(); st.EvictedIP != 1 || st.Pending != 2 {
+		t.Fatalf("got stats %+v", st)
+	}
+
+	p.add("b1", "2.2.2.2", time.Hour)
+	p.add("b2", "2.2.2.2", time.Hour)
+	p.add("c1", "3.3.3.3", time.Hour)
+	if _, ok := p.consume("a2"); ok {
+		t.Fatal("the oldest login overall was not evicted")
+	}
+	if st := p.statistics(); st.EvictedTotal != 1 || st.Pending != 4 {
+		t.Fatalf("got stats %+v", st)
+	}
+	if _, ok := p.consume("c1"); !ok {
+		t.Fatal("the newest login was evicted")
+	}
+	if _, ok := p.consume("c1"); ok {
+		t.Fatal("a login was consumed twice")
+	}
+	if n := p.cleanup(time.Now().Add(2*time.Hour), time.Hour); n != 3 || p.len() != 0 || len(p.ips) != 0 {
+		t.Fatalf("cleanup removed %v, left %v logins and the IPs %v", n, p.len(), p.ips)
+	}
+}
+
+func TestNewStatePerIPCap(t *testing.T) {
+	tests := []struct {
+		name       string
+		remoteAddr string
+		forwarded  string
+		cappedIP   string
+	}{
+		{"direct client", "9.9.9.9:1234", "", "9.9.9.9"},
+		{"direct client with a forged header", "9.9.9.9:1234", "1.1.1.1", "9.9.9.9"},
+		{"trusted proxy", "10.0.0.1:1234", "5.5.5.5", "5.5.5.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret",
+				WithPendingLoginLimits(100, 2), WithTrustedProxies("10.0.0.0/8"))
+
+			var states []string
+			for i := 0; i < 3; i++ {
+				r := httptest.NewRequest("GET", "/slogin", nil)
+				r.RemoteAddr = tt.remoteAddr
+				if tt.forwarded != "" {
+					r.Header.Set("X-Forwarded-For", tt.forwarded)
+				}
+				s, _ := a.store.Get(r, "cookie-name")
+				state, err := a.newState(r, s)
+				if err != nil {
+					t.Fatal(err)
+				}
+				states = append(states, state)
+			}
+
+			if _, ok := a.pending.consume(states[0]); ok {
+				t.Fatal("the oldest login was not evicted by the per IP cap")
+			}
+			if n := a.pending.ips[tt.cappedIP]; n != 2 {
+				t.Fatalf("got %v logins for %v, want 2, all %v", n, tt.cappedIP, a.pending.ips)
+			}
+		})
+	}
+}
+
+func TestNewStateUnknownClient(t *testing.T) {
+	a, _ := NewAuth("http", "localhost", "8080", "key", "id", "secret",
+		WithPendingLoginLimits(100, 2), WithTrustedProxies("10.0.0.0/8"))
+
+	//The chain from the trusted proxy has only trusted proxies, so the
+	// client is not known, and the logins are only capped overall.
+	var states []string
+	for i := 0; i < 3; i++ {
+		r := httptest.NewRequest("GET", "/slogin", nil)
+		r.RemoteAddr = "10.0.0.1:1234"
+		r.Header.Set("X-Forwarded-For", "10.0.0.2")
+		s, _ := a.store.Get(r, "cookie-name")
+		state, err := a.newState(r, s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, state)
+	}
+	if _, ok := a.pending.consume(states[0]); !ok {
+		t.Fatal("the login of an unknown client was evicted by the per IP cap")
+	}
+	if len(a.pending.ips) != 0 {
+		t.Fatalf("got the IPs %v", a.pending.ips)
+	}
+}
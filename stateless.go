@@ -0,0 +1,380 @@
+package authsession
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/sessions"
+)
+
+const (
+	//statelessPrefix marks a token made by the stateless codec.
+	statelessPrefix = "st1."
+	//maxStatelessToken is the max length of a token, which is the max
+	// size of a cookie.
+	maxStatelessToken = 4096
+)
+
+//StatelessConfig is how the sessions are kept in stateless tokens.
+type StatelessConfig struct {
+	//Keys are the AES keys encrypting the tokens, which must be 16, 24 or
+	// 32 bytes. Tokens are encrypted with the first key, and decrypted
+	// with any of the keys, so a new key can be put first while the
+	// tokens of the old keys are still used.
+	Keys [][]byte
+	//Header will also accept the token in an "Authorization: Bearer"
+	// header, for clients without cookies, like apps at the edge or CLIs.
+	// The token of a session is given by SessionToken.
+	Header bool
+	//MaxAge is how long a token is accepted after it was made. The
+	// session also expires as usual. The default is 30 days, like the
+	// cookies.
+	MaxAge time.Duration
+	//Format is the format of the tokens. With TokenFormatPASETO the
+	// tokens are PASETO v4.local tokens, and the keys must be 32 bytes.
+	Format TokenFormat
+}
+
+//statelessCodec is a securecookie.Codec packing the session values in a
+// compact encrypted token, with the values set by the package as short
+// JSON fields, and the other values of the app gob encoded.
+type statelessCodec struct {
+	aeads  []cipher.AEAD
+	maxAge time.Duration
+	//pasetoKeys are the keys of the PASETO tokens, when the format is
+	// TokenFormatPASETO.
+	pasetoKeys [][]byte
+}
+
+//statelessClaims are the values of a session in a token.
+type statelessClaims struct {
+	Issued        int64    `json:"iat"`
+	Authenticated bool     `json:"a,omitempty"`
+	Version       int      `json:"v,omitempty"`
+	ID            string   `json:"sub,omitempty"`
+	FullName      string   `json:"n,omitempty"`
+	Email         string   `json:"e,omitempty"`
+	SID           string   `json:"sid,omitempty"`
+	Tenant        string   `json:"t,omitempty"`
+	Epoch         int64    `json:"ep,omitempty"`
+	Location      string   `json:"l,omitempty"`
+	Expires       int64    `json:"exp,omitempty"`
+	Roles         []string `json:"r,omitempty"`
+	Permissions   []string `json:"p,omitempty"`
+	Scopes        []string `json:"sc,omitempty"`
+	Provider      string   `json:"pr,omitempty"`
+	State         string   `json:"st,omitempty"`
+	RolesInStore  bool     `json:"rs,omitempty"`
+	//Extra are the other values, gob encoded.
+	Extra []byte `json:"x,omitempty"`
+}
+
+//statelessPASETOClaims are the claims of a session in a PASETO token,
+// where the time issued is an ISO 8601 string, as PASETO requires.
+type statelessPASETOClaims struct {
+	statelessClaims
+	Issued time.Time `json:"iat"`
+}
+
+//newStatelessCodec will return a *statelessCodec encrypting with the
+// keys of c.
+func newStatelessCodec(c StatelessConfig) (*statelessCodec, error) {
+	if len(c.Keys) == 0 {
+		return nil, errors.New("no stateless session keys given")
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = cookieMaxAge * time.Second
+	}
+
+	s := &statelessCodec{maxAge: c.MaxAge}
+	if c.Format == TokenFormatPASETO {
+		for i, k := range c.Keys {
+			if len(k) != 32 {
+				return nil, fmt.Errorf("stateless session key %d: a PASETO key must be 32 bytes", i)
+			}
+		}
+		s.pasetoKeys = c.Keys
+		return s, nil
+	}
+	for i, k := range c.Keys {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, fmt.Errorf("stateless session key %d: %v", i, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("stateless session key %d: %v", i, err)
+		}
+		s.aeads = append(s.aeads, aead)
+	}
+	return s, nil
+}
+
+//statelessClaimsOf will return the claims of the session values. Values
+// of a type not expected for their key are kept in Extra.
+func statelessClaimsOf(values map[interface{}]interface{}) (statelessClaims, error) {
+	c := statelessClaims{Issued: time.Now().Unix()}
+	extra := make(map[interface{}]interface{})
+	for k, v := range values {
+		ok := false
+		switch k {
+		case sessionKeyAuthenticated:
+			c.Authenticated, ok = v.(bool)
+		case sessionKeyVersion:
+			c.Version, ok = v.(int)
+		case sessionKeyID:
+			c.ID, ok = v.(string)
+		case sessionKeyFullName:
+			c.FullName, ok = v.(string)
+		case sessionKeyEmail:
+			c.Email, ok = v.(string)
+		case sessionKeySID:
+			c.SID, ok = v.(string)
+		case sessionKeyTenant:
+			c.Tenant, ok = v.(string)
+		case sessionKeyEpoch:
+			c.Epoch, ok = v.(int64)
+		case sessionKeyLocation:
+			c.Location, ok = v.(string)
+		case sessionKeyExpires:
+			c.Expires, ok = v.(int64)
+		case sessionKeyRoles:
+			c.Roles, ok = v.([]string)
+		case sessionKeyPermissions:
+			c.Permissions, ok = v.([]string)
+		case sessionKeyScopes:
+			c.Scopes, ok = v.([]string)
+		case sessionKeyProvider:
+			c.Provider, ok = v.(string)
+		case sessionKeyState:
+			c.State, ok = v.(string)
+		case sessionKeyRolesInStore:
+			c.RolesInStore, ok = v.(bool)
+		}
+		if !ok {
+			extra[k] = v
+		}
+	}
+
+	if len(extra) > 0 {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(extra); err != nil {
+			return c, fmt.Errorf("failed to encode the session values: %v", err)
+		}
+		c.Extra = buf.Bytes()
+	}
+	return c, nil
+}
+
+//values will put the claims in values. Claims with the zero value are
+// left out, like when not set.
+func (c statelessClaims) values(values map[interface{}]interface{}) error {
+	if len(c.Extra) > 0 {
+		if err := gob.NewDecoder(bytes.NewReader(c.Extra)).Decode(&values); err != nil {
+			return fmt.Errorf("failed to decode the session values: %v", err)
+		}
+	}
+
+	set := func(key string, v interface{}, zero bool) {
+		if !zero {
+			values[key] = v
+		}
+	}
+	set(sessionKeyAuthenticated, c.Authenticated, !c.Authenticated)
+	set(sessionKeyVersion, c.Version, c.Version == 0)
+	set(sessionKeyID, c.ID, c.ID == "")
+	set(sessionKeyFullName, c.FullName, c.FullName == "")
+	set(sessionKeyEmail, c.Email, c.Email == "")
+	set(sessionKeySID, c.SID, c.SID == "")
+	set(sessionKeyTenant, c.Tenant, c.Tenant == "")
+	set(sessionKeyEpoch, c.Epoch, c.Epoch == 0)
+	set(sessionKeyLocation, c.Location, c.Location == "")
+	set(sessionKeyExpires, c.Expires, c.Expires == 0)
+	set(sessionKeyRoles, c.Roles, c.Roles == nil)
+	set(sessionKeyPermissions, c.Permissions, c.Permissions == nil)
+	set(sessionKeyScopes, c.Scopes, c.Scopes == nil)
+	set(sessionKeyProvider, c.Provider, c.Provider == "")
+	set(sessionKeyState, c.State, c.State == "")
+	set(sessionKeyRolesInStore, c.RolesInStore, !c.RolesInStore)
+	return nil
+}
+
+//Encode will encode the session values as a token, encrypted with the
+// first key, and the name as associated data.
+func (s *statelessCodec) Encode(name string, value interface{}) (string, error) {
+	values, ok := value.(map[interface{}]interface{})
+	if !ok {
+		return "", fmt.Errorf("stateless codec can't encode %T", value)
+	}
+	c, err := statelessClaimsOf(values)
+	if err != nil {
+		return "", err
+	}
+	token, err := s.seal(name, c)
+	if err != nil {
+		return "", err
+	}
+	if len(token) > maxStatelessToken {
+		return "", fmt.Errorf("stateless token is %d bytes, more than the max %d", len(token), maxStatelessToken)
+	}
+	return token, nil
+}
+
+//prefix will return the prefix of the tokens of the codec.
+func (s *statelessCodec) prefix() string {
+	if s.pasetoKeys != nil {
+		return pasetoLocalHeader
+	}
+	return statelessPrefix
+}
+
+//seal will return the claims as a token, encrypted with the first key,
+// and the name as associated data.
+func (s *statelessCodec) seal(name string, c statelessClaims) (string, error) {
+	if s.pasetoKeys != nil {
+		b, err := json.Marshal(statelessPASETOClaims{statelessClaims: c, Issued: time.Unix(c.Issued, 0).UTC()})
+		if err != nil {
+			return "", err
+		}
+		return pasetoEncrypt(s.pasetoKeys[0], b, nil, []byte(name))
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	aead := s.aeads[0]
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return statelessPrefix + base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, b, []byte(name))), nil
+}
+
+//open will return the claims of a token made by seal, decrypted with the
+// first key that works.
+func (s *statelessCodec) open(name string, value string) (statelessClaims, error) {
+	if !strings.HasPrefix(value, s.prefix()) {
+		return statelessClaims{}, errors.New("not a stateless token")
+	}
+
+	var b []byte
+	if s.pasetoKeys != nil {
+		for _, k := range s.pasetoKeys {
+			var err error
+			if b, err = pasetoDecrypt(k, value, []byte(name)); err == nil {
+				break
+			}
+		}
+	} else {
+		ct, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(value, statelessPrefix))
+		if err != nil {
+			return statelessClaims{}, fmt.Errorf("stateless token is not valid base64: %v", err)
+		}
+		for _, aead := range s.aeads {
+			if len(ct) < aead.NonceSize() {
+				continue
+			}
+			if b, err = aead.Open(nil, ct[:aead.NonceSize()], ct[aead.NonceSize():], []byte(name)); err == nil {
+				break
+			}
+		}
+	}
+	if b == nil {
+		return statelessClaims{}, errors.New("stateless token is not valid for any of the keys")
+	}
+
+	if s.pasetoKeys != nil {
+		var pc statelessPASETOClaims
+		if err := json.Unmarshal(b, &pc); err != nil {
+			return statelessClaims{}, fmt.Errorf("stateless token is not valid: %v", err)
+		}
+		pc.statelessClaims.Issued = pc.Issued.Unix()
+		return pc.statelessClaims, nil
+	}
+	var c statelessClaims
+	if err := json.Unmarshal(b, &c); err != nil {
+		return statelessClaims{}, fmt.Errorf("stateless token is not valid: %v", err)
+	}
+	return c, nil
+}
+
+//Decode will decode a token made by Encode into dst, which must be a
+// *map[interface{}]interface{}, with the first key that works.
+func (s *statelessCodec) Decode(name string, value string, dst interface{}) error {
+	values, ok := dst.(*map[interface{}]interface{})
+	if !ok {
+		return fmt.Errorf("stateless codec can't decode into %T", dst)
+	}
+	c, err := s.open(name, value)
+	if err != nil {
+		return err
+	}
+	if time.Since(time.Unix(c.Issued, 0)) > s.maxAge {
+		return errors.New("stateless token is too old")
+	}
+
+	if *values == nil {
+		*values = make(map[interface{}]interface{})
+	}
+	return c.values(*values)
+}
+
+//headerSession will return the session of the stateless token in the
+// Authorization header of the request, and false if there is none, or it
+// is not valid.
+func (a *Auth) headerSession(r *http.Request) (*sessions.Session, bool) {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") || !strings.HasPrefix(token, a.stateless.prefix()) {
+		return nil, false
+	}
+
+	session := sessions.NewSession(a.store, "cookie-name")
+	if err := a.stateless.Decode("cookie-name", token, &session.Values); err != nil {
+		logRequestf(r, "info: stateless token in the Authorization header refused: %v\n", err)
+		return nil, false
+	}
+	return session, true
+}
+
+//SessionToken will return the session of the request as a stateless
+// token, to be sent in an "Authorization: Bearer" header by clients
+// without cookies. It needs WithStatelessSessions with Header set, and
+// the request must be authenticated.
+func (a *Auth) SessionToken(r *http.Request) (string, error) {
+	if a.stateless == nil || !a.statelessHeader {
+		return "", errors.New("stateless session tokens in headers are not enabled")
+	}
+	session, ok := a.authenticated(r)
+	if !ok {
+		return "", errors.New("the request is not authenticated")
+	}
+	return a.stateless.Encode("cookie-name", session.Values)
+}
+
+//EpochFunc is an EpochStore reading the epoch of a user with a function,
+// like from a key-value store at the edge, for stateless sessions
+// revoked by incrementing the epoch elsewhere. The epoch is put in the
+// token at login, and checked for every request. Increment is not
+// supported, so RevokeUserSessions fails.
+type EpochFunc func(user string) (int64, error)
+
+//Get will return the epoch for the user, which is 0 if not set.
+func (f EpochFunc) Get(user string) (int64, error) {
+	return f(user)
+}
+
+//Increment will return an error, since the epochs are read only.
+func (f EpochFunc) Increment(user string) (int64, error) {
+	return 0, errors.New("the epochs of an EpochFunc can't be incremented")
+}
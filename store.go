@@ -0,0 +1,301 @@
+package authsession
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+//jsonFileMap is a map of values that is kept in a JSON file on disk, so
+// the same data can be used both by the web server and by the admin
+// tools running in another process. The file is read before, and written
+// after every operation, so changes done by other processes are seen.
+// The operations hold an advisory lock on the file path+".lock", so an
+// update by another process is not lost between the read and the write.
+// If path is empty the values are only kept in memory.
+type jsonFileMap[T any] struct {
+	mu   sync.Mutex
+	path string
+	m    map[string]T
+}
+
+//newJSONFileMap will return a *jsonFileMap using the file at path.
+func newJSONFileMap[T any](path string) *jsonFileMap[T] {
+	return &jsonFileMap[T]{
+		path: path,
+		m:    make(map[string]T),
+	}
+}
+
+//load will read the map from disk. A missing file is not an error,
+// and will give an empty map.
+func (j *jsonFileMap[T]) load() error {
+	if j.path == "" {
+		return nil
+	}
+
+	b, err := os.ReadFile(j.path)
+	if os.IsNotExist(err) {
+		j.m = make(map[string]T)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	m := make(map[string]T)
+	if len(b) > 0 {
+		if err := json.Unmarshal(b, &m); err != nil {
+			return err
+		}
+	}
+	j.m = m
+
+	return nil
+}
+
+//save will write the map to disk. The data is first written to a
+// temporary file which is then renamed, so readers will never see a
+// half written file.
+func (j *jsonFileMap[T]) save() error {
+	if j.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(j.m, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(j.path), filepath.Base(j.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), j.path)
+}
+
+//lock will take the lock on the file shared with other processes, and
+// return the function releasing it.
+func (j *jsonFileMap[T]) lock(exclusive bool) (func(), error) {
+	if j.path == "" {
+		return func() {}, nil
+	}
+	return lockFile(j.path+".lock", exclusive)
+}
+
+//view will load the map and call fn with it. fn should not modify the map.
+func (j *jsonFileMap[T]) view(fn func(m map[string]T) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	unlock, err := j.lock(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := j.load(); err != nil {
+		return err
+	}
+	return fn(j.m)
+}
+
+//update will load the map, call fn to modify it, and save it back to disk.
+func (j *jsonFileMap[T]) update(fn func(m map[string]T) error) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	unlock, err := j.lock(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if err := j.load(); err != nil {
+		return err
+	}
+	if err := fn(j.m); err != nil {
+		return err
+	}
+	return j.save()
+}
+
+//SessionInfo holds the information about an active session kept
+// server side, so sessions can be listed and revoked.
+type SessionInfo struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userID"`
+	Email     string    `json:"email"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"userAgent"`
+	Tenant    string    `json:"tenant,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+	//Device is the browser and OS from the user agent, like "Chrome on macOS".
+	Device string `json:"device,omitempty"`
+	//Name is the name given to the session by the user.
+	Name string `json:"name,omitempty"`
+	//Location is where the session was created, from the function given
+	// with WithSessionLocation.
+	Location string `json:"location,omitempty"`
+	//Roles and Permissions are the roles and permissions of the user, when
+	// too large to keep in the session cookie.
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"permissions,omitempty"`
+	//Risk is the risk score of the session from the RiskScorer set with
+	// WithRiskScoring.
+	Risk int `json:"risk,omitempty"`
+	//Region is the region of the user, when data residency is set with
+	// WithDataResidency.
+	Region string `json:"region,omitempty"`
+}
+
+//SessionStore keeps track of the active sessions. When a SessionStore is
+// set with WithSessionStore, a session cookie is only accepted as long
+// as its session is present in the store, so deleting a session from
+// the store will revoke it.
+type SessionStore interface {
+	//Add will add, or replace a session.
+	Add(s SessionInfo) error
+	//Get will return the session with the id, and false if not found.
+	Get(id string) (SessionInfo, bool, error)
+	//List will return all the sessions that are not expired.
+	List() ([]SessionInfo, error)
+	//ListUser will return the sessions that are not expired where the
+	// user ID or the email matches user.
+	ListUser(user string) ([]SessionInfo, error)
+	//Delete will delete the session with the id.
+	Delete(id string) error
+	//DeleteUser will delete all the sessions where the user ID or the
+	// email matches user, and return the number of sessions deleted.
+	DeleteUser(user string) (int, error)
+}
+
+//FileSessionStore is a SessionStore keeping the sessions in a JSON file.
+type FileSessionStore struct {
+	m *jsonFileMap[SessionInfo]
+}
+
+//NewFileSessionStore will return a *FileSessionStore storing the sessions
+// in the file at path. If path is empty the sessions are only kept in memory.
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{
+		m: newJSONFileMap[SessionInfo](path),
+	}
+}
+
+//Add will add, or replace a session. Expired sessions are removed at
+// the same time.
+func (f *FileSessionStore) Add(s SessionInfo) error {
+	return f.m.update(func(m map[string]SessionInfo) error {
+		now := time.Now()
+		for id, v := range m {
+			if !v.Expires.IsZero() && now.After(v.Expires) {
+				delete(m, id)
+			}
+		}
+		m[s.ID] = s
+		return nil
+	})
+}
+
+//Cleanup will remove the sessions expired at now, and return the number
+// removed.
+func (f *FileSessionStore) Cleanup(now time.Time) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]SessionInfo) error {
+		for id, v := range m {
+			if !v.Expires.IsZero() && now.After(v.Expires) {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
+
+//Get will return the session with the id, and false if the session
+// is not found or expired.
+func (f *FileSessionStore) Get(id string) (SessionInfo, bool, error) {
+	var s SessionInfo
+	var ok bool
+	err := f.m.view(func(m map[string]SessionInfo) error {
+		s, ok = m[id]
+		if ok && !s.Expires.IsZero() && time.Now().After(s.Expires) {
+			ok = false
+		}
+		return nil
+	})
+	return s, ok, err
+}
+
+//List will return all the sessions that are not expired.
+func (f *FileSessionStore) List() ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	err := f.m.view(func(m map[string]SessionInfo) error {
+		now := time.Now()
+		for _, v := range m {
+			if !v.Expires.IsZero() && now.After(v.Expires) {
+				continue
+			}
+			sessions = append(sessions, v)
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user.
+func (f *FileSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	err := f.m.view(func(m map[string]SessionInfo) error {
+		now := time.Now()
+		for _, v := range m {
+			if !v.Expires.IsZero() && now.After(v.Expires) {
+				continue
+			}
+			if v.UserID == user || strings.EqualFold(v.Email, user) {
+				sessions = append(sessions, v)
+			}
+		}
+		return nil
+	})
+	return sessions, err
+}
+
+//Delete will delete the session with the id.
+func (f *FileSessionStore) Delete(id string) error {
+	return f.m.update(func(m map[string]SessionInfo) error {
+		delete(m, id)
+		return nil
+	})
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user, and return the number of sessions deleted.
+func (f *FileSessionStore) DeleteUser(user string) (int, error) {
+	var n int
+	err := f.m.update(func(m map[string]SessionInfo) error {
+		for id, v := range m {
+			if v.UserID == user || strings.EqualFold(v.Email, user) {
+				delete(m, id)
+				n++
+			}
+		}
+		return nil
+	})
+	return n, err
+}
@@ -0,0 +1,244 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//DynamoDBSessionStore is a SessionStore keeping the sessions in an Amazon
+// DynamoDB table, using the DynamoDB API. The table must have the string
+// partition key "id". The expiry is kept as unix seconds in the "expires"
+// attribute, which should be set as the TTL attribute of the table so
+// DynamoDB removes the expired sessions. Listing the sessions scans the
+// table.
+type DynamoDBSessionStore struct {
+	region          string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	table           string
+	client          *http.Client
+	endpoint        string
+	timeout         time.Duration
+}
+
+//NewDynamoDBSessionStore will return a *DynamoDBSessionStore storing the
+// sessions in the table, in the AWS region. The requests are signed with
+// the access key. sessionToken is only needed for temporary credentials,
+// and can be empty.
+func NewDynamoDBSessionStore(region string, accessKeyID string, secretAccessKey string, sessionToken string, table string) *DynamoDBSessionStore {
+	return &DynamoDBSessionStore{
+		region:          region,
+		accessKeyID:     accessKeyID,
+		secretAccessKey: secretAccessKey,
+		sessionToken:    sessionToken,
+		table:           table,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		endpoint:        "https://dynamodb." + region + ".amazonaws.com",
+		timeout:         10 * time.Second,
+	}
+}
+
+//dynamoItem is an item of the DynamoDB API, with the attribute values
+// keyed by their type, like {"S": "text"}.
+type dynamoItem map[string]map[string]string
+
+//call will do the DynamoDB API action with the body, and decode the
+// response into v if not nil.
+func (d *DynamoDBSessionStore) call(action string, body map[string]interface{}, v interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d.timeout)
+	defer cancel()
+
+	body["TableName"] = d.table
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.endpoint+"/", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+action)
+	signV4(req, b, d.region, "dynamodb", d.accessKeyID, d.secretAccessKey, d.sessionToken, time.Now())
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("dynamodb %s failed: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Type    string `json:"__type"`
+			Message string `json:"message"`
+		}
+		rb, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(rb, &e)
+		//The type is like "com.amazonaws.dynamodb.v20120810#ResourceNotFoundException".
+		_, typ, _ := strings.Cut(e.Type, "#")
+		return fmt.Errorf("dynamodb %s failed: %v: %v %v", action, resp.Status, typ, e.Message)
+	}
+	if v == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("failed parsing dynamodb %s response: %v", action, err)
+	}
+	return nil
+}
+
+//key will return the key of the item of the session with the id.
+func (d *DynamoDBSessionStore) key(id string) dynamoItem {
+	return dynamoItem{"id": {"S": id}}
+}
+
+//sessionFromItem will return the session kept in the item.
+func sessionFromItem(item dynamoItem) (SessionInfo, error) {
+	var s SessionInfo
+	if err := json.Unmarshal([]byte(item["data"]["S"]), &s); err != nil {
+		return SessionInfo{}, fmt.Errorf("failed parsing dynamodb session: %v", err)
+	}
+	return s, nil
+}
+
+//Add will add, or replace a session.
+func (d *DynamoDBSessionStore) Add(s SessionInfo) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	item := d.key(s.ID)
+	item["data"] = map[string]string{"S": string(data)}
+	if s.UserID != "" {
+		item["userID"] = map[string]string{"S": s.UserID}
+	}
+	if s.Email != "" {
+		item["email"] = map[string]string{"S": strings.ToLower(s.Email)}
+	}
+	if !s.Expires.IsZero() {
+		item["expires"] = map[string]string{"N": strconv.FormatInt(s.Expires.Unix(), 10)}
+	}
+	return d.call("PutItem", map[string]interface{}{"Item": item}, nil)
+}
+
+//Get will return the session with the id, and false if the session is
+// not found or expired. DynamoDB can take a while to remove the expired
+// items, so the expiry is checked too.
+func (d *DynamoDBSessionStore) Get(id string) (SessionInfo, bool, error) {
+	var resp struct {
+		Item dynamoItem `json:"Item"`
+	}
+	err := d.call("GetItem", map[string]interface{}{"Key": d.key(id), "ConsistentRead": true}, &resp)
+	if err != nil || resp.Item == nil {
+		return SessionInfo{}, false, err
+	}
+	s, err := sessionFromItem(resp.Item)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	if !s.Expires.IsZero() && time.Now().After(s.Expires) {
+		return s, false, nil
+	}
+	return s, true, nil
+}
+
+//scan will return the sessions in the table matching the filter, which
+// can be empty, with the names and values used in it. Expired sessions
+// are included.
+func (d *DynamoDBSessionStore) scan(filter string, names map[string]string, values dynamoItem) ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	var start dynamoItem
+	for {
+		body := map[string]interface{}{"ConsistentRead": true}
+		if filter != "" {
+			body["FilterExpression"] = filter
+			body["ExpressionAttributeNames"] = names
+			body["ExpressionAttributeValues"] = values
+		}
+		if start != nil {
+			body["ExclusiveStartKey"] = start
+		}
+
+		var page struct {
+			Items            []dynamoItem `json:"Items"`
+			LastEvaluatedKey dynamoItem   `json:"LastEvaluatedKey"`
+		}
+		if err := d.call("Scan", body, &page); err != nil {
+			return nil, err
+		}
+		for _, item := range page.Items {
+			s, err := sessionFromItem(item)
+			if err != nil {
+				return nil, err
+			}
+			sessions = append(sessions, s)
+		}
+
+		if page.LastEvaluatedKey == nil {
+			return sessions, nil
+		}
+		start = page.LastEvaluatedKey
+	}
+}
+
+//scanUser will return the sessions where the user ID or the email
+// matches user, expired or not.
+func (d *DynamoDBSessionStore) scanUser(user string) ([]SessionInfo, error) {
+	return d.scan("#u = :u OR #e = :e",
+		map[string]string{"#u": "userID", "#e": "email"},
+		dynamoItem{":u": {"S": user}, ":e": {"S": strings.ToLower(user)}})
+}
+
+//notExpired will return the sessions not expired at now.
+func notExpired(sessions []SessionInfo, now time.Time) []SessionInfo {
+	var valid []SessionInfo
+	for _, s := range sessions {
+		if s.Expires.IsZero() || !now.After(s.Expires) {
+			valid = append(valid, s)
+		}
+	}
+	return valid
+}
+
+//List will return all the sessions that are not expired.
+func (d *DynamoDBSessionStore) List() ([]SessionInfo, error) {
+	sessions, err := d.scan("", nil, nil)
+	return notExpired(sessions, time.Now()), err
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user.
+func (d *DynamoDBSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	sessions, err := d.scanUser(user)
+	return notExpired(sessions, time.Now()), err
+}
+
+//Delete will delete the session with the id.
+func (d *DynamoDBSessionStore) Delete(id string) error {
+	return d.call("DeleteItem", map[string]interface{}{"Key": d.key(id)}, nil)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user, and return the number of sessions deleted.
+func (d *DynamoDBSessionStore) DeleteUser(user string) (int, error) {
+	sessions, err := d.scanUser(user)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, s := range sessions {
+		if err := d.Delete(s.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
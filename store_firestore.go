@@ -0,0 +1,253 @@
+package authsession
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+//FirestoreSessionStore is a SessionStore keeping the sessions as documents
+// in a Google Cloud Firestore collection, using the Firestore REST API.
+// The expiry is kept as a timestamp in the "expires" field, and the
+// expired sessions are removed by Cleanup, which is run by the janitor of
+// RunJobs. A TTL policy on the field can be used instead.
+type FirestoreSessionStore struct {
+	client     *http.Client
+	baseURL    string
+	collection string
+	timeout    time.Duration
+}
+
+//NewFirestoreSessionStore will return a *FirestoreSessionStore storing the
+// sessions in the collection of the default database of the Google Cloud
+// project, doing the requests with tokens from ts, which must have the
+// datastore scope, like the default credentials on Cloud Run.
+func NewFirestoreSessionStore(ts oauth2.TokenSource, project string, collection string) *FirestoreSessionStore {
+	return &FirestoreSessionStore{
+		client:     oauth2.NewClient(context.Background(), ts),
+		baseURL:    "https://firestore.googleapis.com/v1/projects/" + url.PathEscape(project) + "/databases/(default)/documents",
+		collection: collection,
+		timeout:    10 * time.Second,
+	}
+}
+
+//firestoreDocument is a document of the Firestore REST API, with the
+// field values keyed by their type, like {"stringValue": "text"}.
+type firestoreDocument struct {
+	Fields map[string]map[string]string `json:"fields"`
+}
+
+//do will do the request to the Firestore API, and decode the response
+// into v if not nil. It returns false if the document was not found.
+func (f *FirestoreSessionStore) do(method string, u string, body interface{}, v interface{}) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), f.timeout)
+	defer cancel()
+
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return false, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("firestore request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("firestore request failed: %v", resp.Status)
+	}
+	if v == nil {
+		return true, nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return false, fmt.Errorf("failed parsing firestore response: %v", err)
+	}
+	return true, nil
+}
+
+//documentURL will return the URL of the document of the session with the id.
+func (f *FirestoreSessionStore) documentURL(id string) string {
+	return f.baseURL + "/" + url.PathEscape(f.collection) + "/" + url.PathEscape(id)
+}
+
+//sessionFromDocument will return the session kept in the document.
+func sessionFromDocument(d firestoreDocument) (SessionInfo, error) {
+	var s SessionInfo
+	if err := json.Unmarshal([]byte(d.Fields["data"]["stringValue"]), &s); err != nil {
+		return SessionInfo{}, fmt.Errorf("failed parsing firestore session: %v", err)
+	}
+	return s, nil
+}
+
+//Add will add, or replace a session.
+func (f *FirestoreSessionStore) Add(s SessionInfo) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	d := firestoreDocument{Fields: map[string]map[string]string{
+		"data":   {"stringValue": string(data)},
+		"userID": {"stringValue": s.UserID},
+		"email":  {"stringValue": strings.ToLower(s.Email)},
+	}}
+	if !s.Expires.IsZero() {
+		d.Fields["expires"] = map[string]string{"timestampValue": s.Expires.UTC().Format(time.RFC3339Nano)}
+	}
+	_, err = f.do(http.MethodPatch, f.documentURL(s.ID), d, nil)
+	return err
+}
+
+//Get will return the session with the id, and false if the session is
+// not found or expired.
+func (f *FirestoreSessionStore) Get(id string) (SessionInfo, bool, error) {
+	var d firestoreDocument
+	found, err := f.do(http.MethodGet, f.documentURL(id), nil, &d)
+	if err != nil || !found {
+		return SessionInfo{}, false, err
+	}
+	s, err := sessionFromDocument(d)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	if !s.Expires.IsZero() && time.Now().After(s.Expires) {
+		return s, false, nil
+	}
+	return s, true, nil
+}
+
+//query will return the sessions of the collection matching the field
+// filter, or all the sessions if nil. Expired sessions are included.
+func (f *FirestoreSessionStore) query(filter map[string]interface{}) ([]SessionInfo, error) {
+	q := map[string]interface{}{
+		"from": []map[string]string{{"collectionId": f.collection}},
+	}
+	if filter != nil {
+		q["where"] = map[string]interface{}{"fieldFilter": filter}
+	}
+
+	var results []struct {
+		Document *firestoreDocument `json:"document"`
+	}
+	if _, err := f.do(http.MethodPost, f.baseURL+":runQuery", map[string]interface{}{"structuredQuery": q}, &results); err != nil {
+		return nil, err
+	}
+	var sessions []SessionInfo
+	for _, r := range results {
+		if r.Document == nil {
+			continue
+		}
+		s, err := sessionFromDocument(*r.Document)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+//fieldFilter will return the filter of a query comparing the field with
+// the value with op, like "EQUAL".
+func fieldFilter(field string, op string, value map[string]string) map[string]interface{} {
+	return map[string]interface{}{
+		"field": map[string]string{"fieldPath": field},
+		"op":    op,
+		"value": value,
+	}
+}
+
+//queryUser will return the sessions where the user ID or the email
+// matches user, expired or not.
+func (f *FirestoreSessionStore) queryUser(user string) ([]SessionInfo, error) {
+	byID, err := f.query(fieldFilter("userID", "EQUAL", map[string]string{"stringValue": user}))
+	if err != nil {
+		return nil, err
+	}
+	byEmail, err := f.query(fieldFilter("email", "EQUAL", map[string]string{"stringValue": strings.ToLower(user)}))
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := byID
+	for _, s := range byEmail {
+		if s.UserID != user {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+//List will return all the sessions that are not expired.
+func (f *FirestoreSessionStore) List() ([]SessionInfo, error) {
+	sessions, err := f.query(nil)
+	return notExpired(sessions, time.Now()), err
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user.
+func (f *FirestoreSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	sessions, err := f.queryUser(user)
+	return notExpired(sessions, time.Now()), err
+}
+
+//Delete will delete the session with the id.
+func (f *FirestoreSessionStore) Delete(id string) error {
+	_, err := f.do(http.MethodDelete, f.documentURL(id), nil, nil)
+	return err
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user, and return the number of sessions deleted.
+func (f *FirestoreSessionStore) DeleteUser(user string) (int, error) {
+	sessions, err := f.queryUser(user)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, s := range sessions {
+		if err := f.Delete(s.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+//Cleanup will remove the sessions expired at now, and return the number
+// removed.
+func (f *FirestoreSessionStore) Cleanup(now time.Time) (int, error) {
+	sessions, err := f.query(fieldFilter("expires", "LESS_THAN", map[string]string{"timestampValue": now.UTC().Format(time.RFC3339Nano)}))
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, s := range sessions {
+		if err := f.Delete(s.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,32 @@
+//go:build unix
+
+package authsession
+
+import (
+	"os"
+	"syscall"
+)
+
+//lockFile will take an advisory lock on the file at path, created if
+// missing, shared if not exclusive. The lock is released by calling the
+// function returned.
+func lockFile(path string, exclusive bool) (func(), error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(f.Fd()), how); err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
@@ -0,0 +1,535 @@
+package authsession
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//memcachedMaxKey is the max length of a memcached key.
+	memcachedMaxKey = 250
+	//memcachedMaxIdle is the max number of idle connections kept for
+	// each node.
+	memcachedMaxIdle = 8
+	//memcachedCASRetries is how many times an index is read again when
+	// changed by another instance while updated.
+	memcachedCASRetries = 10
+)
+
+//errMemcachedCASConflict is returned when an index could not be updated
+// since it kept being changed by other instances.
+var errMemcachedCASConflict = errors.New("memcached index changed too many times while updated")
+
+//MemcachedConfig is how MemcachedSessionStore connects to memcached.
+type MemcachedConfig struct {
+	//Addrs are the host:port addresses of the memcached nodes. The keys
+	// are spread over the nodes with consistent hashing, so adding or
+	// removing a node only moves the keys of that node.
+	Addrs []string
+	//Prefix is put in front of all the keys, like "authsession:".
+	Prefix string
+	//Timeout is the timeout of a request to a node. The default is 2
+	// seconds.
+	Timeout time.Duration
+	//MaxValueSize is the max size of a value stored, which must not be
+	// larger than the item size of the nodes. The default is 1 MB, the
+	// default item size of memcached.
+	MaxValueSize int
+}
+
+//MemcachedSessionStore is a SessionStore keeping the sessions in
+// memcached, using the text protocol. The sessions expire with the items,
+// and since memcached can't list its keys the IDs of the sessions are
+// kept in index items for all the sessions and for each user. An index
+// larger than MaxValueSize drops its oldest sessions, which are then not
+// listed, and memcached can evict items when full, so a session can be
+// lost before it expires.
+type MemcachedSessionStore struct {
+	conf  MemcachedConfig
+	ring  *hashRing
+	nodes []*memcachedNode
+}
+
+//memcachedNode is a memcached node with its idle connections.
+type memcachedNode struct {
+	addr string
+
+	mu   sync.Mutex
+	idle []*memcachedConn
+}
+
+//memcachedConn is a connection to a node.
+type memcachedConn struct {
+	conn net.Conn
+	rw   *bufio.ReadWriter
+}
+
+//memcachedItem is a value read from memcached, with its CAS value.
+type memcachedItem struct {
+	value []byte
+	cas   uint64
+}
+
+//memcachedIndexEntry is a session in an index.
+type memcachedIndexEntry struct {
+	ID      string    `json:"id"`
+	Expires time.Time `json:"expires"`
+}
+
+//NewMemcachedSessionStore will return a *MemcachedSessionStore using the
+// memcached nodes in c.
+func NewMemcachedSessionStore(c MemcachedConfig) *MemcachedSessionStore {
+	if c.Timeout <= 0 {
+		c.Timeout = 2 * time.Second
+	}
+	if c.MaxValueSize <= 0 {
+		c.MaxValueSize = 1024 * 1024
+	}
+
+	m := &MemcachedSessionStore{
+		conf: c,
+		ring: newHashRing(c.Addrs),
+	}
+	for _, addr := range c.Addrs {
+		m.nodes = append(m.nodes, &memcachedNode{addr: addr})
+	}
+	return m
+}
+
+//node will return the node keeping the key, which is the node of the
+// first point on the ring at or after the hash of the key.
+func (m *MemcachedSessionStore) node(key string) (*memcachedNode, error) {
+	nodes := m.ring.lookup(key, 1)
+	if len(nodes) == 0 {
+		return nil, errors.New("no memcached nodes given")
+	}
+	return m.nodes[nodes[0]], nil
+}
+
+//key will return the memcached key for the name of the kind, like a
+// session ID. Names which can't be used in a key, like emails with
+// spaces, or too long names, are hashed.
+func (m *MemcachedSessionStore) key(kind string, name string) string {
+	k := m.conf.Prefix + kind + ":" + name
+	if len(k) > memcachedMaxKey || strings.ContainsFunc(name, func(r rune) bool { return r <= ' ' || r == 0x7f }) {
+		sum := sha256.Sum256([]byte(name))
+		k = m.conf.Prefix + kind + ":" + hex.EncodeToString(sum[:])
+	}
+	return k
+}
+
+//do will call fn with a connection to the node, with the deadline set.
+// The connection is closed if fn fails, and kept for reuse if not.
+func (m *MemcachedSessionStore) do(n *memcachedNode, fn func(c *memcachedConn) error) error {
+	n.mu.Lock()
+	var c *memcachedConn
+	if len(n.idle) > 0 {
+		c = n.idle[len(n.idle)-1]
+		n.idle = n.idle[:len(n.idle)-1]
+	}
+	n.mu.Unlock()
+
+	if c == nil {
+		conn, err := net.DialTimeout("tcp", n.addr, m.conf.Timeout)
+		if err != nil {
+			return fmt.Errorf("memcached %v: %v", n.addr, err)
+		}
+		c = &memcachedConn{conn: conn, rw: bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))}
+	}
+
+	c.conn.SetDeadline(time.Now().Add(m.conf.Timeout))
+	if err := fn(c); err != nil {
+		c.conn.Close()
+		return fmt.Errorf("memcached %v: %v", n.addr, err)
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if len(n.idle) >= memcachedMaxIdle {
+		return c.conn.Close()
+	}
+	n.idle = append(n.idle, c)
+	return nil
+}
+
+//reply will write the command, and return the reply line without the
+// line ending.
+func (c *memcachedConn) reply(cmd string, data []byte) (string, error) {
+	c.rw.WriteString(cmd + "\r\n")
+	if data != nil {
+		c.rw.Write(data)
+		c.rw.WriteString("\r\n")
+	}
+	if err := c.rw.Flush(); err != nil {
+		return "", err
+	}
+	line, err := c.rw.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if strings.HasPrefix(line, "ERROR") || strings.HasPrefix(line, "CLIENT_ERROR") || strings.HasPrefix(line, "SERVER_ERROR") {
+		return "", errors.New(line)
+	}
+	return line, nil
+}
+
+//value will read the value of the item with the VALUE line, and return
+// the key and the item.
+func (c *memcachedConn) value(line string) (string, memcachedItem, error) {
+	//VALUE <key> <flags> <bytes> <cas unique>
+	f := strings.Fields(line)
+	if len(f) != 5 || f[0] != "VALUE" {
+		return "", memcachedItem{}, fmt.Errorf("unexpected reply %q", line)
+	}
+	size, err := strconv.Atoi(f[3])
+	if err != nil {
+		return "", memcachedItem{}, err
+	}
+	cas, err := strconv.ParseUint(f[4], 10, 64)
+	if err != nil {
+		return "", memcachedItem{}, err
+	}
+	value := make([]byte, size+2)
+	if _, err := io.ReadFull(c.rw, value); err != nil {
+		return "", memcachedItem{}, err
+	}
+	return f[1], memcachedItem{value: value[:size], cas: cas}, nil
+}
+
+//getMulti will return the items found for the keys, asking each node
+// for its keys at once.
+func (m *MemcachedSessionStore) getMulti(keys ...string) (map[string]memcachedItem, error) {
+	byNode := make(map[*memcachedNode][]string)
+	for _, k := range keys {
+		n, err := m.node(k)
+		if err != nil {
+			return nil, err
+		}
+		byNode[n] = append(byNode[n], k)
+	}
+
+	items := make(map[string]memcachedItem)
+	for n, keys := range byNode {
+		err := m.do(n, func(c *memcachedConn) error {
+			line, err := c.reply("gets "+strings.Join(keys, " "), nil)
+			for err == nil && line != "END" {
+				var k string
+				var item memcachedItem
+				if k, item, err = c.value(line); err != nil {
+					return err
+				}
+				items[k] = item
+
+				line, err = c.rw.ReadString('\n')
+				line = strings.TrimSuffix(line, "\r\n")
+			}
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return items, nil
+}
+
+//store will store the value with the command, which is "set", "add" or
+// "cas", and return false if not stored since the key existed for "add",
+// or was changed or removed for "cas". The item expires at expires, or
+// never if zero.
+func (m *MemcachedSessionStore) store(cmd string, key string, value []byte, expires time.Time, cas uint64) (bool, error) {
+	if len(value) > m.conf.MaxValueSize {
+		return false, fmt.Errorf("memcached value for %v is %d bytes, larger than the max %d bytes", key, len(value), m.conf.MaxValueSize)
+	}
+	n, err := m.node(key)
+	if err != nil {
+		return false, err
+	}
+
+	//An exptime larger than 30 days is a unix time, which all the
+	// expiry times of the sessions are.
+	var exptime int64
+	if !expires.IsZero() {
+		exptime = expires.Unix()
+	}
+	line := fmt.Sprintf("%s %s 0 %d %d", cmd, key, exptime, len(value))
+	if cmd == "cas" {
+		line += " " + strconv.FormatUint(cas, 10)
+	}
+
+	var stored bool
+	err = m.do(n, func(c *memcachedConn) error {
+		reply, err := c.reply(line, value)
+		if err != nil {
+			return err
+		}
+		switch reply {
+		case "STORED":
+			stored = true
+		case "NOT_STORED", "EXISTS", "NOT_FOUND":
+		default:
+			return fmt.Errorf("unexpected reply %q", reply)
+		}
+		return nil
+	})
+	return stored, err
+}
+
+//delete will delete the key.
+func (m *MemcachedSessionStore) delete(key string) error {
+	n, err := m.node(key)
+	if err != nil {
+		return err
+	}
+	return m.do(n, func(c *memcachedConn) error {
+		reply, err := c.reply("delete "+key, nil)
+		if err != nil {
+			return err
+		}
+		if reply != "DELETED" && reply != "NOT_FOUND" {
+			return fmt.Errorf("unexpected reply %q", reply)
+		}
+		return nil
+	})
+}
+
+//indexKeys will return the keys of the indexes the session is kept in.
+func (m *MemcachedSessionStore) indexKeys(s SessionInfo) []string {
+	keys := []string{m.key("index", "all")}
+	if s.UserID != "" {
+		keys = append(keys, m.key("index:id", s.UserID))
+	}
+	if s.Email != "" {
+		keys = append(keys, m.key("index:email", strings.ToLower(s.Email)))
+	}
+	return keys
+}
+
+//updateIndex will update the index with fn, and remove the expired
+// sessions from it. If the index gets too large, the oldest sessions are
+// dropped. The index is read again if changed by another instance.
+func (m *MemcachedSessionStore) updateIndex(key string, fn func(entries []memcachedIndexEntry) []memcachedIndexEntry) error {
+	for i := 0; i < memcachedCASRetries; i++ {
+		items, err := m.getMulti(key)
+		if err != nil {
+			return err
+		}
+		item, found := items[key]
+		var entries []memcachedIndexEntry
+		if found {
+			if err := json.Unmarshal(item.value, &entries); err != nil {
+				return fmt.Errorf("failed parsing memcached index %v: %v", key, err)
+			}
+		}
+
+		now := time.Now()
+		var kept []memcachedIndexEntry
+		for _, e := range fn(entries) {
+			if e.Expires.IsZero() || now.Before(e.Expires) {
+				kept = append(kept, e)
+			}
+		}
+		value, err := json.Marshal(kept)
+		if err != nil {
+			return err
+		}
+		for len(value) > m.conf.MaxValueSize {
+			kept = kept[len(kept)/10+1:]
+			if value, err = json.Marshal(kept); err != nil {
+				return err
+			}
+		}
+
+		var stored bool
+		if found {
+			stored, err = m.store("cas", key, value, time.Time{}, item.cas)
+		} else {
+			stored, err = m.store("add", key, value, time.Time{}, 0)
+		}
+		if err != nil || stored {
+			return err
+		}
+	}
+	return errMemcachedCASConflict
+}
+
+//readIndexes will return the sessions in the indexes, not expired, and
+// matching keep.
+func (m *MemcachedSessionStore) readIndexes(keep func(s SessionInfo) bool, indexes ...string) ([]SessionInfo, error) {
+	items, err := m.getMulti(indexes...)
+	if err != nil {
+		return nil, err
+	}
+	seen := make(map[string]bool)
+	var keys []string
+	for _, k := range indexes {
+		var entries []memcachedIndexEntry
+		if item, ok := items[k]; ok {
+			if err := json.Unmarshal(item.value, &entries); err != nil {
+				return nil, fmt.Errorf("failed parsing memcached index %v: %v", k, err)
+			}
+		}
+		for _, e := range entries {
+			if !seen[e.ID] {
+				seen[e.ID] = true
+				keys = append(keys, m.key("session", e.ID))
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	items, err = m.getMulti(keys...)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var sessions []SessionInfo
+	for _, k := range keys {
+		item, ok := items[k]
+		if !ok {
+			continue
+		}
+		var s SessionInfo
+		if err := json.Unmarshal(item.value, &s); err != nil {
+			return nil, fmt.Errorf("failed parsing memcached session: %v", err)
+		}
+		if !s.Expires.IsZero() && now.After(s.Expires) {
+			continue
+		}
+		if keep(s) {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions, nil
+}
+
+//Add will add, or replace a session.
+func (m *MemcachedSessionStore) Add(s SessionInfo) error {
+	value, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	if _, err := m.store("set", m.key("session", s.ID), value, s.Expires, 0); err != nil {
+		return err
+	}
+
+	for _, k := range m.indexKeys(s) {
+		err := m.updateIndex(k, func(entries []memcachedIndexEntry) []memcachedIndexEntry {
+			var updated []memcachedIndexEntry
+			for _, e := range entries {
+				if e.ID != s.ID {
+					updated = append(updated, e)
+				}
+			}
+			return append(updated, memcachedIndexEntry{ID: s.ID, Expires: s.Expires})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Get will return the session with the id, and false if not found.
+func (m *MemcachedSessionStore) Get(id string) (SessionInfo, bool, error) {
+	k := m.key("session", id)
+	items, err := m.getMulti(k)
+	if err != nil {
+		return SessionInfo{}, false, err
+	}
+	item, ok := items[k]
+	if !ok {
+		return SessionInfo{}, false, nil
+	}
+	var s SessionInfo
+	if err := json.Unmarshal(item.value, &s); err != nil {
+		return SessionInfo{}, false, fmt.Errorf("failed parsing memcached session: %v", err)
+	}
+	return s, true, nil
+}
+
+//List will return all the sessions that are not expired.
+func (m *MemcachedSessionStore) List() ([]SessionInfo, error) {
+	return m.readIndexes(func(SessionInfo) bool { return true }, m.key("index", "all"))
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user.
+func (m *MemcachedSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	return m.readIndexes(func(s SessionInfo) bool {
+		return s.UserID == user || strings.EqualFold(s.Email, user)
+	}, m.key("index:id", user), m.key("index:email", strings.ToLower(user)))
+}
+
+//Delete will delete the session with the id, and remove it from the
+// indexes.
+func (m *MemcachedSessionStore) Delete(id string) error {
+	s, ok, err := m.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := m.delete(m.key("session", id)); err != nil {
+		return err
+	}
+	if !ok {
+		return nil
+	}
+
+	for _, k := range m.indexKeys(s) {
+		err := m.updateIndex(k, func(entries []memcachedIndexEntry) []memcachedIndexEntry {
+			var updated []memcachedIndexEntry
+			for _, e := range entries {
+				if e.ID != id {
+					updated = append(updated, e)
+				}
+			}
+			return updated
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user, and return the number of sessions deleted.
+func (m *MemcachedSessionStore) DeleteUser(user string) (int, error) {
+	sessions, err := m.ListUser(user)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, s := range sessions {
+		if err := m.Delete(s.ID); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+//Close will close the idle connections to the nodes.
+func (m *MemcachedSessionStore) Close() error {
+	for _, n := range m.nodes {
+		n.mu.Lock()
+		for _, c := range n.idle {
+			c.conn.Close()
+		}
+		n.idle = nil
+		n.mu.Unlock()
+	}
+	return nil
+}
@@ -0,0 +1,214 @@
+package authsession
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+)
+
+//SessionShard is a session store used as a shard of a
+// ShardedSessionStore.
+type SessionShard struct {
+	//Name is the name of the shard, like "redis-a". The sessions are
+	// spread over the shards by their names, so a name must stay the same
+	// when shards are added or removed.
+	Name  string
+	Store SessionStore
+}
+
+//ShardedSessionStore is a SessionStore spreading the sessions over
+// several stores by the session ID with consistent hashing, like over
+// several Redis instances, for deployments outgrowing a single store
+// without moving to a cluster. Adding or removing a shard only moves the
+// sessions of that shard, and the sessions moved are lost, so the users
+// have to log in again. Each session can be kept in several shards, so
+// it can still be read when one of its shards is down. Lists ask every
+// shard.
+type ShardedSessionStore struct {
+	shards   []SessionShard
+	ring     *hashRing
+	replicas int
+}
+
+//NewShardedSessionStore will return a *ShardedSessionStore spreading the
+// sessions over the shards, keeping each session in replicas shards. The
+// default is 1 replica, and replicas are capped to the number of shards.
+func NewShardedSessionStore(shards []SessionShard, replicas int) (*ShardedSessionStore, error) {
+	if len(shards) == 0 {
+		return nil, errors.New("no session store shards given")
+	}
+	if replicas <= 0 {
+		replicas = 1
+	}
+
+	seen := make(map[string]bool)
+	var names []string
+	for _, s := range shards {
+		if s.Name == "" || s.Store == nil {
+			return nil, errors.New("a session store shard needs a name and a store")
+		}
+		if seen[s.Name] {
+			return nil, fmt.Errorf("session store shard %v given twice", s.Name)
+		}
+		seen[s.Name] = true
+		names = append(names, s.Name)
+	}
+
+	return &ShardedSessionStore{
+		shards:   append([]SessionShard{}, shards...),
+		ring:     newHashRing(names),
+		replicas: replicas,
+	}, nil
+}
+
+//shardsOf will return the shards keeping the session with the id.
+func (s *ShardedSessionStore) shardsOf(id string) []SessionShard {
+	var shards []SessionShard
+	for _, i := range s.ring.lookup(id, s.replicas) {
+		shards = append(shards, s.shards[i])
+	}
+	return shards
+}
+
+//Add will add, or replace a session in its shards. A shard failing is
+// logged, and Add only fails if the session could not be added to any of
+// its shards, so logins work while a shard is down.
+func (s *ShardedSessionStore) Add(si SessionInfo) error {
+	var errs []error
+	shards := s.shardsOf(si.ID)
+	for _, sh := range shards {
+		if err := sh.Store.Add(si); err != nil {
+			errs = append(errs, fmt.Errorf("shard %v: %v", sh.Name, err))
+		}
+	}
+	if len(errs) == len(shards) {
+		return errors.Join(errs...)
+	}
+	for _, err := range errs {
+		log.Printf("error: adding session to a replica failed: %v\n", err)
+	}
+	return nil
+}
+
+//Get will return the session with the id from the first of its shards
+// having it, and false if not found or expired. An error is only returned
+// if the session was not found, and a shard failed.
+func (s *ShardedSessionStore) Get(id string) (SessionInfo, bool, error) {
+	var errs []error
+	for _, sh := range s.shardsOf(id) {
+		si, ok, err := sh.Store.Get(id)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("shard %v: %v", sh.Name, err))
+			continue
+		}
+		if ok {
+			return si, true, nil
+		}
+	}
+	return SessionInfo{}, false, errors.Join(errs...)
+}
+
+//list will return the sessions of all the shards given by fn, with the
+// sessions kept in several shards given once.
+func (s *ShardedSessionStore) list(fn func(store SessionStore) ([]SessionInfo, error)) ([]SessionInfo, error) {
+	var sessions []SessionInfo
+	for _, sh := range s.shards {
+		l, err := fn(sh.Store)
+		if err != nil {
+			return nil, fmt.Errorf("shard %v: %v", sh.Name, err)
+		}
+		sessions = mergeSessions(sessions, l)
+	}
+	return sessions, nil
+}
+
+//List will return all the sessions that are not expired, from all the
+// shards.
+func (s *ShardedSessionStore) List() ([]SessionInfo, error) {
+	return s.list(func(store SessionStore) ([]SessionInfo, error) {
+		return store.List()
+	})
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user, from all the shards.
+func (s *ShardedSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	return s.list(func(store SessionStore) ([]SessionInfo, error) {
+		return store.ListUser(user)
+	})
+}
+
+//Delete will delete the session with the id from all its shards. Unlike
+// Add, a shard failing fails the delete, so a revoked session can't be
+// read from a replica.
+func (s *ShardedSessionStore) Delete(id string) error {
+	var errs []error
+	for _, sh := range s.shardsOf(id) {
+		if err := sh.Store.Delete(id); err != nil {
+			errs = append(errs, fmt.Errorf("shard %v: %v", sh.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user from all the shards, and return the number of sessions not
+// expired that were deleted.
+func (s *ShardedSessionStore) DeleteUser(user string) (int, error) {
+	sessions, err := s.ListUser(user)
+	if err != nil {
+		return 0, err
+	}
+	var errs []error
+	for _, sh := range s.shards {
+		if _, err := sh.Store.DeleteUser(user); err != nil {
+			errs = append(errs, fmt.Errorf("shard %v: %v", sh.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return 0, errors.Join(errs...)
+	}
+	return len(sessions), nil
+}
+
+//Cleanup will remove the expired sessions of the shards implementing
+// Cleaner.
+func (s *ShardedSessionStore) Cleanup(now time.Time) (int, error) {
+	var n int
+	var errs []error
+	for _, sh := range s.shards {
+		if c, ok := sh.Store.(Cleaner); ok {
+			removed, err := c.Cleanup(now)
+			n += removed
+			if err != nil {
+				errs = append(errs, fmt.Errorf("shard %v: %v", sh.Name, err))
+			}
+		}
+	}
+	return n, errors.Join(errs...)
+}
+
+//Close will close the shards implementing io.Closer.
+func (s *ShardedSessionStore) Close() error {
+	var errs []error
+	for _, sh := range s.shards {
+		if c, ok := sh.Store.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				errs = append(errs, fmt.Errorf("shard %v: %v", sh.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//ShardNames will return the names of the shards keeping the session with
+// the id, like to find the shard of a session when debugging.
+func (s *ShardedSessionStore) ShardNames(id string) []string {
+	var names []string
+	for _, sh := range s.shardsOf(id) {
+		names = append(names, sh.Name)
+	}
+	return names
+}
@@ -0,0 +1,230 @@
+package authsession
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+//StoreMigrationOptions are the options of MigrateSessions.
+type StoreMigrationOptions struct {
+	//Overwrite will replace the sessions already in the new store. If
+	// not set they are skipped, so the migration can be run again.
+	Overwrite bool
+	//DeleteSource will delete the sessions from the old store when
+	// copied.
+	DeleteSource bool
+	//DryRun will only count the sessions to copy, without changing any
+	// of the stores.
+	DryRun bool
+}
+
+//StoreMigrationResult are the counts of a migration of sessions.
+type StoreMigrationResult struct {
+	//Copied is the number of sessions copied to the new store.
+	Copied int `json:"copied"`
+	//Skipped is the number of sessions already in the new store.
+	Skipped int `json:"skipped"`
+	//Expired is the number of expired sessions not copied.
+	Expired int `json:"expired"`
+}
+
+//MigrateSessions will copy the sessions not expired from one session
+// store to another, so a deployment can change the session store without
+// logging out the users. The sessions keep their IDs, so the cookies of
+// the users stay valid. Run it while the servers use a
+// MigratingSessionStore, so sessions added or deleted during the copy are
+// not lost. Sessions kept only in cookies can't be listed, so they can't
+// be migrated.
+func MigrateSessions(ctx context.Context, from SessionStore, to SessionStore, o StoreMigrationOptions) (StoreMigrationResult, error) {
+	var res StoreMigrationResult
+
+	sessions, err := from.List()
+	if err != nil {
+		return res, err
+	}
+	now := time.Now()
+	for _, s := range sessions {
+		if err := ctx.Err(); err != nil {
+			return res, err
+		}
+		if !s.Expires.IsZero() && now.After(s.Expires) {
+			res.Expired++
+			continue
+		}
+		if !o.Overwrite {
+			_, found, err := to.Get(s.ID)
+			if err != nil {
+				return res, err
+			}
+			if found {
+				res.Skipped++
+				continue
+			}
+		}
+
+		if o.DryRun {
+			res.Copied++
+			continue
+		}
+		if err := to.Add(s); err != nil {
+			return res, err
+		}
+		//A session revoked while copied is deleted from the new store too,
+		// so it doesn't come back.
+		_, found, err := from.Get(s.ID)
+		if err != nil {
+			return res, err
+		}
+		if !found {
+			if err := to.Delete(s.ID); err != nil {
+				return res, err
+			}
+			continue
+		}
+		if o.DeleteSource {
+			if err := from.Delete(s.ID); err != nil {
+				return res, err
+			}
+		}
+		res.Copied++
+	}
+	return res, nil
+}
+
+//MigratingSessionStore is a SessionStore used while the sessions are
+// moved from an old store to a new one with MigrateSessions. New sessions
+// are added to the new store, sessions not yet in the new store are read
+// from the old store and copied when used, and deletes are done in both,
+// so a revoked session can't come back from the old store. When the
+// migration is done, use the new store alone.
+type MigratingSessionStore struct {
+	from SessionStore
+	to   SessionStore
+}
+
+//NewMigratingSessionStore will return a *MigratingSessionStore moving the
+// sessions from the store from to the store to.
+func NewMigratingSessionStore(from SessionStore, to SessionStore) *MigratingSessionStore {
+	return &MigratingSessionStore{from: from, to: to}
+}
+
+//Add will add, or replace a session in the new store.
+func (m *MigratingSessionStore) Add(s SessionInfo) error {
+	return m.to.Add(s)
+}
+
+//Get will return the session with the id from the new store, or from the
+// old store, copying it to the new store.
+func (m *MigratingSessionStore) Get(id string) (SessionInfo, bool, error) {
+	s, ok, err := m.to.Get(id)
+	if err != nil || ok {
+		return s, ok, err
+	}
+
+	s, ok, err = m.from.Get(id)
+	if err != nil || !ok {
+		return s, ok, err
+	}
+	if err := m.to.Add(s); err != nil {
+		return s, false, err
+	}
+	return s, true, nil
+}
+
+//mergeSessions will return the sessions of both stores, where the
+// sessions of the new store replace the sessions with the same ID in the
+// old store.
+func mergeSessions(to []SessionInfo, from []SessionInfo) []SessionInfo {
+	seen := make(map[string]bool, len(to))
+	for _, s := range to {
+		seen[s.ID] = true
+	}
+	for _, s := range from {
+		if !seen[s.ID] {
+			to = append(to, s)
+		}
+	}
+	return to
+}
+
+//List will return all the sessions that are not expired, from both
+// stores.
+func (m *MigratingSessionStore) List() ([]SessionInfo, error) {
+	to, err := m.to.List()
+	if err != nil {
+		return nil, err
+	}
+	from, err := m.from.List()
+	if err != nil {
+		return nil, err
+	}
+	return mergeSessions(to, from), nil
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user, from both stores.
+func (m *MigratingSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	to, err := m.to.ListUser(user)
+	if err != nil {
+		return nil, err
+	}
+	from, err := m.from.ListUser(user)
+	if err != nil {
+		return nil, err
+	}
+	return mergeSessions(to, from), nil
+}
+
+//Delete will delete the session with the id from both stores.
+func (m *MigratingSessionStore) Delete(id string) error {
+	if err := m.from.Delete(id); err != nil {
+		return err
+	}
+	return m.to.Delete(id)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user from both stores, and return the number of sessions not
+// expired that were deleted.
+func (m *MigratingSessionStore) DeleteUser(user string) (int, error) {
+	sessions, err := m.ListUser(user)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := m.from.DeleteUser(user); err != nil {
+		return 0, err
+	}
+	if _, err := m.to.DeleteUser(user); err != nil {
+		return 0, err
+	}
+	return len(sessions), nil
+}
+
+//Cleanup will remove the expired sessions of the stores implementing
+// Cleaner.
+func (m *MigratingSessionStore) Cleanup(now time.Time) (int, error) {
+	var n int
+	for _, s := range []SessionStore{m.from, m.to} {
+		if c, ok := s.(Cleaner); ok {
+			removed, err := c.Cleanup(now)
+			n += removed
+			if err != nil {
+				return n, err
+			}
+		}
+	}
+	return n, nil
+}
+
+//Close will close the stores implementing io.Closer.
+func (m *MigratingSessionStore) Close() error {
+	var errs []error
+	for _, s := range []SessionStore{m.from, m.to} {
+		if c, ok := s.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,420 @@
+package authsession
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+//readyPath is the path of the readiness endpoint.
+const readyPath = "/auth/ready"
+
+//defaultSlowStoreOperation is the duration of a store operation which is
+// logged as slow, unless set with WithStoreObservability.
+const defaultSlowStoreOperation = 100 * time.Millisecond
+
+//StoreOperation is a finished operation of one of the stores, like a Get
+// of the session store.
+type StoreOperation struct {
+	//Store is the store, "sessions", "bans", "epochs" or "users".
+	Store string
+	//Op is the method called, like "Get".
+	Op       string
+	Start    time.Time
+	Duration time.Duration
+	Err      error
+}
+
+//StoreObservability is how the operations of the stores are observed, set
+// with WithStoreObservability.
+type StoreObservability struct {
+	//SlowThreshold is the duration of an operation which is logged as
+	// slow, and makes the store degraded in the readiness endpoint. The
+	// default is 100ms.
+	SlowThreshold time.Duration
+	//Observer is called with every operation when done, like to export
+	// metrics, or to record a tracing span with the start and the
+	// duration. It must not block.
+	Observer func(op StoreOperation)
+}
+
+//StoreStats are the counts of the operations of a store, by method.
+type StoreStats struct {
+	Store         string        `json:"store"`
+	Op            string        `json:"op"`
+	Calls         int           `json:"calls"`
+	Errors        int           `json:"errors"`
+	Slow          int           `json:"slow"`
+	TotalDuration time.Duration `json:"totalDuration"`
+	MaxDuration   time.Duration `json:"maxDuration"`
+	LastError     string        `json:"lastError,omitempty"`
+}
+
+//storeObserver keeps the stats of the store operations.
+type storeObserver struct {
+	conf StoreObservability
+
+	mu    sync.Mutex
+	stats map[[2]string]*StoreStats
+}
+
+//observe will record the operation op of the store started at start,
+// log it if slow, and give it to the observer.
+func (o *storeObserver) observe(store string, op string, start time.Time, err error) {
+	d := time.Since(start)
+	threshold := o.conf.SlowThreshold
+	if threshold <= 0 {
+		threshold = defaultSlowStoreOperation
+	}
+	slow := d >= threshold
+
+	o.mu.Lock()
+	if o.stats == nil {
+		o.stats = make(map[[2]string]*StoreStats)
+	}
+	st, ok := o.stats[[2]string{store, op}]
+	if !ok {
+		st = &StoreStats{Store: store, Op: op}
+		o.stats[[2]string{store, op}] = st
+	}
+	st.Calls++
+	st.TotalDuration += d
+	if d > st.MaxDuration {
+		st.MaxDuration = d
+	}
+	if slow {
+		st.Slow++
+	}
+	if err != nil {
+		st.Errors++
+		st.LastError = err.Error()
+	}
+	o.mu.Unlock()
+
+	if slow {
+		log.Printf("warning: slow %v store %v took %v\n", store, op, d)
+	}
+	if o.conf.Observer != nil {
+		o.conf.Observer(StoreOperation{Store: store, Op: op, Start: start, Duration: d, Err: err})
+	}
+}
+
+//StoreStats will return the counts of the operations of the stores,
+// sorted by store and method.
+func (a *Auth) StoreStats() []StoreStats {
+	a.storeObserver.mu.Lock()
+	defer a.storeObserver.mu.Unlock()
+
+	var stats []StoreStats
+	for _, st := range a.storeObserver.stats {
+		stats = append(stats, *st)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if stats[i].Store != stats[j].Store {
+			return stats[i].Store < stats[j].Store
+		}
+		return stats[i].Op < stats[j].Op
+	})
+	return stats
+}
+
+//storeWrapper is implemented by the stores wrapping another store, so the
+// store set can be found, like to check if it implements Cleaner.
+type storeWrapper interface {
+	unwrapStore() interface{}
+}
+
+//unwrapStore will return the store wrapped by v, like for the
+// observability or the replication, or v if not wrapped.
+func unwrapStore(v interface{}) interface{} {
+	for {
+		w, ok := v.(storeWrapper)
+		if !ok {
+			return v
+		}
+		v = w.unwrapStore()
+	}
+}
+
+//observeStores will wrap the stores set, so their operations are
+// observed.
+func (a *Auth) observeStores() {
+	o := &a.storeObserver
+	if a.sessions != nil {
+		a.sessions = &observedSessionStore{store: a.sessions, o: o}
+	}
+	if a.bans != nil {
+		a.bans = &observedBanStore{store: a.bans, o: o}
+	}
+	if a.epochs != nil {
+		a.epochs = &observedEpochStore{store: a.epochs, o: o}
+	}
+	if a.users != nil {
+		a.users = &observedUserStore{store: a.users, o: o}
+	}
+}
+
+//observedSessionStore is a SessionStore observing the operations of
+// another SessionStore.
+type observedSessionStore struct {
+	store SessionStore
+	o     *storeObserver
+}
+
+//unwrapStore will return the store observed.
+func (s *observedSessionStore) unwrapStore() interface{} { return s.store }
+
+//Add will call Add of the store, and observe it.
+func (s *observedSessionStore) Add(si SessionInfo) error {
+	start := time.Now()
+	err := s.store.Add(si)
+	s.o.observe("sessions", "Add", start, err)
+	return err
+}
+
+//Get will call Get of the store, and observe it.
+func (s *observedSessionStore) Get(id string) (SessionInfo, bool, error) {
+	start := time.Now()
+	si, ok, err := s.store.Get(id)
+	s.o.observe("sessions", "Get", start, err)
+	return si, ok, err
+}
+
+//List will call List of the store, and observe it.
+func (s *observedSessionStore) List() ([]SessionInfo, error) {
+	start := time.Now()
+	list, err := s.store.List()
+	s.o.observe("sessions", "List", start, err)
+	return list, err
+}
+
+//ListUser will call ListUser of the store, and observe it.
+func (s *observedSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	start := time.Now()
+	list, err := s.store.ListUser(user)
+	s.o.observe("sessions", "ListUser", start, err)
+	return list, err
+}
+
+//Delete will call Delete of the store, and observe it.
+func (s *observedSessionStore) Delete(id string) error {
+	start := time.Now()
+	err := s.store.Delete(id)
+	s.o.observe("sessions", "Delete", start, err)
+	return err
+}
+
+//DeleteUser will call DeleteUser of the store, and observe it.
+func (s *observedSessionStore) DeleteUser(user string) (int, error) {
+	start := time.Now()
+	n, err := s.store.DeleteUser(user)
+	s.o.observe("sessions", "DeleteUser", start, err)
+	return n, err
+}
+
+//observedBanStore is a BanStore observing the operations of another
+// BanStore.
+type observedBanStore struct {
+	store BanStore
+	o     *storeObserver
+}
+
+//unwrapStore will return the store observed.
+func (s *observedBanStore) unwrapStore() interface{} { return s.store }
+
+//Ban will call Ban of the store, and observe it.
+func (s *observedBanStore) Ban(b Ban) error {
+	start := time.Now()
+	err := s.store.Ban(b)
+	s.o.observe("bans", "Ban", start, err)
+	return err
+}
+
+//Unban will call Unban of the store, and observe it.
+func (s *observedBanStore) Unban(ip string) error {
+	start := time.Now()
+	err := s.store.Unban(ip)
+	s.o.observe("bans", "Unban", start, err)
+	return err
+}
+
+//IsBanned will call IsBanned of the store, and observe it.
+func (s *observedBanStore) IsBanned(ip string) (bool, error) {
+	start := time.Now()
+	banned, err := s.store.IsBanned(ip)
+	s.o.observe("bans", "IsBanned", start, err)
+	return banned, err
+}
+
+//List will call List of the store, and observe it.
+func (s *observedBanStore) List() ([]Ban, error) {
+	start := time.Now()
+	list, err := s.store.List()
+	s.o.observe("bans", "List", start, err)
+	return list, err
+}
+
+//observedEpochStore is an EpochStore observing the operations of another
+// EpochStore.
+type observedEpochStore struct {
+	store EpochStore
+	o     *storeObserver
+}
+
+//unwrapStore will return the store observed.
+func (s *observedEpochStore) unwrapStore() interface{} { return s.store }
+
+//Get will call Get of the store, and observe it.
+func (s *observedEpochStore) Get(user string) (int64, error) {
+	start := time.Now()
+	epoch, err := s.store.Get(user)
+	s.o.observe("epochs", "Get", start, err)
+	return epoch, err
+}
+
+//Increment will call Increment of the store, and observe it.
+func (s *observedEpochStore) Increment(user string) (int64, error) {
+	start := time.Now()
+	epoch, err := s.store.Increment(user)
+	s.o.observe("epochs", "Increment", start, err)
+	return epoch, err
+}
+
+//observedUserStore is a UserStore observing the operations of another
+// UserStore.
+type observedUserStore struct {
+	store UserStore
+	o     *storeObserver
+}
+
+//unwrapStore will return the store observed.
+func (s *observedUserStore) unwrapStore() interface{} { return s.store }
+
+//Put will call Put of the store, and observe it.
+func (s *observedUserStore) Put(u UserRecord) error {
+	start := time.Now()
+	err := s.store.Put(u)
+	s.o.observe("users", "Put", start, err)
+	return err
+}
+
+//Get will call Get of the store, and observe it.
+func (s *observedUserStore) Get(email string) (UserRecord, bool, error) {
+	start := time.Now()
+	u, ok, err := s.store.Get(email)
+	s.o.observe("users", "Get", start, err)
+	return u, ok, err
+}
+
+//List will call List of the store, and observe it.
+func (s *observedUserStore) List() ([]UserRecord, error) {
+	start := time.Now()
+	list, err := s.store.List()
+	s.o.observe("users", "List", start, err)
+	return list, err
+}
+
+//StoreHealth is the health of a store in the readiness endpoint.
+type StoreHealth struct {
+	Store string `json:"store"`
+	//Status is "ok", "degraded" if the store answered slower than the
+	// slow threshold, or "down" if it failed.
+	Status  string        `json:"status"`
+	Latency time.Duration `json:"latency"`
+	//Error is the error of a store down, which is logged but not given
+	// by the readiness endpoint, since it can tell about the internals.
+	Error string `json:"-"`
+}
+
+//Readiness will check the stores set by reading from them, and return
+// their health, and false if any of them failed.
+func (a *Auth) Readiness(ctx context.Context) ([]StoreHealth, bool) {
+	type probe struct {
+		store string
+		read  func() error
+	}
+	var probes []probe
+	if a.sessions != nil {
+		probes = append(probes, probe{"sessions", func() error { _, _, err := a.sessions.Get("readiness-probe"); return err }})
+	}
+	if a.bans != nil {
+		probes = append(probes, probe{"bans", func() error { _, err := a.bans.IsBanned("0.0.0.0"); return err }})
+	}
+	if a.epochs != nil {
+		probes = append(probes, probe{"epochs", func() error { _, err := a.epochs.Get("readiness-probe"); return err }})
+	}
+	if a.users != nil {
+		probes = append(probes, probe{"users", func() error { _, _, err := a.users.Get("readiness-probe"); return err }})
+	}
+
+	threshold := a.storeObserver.conf.SlowThreshold
+	if threshold <= 0 {
+		threshold = defaultSlowStoreOperation
+	}
+	health := make([]StoreHealth, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			start := time.Now()
+			done := make(chan error, 1)
+			go func() { done <- p.read() }()
+			h := StoreHealth{Store: p.store, Status: "ok"}
+			select {
+			case err := <-done:
+				if err != nil {
+					h.Status, h.Error = "down", err.Error()
+				}
+			case <-ctx.Done():
+				h.Status, h.Error = "down", ctx.Err().Error()
+			}
+			h.Latency = time.Since(start)
+			if h.Status == "ok" && h.Latency >= threshold {
+				h.Status = "degraded"
+			}
+			health[i] = h
+		}()
+	}
+	wg.Wait()
+
+	ready := true
+	for _, h := range health {
+		if h.Status == "down" {
+			ready = false
+		}
+	}
+	return health, ready
+}
+
+//ready will write the health of the stores as JSON, with the status 503
+// if any of them failed, for the readiness probe of the deployment.
+func (a *Auth) ready(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		a.writeJSONMessage(w, r, http.StatusMethodNotAllowed, "error.method_not_allowed")
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+	defer cancel()
+	health, ok := a.Readiness(ctx)
+	for _, h := range health {
+		if h.Error != "" {
+			logRequestf(r, "error: readiness: %v store is down: %v\n", h.Store, h.Error)
+		}
+	}
+
+	status := http.StatusOK
+	if !ok {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	writeJSON(w, status, struct {
+		Ready  bool          `json:"ready"`
+		Stores []StoreHealth `json:"stores"`
+	}{ok, health})
+}
@@ -0,0 +1,169 @@
+package authsession
+
+import (
+	"context"
+	"crypto/subtle"
+	"html/template"
+	"net/http"
+
+	"github.com/gorilla/sessions"
+)
+
+//csrfFieldName is the name of the form field, and csrfHeader the header,
+// holding the CSRF token made by CSRFToken.
+const (
+	csrfFieldName = "csrf_token"
+	csrfHeader    = "X-CSRF-Token"
+)
+
+//sessionUser is the user of an authenticated session, kept in the
+// request context by IsAuthenticated.
+type sessionUser struct {
+	user User
+	sid  string
+}
+
+//hasRole will return true if the user has the role.
+func (su sessionUser) hasRole(role string) bool {
+	return contains(su.user.Roles, role)
+}
+
+//hasPermission will return true if the user has the permission.
+func (su sessionUser) hasPermission(permission string) bool {
+	return contains(su.user.Permissions, permission)
+}
+
+//contains will return true if the list has s.
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+//sessionUserKey is the context key of the user of the session.
+type sessionUserKey struct{}
+
+//newSessionUser will return the user of the values of an authenticated
+// session.
+func (a *Auth) newSessionUser(r *http.Request, values map[interface{}]interface{}) sessionUser {
+	s := &Session{s: &sessions.Session{Values: values}}
+	return sessionUser{user: a.sessionRoles(r, values, s.User()), sid: s.ID()}
+}
+
+//withSessionUser will return the request with the user of the values of
+// an authenticated session in the context.
+func (a *Auth) withSessionUser(r *http.Request, values map[interface{}]interface{}) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, a.newSessionUser(r, values)))
+}
+
+//CurrentUser will return the user of the session, in the context of a
+// request to a handler wrapped with IsAuthenticated, and false if there
+// is none.
+func CurrentUser(ctx context.Context) (User, bool) {
+	su, ok := ctx.Value(sessionUserKey{}).(sessionUser)
+	return su.user, ok
+}
+
+//sessionUserOf will return the user of the session of the request, from
+// the context if set by IsAuthenticated, or else from the session cookie.
+func (a *Auth) sessionUserOf(r *http.Request) (sessionUser, bool) {
+	if su, ok := r.Context().Value(sessionUserKey{}).(sessionUser); ok {
+		return su, true
+	}
+	session, ok := a.authenticated(r)
+	if !ok {
+		return sessionUser{}, false
+	}
+	return a.newSessionUser(r, session.Values), true
+}
+
+//CSRFToken will return a token to put in forms and in the X-CSRF-Token
+// header of requests done by scripts, checked with VerifyCSRFToken. The
+// token is bound to the session, and an empty string is returned if the
+// request has no authenticated session.
+func (a *Auth) CSRFToken(r *http.Request) string {
+	su, ok := a.sessionUserOf(r)
+	if !ok || su.sid == "" {
+		return ""
+	}
+	token, err := a.codec.Encode("csrf", su.sid)
+	if err != nil {
+		a.logRequestError(r, "error: failed to create csrf token: ", err)
+		return ""
+	}
+	return token
+}
+
+//VerifyCSRFToken will return true if the request has a token made by
+// CSRFToken for its session, in the csrf_token form field or the
+// X-CSRF-Token header.
+func (a *Auth) VerifyCSRFToken(r *http.Request) bool {
+	su, ok := a.sessionUserOf(r)
+	if !ok || su.sid == "" {
+		return false
+	}
+	token := r.Header.Get(csrfHeader)
+	if token == "" {
+		token = r.PostFormValue(csrfFieldName)
+	}
+	var sid string
+	if err := a.codec.Decode("csrf", token, &sid); err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(sid), []byte(su.sid)) == 1
+}
+
+//TemplateFuncs will return the html/template functions for the session
+// of the request, so server-rendered pages can show menus and guards
+// without the Auth:
+//
+//   - isAuthenticated returns true if the user is logged in.
+//   - currentUser returns the User, with ID, Email and FullName set.
+//   - hasRole returns true if the user has the role, like from LDAP.
+//   - hasPermission returns true if the user has the permission.
+//   - csrfField returns a hidden csrf_token input for forms.
+//   - loginURL returns the url to log in and come back to the page.
+//   - logoutURL returns the url to log out.
+//
+// Parse the templates with TemplateFuncs(nil), which gives the functions
+// of a user not logged in, and execute a clone with the functions of the
+// request, like t.Clone() followed by Funcs(a.TemplateFuncs(r)).
+func (a *Auth) TemplateFuncs(r *http.Request) template.FuncMap {
+	var su sessionUser
+	var ok bool
+	if r != nil {
+		su, ok = a.sessionUserOf(r)
+	}
+
+	return template.FuncMap{
+		"isAuthenticated": func() bool { return ok },
+		"currentUser":     func() User { return su.user },
+		"hasRole":         su.hasRole,
+		"hasPermission":   su.hasPermission,
+		"csrfField": func() template.HTML {
+			if r == nil {
+				return ""
+			}
+			token := a.CSRFToken(r)
+			if token == "" {
+				return ""
+			}
+			return template.HTML(`<input type="hidden" name="` + csrfFieldName + `" value="` + template.HTMLEscapeString(token) + `">`)
+		},
+		"loginURL": func() string {
+			if r == nil {
+				return "/slogin"
+			}
+			return a.loginURLReturningTo(r)
+		},
+		"logoutURL": func() string {
+			if r == nil {
+				return "/slogout"
+			}
+			return a.tenantPath(r, "/slogout")
+		},
+	}
+}
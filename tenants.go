@@ -0,0 +1,258 @@
+package authsession
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/sessions"
+	"golang.org/x/oauth2"
+)
+
+//TenantFrom tells where the tenant is found in the request.
+type TenantFrom int
+
+const (
+	//TenantFromHost will use the host name of the request as the tenant
+	// ID, like customer.example.com.
+	TenantFromHost TenantFrom = iota
+	//TenantFromPath will use the first part of the path as the tenant
+	// ID, like /customer/slogin. Run will then also register the login,
+	// logout and callback handlers under /{tenant}/.
+	TenantFromPath
+)
+
+//Branding is the look of the built-in pages, set with WithBranding, and
+// for each tenant. Empty values are left out of the pages.
+type Branding struct {
+	//ProductName is shown in the title and the header of the pages.
+	ProductName string `json:"productName"`
+	//LogoURL is the logo shown in the header of the pages.
+	LogoURL string `json:"logoURL"`
+	//Colors are CSS custom properties set on the pages, like
+	// {"primary": "#0a6cff"} which sets --primary. The built-in pages use
+	// primary, background and text.
+	Colors map[string]string `json:"colors,omitempty"`
+	//FooterLinks are the links shown in the footer of the pages, like
+	// the privacy policy or the support page.
+	FooterLinks []Link `json:"footerLinks,omitempty"`
+}
+
+//Link is a link with the text to show.
+type Link struct {
+	Text string `json:"text"`
+	URL  string `json:"url"`
+}
+
+//merge will return b with the values set in o replacing the values of b.
+func (b Branding) merge(o Branding) Branding {
+	if o.ProductName != "" {
+		b.ProductName = o.ProductName
+	}
+	if o.LogoURL != "" {
+		b.LogoURL = o.LogoURL
+	}
+	if len(o.Colors) > 0 {
+		colors := make(map[string]string, len(b.Colors)+len(o.Colors))
+		for k, v := range b.Colors {
+			colors[k] = v
+		}
+		for k, v := range o.Colors {
+			colors[k] = v
+		}
+		b.Colors = colors
+	}
+	if len(o.FooterLinks) > 0 {
+		b.FooterLinks = o.FooterLinks
+	}
+	return b
+}
+
+//Tenant holds the settings for one tenant, each having its own oauth
+// app with the provider, and its own sessions.
+type Tenant struct {
+	//ID is the host name, or the first part of the path for the tenant.
+	ID string `json:"id"`
+	//ClientID is the Client ID key for the oauth app of the tenant.
+	ClientID string `json:"clientID"`
+	//ClientSecret is the client secret for the oauth app of the tenant.
+	ClientSecret string `json:"clientSecret"`
+	//RedirectURL is the callback registered for the oauth app of the
+	// tenant. If empty the redirect URL given to NewAuth is used, with the
+	// path /{tenant}/callback when the tenant is found in the path.
+	RedirectURL string `json:"redirectURL"`
+	//AllowList are the emails, or domains starting with @, allowed to
+	// log in for the tenant. All users are allowed if empty.
+	AllowList []string `json:"allowList"`
+	Branding  Branding `json:"branding"`
+}
+
+//allowed will return true if the tenant allows the email to log in.
+func (t Tenant) allowed(email string) bool {
+	if len(t.AllowList) == 0 {
+		return true
+	}
+
+	email = strings.ToLower(email)
+	domain := emailDomain(email)
+
+	for _, e := range t.AllowList {
+		e = strings.ToLower(e)
+		if e == email || (domain != "" && e == domain) {
+			return true
+		}
+	}
+	return false
+}
+
+//TenantStore keeps the tenants.
+type TenantStore interface {
+	//Put will add, or replace a tenant.
+	Put(t Tenant) error
+	//Get will return the tenant with the id, and false if not found.
+	Get(id string) (Tenant, bool, error)
+	//Delete will delete the tenant with the id.
+	Delete(id string) error
+	//List will return all the tenants.
+	List() ([]Tenant, error)
+}
+
+//FileTenantStore is a TenantStore keeping the tenants in a JSON file.
+type FileTenantStore struct {
+	m *jsonFileMap[Tenant]
+}
+
+//NewFileTenantStore will return a *FileTenantStore storing the tenants
+// in the file at path. If path is empty the tenants are only kept in memory.
+func NewFileTenantStore(path string) *FileTenantStore {
+	return &FileTenantStore{
+		m: newJSONFileMap[Tenant](path),
+	}
+}
+
+//Put will add, or replace a tenant.
+func (f *FileTenantStore) Put(t Tenant) error {
+	return f.m.update(func(m map[string]Tenant) error {
+		m[t.ID] = t
+		return nil
+	})
+}
+
+//Get will return the tenant with the id, and false if not found.
+func (f *FileTenantStore) Get(id string) (Tenant, bool, error) {
+	var t Tenant
+	var ok bool
+	err := f.m.view(func(m map[string]Tenant) error {
+		t, ok = m[id]
+		return nil
+	})
+	return t, ok, err
+}
+
+//Delete will delete the tenant with the id.
+func (f *FileTenantStore) Delete(id string) error {
+	return f.m.update(func(m map[string]Tenant) error {
+		delete(m, id)
+		return nil
+	})
+}
+
+//List will return all the tenants.
+func (f *FileTenantStore) List() ([]Tenant, error) {
+	var tenants []Tenant
+	err := f.m.view(func(m map[string]Tenant) error {
+		for _, t := range m {
+			tenants = append(tenants, t)
+		}
+		return nil
+	})
+	return tenants, err
+}
+
+//tenantID will return the ID of the tenant for the request.
+func (a *Auth) tenantID(r *http.Request) string {
+	if a.tenantFrom == TenantFromPath {
+		if id := r.PathValue("tenant"); id != "" {
+			return id
+		}
+		p := strings.TrimPrefix(r.URL.Path, "/")
+		if i := strings.Index(p, "/"); i >= 0 {
+			p = p[:i]
+		}
+		return p
+	}
+
+	host, _, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = r.Host
+	}
+	return strings.ToLower(host)
+}
+
+//Tenant will return the tenant for the request. It returns false if
+// tenants are not used, or the tenant is not found.
+func (a *Auth) Tenant(r *http.Request) (Tenant, bool) {
+	if a.tenants == nil {
+		return Tenant{}, false
+	}
+
+	t, ok, err := a.tenants.Get(a.tenantID(r))
+	if err != nil {
+		a.logRequestError(r, "error: tenant store Get failed: ", err)
+		return Tenant{}, false
+	}
+	return t, ok
+}
+
+//oauthConfig will return the oauth config to use for the request. When
+// tenants are used it is the config for the oauth app of the tenant, and
+// an error is returned if the tenant is not found.
+func (a *Auth) oauthConfig(r *http.Request) (*oauth2.Config, error) {
+	if a.tenants == nil {
+		return a.googleOauthConfig, nil
+	}
+
+	t, ok := a.Tenant(r)
+	if !ok {
+		return nil, fmt.Errorf("unknown tenant %q", a.tenantID(r))
+	}
+
+	c := *a.googleOauthConfig
+	c.ClientID = t.ClientID
+	c.ClientSecret = t.ClientSecret
+	switch {
+	case t.RedirectURL != "":
+		c.RedirectURL = t.RedirectURL
+	case a.tenantFrom == TenantFromPath:
+		//The callback must be under the path of the tenant, to find the
+		// tenant and get the session cookie limited to the path.
+		u, err := url.Parse(c.RedirectURL)
+		if err != nil {
+			return nil, fmt.Errorf("redirect url %q is not valid: %v", c.RedirectURL, err)
+		}
+		u.Path = "/" + t.ID + "/callback"
+		c.RedirectURL = u.String()
+	}
+	return &c, nil
+}
+
+//tenantPath will return p prefixed with /{tenant} when the tenant is
+// found in the path, so redirects stays within the tenant.
+func (a *Auth) tenantPath(r *http.Request, p string) string {
+	if a.tenants == nil || a.tenantFrom != TenantFromPath {
+		return p
+	}
+	return "/" + a.tenantID(r) + p
+}
+
+//setTenantCookiePath will limit the session cookie to the path of the
+// tenant when the tenant is found in the path, so the sessions for the
+// tenants are kept in separate cookies.
+func (a *Auth) setTenantCookiePath(r *http.Request, options *sessions.Options) {
+	if a.tenants == nil || a.tenantFrom != TenantFromPath {
+		return
+	}
+	options.Path = "/" + a.tenantID(r)
+}
@@ -0,0 +1,130 @@
+package authsession
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+//termsPath is where users accept the terms of service.
+const termsPath = "/auth/terms"
+
+//reasonTermsNotAccepted is the reason given by checkSession for the
+// sessions of users who have not accepted the current terms.
+const reasonTermsNotAccepted = "terms not accepted"
+
+//Terms are the terms of service users must accept before their session
+// can be used, set with WithTerms.
+type Terms struct {
+	//Version is the version of the terms. Users accept the terms again
+	// when it is changed.
+	Version string
+	//URL is where the terms can be read.
+	URL string
+}
+
+//termsPending will return true if the session would be valid, except
+// the user has not accepted the current terms.
+func (a *Auth) termsPending(r *http.Request, values map[interface{}]interface{}) bool {
+	if a.terms == nil {
+		return false
+	}
+	_, reason := a.checkSession(r, values)
+	return reason == reasonTermsNotAccepted
+}
+
+//termsURL will return the url of the terms page, which brings the user
+// back to the local path p when the terms are accepted.
+func (a *Auth) termsURL(r *http.Request, p string) string {
+	value, err := a.SignReturnTo(p)
+	if err != nil {
+		a.logRequestError(r, "error: failed to sign return to: ", err)
+		return termsPath
+	}
+	return termsPath + "?" + url.Values{"return_to": {value}}.Encode()
+}
+
+//acceptTerms will show the terms page with GET, and record that the user
+// has accepted the current terms in the user store with a POST from the
+// form of the page. The user is then sent to the page signed in the
+// return_to query parameter, or the start page.
+func (a *Auth) acceptTerms(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "no-store")
+
+	session, err := a.store.Get(r, "cookie-name")
+	if err != nil {
+		a.logRequestError(r, "error: store.Get in "+termsPath+": ", err)
+	}
+
+	next := a.tenantPath(r, "/")
+	if p, ok := a.VerifyReturnTo(r.URL.Query().Get("return_to")); ok {
+		next = p
+	}
+	ok, reason := a.checkSession(r, session.Values)
+	if ok {
+		a.safeRedirect(w, r, next, http.StatusSeeOther)
+		return
+	}
+	if reason != reasonTermsNotAccepted {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		token, err := a.newKey(16, KeyBase64URLPadded)
+		if err != nil {
+			a.logRequestError(r, "error: failed to create terms token: ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		session.Values["termstoken"] = token
+		a.setTenantCookiePath(r, session.Options)
+		if err := session.Save(r, w); err != nil {
+			a.logRequestError(r, "error: session.Save in "+termsPath+": ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		a.renderPage(w, r, http.StatusOK, pageTerms, PageData{TermsURL: a.terms.URL, TermsVersion: a.terms.Version, FormToken: token})
+
+	case http.MethodPost:
+		token, _ := session.Values["termstoken"].(string)
+		if token == "" || subtle.ConstantTimeCompare([]byte(token), []byte(r.PostFormValue("terms_token"))) != 1 {
+			a.logRequestError(r, "error: terms token missing or not valid")
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		delete(session.Values, "termstoken")
+
+		email, _ := session.Values[sessionKeyEmail].(string)
+		u, found, err := a.users.Get(email)
+		if err != nil {
+			a.logRequestError(r, "error: user store Get failed: ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !found {
+			u = UserRecord{Email: email, Created: time.Now()}
+		}
+		u.TermsVersion = a.terms.Version
+		u.TermsAccepted = time.Now()
+		if err := a.users.Put(u); err != nil {
+			a.logRequestError(r, "error: user store Put failed: ", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		logRequestf(r, "info: %v accepted the terms version %v\n", a.LogIdentifier(email), a.terms.Version)
+
+		a.setTenantCookiePath(r, session.Options)
+		if err := session.Save(r, w); err != nil {
+			a.logRequestError(r, "error: session.Save in "+termsPath+": ", err)
+		}
+		a.safeRedirect(w, r, next, http.StatusSeeOther)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
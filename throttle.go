@@ -0,0 +1,185 @@
+package authsession
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//maxThrottleKeys is the number of IPs and users with failed logins kept,
+// before the ones with no recent failures are removed.
+const maxThrottleKeys = 10000
+
+//LoginThrottle is how many failed logins are allowed before logins are
+// refused for a while, set with WithLoginThrottle. The failures are
+// counted both for the IP and for the user, like the username given to
+// the LDAP login form.
+type LoginThrottle struct {
+	//Attempts is the number of failed logins allowed within Window.
+	Attempts int
+	Window   time.Duration
+	//Lockout is how long logins are refused when the attempts are used,
+	// which defaults to Window.
+	Lockout time.Duration
+}
+
+//loginThrottle keeps the failed logins and the lockouts.
+type loginThrottle struct {
+	conf LoginThrottle
+
+	mu       sync.Mutex
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+}
+
+//newLoginThrottle will return a *loginThrottle for the conf.
+func newLoginThrottle(conf LoginThrottle) *loginThrottle {
+	if conf.Lockout == 0 {
+		conf.Lockout = conf.Window
+	}
+	return &loginThrottle{
+		conf:     conf,
+		failures: map[string][]time.Time{},
+		locked:   map[string]time.Time{},
+	}
+}
+
+//throttleKeys will return the keys the failed logins are counted for,
+// which are the IP and the user if known.
+func throttleKeys(ip string, user string) []string {
+	keys := []string{"ip:" + ip}
+	if user != "" {
+		keys = append(keys, "user:"+strings.ToLower(user))
+	}
+	return keys
+}
+
+//failure will count a failed login for the keys, and lock them out when
+// the attempts are used.
+func (t *loginThrottle) failure(now time.Time, keys ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.failures) > maxThrottleKeys {
+		t.prune(now)
+	}
+	for _, key := range keys {
+		var recent []time.Time
+		for _, f := range t.failures[key] {
+			if now.Sub(f) < t.conf.Window {
+				recent = append(recent, f)
+			}
+		}
+		recent = append(recent, now)
+
+		if len(recent) >= t.conf.Attempts {
+			t.locked[key] = now.Add(t.conf.Lockout)
+			delete(t.failures, key)
+			continue
+		}
+		t.failures[key] = recent
+	}
+}
+
+//prune will remove the failures and lockouts which no longer count.
+func (t *loginThrottle) prune(now time.Time) {
+	for key, failures := range t.failures {
+		if len(failures) == 0 || now.Sub(failures[len(failures)-1]) >= t.conf.Window {
+			delete(t.failures, key)
+		}
+	}
+	for key, until := range t.locked {
+		if !now.Before(until) {
+			delete(t.locked, key)
+		}
+	}
+}
+
+//cleanup will remove the failures and lockouts expired at now, and
+// return the number of keys removed.
+func (t *loginThrottle) cleanup(now time.Time) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	before := len(t.failures) + len(t.locked)
+	t.prune(now)
+	return before - len(t.failures) - len(t.locked)
+}
+
+//wait will return how long until logins are allowed for all the keys,
+// and zero if they are allowed now.
+func (t *loginThrottle) wait(now time.Time, keys ...string) time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var wait time.Duration
+	for _, key := range keys {
+		until, ok := t.locked[key]
+		if !ok {
+			continue
+		}
+		if !now.Before(until) {
+			delete(t.locked, key)
+			continue
+		}
+		if d := until.Sub(now); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+//throttleFailure will count the failed login of the event. It is called
+// for the failures added to the events.
+func (a *Auth) throttleFailure(e LoginEvent) {
+	if a.throttle == nil {
+		return
+	}
+	a.throttle.failure(e.Time, throttleKeys(e.IP, e.Email)...)
+}
+
+//loginWait will return how long the client of the request, and the user
+// if known, must wait before logging in again, and zero if not throttled.
+func (a *Auth) loginWait(r *http.Request, user string) time.Duration {
+	if a.throttle == nil {
+		return 0
+	}
+	wait := a.throttle.wait(time.Now(), throttleKeys(a.clientIP(r), user)...)
+	if wait > 0 {
+		logRequestf(r, "info: login throttled for %v %v, %v left\n", a.clientIP(r), a.LogIdentifier(user), wait.Round(time.Second))
+	}
+	return wait
+}
+
+//retryAfterSeconds will return the wait in whole seconds, rounded up.
+func retryAfterSeconds(wait time.Duration) int {
+	return int((wait + time.Second - 1) / time.Second)
+}
+
+//renderThrottled will render the too many attempts page with 429, and the
+// Retry-After header set to the wait.
+func (a *Auth) renderThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	until := time.Now().Add(wait)
+	setRetryAfter(w, until)
+	a.renderPage(w, r, http.StatusTooManyRequests, pageTooManyAttempts, PageData{Until: until, RetryAfter: retryAfterSeconds(wait)})
+}
+
+//writeThrottled will write the too many attempts JSON error with 429,
+// with the wait in seconds in retry_after and when it ends in until, so
+// frontends can show a countdown.
+func (a *Auth) writeThrottled(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	until := time.Now().Add(wait)
+	setRetryAfter(w, until)
+	w.Header().Set("Content-Language", a.language(r))
+	body := map[string]interface{}{
+		"error":       a.message(r, "too_many_attempts.text"),
+		"code":        "too_many_attempts.text",
+		"retry_after": retryAfterSeconds(wait),
+		"until":       until.UTC().Truncate(time.Second),
+	}
+	if id := RequestID(r.Context()); id != "" {
+		body["requestID"] = id
+	}
+	writeJSON(w, http.StatusTooManyRequests, body)
+}
@@ -0,0 +1,121 @@
+package authsession
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	//grantTypeTokenExchange is the grant type of token exchange, RFC 8693.
+	grantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	//tokenTypeAccessToken is the token type of an access token in token
+	// exchange.
+	tokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+)
+
+//tokenExchange will handle the token exchange grant of RFC 8693 at the
+// token endpoint, where a service gives the access token of a user it
+// got, the subject token, and gets a new access token for the user to
+// call a downstream API with. The new token is for one of the Audiences
+// of the service, with at most the scopes of the subject token, expires
+// no later than it, and has the service added to the act claim, so the
+// chain of services acting for the user is kept.
+func (a *Auth) tokenExchange(w http.ResponseWriter, r *http.Request, client OIDCClient, iss string, jkt string) {
+	if r.PostFormValue("subject_token_type") != tokenTypeAccessToken {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "the subject_token_type must be an access token")
+		return
+	}
+	if t := r.PostFormValue("requested_token_type"); t != "" && t != tokenTypeAccessToken {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "only access tokens can be requested")
+		return
+	}
+	if r.PostFormValue("actor_token") != "" {
+		tokenError(w, http.StatusBadRequest, "invalid_request", "actor tokens are not supported, the client is the actor")
+		return
+	}
+
+	subject, claims, err := a.parseIssuedToken(r.PostFormValue("subject_token"))
+	if err != nil || subject.Issuer != iss {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the subject token is not valid")
+		return
+	}
+	//Only the service the subject token was issued for can exchange it.
+	if claims.Aud != client.ID && !slices.Contains(client.Resources, claims.Aud) {
+		tokenError(w, http.StatusBadRequest, "invalid_grant", "the subject token was not issued for the client")
+		return
+	}
+
+	audience := r.PostFormValue("resource")
+	if audience == "" {
+		audience = r.PostFormValue("audience")
+	}
+	if audience == "" || !slices.Contains(client.Audiences, audience) {
+		tokenError(w, http.StatusBadRequest, "invalid_target", "the audience is not allowed for the client")
+		return
+	}
+
+	//The scope can only be narrowed.
+	scope := claims.Scope
+	if s := r.PostFormValue("scope"); s != "" {
+		for _, sc := range strings.Fields(s) {
+			if !subject.HasScope(sc) {
+				tokenError(w, http.StatusBadRequest, "invalid_scope", "the scope was not granted to the subject token")
+				return
+			}
+		}
+		scope = strings.Join(strings.Fields(s), " ")
+	}
+
+	now := time.Now()
+	exp := now.Add(a.issuer.conf.TokenTTL).Unix()
+	if exp > claims.Exp {
+		exp = claims.Exp
+	}
+	jti, err := a.newKey(16, KeyBase64URL)
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to make token ID: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+
+	newClaims := map[string]interface{}{
+		"iss":   iss,
+		"sub":   claims.Sub,
+		"aud":   audience,
+		"azp":   client.ID,
+		"iat":   now.Unix(),
+		"exp":   exp,
+		"email": claims.Email,
+		"name":  claims.Name,
+		"jti":   jti,
+		"act":   tokenActor{Sub: client.ID, Act: claims.Act},
+	}
+	if scope != "" {
+		newClaims["scope"] = scope
+	}
+	tokenType := "Bearer"
+	if jkt != "" {
+		newClaims["cnf"] = map[string]string{"jkt": jkt}
+		tokenType = "DPoP"
+	}
+	accessToken, err := a.issuer.signAccessToken(newClaims, a.issuer.referenceTokenRegion(r.PostFormValue("subject_token")))
+	if err != nil {
+		a.logRequestError(r, "error: issuer: failed to sign access token: ", err)
+		tokenError(w, http.StatusInternalServerError, "server_error", "failed to sign token")
+		return
+	}
+	logRequestf(r, "info: issuer: client %v exchanged a token of %v for audience %v\n", client.ID, a.LogIdentifier(claims.Email), audience)
+
+	resp := map[string]interface{}{
+		"access_token":      accessToken,
+		"issued_token_type": tokenTypeAccessToken,
+		"token_type":        tokenType,
+		"expires_in":        exp - now.Unix(),
+	}
+	if scope != "" {
+		resp["scope"] = scope
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -0,0 +1,85 @@
+package authsession
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+)
+
+//insufficientScopeError is returned when a valid access token does not
+// have the scope needed.
+type insufficientScopeError struct {
+	scope string
+}
+
+func (e insufficientScopeError) Error() string {
+	return "access token does not have the scope " + e.scope
+}
+
+//grantScopes will return the API scopes of the space separated requested
+// scopes the user is granted by the ScopeRoles of the issuer, space
+// separated. Scopes not in ScopeRoles, like openid, are left out.
+func (i *issuer) grantScopes(requested string, u User) string {
+	var granted []string
+	for _, s := range strings.Fields(requested) {
+		roles, ok := i.conf.ScopeRoles[s]
+		if !ok || slices.Contains(granted, s) {
+			continue
+		}
+		for _, role := range roles {
+			if slices.Contains(u.Roles, role) {
+				granted = append(granted, s)
+				break
+			}
+		}
+	}
+	return strings.Join(granted, " ")
+}
+
+//apiScopes will return the API scopes of the issuer, sorted.
+func (i *issuer) apiScopes() []string {
+	var scopes []string
+	for s := range i.conf.ScopeRoles {
+		scopes = append(scopes, s)
+	}
+	sort.Strings(scopes)
+	return scopes
+}
+
+//HasScope will return true if the token was granted the scope.
+func (t AccessToken) HasScope(scope string) bool {
+	return slices.Contains(strings.Fields(t.Scope), scope)
+}
+
+//RequireTokenScope will only call h if the request carries a valid access
+// token issued for the audience, checked with VerifyAccessTokenFor, which
+// was granted the scope, like "reports:read". The audience is the API,
+// like "https://api.example.com", so a token with the scope for another
+// API is not accepted. A token without the scope gets 403 Forbidden with
+// the insufficient_scope error. The scopes are granted when the token is
+// issued by the ScopeRoles of the IssuerConfig, so the access of an API is
+// decided by the token, and not by the roles of a session.
+func (a *Auth) RequireTokenScope(audience string, scope string, h http.HandlerFunc) http.HandlerFunc {
+	return a.requireAccessToken(func(r *http.Request) (AccessToken, error) {
+		at, err := a.VerifyAccessTokenFor(r, audience)
+		if err != nil {
+			return AccessToken{}, err
+		}
+		if !at.HasScope(scope) {
+			return AccessToken{}, insufficientScopeError{scope: scope}
+		}
+		return at, nil
+	}, h)
+}
+
+//scopeErrorHeader will return the WWW-Authenticate header for err, and
+// false if err is not an insufficientScopeError.
+func scopeErrorHeader(err error) (string, bool) {
+	var se insufficientScopeError
+	if !errors.As(err, &se) {
+		return "", false
+	}
+	return `Bearer error="insufficient_scope", scope="` + se.scope + `"`, true
+}
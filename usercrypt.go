@@ -0,0 +1,176 @@
+package authsession
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+//blindIndexPrefix marks the blind index of an email, kept as the email of
+// the users stored by EncryptedUserStore.
+const blindIndexPrefix = "bidx1:"
+
+//minBlindIndexKeySize is the smallest key for the blind index.
+const minBlindIndexKeySize = 16
+
+//EncryptedUserStore is a UserStore encrypting the personal data of the
+// users, the email, the full name and the picture, before they are stored
+// in another UserStore, so a copy of the database does not leak the user
+// directory. The values are encrypted with AES-GCM, like with
+// EncryptedSessionStore. The email of the stored user is replaced with a
+// blind index, a keyed hash of the email, so the users are still found by
+// their email, and the encrypted email is kept in EncryptedEmail.
+type EncryptedUserStore struct {
+	store    UserStore
+	indexKey []byte
+	fieldCipher
+}
+
+//NewEncryptedUserStore will return an *EncryptedUserStore storing the
+// users in store. The indexKey for the blind index must be at least 16
+// bytes, and can't be changed without losing the users stored. The keys
+// must be 16, 24 or 32 bytes. Values are encrypted with the first key,
+// and decrypted with any of the keys, so a new key can be put first while
+// the old keys are still needed.
+func NewEncryptedUserStore(store UserStore, indexKey []byte, keys ...[]byte) (*EncryptedUserStore, error) {
+	if len(indexKey) < minBlindIndexKeySize {
+		return nil, fmt.Errorf("user blind index key must be at least %d bytes", minBlindIndexKeySize)
+	}
+	c, err := newFieldCipher("user", keys)
+	if err != nil {
+		return nil, err
+	}
+	return &EncryptedUserStore{store: store, indexKey: indexKey, fieldCipher: c}, nil
+}
+
+//blindIndex will return the blind index of the email, which is the same
+// for the same email in any case.
+func (e *EncryptedUserStore) blindIndex(email string) string {
+	mac := hmac.New(sha256.New, e.indexKey)
+	mac.Write([]byte(strings.ToLower(email)))
+	return blindIndexPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+//seal will return the user with the personal data encrypted, and the
+// email replaced by its blind index.
+func (e *EncryptedUserStore) seal(u UserRecord) (UserRecord, error) {
+	index := e.blindIndex(u.Email)
+
+	var err error
+	if u.EncryptedEmail, err = e.encrypt("email", index, u.Email); err != nil {
+		return u, err
+	}
+	if u.FullName, err = e.encrypt("fullName", index, u.FullName); err != nil {
+		return u, err
+	}
+	if u.Picture, err = e.encrypt("picture", index, u.Picture); err != nil {
+		return u, err
+	}
+	u.Email = index
+	return u, nil
+}
+
+//open will return the user with the personal data decrypted. Users
+// stored before encryption was turned on are returned as they are.
+func (e *EncryptedUserStore) open(u UserRecord) (UserRecord, error) {
+	if !strings.HasPrefix(u.Email, blindIndexPrefix) {
+		return u, nil
+	}
+	index := u.Email
+
+	var err error
+	if u.Email, err = e.decrypt("email", index, u.EncryptedEmail); err != nil {
+		return u, err
+	}
+	if u.FullName, err = e.decrypt("fullName", index, u.FullName); err != nil {
+		return u, err
+	}
+	if u.Picture, err = e.decrypt("picture", index, u.Picture); err != nil {
+		return u, err
+	}
+	u.EncryptedEmail = ""
+	return u, nil
+}
+
+//Put will encrypt and add, or replace the user. A user stored before
+// encryption was turned on is deleted, if the store can delete users.
+func (e *EncryptedUserStore) Put(u UserRecord) error {
+	email := u.Email
+	u, err := e.seal(u)
+	if err != nil {
+		return err
+	}
+	if err := e.store.Put(u); err != nil {
+		return err
+	}
+
+	d, ok := e.store.(UserDeleter)
+	if !ok {
+		return nil
+	}
+	if _, found, err := e.store.Get(email); err != nil || !found {
+		return err
+	}
+	return d.Delete(email)
+}
+
+//Get will return the decrypted user with the email, and false if not
+// found. A user stored before encryption was turned on is found by the
+// email.
+func (e *EncryptedUserStore) Get(email string) (UserRecord, bool, error) {
+	u, ok, err := e.store.Get(e.blindIndex(email))
+	if err != nil {
+		return u, false, err
+	}
+	if !ok {
+		return e.store.Get(email)
+	}
+	u, err = e.open(u)
+	return u, err == nil, err
+}
+
+//List will return all the decrypted users. Users that can't be decrypted
+// are left out.
+func (e *EncryptedUserStore) List() ([]UserRecord, error) {
+	list, err := e.store.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []UserRecord
+	var errs []error
+	for _, u := range list {
+		u, err := e.open(u)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %v: %v", u.ID, err))
+			continue
+		}
+		users = append(users, u)
+	}
+	return users, errors.Join(errs...)
+}
+
+//Delete will delete the user with the email, if the store can delete
+// users.
+func (e *EncryptedUserStore) Delete(email string) error {
+	d, ok := e.store.(UserDeleter)
+	if !ok {
+		return fmt.Errorf("user store %T can't delete users", e.store)
+	}
+	if err := d.Delete(e.blindIndex(email)); err != nil {
+		return err
+	}
+	return d.Delete(email)
+}
+
+//Close will close the store, if it has a Close method.
+func (e *EncryptedUserStore) Close() error {
+	if c, ok := e.store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
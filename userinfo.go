@@ -0,0 +1,229 @@
+package authsession
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"golang.org/x/oauth2"
+)
+
+var (
+	//ErrInvalidToken is matched by errors.Is for a user info request
+	// failing since the access token is not valid, or has expired.
+	ErrInvalidToken = errors.New("invalid_token")
+	//ErrInsufficientScope is matched by errors.Is for a user info request
+	// failing since the access token doesn't have the scopes needed.
+	ErrInsufficientScope = errors.New("insufficient_scope")
+	//ErrEmailNotVerified is matched by errors.Is when the provider has
+	// not verified the email of the user, which then can't log in.
+	ErrEmailNotVerified = errors.New("email not verified by the provider")
+)
+
+const (
+	//maxUserInfoBody is the max size of a user info response read.
+	maxUserInfoBody = 1 << 20
+	//googleIssuer is the issuer of Google, used to find the UserInfo
+	// endpoint in the discovery document.
+	googleIssuer = "https://accounts.google.com"
+	//googleUserInfoURL is the UserInfo endpoint of Google, used if the
+	// discovery document can't be fetched.
+	googleUserInfoURL = "https://openidconnect.googleapis.com/v1/userinfo"
+)
+
+//UserInfoError is an error response from the user info endpoint of a
+// provider.
+type UserInfoError struct {
+	//StatusCode is the HTTP status of the response.
+	StatusCode int
+	//Code is the error code, like "invalid_token" or "insufficient_scope".
+	Code string
+	//Description is the description of the error given by the provider.
+	Description string
+}
+
+//Error will return the error as a string.
+func (e *UserInfoError) Error() string {
+	msg := fmt.Sprintf("user info request failed with status %d", e.StatusCode)
+	if e.Code != "" {
+		msg += ": " + e.Code
+	}
+	if e.Description != "" {
+		msg += ": " + e.Description
+	}
+	return msg
+}
+
+//Is will return true if target is ErrInvalidToken or ErrInsufficientScope,
+// and the code of the error is the same.
+func (e *UserInfoError) Is(target error) bool {
+	switch target {
+	case ErrInvalidToken:
+		return e.Code == "invalid_token"
+	case ErrInsufficientScope:
+		return e.Code == "insufficient_scope"
+	}
+	return false
+}
+
+//userInfoError will return the *UserInfoError for a failed user info
+// response. The error is taken from the WWW-Authenticate header as in
+// RFC 6750, or the JSON body, which is either an OAuth2 error or a Google
+// API error. If the provider gives no code, it is set from the status.
+func userInfoError(resp *http.Response) *UserInfoError {
+	e := &UserInfoError{StatusCode: resp.StatusCode}
+
+	params := bearerChallenge(resp.Header.Get("WWW-Authenticate"))
+	e.Code = params["error"]
+	e.Description = params["error_description"]
+
+	var body struct {
+		Error            json.RawMessage `json:"error"`
+		ErrorDescription string          `json:"error_description"`
+	}
+	b, _ := io.ReadAll(io.LimitReader(resp.Body, maxUserInfoBody))
+	if json.Unmarshal(b, &body) == nil && len(body.Error) > 0 {
+		var code string
+		var apiErr struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		}
+		switch {
+		case json.Unmarshal(body.Error, &code) == nil:
+			if e.Code == "" {
+				e.Code = code
+			}
+			if e.Description == "" {
+				e.Description = body.ErrorDescription
+			}
+		case json.Unmarshal(body.Error, &apiErr) == nil:
+			if e.Code == "" {
+				switch apiErr.Status {
+				case "UNAUTHENTICATED":
+					e.Code = "invalid_token"
+				case "PERMISSION_DENIED":
+					e.Code = "insufficient_scope"
+				}
+			}
+			if e.Description == "" {
+				e.Description = apiErr.Message
+			}
+		}
+	}
+
+	if e.Code == "" {
+		switch resp.StatusCode {
+		case http.StatusUnauthorized:
+			e.Code = "invalid_token"
+		case http.StatusForbidden:
+			e.Code = "insufficient_scope"
+		}
+	}
+
+	return e
+}
+
+//bearerChallenge will return the parameters of a Bearer challenge in a
+// WWW-Authenticate header, like error="invalid_token".
+func bearerChallenge(header string) map[string]string {
+	params := make(map[string]string)
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(header), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return params
+	}
+
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = strings.TrimSpace(value)
+	}
+	return params
+}
+
+//decodeUserInfo will decode the user info response into v, or return a
+// *UserInfoError if the provider returned an error.
+func decodeUserInfo(resp *http.Response, v interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		return userInfoError(resp)
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxUserInfoBody)).Decode(v); err != nil {
+		return fmt.Errorf("failed reading user info: %v", err)
+	}
+	return nil
+}
+
+//userInfoClaims are the standard claims from a UserInfo endpoint used.
+type userInfoClaims struct {
+	Sub           string `json:"sub"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Picture       string `json:"picture"`
+	Name          string `json:"name"`
+	GivenName     string `json:"given_name"`
+	FamilyName    string `json:"family_name"`
+}
+
+//fetchUserInfo will get the claims about the user from the OpenID Connect
+// UserInfo endpoint, with the access token in the Authorization header.
+func fetchUserInfo(ctx context.Context, client *http.Client, endpoint string, token *oauth2.Token) (User, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return User{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	req.Header.Set("Accept", "application/json")
+
+	response, err := client.Do(req)
+	if err != nil {
+		return User{}, fmt.Errorf("failed getting user info: %w", err)
+	}
+	defer response.Body.Close()
+
+	var claims userInfoClaims
+	if err := decodeUserInfo(response, &claims); err != nil {
+		return User{}, err
+	}
+
+	return User{
+		ID:            claims.Sub,
+		Email:         claims.Email,
+		VerifiedEmail: claims.EmailVerified,
+		Picture:       claims.Picture,
+		FullName:      claims.Name,
+		FirstName:     claims.GivenName,
+		LastName:      claims.FamilyName,
+	}, nil
+}
+
+//googleUserInfoEndpoint will return the UserInfo endpoint of Google from
+// the discovery document, which is fetched once. If it can't be fetched,
+// the known endpoint is used.
+func (a *Auth) googleUserInfoEndpoint(ctx context.Context) string {
+	a.userInfoMu.Lock()
+	defer a.userInfoMu.Unlock()
+
+	if a.userInfoURL != "" {
+		return a.userInfoURL
+	}
+
+	doc, err := fetchDiscovery(ctx, googleIssuer)
+	switch {
+	case err != nil:
+		a.logError("error: failed to find the userinfo endpoint, using "+googleUserInfoURL+": ", err)
+		a.userInfoURL = googleUserInfoURL
+	case doc.UserInfoEndpoint == "":
+		a.userInfoURL = googleUserInfoURL
+	default:
+		a.userInfoURL = doc.UserInfoEndpoint
+	}
+	return a.userInfoURL
+}
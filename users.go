@@ -0,0 +1,97 @@
+package authsession
+
+import (
+	"strings"
+	"time"
+)
+
+//UserRecord holds what is known about a user that has logged in.
+type UserRecord struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	FullName  string    `json:"fullName"`
+	Disabled  bool      `json:"disabled"`
+	Created   time.Time `json:"created"`
+	LastLogin time.Time `json:"lastLogin"`
+	//TermsVersion is the version of the terms the user has accepted, and
+	// TermsAccepted is when.
+	TermsVersion  string    `json:"termsVersion,omitempty"`
+	TermsAccepted time.Time `json:"termsAccepted"`
+	//Picture is the URL of the picture of the user, only kept when the
+	// PrivacyPolicy gives a purpose for it.
+	Picture string `json:"picture,omitempty"`
+	//Privacy is the source, purpose and retention of the personal fields,
+	// by PersonalFieldEmail, PersonalFieldName and PersonalFieldPicture.
+	Privacy map[string]PersonalData `json:"privacy,omitempty"`
+	//Region is the region of the user, when data residency is set with
+	// WithDataResidency.
+	Region string `json:"region,omitempty"`
+	//EncryptedEmail is the encrypted email of a user stored by
+	// EncryptedUserStore, which keeps the blind index of the email in
+	// Email. It is empty for the users returned by the stores.
+	EncryptedEmail string `json:"encryptedEmail,omitempty"`
+}
+
+//UserStore keeps the users that have logged in. When a UserStore is set
+// with WithUserStore, the user is added or updated on every login, and
+// disabled users are refused login and access to protected handlers.
+type UserStore interface {
+	//Put will add, or replace the user.
+	Put(u UserRecord) error
+	//Get will return the user with the email, and false if not found.
+	Get(email string) (UserRecord, bool, error)
+	//List will return all the users.
+	List() ([]UserRecord, error)
+}
+
+//FileUserStore is a UserStore keeping the users in a JSON file.
+type FileUserStore struct {
+	m *jsonFileMap[UserRecord]
+}
+
+//NewFileUserStore will return a *FileUserStore storing the users in the
+// file at path. If path is empty the users are only kept in memory.
+func NewFileUserStore(path string) *FileUserStore {
+	return &FileUserStore{
+		m: newJSONFileMap[UserRecord](path),
+	}
+}
+
+//Put will add, or replace the user.
+func (f *FileUserStore) Put(u UserRecord) error {
+	return f.m.update(func(m map[string]UserRecord) error {
+		m[strings.ToLower(u.Email)] = u
+		return nil
+	})
+}
+
+//Get will return the user with the email, and false if not found.
+func (f *FileUserStore) Get(email string) (UserRecord, bool, error) {
+	var u UserRecord
+	var ok bool
+	err := f.m.view(func(m map[string]UserRecord) error {
+		u, ok = m[strings.ToLower(email)]
+		return nil
+	})
+	return u, ok, err
+}
+
+//Delete will delete the user with the email.
+func (f *FileUserStore) Delete(email string) error {
+	return f.m.update(func(m map[string]UserRecord) error {
+		delete(m, strings.ToLower(email))
+		return nil
+	})
+}
+
+//List will return all the users.
+func (f *FileUserStore) List() ([]UserRecord, error) {
+	var users []UserRecord
+	err := f.m.view(func(m map[string]UserRecord) error {
+		for _, u := range m {
+			users = append(users, u)
+		}
+		return nil
+	})
+	return users, err
+}
@@ -0,0 +1,308 @@
+package authsession
+
+import (
+	"errors"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+//WriteBehindConfig is how WriteBehindSessionStore keeps the sessions.
+// Zero values use the defaults.
+type WriteBehindConfig struct {
+	//FlushInterval is how often the sessions added are written to the
+	// backing store, which is the most time of added sessions lost if the
+	// process dies. The default is 1 second.
+	FlushInterval time.Duration
+	//MaxAge is how long a session read from the backing store is served
+	// from memory before it is read again, which is how long a session
+	// revoked by another instance can still be used. The default is 5
+	// seconds.
+	MaxAge time.Duration
+	//Size is the max number of sessions kept in memory. Sessions not yet
+	// written are kept even if the set is full. The default is 100000.
+	Size int
+}
+
+//WriteBehindSessionStore is a SessionStore serving the sessions from an
+// in-memory hot set, and writing the sessions added to a backing store in
+// the background, for apps where the backing store can't take a write
+// for every login. Deletes, which revoke sessions, are written to the
+// backing store at once, so they are never lost. Close must be called to
+// write the last sessions added, and stop the background writes.
+type WriteBehindSessionStore struct {
+	store SessionStore
+	conf  WriteBehindConfig
+
+	mu    sync.Mutex
+	hot   map[string]hotSession
+	dirty map[string]SessionInfo
+	//gen is incremented for every delete, so a session read from the
+	// backing store while deleted is not put in the hot set.
+	gen uint64
+
+	//flushMu is held while writing to the backing store, so a delete is
+	// not undone by a write of the same session in progress.
+	flushMu sync.Mutex
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+//hotSession is a session in the hot set.
+type hotSession struct {
+	session SessionInfo
+	read    time.Time
+}
+
+//NewWriteBehindSessionStore will return a *WriteBehindSessionStore in
+// front of store, and start writing the sessions added to it every
+// FlushInterval.
+func NewWriteBehindSessionStore(store SessionStore, c WriteBehindConfig) *WriteBehindSessionStore {
+	if c.FlushInterval <= 0 {
+		c.FlushInterval = time.Second
+	}
+	if c.MaxAge <= 0 {
+		c.MaxAge = 5 * time.Second
+	}
+	if c.Size <= 0 {
+		c.Size = 100000
+	}
+
+	w := &WriteBehindSessionStore{
+		store: store,
+		conf:  c,
+		hot:   make(map[string]hotSession),
+		dirty: make(map[string]SessionInfo),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+//run will write the sessions added every FlushInterval, until stopped.
+func (w *WriteBehindSessionStore) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.conf.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Flush(); err != nil {
+				log.Printf("error: write-behind session store: %v\n", err)
+			}
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+//Flush will write the sessions added since the last flush to the backing
+// store. Sessions failing to be written are tried again at the next
+// flush.
+func (w *WriteBehindSessionStore) Flush() error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.mu.Lock()
+	dirty := w.dirty
+	w.dirty = make(map[string]SessionInfo)
+	w.mu.Unlock()
+
+	var errs []error
+	for id, s := range dirty {
+		if err := w.store.Add(s); err != nil {
+			errs = append(errs, err)
+			w.mu.Lock()
+			if _, ok := w.dirty[id]; !ok {
+				w.dirty[id] = s
+			}
+			w.mu.Unlock()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//put will add the session to the hot set, and remove clean sessions if
+// the set is full. The lock must be held.
+func (w *WriteBehindSessionStore) put(s SessionInfo, now time.Time) {
+	w.hot[s.ID] = hotSession{session: s, read: now}
+	for id := range w.hot {
+		if len(w.hot) <= w.conf.Size {
+			break
+		}
+		if _, dirty := w.dirty[id]; !dirty && id != s.ID {
+			delete(w.hot, id)
+		}
+	}
+}
+
+//Add will add, or replace a session in the hot set. It is written to the
+// backing store at the next flush.
+func (w *WriteBehindSessionStore) Add(s SessionInfo) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dirty[s.ID] = s
+	w.put(s, time.Now())
+	return nil
+}
+
+//Get will return the session with the id from the hot set, or else from
+// the backing store, and false if not found or expired.
+func (w *WriteBehindSessionStore) Get(id string) (SessionInfo, bool, error) {
+	now := time.Now()
+	w.mu.Lock()
+	h, ok := w.hot[id]
+	_, dirty := w.dirty[id]
+	gen := w.gen
+	w.mu.Unlock()
+
+	if !ok || (!dirty && now.Sub(h.read) >= w.conf.MaxAge) {
+		s, found, err := w.store.Get(id)
+		if err != nil || !found {
+			return s, found, err
+		}
+		w.mu.Lock()
+		if w.gen == gen {
+			if _, dirty := w.dirty[id]; !dirty {
+				w.put(s, now)
+			}
+		}
+		w.mu.Unlock()
+		h = hotSession{session: s, read: now}
+	}
+
+	if !h.session.Expires.IsZero() && now.After(h.session.Expires) {
+		return h.session, false, nil
+	}
+	return h.session, true, nil
+}
+
+//pending will return the sessions not yet written, with the sessions
+// read from the backing store replaced by them.
+func (w *WriteBehindSessionStore) pending(stored []SessionInfo, keep func(s SessionInfo) bool) []SessionInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	now := time.Now()
+	var sessions []SessionInfo
+	for _, s := range w.dirty {
+		if keep(s) && (s.Expires.IsZero() || !now.After(s.Expires)) {
+			sessions = append(sessions, s)
+		}
+	}
+	for _, s := range stored {
+		if _, dirty := w.dirty[s.ID]; !dirty {
+			sessions = append(sessions, s)
+		}
+	}
+	return sessions
+}
+
+//List will return all the sessions that are not expired, from the
+// backing store and the sessions not yet written.
+func (w *WriteBehindSessionStore) List() ([]SessionInfo, error) {
+	stored, err := w.store.List()
+	if err != nil {
+		return nil, err
+	}
+	return w.pending(stored, func(SessionInfo) bool { return true }), nil
+}
+
+//ListUser will return the sessions that are not expired where the user
+// ID or the email matches user, from the backing store and the sessions
+// not yet written.
+func (w *WriteBehindSessionStore) ListUser(user string) ([]SessionInfo, error) {
+	stored, err := w.store.ListUser(user)
+	if err != nil {
+		return nil, err
+	}
+	return w.pending(stored, func(s SessionInfo) bool {
+		return s.UserID == user || strings.EqualFold(s.Email, user)
+	}), nil
+}
+
+//remove will remove the sessions matching fn from the hot set and the
+// sessions not yet written.
+func (w *WriteBehindSessionStore) remove(fn func(s SessionInfo) bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.gen++
+	for id, h := range w.hot {
+		if fn(h.session) {
+			delete(w.hot, id)
+		}
+	}
+	for id, s := range w.dirty {
+		if fn(s) {
+			delete(w.dirty, id)
+		}
+	}
+}
+
+//Delete will delete the session with the id from the hot set and the
+// backing store at once.
+func (w *WriteBehindSessionStore) Delete(id string) error {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	w.remove(func(s SessionInfo) bool { return s.ID == id })
+	return w.store.Delete(id)
+}
+
+//DeleteUser will delete all the sessions where the user ID or the email
+// matches user from the hot set and the backing store at once, and
+// return the number of sessions not expired that were deleted.
+func (w *WriteBehindSessionStore) DeleteUser(user string) (int, error) {
+	w.flushMu.Lock()
+	defer w.flushMu.Unlock()
+
+	sessions, err := w.ListUser(user)
+	if err != nil {
+		return 0, err
+	}
+	w.remove(func(s SessionInfo) bool {
+		return s.UserID == user || strings.EqualFold(s.Email, user)
+	})
+	if _, err := w.store.DeleteUser(user); err != nil {
+		return 0, err
+	}
+	return len(sessions), nil
+}
+
+//Cleanup will remove the expired sessions of the backing store, if it
+// implements Cleaner.
+func (w *WriteBehindSessionStore) Cleanup(now time.Time) (int, error) {
+	w.mu.Lock()
+	for id, h := range w.hot {
+		if _, dirty := w.dirty[id]; !dirty && !h.session.Expires.IsZero() && now.After(h.session.Expires) {
+			delete(w.hot, id)
+		}
+	}
+	w.mu.Unlock()
+
+	c, ok := w.store.(Cleaner)
+	if !ok {
+		return 0, nil
+	}
+	return c.Cleanup(now)
+}
+
+//Close will stop the background writes, write the sessions not yet
+// written, and close the backing store if it implements io.Closer.
+func (w *WriteBehindSessionStore) Close() error {
+	w.once.Do(func() { close(w.stop) })
+	<-w.done
+
+	err := w.Flush()
+	if c, ok := w.store.(io.Closer); ok {
+		err = errors.Join(err, c.Close())
+	}
+	return err
+}